@@ -0,0 +1,161 @@
+package acl
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Rule 是目标地址访问控制列表中的一条规则，用于 MASQUE CONNECT-UDP 和正向代理的CONNECT隧道。
+//
+// 字段：
+// Host - 主机名规则，"*" 匹配任意主机，"*.example.com" 匹配子域名，为空时使用 Network 匹配解析后的IP地址。
+// Network - IP地址或网段规则，用于匹配解析后的目标IP地址。
+// PortMin - 允许的最小端口。
+// PortMax - 允许的最大端口。
+type Rule struct {
+	Host    string
+	Network *net.IPNet
+	PortMin int
+	PortMax int
+}
+
+// Parse 解析以逗号分隔的规则列表，每一项的格式为 主机:端口。
+// 主机可以是 "*"、主机名、"*.后缀"、IP地址或CIDR网段（IPv6需要放在方括号中），
+// 端口可以是 "*"、单个端口或者 "起始-结束" 的端口范围。
+// 例如 "*:53,*.example.com:443,10.0.0.0/8:*,[2001:db8::/32]:1000-2000"。
+func Parse(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		index := strings.LastIndexByte(item, ':')
+		if index <= 0 {
+			return nil, errors.New("acl: invalid allow rule " + item + ", expected host:port")
+		}
+		var host = strings.TrimSuffix(strings.TrimPrefix(item[:index], "["), "]")
+		var rule Rule
+		var err error
+		rule.PortMin, rule.PortMax, err = parsePortRange(item[index+1:])
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(host, "/") {
+			_, network, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, err
+			}
+			rule.Network = network
+		} else if ip := net.ParseIP(host); ip != nil {
+			var bits = 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			rule.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else {
+			rule.Host = strings.ToLower(host)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parsePortRange 解析端口规则。
+func parsePortRange(s string) (int, int, error) {
+	if s == "*" {
+		return 1, 65535, nil
+	}
+	var low, high = s, s
+	if index := strings.IndexByte(s, '-'); index >= 0 {
+		low, high = s[:index], s[index+1:]
+	}
+	min, err := strconv.Atoi(low)
+	if err != nil {
+		return 0, 0, errors.New("acl: invalid port " + s)
+	}
+	max, err := strconv.Atoi(high)
+	if err != nil {
+		return 0, 0, errors.New("acl: invalid port " + s)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, errors.New("acl: port out of range " + s)
+	}
+	return min, max, nil
+}
+
+// matchHost 判断主机名是否匹配规则。
+func (r Rule) matchHost(host string) bool {
+	if r.Host == "" {
+		return false
+	}
+	if r.Host == "*" {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if suffix, ok := strings.CutPrefix(r.Host, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == r.Host
+}
+
+// Match 判断目标地址是否匹配规则列表中的任意一条规则，不检查默认禁止的地址，用于拒绝列表。
+// 主机名规则匹配请求中的目标主机，IP和网段规则匹配解析后的目标IP地址。
+//
+// 参数:
+// rules - 规则列表。
+// host - 请求中的目标主机。
+// ip - 解析后的目标IP地址。
+// port - 目标端口。
+func Match(rules []Rule, host string, ip net.IP, port int) bool {
+	for _, rule := range rules {
+		if port < rule.PortMin || port > rule.PortMax {
+			continue
+		}
+		if rule.matchHost(host) {
+			return true
+		}
+		if rule.Network != nil && ip != nil && rule.Network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed 判断目标地址是否被规则列表允许。
+// 主机名规则匹配请求中的目标主机，IP和网段规则匹配解析后的目标IP地址。
+// 解析后的IP地址属于 Restricted 的地址时，主机名规则不会生效，
+// 只有显式包含该地址的IP或网段规则才能允许访问，防止通过主机名访问内部网络。
+//
+// 参数:
+// rules - 规则列表。
+// host - 请求中的目标主机。
+// ip - 解析后的目标IP地址。
+// port - 目标端口。
+func Allowed(rules []Rule, host string, ip net.IP, port int) bool {
+	if ip == nil || !Restricted(ip) {
+		return Match(rules, host, ip, port)
+	}
+	for _, rule := range rules {
+		if port < rule.PortMin || port > rule.PortMax {
+			continue
+		}
+		if rule.Network != nil && rule.Network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedAddressSpace 是运营商级NAT使用的共享地址空间 100.64.0.0/10（RFC 6598），
+// 云平台的元数据服务（例如 100.100.100.200）也使用这个网段。
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Restricted 判断IP地址是否默认禁止访问，包括回环地址、私有网络地址（RFC 1918 和 RFC 4193）、
+// 共享地址空间（RFC 6598）、链路本地地址、多播地址和未指定地址。
+func Restricted(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified()
+}
@@ -0,0 +1,74 @@
+package acl
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseAndAllowed(t *testing.T) {
+	rules, err := Parse("*.example.com:443, 10.0.0.0/8:1000-2000, [2001:db8::/32]:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		host    string
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{"dns.example.com", "192.0.2.1", 443, true},
+		{"example.com", "192.0.2.1", 443, false},
+		{"dns.example.com", "192.0.2.1", 53, false},
+		{"10.1.2.3", "10.1.2.3", 1500, true},
+		{"10.1.2.3", "10.1.2.3", 2001, false},
+		{"v6.test", "2001:db8::1", 53, true},
+	} {
+		if got := Allowed(rules, c.host, net.ParseIP(c.ip), c.port); got != c.allowed {
+			t.Errorf("Allowed(%q, %q, %d) = %v", c.host, c.ip, c.port, got)
+		}
+	}
+	if _, err := Parse("example.com"); err == nil {
+		t.Error("expected missing port error")
+	}
+}
+
+func TestAllowedRestricted(t *testing.T) {
+	rules, err := Parse("*:443, *.example.com:53, 10.0.0.0/8:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		host    string
+		ip      string
+		port    int
+		allowed bool
+	}{
+		{"public.test", "192.0.2.1", 443, true},
+		{"localhost", "127.0.0.1", 443, false},
+		{"internal.test", "192.168.1.1", 443, false},
+		{"internal.test", "fd00::1", 443, false},
+		{"metadata.test", "169.254.169.254", 443, false},
+		{"link.test", "fe80::1", 443, false},
+		{"metadata.test", "100.100.100.200", 443, false},
+		{"cgnat.test", "100.127.255.255", 443, false},
+		{"public.test", "100.128.0.1", 443, true},
+		{"multicast.test", "224.0.0.251", 443, false},
+		{"multicast.test", "239.1.2.3", 443, false},
+		{"multicast.test", "ff02::1", 443, false},
+		{"multicast.test", "ff0e::1", 443, false},
+		{"any.test", "0.0.0.0", 443, false},
+		{"any.test", "::", 443, false},
+		{"mapped.test", "::ffff:127.0.0.1", 443, false},
+		{"dns.example.com", "172.16.0.1", 53, false},
+		/* 显式的网段规则可以允许内部地址 */
+		{"internal.test", "10.1.2.3", 443, true},
+		{"internal.test", "10.1.2.3", 53, false},
+	} {
+		if got := Allowed(rules, c.host, net.ParseIP(c.ip), c.port); got != c.allowed {
+			t.Errorf("Allowed(%q, %q, %d) = %v", c.host, c.ip, c.port, got)
+		}
+	}
+	if !Match(rules, "localhost", net.ParseIP("127.0.0.1"), 443) {
+		t.Error("Match should not apply the default deny")
+	}
+}
@@ -0,0 +1,207 @@
+package alt_svc
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ebi-yade/altsvc-go"
+)
+
+// DefaultMaxAge 是 Alt-Svc 没有指定 ma 参数时的缓存时间（RFC 7838 第 3.1 节）。
+const DefaultMaxAge = 24 * time.Hour
+
+// Entry 是一个缓存的替代服务。
+//
+// 字段：
+// ProtocolID - ALPN 协议名称，例如 "h3"。
+// Host - 替代服务的主机，为空时表示与源站相同的主机。
+// Port - 替代服务的端口。
+// Expires - 替代服务的过期时间。
+// Addresses - 替代服务的IP地址，来自 HTTPS 记录，为空时在连接时解析主机。
+type Entry struct {
+	ProtocolID string
+	Host       string
+	Port       string
+	Expires    time.Time
+	Addresses  []string
+}
+
+// Address 返回连接替代服务时使用的地址，主机为空时使用源站的主机。
+func (e Entry) Address(originHost string) string {
+	var host = e.Host
+	if host == "" {
+		host = originHost
+	}
+	return net.JoinHostPort(host, e.Port)
+}
+
+// brokenState 记录源站的HTTP/3连接失败的状态。
+type brokenState struct {
+	until    time.Time
+	failures int
+}
+
+// Cache 按源站缓存 Alt-Svc 替代服务，并记录HTTP/3不可用的源站，可以被多个协程同时使用。
+type Cache struct {
+	mutex   sync.Mutex
+	entries map[string][]Entry
+	broken  map[string]*brokenState
+	/* 获取当前时间的函数，方便测试 */
+	Now func() time.Time
+}
+
+// NewCache 创建一个空的 Alt-Svc 缓存。
+func NewCache() *Cache {
+	return &Cache{
+		entries: map[string][]Entry{},
+		broken:  map[string]*brokenState{},
+		Now:     time.Now,
+	}
+}
+
+// Origin 返回URL的源站，格式为 协议://主机:端口，省略的端口使用协议的默认端口。
+func Origin(u *url.URL) string {
+	var scheme = strings.ToLower(u.Scheme)
+	var port = u.Port()
+	if port == "" {
+		port = "443"
+		if scheme == "http" {
+			port = "80"
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// Update 根据源站响应中的 Alt-Svc 头部更新缓存。
+// 值为 "clear" 时删除该源站的所有替代服务，否则用新的替代服务替换旧的缓存。
+//
+// 参数:
+// origin - 源站，参见 Origin。
+// header - Alt-Svc 头部的值，多个头部需要用逗号连接。
+//
+// 返回值:
+// 解析头部时遇到的错误，出错时缓存不变。
+func (c *Cache) Update(origin string, header string) error {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil
+	}
+	services, err := altsvc.Parse(header)
+	if err != nil {
+		return err
+	}
+	/* 解析库把缺省的 ma 和 ma=0 都当作0，需要按照相同的方式切分头部来区分 */
+	var segments = strings.Split(header, ",")
+	var now = c.Now()
+	var entries []Entry
+	for i, service := range services {
+		if service.Clear {
+			c.mutex.Lock()
+			delete(c.entries, origin)
+			c.mutex.Unlock()
+			return nil
+		}
+		var maxAge = DefaultMaxAge
+		if i < len(segments) && strings.Contains(segments[i], "ma=") {
+			maxAge = time.Duration(service.MaxAge) * time.Second
+		}
+		if service.ProtocolID == "" || maxAge <= 0 {
+			continue
+		}
+		entries = append(entries, Entry{
+			ProtocolID: service.ProtocolID,
+			Host:       service.AltAuthority.Host,
+			Port:       service.AltAuthority.Port,
+			Expires:    now.Add(maxAge),
+		})
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(entries) == 0 {
+		delete(c.entries, origin)
+		return nil
+	}
+	c.entries[origin] = entries
+	return nil
+}
+
+// Add 为源站添加替代服务，替换协议、主机和端口都相同的旧替代服务，新添加的替代服务按顺序排在前面。
+func (c *Cache) Add(origin string, entries ...Entry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var merged = append([]Entry(nil), entries...)
+	for _, old := range c.entries[origin] {
+		var replaced bool
+		for _, entry := range entries {
+			if entry.ProtocolID == old.ProtocolID && entry.Host == old.Host && entry.Port == old.Port {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, old)
+		}
+	}
+	c.entries[origin] = merged
+}
+
+// Lookup 返回源站第一个未过期的指定协议的替代服务。
+func (c *Cache) Lookup(origin string, protocolID string) (Entry, bool) {
+	var now = c.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, entry := range c.entries[origin] {
+		if entry.ProtocolID == protocolID && now.Before(entry.Expires) {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
+
+// MarkBroken 记录源站的HTTP/3连接失败，在退避时间内不再尝试HTTP/3。
+// 每次连续失败退避时间加倍，最多不超过 max。
+//
+// 参数:
+// origin - 源站。
+// base - 第一次失败时的退避时间。
+// max - 最长的退避时间。
+//
+// 返回值:
+// 本次的退避时间。
+func (c *Cache) MarkBroken(origin string, base time.Duration, max time.Duration) time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var state = c.broken[origin]
+	if state == nil {
+		state = &brokenState{}
+		c.broken[origin] = state
+	}
+	var backoff = base
+	for i := 0; i < state.failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	state.failures++
+	state.until = c.Now().Add(backoff)
+	return backoff
+}
+
+// IsBroken 判断源站的HTTP/3是否仍在退避时间内。
+func (c *Cache) IsBroken(origin string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var state = c.broken[origin]
+	return state != nil && c.Now().Before(state.until)
+}
+
+// MarkWorking 记录源站的HTTP/3请求成功，清除失败记录。
+func (c *Cache) MarkWorking(origin string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.broken, origin)
+}
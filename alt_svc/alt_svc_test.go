@@ -0,0 +1,492 @@
+package alt_svc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestCacheUpdate(t *testing.T) {
+	var now = time.Unix(1000, 0)
+	cache := NewCache()
+	cache.Now = func() time.Time { return now }
+	var origin = "https://example.com:443"
+
+	if err := cache.Update(origin, `h3=":8443"; ma=60, h2=":443"`); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := cache.Lookup(origin, ProtocolH3)
+	if !ok || entry.Address("example.com") != "example.com:8443" {
+		t.Fatalf("unexpected h3 entry: %+v %v", entry, ok)
+	}
+	if entry, ok := cache.Lookup(origin, "h2"); !ok || !entry.Expires.Equal(now.Add(DefaultMaxAge)) {
+		t.Errorf("h2 entry should use the default max age: %+v %v", entry, ok)
+	}
+	now = now.Add(61 * time.Second)
+	if _, ok := cache.Lookup(origin, ProtocolH3); ok {
+		t.Error("expired entry returned")
+	}
+
+	cache.Update(origin, `h3=":443"`)
+	cache.Update(origin, "clear")
+	if _, ok := cache.Lookup(origin, ProtocolH3); ok {
+		t.Error("clear did not remove entries")
+	}
+	if err := cache.Update(origin, `h3=443`); err == nil {
+		t.Error("invalid header accepted")
+	}
+
+	if backoff := cache.MarkBroken(origin, time.Minute, 3*time.Minute); backoff != time.Minute {
+		t.Errorf("unexpected first backoff: %v", backoff)
+	}
+	cache.MarkBroken(origin, time.Minute, 3*time.Minute)
+	if backoff := cache.MarkBroken(origin, time.Minute, 3*time.Minute); backoff != 3*time.Minute {
+		t.Errorf("backoff should be capped: %v", backoff)
+	}
+	if !cache.IsBroken(origin) {
+		t.Error("origin should be broken")
+	}
+	cache.MarkWorking(origin)
+	if cache.IsBroken(origin) {
+		t.Error("origin should be working")
+	}
+}
+
+func TestTransportUpgradeAndFallback(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":`+strconv.Itoa(udpConn.LocalAddr().(*net.UDPAddr).Port)+`"; ma=3600`)
+		io.WriteString(w, r.Proto)
+	})
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h3 := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(h2.TLS.Clone())}
+	go h3.Serve(udpConn)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(h2.Certificate())
+	transport := NewTransport(func(o *Options) {
+		o.H2 = h2.Client().Transport
+		o.TLSClientConfig = &tls.Config{RootCAs: pool}
+		o.QUICConfig = &quic.Config{HandshakeIdleTimeout: 500 * time.Millisecond}
+	})
+	defer transport.Close()
+	var get = func() string {
+		request, err := http.NewRequestWithContext(t.Context(), http.MethodGet, h2.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	if proto := get(); proto != "HTTP/2.0" {
+		t.Fatalf("first request should use http2, got %s", proto)
+	}
+	if proto := get(); proto != "HTTP/3.0" {
+		t.Fatalf("request after Alt-Svc should use http3, got %s", proto)
+	}
+
+	h3.Close()
+	udpConn.Close()
+	transport.h3.CloseIdleConnections()
+	if proto := get(); proto != "HTTP/2.0" {
+		t.Fatalf("request should fall back to http2, got %s", proto)
+	}
+	if !transport.Cache().IsBroken("https://" + h2.Listener.Addr().String()) {
+		t.Error("origin should be marked broken")
+	}
+}
+
+func TestTransportRace(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":`+strconv.Itoa(udpConn.LocalAddr().(*net.UDPAddr).Port)+`"`)
+		io.WriteString(w, r.Proto)
+	})
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h3 := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(h2.TLS.Clone())}
+	go h3.Serve(udpConn)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(h2.Certificate())
+	transport := NewTransport(func(o *Options) {
+		o.H2 = h2.Client().Transport
+		o.TLSClientConfig = &tls.Config{RootCAs: pool}
+		o.QUICConfig = &quic.Config{HandshakeIdleTimeout: 2 * time.Second}
+		o.Race = true
+		o.QUICHeadStart = 200 * time.Millisecond
+	})
+	defer transport.Close()
+	var origin = "https://" + h2.Listener.Addr().String()
+	var get = func() string {
+		request, err := http.NewRequestWithContext(t.Context(), http.MethodGet, h2.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	get()
+	if proto := get(); proto != "HTTP/3.0" {
+		t.Fatalf("quic with head start should win the race, got %s", proto)
+	}
+	if stats := transport.Stats(origin); stats.QUICWins != 1 || !stats.PreferQUIC() {
+		t.Fatalf("unexpected stats after quic win: %+v", stats)
+	}
+	if proto := get(); proto != "HTTP/3.0" {
+		t.Fatalf("pooled quic connection should be reused, got %s", proto)
+	}
+
+	/* QUIC 不可用时 TCP 在领先时间之后开始并赢得竞速，偏好随之转向TCP */
+	h3.Close()
+	udpConn.Close()
+	if conn := transport.pooled(origin); conn != nil {
+		transport.drop(origin, conn)
+	}
+	if proto := get(); proto != "HTTP/2.0" {
+		t.Fatalf("tcp should win the race, got %s", proto)
+	}
+	if stats := transport.Stats(origin); stats.TCPWins != 1 || stats.PreferQUIC() {
+		t.Fatalf("unexpected stats after tcp win: %+v", stats)
+	}
+}
+
+func TestTransportHTTPSRecords(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	h3 := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(h2.TLS.Clone())}
+	go h3.Serve(udpConn)
+	defer h3.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(h2.Certificate())
+	var lookups atomic.Int32
+	transport := NewTransport(func(o *Options) {
+		o.H2 = h2.Client().Transport
+		o.TLSClientConfig = &tls.Config{RootCAs: pool}
+		o.QUICConfig = &quic.Config{HandshakeIdleTimeout: 2 * time.Second}
+		/* 端点的目标名称无法解析，只能通过记录中的地址连接，TLS 仍然校验源站的名称 */
+		o.LookupServiceEndpoints = func(host string, port int) ([]dns_experiment.ServiceEndpoint, error) {
+			lookups.Add(1)
+			if host != "127.0.0.1" || port != h2.Listener.Addr().(*net.TCPAddr).Port {
+				t.Errorf("unexpected lookup: %s %d", host, port)
+			}
+			return []dns_experiment.ServiceEndpoint{{
+				Priority:  1,
+				Host:      "svc.invalid",
+				Port:      udpConn.LocalAddr().(*net.UDPAddr).Port,
+				Protocols: []string{"h3", "h2"},
+				Addresses: []string{"127.0.0.1"},
+				TTL:       300,
+			}}, nil
+		}
+	})
+	defer transport.Close()
+	for i := 0; i < 2; i++ {
+		request, err := http.NewRequestWithContext(t.Context(), http.MethodGet, h2.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if string(body) != "HTTP/3.0" {
+			t.Fatalf("https record should upgrade the first request to http3, got %s", body)
+		}
+	}
+	if lookups.Load() != 1 {
+		t.Errorf("https records should be looked up once, got %d", lookups.Load())
+	}
+}
+
+func TestTransportHTTPSRecordH2Endpoint(t *testing.T) {
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	/* 源站的端口上没有服务，只能通过 HTTPS 记录中的端点连接 */
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var originPort = closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(h2.Certificate())
+	transport := NewTransport(func(o *Options) {
+		o.H2 = h2.Client().Transport
+		o.TLSClientConfig = &tls.Config{RootCAs: pool}
+		o.LookupServiceEndpoints = func(host string, port int) ([]dns_experiment.ServiceEndpoint, error) {
+			if host != "127.0.0.1" || port != originPort {
+				t.Errorf("unexpected lookup: %s %d", host, port)
+			}
+			return []dns_experiment.ServiceEndpoint{{
+				Priority:  1,
+				Host:      "svc.invalid",
+				Port:      h2.Listener.Addr().(*net.TCPAddr).Port,
+				Protocols: []string{"h2"},
+				Addresses: []string{"127.0.0.1"},
+				TTL:       300,
+			}}, nil
+		}
+	})
+	defer transport.Close()
+	for i := 0; i < 2; i++ {
+		request, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "https://127.0.0.1:"+strconv.Itoa(originPort)+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if string(body) != "HTTP/2.0" {
+			t.Fatalf("request should use the http2 endpoint from the https record, got %s", body)
+		}
+	}
+	if transport.pooled("https://127.0.0.1:"+strconv.Itoa(originPort)) == nil {
+		t.Error("http2 endpoint connection should be pooled")
+	}
+}
+
+func TestTransportStrictECH(t *testing.T) {
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(h2.Certificate())
+	var port = h2.Listener.Addr().(*net.TCPAddr).Port
+	/* 源站没有发布 ECH 配置，严格模式下连接 HTTPS 记录中的端点也必须失败 */
+	transport := NewTransport(func(o *Options) {
+		o.H2 = h2.Client().Transport
+		o.TLSClientConfig = &tls.Config{RootCAs: pool}
+		o.LookupServiceEndpoints = func(host string, port int) ([]dns_experiment.ServiceEndpoint, error) {
+			return []dns_experiment.ServiceEndpoint{{Priority: 1, Port: port, Protocols: []string{"h2"}, Addresses: []string{"127.0.0.1"}, TTL: 300}}, nil
+		}
+		o.GetECHClient = func() *ech.Client {
+			return ech.NewClient(func(o *ech.Options) {
+				o.Strict = true
+			})
+		}
+	})
+	defer transport.Close()
+	request, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "https://127.0.0.1:"+strconv.Itoa(port)+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := transport.RoundTrip(request)
+	if err == nil {
+		response.Body.Close()
+	}
+	if !errors.Is(err, ech.ErrECHRequired) {
+		t.Fatalf("expected ech required error, got %v", err)
+	}
+}
+
+func TestTransportLookupAddresses(t *testing.T) {
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(h2.Certificate())
+	var port = h2.Listener.Addr().(*net.TCPAddr).Port
+	var lookups []string
+	/* 端点没有给出地址时，目标主机通过注入的解析函数解析，例如使用覆盖表和分流规则 */
+	transport := NewTransport(func(o *Options) {
+		o.H2 = h2.Client().Transport
+		o.TLSClientConfig = &tls.Config{RootCAs: pool}
+		o.LookupServiceEndpoints = func(host string, port int) ([]dns_experiment.ServiceEndpoint, error) {
+			return []dns_experiment.ServiceEndpoint{{Priority: 1, Host: "svc.invalid", Port: port, Protocols: []string{"h2"}, TTL: 300}}, nil
+		}
+		o.LookupAddresses = func(ctx context.Context, host string) ([]string, error) {
+			lookups = append(lookups, host)
+			return []string{"127.0.0.1"}, nil
+		}
+	})
+	defer transport.Close()
+	request, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "https://127.0.0.1:"+strconv.Itoa(port)+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("unexpected protocol: %s", body)
+	}
+	if len(lookups) != 1 || lookups[0] != "svc.invalid" {
+		t.Errorf("unexpected lookups: %v", lookups)
+	}
+}
+
+func TestTransportPooledRoundTrip(t *testing.T) {
+	transport := NewTransport()
+	defer transport.Close()
+	var origin = "https://example.com:443"
+	var dials, closes atomic.Int32
+	var dead atomic.Bool
+	var fail atomic.Value
+	fail.Store(false)
+	var dial = func(ctx context.Context) (*raceConn, error) {
+		dials.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return &raceConn{
+			roundTrip: func(r *http.Request) (*http.Response, error) {
+				if fail.Load().(bool) {
+					return nil, errors.New("stream reset")
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+			},
+			alive: func() bool { return !dead.Load() },
+			close: func() error { closes.Add(1); return nil },
+		}, nil
+	}
+	var roundTrip = func() error {
+		request, err := http.NewRequestWithContext(t.Context(), http.MethodGet, origin+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = transport.pooledRoundTrip(request, origin, dial)
+		return err
+	}
+
+	/* 同时到达的请求共用同一次连接 */
+	var done = make(chan error, 10)
+	for range 10 {
+		go func() { done <- roundTrip() }()
+	}
+	for range 10 {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := dials.Load(); count != 1 {
+		t.Fatalf("concurrent requests should share one dial: %d", count)
+	}
+
+	/* 请求层面的错误不关闭其他请求正在使用的连接 */
+	fail.Store(true)
+	if err := roundTrip(); err == nil {
+		t.Fatal("expected stream error")
+	}
+	if closes.Load() != 0 || transport.pooled(origin) == nil || dials.Load() != 1 {
+		t.Fatalf("live connection should be kept: closes %d dials %d", closes.Load(), dials.Load())
+	}
+
+	/* 连接不再可用时从连接池中移除，并在新的连接上重试 */
+	dead.Store(true)
+	fail.Store(false)
+	if err := roundTrip(); err != nil {
+		t.Fatal(err)
+	}
+	if dials.Load() != 2 || closes.Load() != 0 {
+		t.Fatalf("dead connection should be replaced without closing it: closes %d dials %d", closes.Load(), dials.Load())
+	}
+}
+
+func TestTransportHTTP1OriginCached(t *testing.T) {
+	var conns atomic.Int32
+	h1 := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	h1.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	h1.StartTLS()
+	defer h1.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(h1.Certificate())
+	transport := NewTransport(func(o *Options) {
+		o.H2 = h1.Client().Transport
+		o.TLSClientConfig = &tls.Config{RootCAs: pool}
+	})
+	defer transport.Close()
+	var addr = h1.Listener.Addr().String()
+	var origin = "https://" + addr
+	for range 3 {
+		request, err := http.NewRequestWithContext(t.Context(), http.MethodGet, origin+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := transport.pooledRoundTrip(request, origin, func(ctx context.Context) (*raceConn, error) {
+			return transport.dialTCP(ctx, addr)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if string(body) != "HTTP/1.1" {
+			t.Fatalf("unexpected protocol %s", body)
+		}
+	}
+	/* 只有第一次请求协商协议，之后的请求复用 H2 传输的HTTP/1.1连接 */
+	if count := conns.Load(); count != 2 {
+		t.Errorf("http/1.1 origin should not be dialed for every request: %d connections", count)
+	}
+}
@@ -0,0 +1,75 @@
+package alt_svc
+
+import (
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProtocolH2 是HTTP/2在 HTTPS 记录 alpn 参数中的协议名称。
+const ProtocolH2 = "h2"
+
+// serviceEndpointsMinInterval 是两次查询同一源站 HTTPS 记录的最短间隔。
+const serviceEndpointsMinInterval = time.Minute
+
+// lookupServiceEndpoints 在需要时查询源站的 HTTPS 记录（RFC 9460），
+// 把支持HTTP/3和HTTP/2的服务端点按照优先级加入替代服务缓存，端点的端口和地址也一起保存。
+func (t *Transport) lookupServiceEndpoints(origin string, u *url.URL) {
+	if t.LookupServiceEndpoints == nil {
+		return
+	}
+	var now = t.cache.Now()
+	t.mutex.Lock()
+	if next, ok := t.endpointsChecked[origin]; ok && now.Before(next) {
+		t.mutex.Unlock()
+		return
+	}
+	/* 查询期间的其他请求不重复查询 */
+	t.endpointsChecked[origin] = now.Add(serviceEndpointsMinInterval)
+	t.mutex.Unlock()
+
+	var host = strings.ToLower(u.Hostname())
+	var port = 443
+	if u.Port() != "" {
+		port, _ = strconv.Atoi(u.Port())
+	}
+	endpoints, err := t.LookupServiceEndpoints(host, port)
+	if err != nil {
+		log.Println("alt_svc: lookup https records", origin, err)
+		return
+	}
+	var entries []Entry
+	/* 最先过期的端点过期时重新查询 */
+	var ttl time.Duration
+	for _, endpoint := range endpoints {
+		var endpointTTL = max(time.Duration(endpoint.TTL)*time.Second, serviceEndpointsMinInterval)
+		if ttl == 0 || endpointTTL < ttl {
+			ttl = endpointTTL
+		}
+		var entryHost = endpoint.Host
+		if strings.EqualFold(entryHost, host) {
+			entryHost = ""
+		}
+		for _, protocol := range []string{ProtocolH3, ProtocolH2} {
+			if !endpoint.Supports(protocol) {
+				continue
+			}
+			entries = append(entries, Entry{
+				ProtocolID: protocol,
+				Host:       entryHost,
+				Port:       strconv.Itoa(endpoint.Port),
+				Expires:    now.Add(endpointTTL),
+				Addresses:  endpoint.Addresses,
+			})
+		}
+	}
+	t.mutex.Lock()
+	t.endpointsChecked[origin] = now.Add(max(ttl, serviceEndpointsMinInterval))
+	t.mutex.Unlock()
+	if len(entries) > 0 {
+		log.Println("alt_svc: https records", origin, entries)
+		t.cache.Add(origin, entries...)
+	}
+}
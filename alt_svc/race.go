@@ -0,0 +1,402 @@
+package alt_svc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/happy_eyeballs"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// raceScoreWeight 是每次竞速结果在协议偏好分数中的权重。
+const raceScoreWeight = 0.25
+
+// raceDialTimeout 是为源站建立连接的超时时间，连接由等待它的所有请求共用，不受单个请求的取消影响。
+const raceDialTimeout = 30 * time.Second
+
+// http1OriginTTL 是记住源站只支持HTTP/1.1的时间，期间请求直接使用 H2 传输，不再为每个请求重新建立连接。
+const http1OriginTTL = 5 * time.Minute
+
+// OriginStats 是一个源站的QUIC和TCP连接竞速统计。
+//
+// 字段：
+// QUICWins - QUIC连接先建立的次数。
+// TCPWins - TCP+TLS连接先建立的次数。
+// QUICFailures - QUIC连接建立失败的次数。
+// TCPFailures - TCP+TLS连接建立失败的次数。
+// QUICHandshake - 最近一次QUIC握手成功的耗时。
+// TCPHandshake - 最近一次TCP+TLS握手成功的耗时。
+// Score - 协议偏好分数，范围为 -1 到 1，大于等于0时优先QUIC，否则优先TCP。
+type OriginStats struct {
+	QUICWins      int
+	TCPWins       int
+	QUICFailures  int
+	TCPFailures   int
+	QUICHandshake time.Duration
+	TCPHandshake  time.Duration
+	Score         float64
+}
+
+// PreferQUIC 判断该源站是否优先使用QUIC。
+func (s OriginStats) PreferQUIC() bool {
+	return s.Score >= 0
+}
+
+// raceConn 是竞速建立的连接。
+type raceConn struct {
+	quic      bool
+	roundTrip func(*http.Request) (*http.Response, error)
+	alive     func() bool
+	close     func() error
+}
+
+// pendingConn 是正在为源站建立的连接，同一时间到达的请求等待同一次连接。
+type pendingConn struct {
+	done chan struct{}
+	conn *raceConn
+	err  error
+}
+
+// raceResult 是一个协议的连接结果。
+type raceResult struct {
+	conn    *raceConn
+	elapsed time.Duration
+	err     error
+}
+
+// Stats 返回源站的连接竞速统计。
+func (t *Transport) Stats(origin string) OriginStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if stats := t.stats[origin]; stats != nil {
+		return *stats
+	}
+	return OriginStats{}
+}
+
+// record 记录一次竞速的结果，并更新协议偏好分数。
+func (t *Transport) record(origin string, winner *raceResult, quicErr error, tcpErr error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var stats = t.stats[origin]
+	if stats == nil {
+		stats = &OriginStats{}
+		t.stats[origin] = stats
+	}
+	if quicErr != nil {
+		stats.QUICFailures++
+	}
+	if tcpErr != nil {
+		stats.TCPFailures++
+	}
+	if winner == nil {
+		return
+	}
+	var outcome = -1.0
+	if winner.conn.quic {
+		stats.QUICWins++
+		stats.QUICHandshake = winner.elapsed
+		outcome = 1
+	} else {
+		stats.TCPWins++
+		stats.TCPHandshake = winner.elapsed
+	}
+	stats.Score = stats.Score*(1-raceScoreWeight) + outcome*raceScoreWeight
+}
+
+// pooled 返回源站仍然可用的连接。
+func (t *Transport) pooled(origin string) *raceConn {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.pooledLocked(origin)
+}
+
+// pooledLocked 返回源站仍然可用的连接，并移除不再可用的连接，调用者需要持有锁。
+func (t *Transport) pooledLocked(origin string) *raceConn {
+	var conn = t.conns[origin]
+	if conn != nil && !conn.alive() {
+		delete(t.conns, origin)
+		return nil
+	}
+	return conn
+}
+
+// dialQUIC 建立到源站HTTP/3替代服务的连接。
+func (t *Transport) dialQUIC(ctx context.Context, addr string) (*raceConn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConf = &tls.Config{}
+	if t.TLSClientConfig != nil {
+		tlsConf = t.TLSClientConfig.Clone()
+	}
+	tlsConf.ServerName = host
+	tlsConf.NextProtos = []string{http3.NextProtoH3}
+	conn, err := t.dial(ctx, addr, tlsConf, t.QUICConfig)
+	if err != nil {
+		return nil, err
+	}
+	var client = t.h3.NewClientConn(conn)
+	return &raceConn{
+		quic:      true,
+		roundTrip: client.RoundTrip,
+		alive:     func() bool { return client.Context().Err() == nil },
+		close:     func() error { return client.CloseWithError(http3.ErrCodeNoError, "") },
+	}, nil
+}
+
+// dialTCP 建立到源站的TCP+TLS连接，协商到HTTP/2时在该连接上发送请求，
+// 否则关闭连接，由 H2 传输发送HTTP/1.1请求。
+func (t *Transport) dialTCP(ctx context.Context, addr string) (*raceConn, error) {
+	host, originPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var port = originPort
+	var tlsConf = &tls.Config{}
+	if t.TLSClientConfig != nil {
+		tlsConf = t.TLSClientConfig.Clone()
+	}
+	tlsConf.ServerName = host
+	tlsConf.NextProtos = []string{"h2", "http/1.1"}
+	/* HTTPS 记录中支持HTTP/2的端点优先于源站本身 */
+	var ips []string
+	if entry, ok := t.cache.Lookup("https://"+strings.ToLower(addr), ProtocolH2); ok {
+		if _, port, err = net.SplitHostPort(entry.Address(host)); err != nil {
+			return nil, err
+		}
+		ips = happy_eyeballs.SortAddresses(entry.Addresses)
+		if len(ips) == 0 && entry.Host != "" {
+			if ips, err = t.LookupAddresses(ctx, entry.Host); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if ips, err = t.LookupAddresses(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	var dialer net.Dialer
+	/* 服务器拒绝 ECH 后重新握手时需要重新建立TCP连接 */
+	conn, err := ech.Handshake(ctx, t.echClient(), originPort, tlsConf, func(ctx context.Context, tlsConf *tls.Config) (*tls.Conn, error) {
+		tcpConn, err := happy_eyeballs.Dial(ctx, ips, happy_eyeballs.DefaultAttemptDelay, func(ctx context.Context, ip string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+		}, func(conn net.Conn) {
+			conn.Close()
+		})
+		if err != nil {
+			return nil, err
+		}
+		var conn = tls.Client(tcpConn, tlsConf)
+		if err := conn.HandshakeContext(ctx); err != nil {
+			tcpConn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}, (*tls.Conn).ConnectionState)
+	if err != nil {
+		return nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol != "h2" {
+		conn.Close()
+		/* 源站只支持HTTP/1.1，一段时间内由 H2 传输的连接池发送请求 */
+		var expires = time.Now().Add(http1OriginTTL)
+		return &raceConn{
+			roundTrip: t.H2.RoundTrip,
+			alive:     func() bool { return time.Now().Before(expires) },
+			close:     func() error { return nil },
+		}, nil
+	}
+	client, err := t.h2.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &raceConn{
+		roundTrip: client.RoundTrip,
+		alive: func() bool {
+			/* 收到 GOAWAY 的连接在已有的请求完成后自己关闭 */
+			var state = client.State()
+			return !state.Closed && !state.Closing
+		},
+		close: client.Close,
+	}, nil
+}
+
+// race 同时建立QUIC连接和TCP+TLS连接，优先的协议先开始，另一个协议在领先时间之后开始，
+// 任意一方失败时另一方立即开始，返回先建立的连接，另一个连接会被关闭。
+func (t *Transport) race(ctx context.Context, origin string, addr string) (*raceConn, error) {
+	var preferQUIC = t.Stats(origin).PreferQUIC()
+	ctx, cancel := context.WithCancel(ctx)
+	var failed = make(chan struct{})
+	var results = make(chan raceResult, 2)
+	var start = func(quic bool) {
+		var delay time.Duration
+		if quic != preferQUIC {
+			delay = t.QUICHeadStart
+		}
+		var timer = time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-failed:
+		case <-ctx.Done():
+			results <- raceResult{conn: &raceConn{quic: quic}, err: ctx.Err()}
+			return
+		}
+		var begin = time.Now()
+		var conn *raceConn
+		var err error
+		if quic {
+			conn, err = t.dialQUIC(ctx, addr)
+		} else {
+			conn, err = t.dialTCP(ctx, addr)
+		}
+		if conn == nil {
+			conn = &raceConn{quic: quic}
+		}
+		results <- raceResult{conn: conn, elapsed: time.Since(begin), err: err}
+	}
+	go start(true)
+	go start(false)
+
+	var winner *raceResult
+	var quicErr, tcpErr error
+	var failedOnce bool
+	for i := 0; i < 2; i++ {
+		var result = <-results
+		if result.err != nil {
+			if result.conn.quic {
+				quicErr = result.err
+			} else {
+				tcpErr = result.err
+			}
+			if !failedOnce {
+				failedOnce = true
+				close(failed)
+			}
+			continue
+		}
+		winner = &result
+		cancel()
+		/* 竞速失败的一方可能仍然建立了连接，需要在后台关闭 */
+		if i == 0 {
+			go func() {
+				if loser := <-results; loser.err == nil {
+					loser.conn.close()
+				}
+			}()
+		}
+		break
+	}
+	cancel()
+	if winner == nil {
+		t.record(origin, nil, quicErr, tcpErr)
+		return nil, errors.Join(quicErr, tcpErr)
+	}
+	if winner.conn.quic {
+		tcpErr = nil
+	} else if quicErr != nil {
+		var backoff = t.cache.MarkBroken(origin, t.BrokenBackoff, t.MaxBrokenBackoff)
+		log.Println("alt_svc: quic failed during connection race", origin, "backoff", backoff, quicErr)
+	}
+	t.record(origin, winner, quicErr, tcpErr)
+	log.Println("alt_svc: connection race won by quic", winner.conn.quic, origin, "handshake", winner.elapsed)
+	return winner.conn, nil
+}
+
+// raceRoundTrip 在已有的连接上发送请求，没有可用连接时通过竞速建立连接。
+func (t *Transport) raceRoundTrip(req *http.Request, origin string) (*http.Response, error) {
+	return t.pooledRoundTrip(req, origin, func(ctx context.Context) (*raceConn, error) {
+		conn, err := t.race(ctx, origin, strings.TrimPrefix(origin, "https://"))
+		if err == nil && conn.quic {
+			t.cache.MarkWorking(origin)
+		}
+		return conn, err
+	})
+}
+
+// pooledRoundTrip 在源站已有的连接上发送请求，没有可用连接时使用 dial 建立新的连接，同时到达的请求共用同一次连接。
+// 单个请求失败不会关闭其他请求正在使用的连接，只有连接不再可用时才从连接池中移除，并在新的连接上重试一次。
+func (t *Transport) pooledRoundTrip(req *http.Request, origin string, dial func(ctx context.Context) (*raceConn, error)) (*http.Response, error) {
+	conn, fresh, err := t.pooledConn(req.Context(), origin, dial)
+	if err != nil {
+		return nil, err
+	}
+	response, err := conn.roundTrip(req)
+	if err == nil || fresh || conn.alive() || req.Context().Err() != nil {
+		return response, err
+	}
+	t.forget(origin, conn)
+	retry, ok := rewind(req)
+	if !ok {
+		return nil, err
+	}
+	if conn, _, err = t.pooledConn(retry.Context(), origin, dial); err != nil {
+		return nil, err
+	}
+	return conn.roundTrip(retry)
+}
+
+// pooledConn 返回源站可用的连接，没有时等待正在建立的连接，或者开始建立新的连接。
+//
+// 返回值:
+// 连接，连接是否为这次等待新建立的，以及建立连接时遇到的错误。
+func (t *Transport) pooledConn(ctx context.Context, origin string, dial func(ctx context.Context) (*raceConn, error)) (*raceConn, bool, error) {
+	t.mutex.Lock()
+	if conn := t.pooledLocked(origin); conn != nil {
+		t.mutex.Unlock()
+		return conn, false, nil
+	}
+	var pending = t.dialing[origin]
+	if pending == nil {
+		pending = &pendingConn{done: make(chan struct{})}
+		t.dialing[origin] = pending
+		go t.dialPending(origin, pending, dial)
+	}
+	t.mutex.Unlock()
+	select {
+	case <-pending.done:
+		return pending.conn, true, pending.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// dialPending 建立连接并放入连接池，然后通知等待的请求。
+func (t *Transport) dialPending(origin string, pending *pendingConn, dial func(ctx context.Context) (*raceConn, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), raceDialTimeout)
+	defer cancel()
+	pending.conn, pending.err = dial(ctx)
+	t.mutex.Lock()
+	delete(t.dialing, origin)
+	if pending.err == nil {
+		t.conns[origin] = pending.conn
+	}
+	t.mutex.Unlock()
+	close(pending.done)
+}
+
+// forget 从连接池中移除不再可用的连接，不关闭它，连接上其他请求的流不受影响。
+func (t *Transport) forget(origin string, conn *raceConn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conns[origin] == conn {
+		delete(t.conns, origin)
+	}
+}
+
+// drop 从连接池中移除并关闭连接。
+func (t *Transport) drop(origin string, conn *raceConn) {
+	t.forget(origin, conn)
+	conn.close()
+}
@@ -0,0 +1,281 @@
+package alt_svc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/happy_eyeballs"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// ProtocolH3 是HTTP/3在 Alt-Svc 中的协议名称。
+const ProtocolH3 = "h3"
+
+// Options 是自动升级传输的配置。
+//
+// 字段：
+// H2 - 发送HTTP/2（或HTTP/1.1）请求的传输，默认使用 http.Transport，HTTPS 记录给出了支持HTTP/2的端点时不使用。
+// TLSClientConfig - HTTP/3连接使用的TLS配置。
+// QUICConfig - HTTP/3连接使用的QUIC配置。
+// BrokenBackoff - HTTP/3第一次失败后不再尝试HTTP/3的时间。
+// MaxBrokenBackoff - 连续失败时退避时间的上限。
+// Race - 源站同时支持HTTP/3和HTTP/2时，是否让QUIC握手和TCP+TLS握手竞速，使用先建立的连接。
+// QUICHeadStart - 竞速时优先的协议领先开始的时间。
+// LookupServiceEndpoints - 解析源站 HTTPS 记录的函数，参见 dns.ResolveServiceEndpoints，为nil时只使用 Alt-Svc 头部。
+// GetECHClient - 返回建立QUIC连接和TCP+TLS连接时使用的 ECH 客户端，为nil或者返回nil时不使用 ECH。
+// LookupAddresses - 解析源站和替代服务主机地址的函数，默认使用 happy_eyeballs.LookupAddresses。
+type Options struct {
+	H2                     http.RoundTripper
+	TLSClientConfig        *tls.Config
+	QUICConfig             *quic.Config
+	BrokenBackoff          time.Duration
+	MaxBrokenBackoff       time.Duration
+	Race                   bool
+	QUICHeadStart          time.Duration
+	LookupServiceEndpoints func(host string, port int) ([]dns_experiment.ServiceEndpoint, error)
+	GetECHClient           func() *ech.Client
+	LookupAddresses        func(ctx context.Context, host string) ([]string, error)
+}
+
+// Transport 是自动选择上游协议的传输：先使用HTTP/2发送请求，
+// 从响应的 Alt-Svc 头部或者源站的 HTTPS 记录中发现HTTP/3后，后续请求改用HTTP/3；
+// HTTP/3连接失败时退回HTTP/2，并在退避时间内不再尝试HTTP/3。
+// 开启竞速时，QUIC和TCP+TLS同时建立连接，并按源站统计竞速结果调整优先的协议。
+type Transport struct {
+	Options
+	cache *Cache
+	h3    *http3.Transport
+	h2    *http2.Transport
+	mutex sync.Mutex
+	stats map[string]*OriginStats
+	conns map[string]*raceConn
+	/* 每个源站正在建立的连接 */
+	dialing map[string]*pendingConn
+	/* 每个源站下一次查询 HTTPS 记录的时间 */
+	endpointsChecked map[string]time.Time
+}
+
+// NewTransport 创建一个自动升级到HTTP/3的传输。
+//
+// 参数:
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的传输。
+func NewTransport(options ...func(*Options)) *Transport {
+	var transport = &Transport{
+		Options: Options{
+			BrokenBackoff:    5 * time.Minute,
+			MaxBrokenBackoff: 48 * time.Hour,
+			QUICHeadStart:    300 * time.Millisecond,
+			LookupAddresses:  happy_eyeballs.LookupAddresses,
+		},
+		cache:   NewCache(),
+		h2:      &http2.Transport{},
+		stats:   map[string]*OriginStats{},
+		conns:   map[string]*raceConn{},
+		dialing: map[string]*pendingConn{},
+
+		endpointsChecked: map[string]time.Time{},
+	}
+	for _, option := range options {
+		option(&transport.Options)
+	}
+	if transport.H2 == nil {
+		transport.H2 = &http.Transport{TLSClientConfig: transport.TLSClientConfig, ForceAttemptHTTP2: true}
+	}
+	transport.h3 = &http3.Transport{
+		TLSClientConfig: transport.TLSClientConfig,
+		QUICConfig:      transport.QUICConfig,
+		Dial:            transport.dial,
+	}
+	return transport
+}
+
+// Cache 返回传输使用的 Alt-Svc 缓存。
+func (t *Transport) Cache() *Cache {
+	return t.cache
+}
+
+// dial 连接源站的HTTP/3替代服务，TLS的服务器名称仍然使用源站的主机名。
+func (t *Transport) dial(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error) {
+	host, originPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var target = addr
+	var ips []string
+	if entry, ok := t.cache.Lookup("https://"+strings.ToLower(addr), ProtocolH3); ok {
+		target = entry.Address(host)
+		ips = happy_eyeballs.SortAddresses(entry.Addresses)
+	}
+	if tlsConf.ServerName == "" {
+		tlsConf = tlsConf.Clone()
+		tlsConf.ServerName = host
+	}
+	targetHost, targetPort, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	/* HTTPS 记录给出了端点的地址时直接使用，否则解析替代服务的主机 */
+	if len(ips) == 0 {
+		ips, err = t.LookupAddresses(ctx, targetHost)
+		if err != nil {
+			log.Println("alt_svc: http3连接失败", addr, target, err)
+			return nil, err
+		}
+	}
+	/* 替代服务解析到多个地址时，按照 RFC 8305 交替地址族依次尝试，ECH 配置使用源站的 HTTPS 记录 */
+	var echClient = t.echClient()
+	conn, err := ech.Handshake(ctx, echClient, originPort, tlsConf, func(ctx context.Context, tlsConf *tls.Config) (*quic.Conn, error) {
+		return happy_eyeballs.Dial(ctx, ips, happy_eyeballs.DefaultAttemptDelay, func(ctx context.Context, ip string) (*quic.Conn, error) {
+			if echClient != nil {
+				/* 需要完成握手才能知道服务器是否接受了 ECH */
+				return quic.DialAddr(ctx, net.JoinHostPort(ip, targetPort), tlsConf, quicConf)
+			}
+			return quic.DialAddrEarly(ctx, net.JoinHostPort(ip, targetPort), tlsConf, quicConf)
+		}, func(conn *quic.Conn) {
+			conn.CloseWithError(0, "")
+		})
+	}, func(conn *quic.Conn) tls.ConnectionState {
+		return conn.ConnectionState().TLS
+	})
+	if err != nil {
+		log.Println("alt_svc: http3连接失败", addr, target, err)
+		return nil, err
+	}
+	log.Println("alt_svc: http3连接成功", addr, target, conn.LocalAddr(), conn.RemoteAddr())
+	return conn, nil
+}
+
+// echClient 返回 GetECHClient 提供的 ECH 客户端，GetECHClient 为nil时返回nil。
+func (t *Transport) echClient() *ech.Client {
+	if t.GetECHClient == nil {
+		return nil
+	}
+	return t.GetECHClient()
+}
+
+// update 记录响应中的 Alt-Svc 头部。
+func (t *Transport) update(origin string, response *http.Response) {
+	var values = response.Header.Values("Alt-Svc")
+	if len(values) == 0 {
+		return
+	}
+	if err := t.cache.Update(origin, strings.Join(values, ",")); err != nil {
+		log.Println("alt_svc: invalid Alt-Svc header", origin, values, err)
+	}
+}
+
+// RoundTrip 实现了 http.RoundTripper 接口。
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var origin = Origin(req.URL)
+	if req.URL.Scheme == "https" {
+		t.lookupServiceEndpoints(origin, req.URL)
+	}
+	if req.URL.Scheme == "https" && !t.cache.IsBroken(origin) {
+		if _, ok := t.cache.Lookup(origin, ProtocolH3); ok && t.Race {
+			response, err := t.raceRoundTrip(req, origin)
+			if err == nil {
+				t.update(origin, response)
+			}
+			return response, err
+		} else if ok {
+			response, err := t.h3.RoundTrip(req)
+			if err == nil {
+				t.cache.MarkWorking(origin)
+				t.update(origin, response)
+				return response, nil
+			}
+			if req.Context().Err() != nil || !isConnectionError(err) {
+				return nil, err
+			}
+			var backoff = t.cache.MarkBroken(origin, t.BrokenBackoff, t.MaxBrokenBackoff)
+			log.Println("alt_svc: http3 failed, falling back to http2", origin, "backoff", backoff, err)
+			retry, ok := rewind(req)
+			if !ok {
+				return nil, err
+			}
+			req = retry
+		}
+	}
+	if req.URL.Scheme == "https" {
+		/* HTTPS 记录给出了支持HTTP/2的端点时，连接到端点的端口和地址 */
+		if _, ok := t.cache.Lookup(origin, ProtocolH2); ok {
+			response, err := t.pooledRoundTrip(req, origin, func(ctx context.Context) (*raceConn, error) {
+				return t.dialTCP(ctx, strings.TrimPrefix(origin, "https://"))
+			})
+			if err == nil {
+				t.update(origin, response)
+			}
+			return response, err
+		}
+	}
+	response, err := t.H2.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme == "https" {
+		t.update(origin, response)
+	}
+	return response, nil
+}
+
+// Close 关闭HTTP/3连接、竞速建立的连接和HTTP/2的空闲连接。
+func (t *Transport) Close() error {
+	t.mutex.Lock()
+	for origin, conn := range t.conns {
+		conn.close()
+		delete(t.conns, origin)
+	}
+	t.mutex.Unlock()
+	if closer, ok := t.H2.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+	return t.h3.Close()
+}
+
+// isConnectionError 判断HTTP/3的错误是否为连接层面的错误，
+// 单个请求流被取消或拒绝属于请求层面的错误，不说明HTTP/3不可用。
+func isConnectionError(err error) bool {
+	var streamError *quic.StreamError
+	if errors.As(err, &streamError) {
+		return false
+	}
+	var h3Error *http3.Error
+	if errors.As(err, &h3Error) {
+		switch h3Error.ErrorCode {
+		case http3.ErrCodeRequestCanceled, http3.ErrCodeRequestRejected, http3.ErrCodeRequestIncomplete, http3.ErrCodeMessageError:
+			return false
+		}
+	}
+	return true
+}
+
+// rewind 返回可以重新发送的请求，请求体无法重放时返回false。
+func rewind(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	var retry = req.Clone(req.Context())
+	retry.Body = body
+	return retry, true
+}
@@ -0,0 +1,313 @@
+package dns
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CacheOptions 是DNS缓存的配置。
+//
+// 字段：
+// MinTTL - 缓存时间的下限，应答的TTL小于它时按它缓存。
+// MaxTTL - 肯定应答缓存时间的上限。
+// NegativeMaxTTL - NXDOMAIN 和 NODATA 否定应答缓存时间的上限（RFC 2308 第 5 节）。
+// StaleTTL - 过期之后，上游查询失败时仍然可以使用过期应答的时间，小于等于0时不使用过期应答（RFC 8767）。
+// StaleAnswerTTL - 返回过期应答时记录的TTL（RFC 8767 第 4 节推荐 30 秒）。
+// PrefetchThreshold - 剩余时间小于缓存时间的这个比例时预取，小于等于0时不预取。
+// PrefetchHits - 缓存条目至少被命中这么多次才会被预取。
+// MaxEntries - 缓存条目的最大数量，超出时先清理过期的条目，小于等于0时不限制。
+// Now - 获取当前时间的函数，便于测试。
+type CacheOptions struct {
+	MinTTL            time.Duration
+	MaxTTL            time.Duration
+	NegativeMaxTTL    time.Duration
+	StaleTTL          time.Duration
+	StaleAnswerTTL    time.Duration
+	PrefetchThreshold float64
+	PrefetchHits      int
+	MaxEntries        int
+	Now               func() time.Time
+}
+
+// Cache 是按照记录TTL过期的DNS应答缓存，支持否定缓存、过期应答和热门条目的预取。
+type Cache struct {
+	CacheOptions
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// cacheEntry 是一个缓存的DNS应答。
+type cacheEntry struct {
+	msg         *dns.Msg
+	stored      time.Time
+	expires     time.Time
+	hits        int
+	prefetching bool
+}
+
+// DefaultCache 是 DnsResolverMultipleServers 默认使用的共享缓存。
+var DefaultCache = NewCache()
+
+// NewCache 创建一个DNS缓存。
+//
+// 参数:
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的缓存。
+func NewCache(options ...func(*CacheOptions)) *Cache {
+	var c = &Cache{
+		CacheOptions: CacheOptions{
+			MinTTL:            5 * time.Second,
+			MaxTTL:            24 * time.Hour,
+			NegativeMaxTTL:    3 * time.Hour,
+			StaleTTL:          24 * time.Hour,
+			StaleAnswerTTL:    30 * time.Second,
+			PrefetchThreshold: 0.1,
+			PrefetchHits:      2,
+			MaxEntries:        10000,
+			Now:               time.Now,
+		},
+		entries: map[string]*cacheEntry{},
+	}
+	for _, option := range options {
+		option(&c.CacheOptions)
+	}
+	return c
+}
+
+// cacheKey 返回查询在缓存中的键，查询的id和EDNS填充选项不参与计算，ECS选项参与计算。
+func cacheKey(server string, msg *dns.Msg) (string, error) {
+	var copy = withoutPadding(msg)
+	copy.Id = 0
+	var buffer, err = copy.Pack()
+	if err != nil {
+		return "", err
+	}
+	return server + "\n" + Sha512(buffer), nil
+}
+
+// Exchange 从缓存中返回查询的应答，缓存中没有未过期的应答时通过 query 查询上游并缓存结果。
+// 上游查询失败或者返回 SERVFAIL、REFUSED 时，如果缓存中有过期时间不超过 StaleTTL 的应答，就返回该应答。
+// 命中次数达到 PrefetchHits 且剩余时间不多的条目会在后台提前刷新。
+//
+// 参数:
+// server - 上游服务器的名称，不同服务器的应答分开缓存。
+// msg - DNS查询。
+// query - 查询上游的函数。
+//
+// 返回值:
+// 应答的副本，其id与查询相同，记录的TTL为剩余的缓存时间；以及查询上游时遇到的错误。
+func (c *Cache) Exchange(server string, msg *dns.Msg, query func(m *dns.Msg) (r *dns.Msg, err error)) (*dns.Msg, error) {
+	key, err := cacheKey(server, msg)
+	if err != nil {
+		log.Println(server, err)
+		return nil, err
+	}
+	var now = c.Now()
+	c.mutex.Lock()
+	var entry = c.entries[key]
+	if entry != nil && now.Before(entry.expires) {
+		entry.hits++
+		var prefetch = c.shouldPrefetch(entry, now)
+		if prefetch {
+			entry.prefetching = true
+		}
+		var response = answerFromEntry(entry, msg.Id, now, 0)
+		c.mutex.Unlock()
+		log.Println(server, "cache hit", key)
+		if prefetch {
+			go c.prefetch(server, key, msg.Copy(), query)
+		}
+		return response, nil
+	}
+	c.mutex.Unlock()
+
+	result, err := query(msg)
+	if err == nil && !serverFailure(result) {
+		log.Println(server, "cache miss", key)
+		c.store(key, result)
+		return result, nil
+	}
+	if stale := c.stale(key, msg.Id); stale != nil {
+		log.Println(server, "serve stale answer", key, err)
+		return stale, nil
+	}
+	if err != nil {
+		log.Println(server, err)
+	}
+	return result, err
+}
+
+// shouldPrefetch 判断是否需要在后台提前刷新缓存条目，调用时需要持有锁。
+func (c *Cache) shouldPrefetch(entry *cacheEntry, now time.Time) bool {
+	if c.PrefetchThreshold <= 0 || entry.prefetching || entry.hits < c.PrefetchHits {
+		return false
+	}
+	var ttl = entry.expires.Sub(entry.stored)
+	return entry.expires.Sub(now) <= time.Duration(float64(ttl)*c.PrefetchThreshold)
+}
+
+// prefetch 在后台重新查询上游并更新缓存条目。
+func (c *Cache) prefetch(server string, key string, msg *dns.Msg, query func(m *dns.Msg) (r *dns.Msg, err error)) {
+	result, err := query(msg)
+	if err == nil && !serverFailure(result) {
+		log.Println(server, "cache prefetch", key)
+		c.store(key, result)
+		return
+	}
+	log.Println(server, "cache prefetch failed", key, err)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if entry := c.entries[key]; entry != nil {
+		entry.prefetching = false
+	}
+}
+
+// stale 返回过期时间不超过 StaleTTL 的应答，没有时返回nil。
+func (c *Cache) stale(key string, id uint16) *dns.Msg {
+	if c.StaleTTL <= 0 {
+		return nil
+	}
+	var now = c.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var entry = c.entries[key]
+	if entry == nil || now.After(entry.expires.Add(c.StaleTTL)) {
+		return nil
+	}
+	return answerFromEntry(entry, id, now, uint32(c.StaleAnswerTTL/time.Second))
+}
+
+// store 按照应答的TTL缓存应答，不应该缓存的应答会被忽略。
+func (c *Cache) store(key string, msg *dns.Msg) {
+	ttl, ok := c.TTL(msg)
+	if !ok {
+		return
+	}
+	var now = c.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, exists := c.entries[key]; !exists && c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = &cacheEntry{msg: msg.Copy(), stored: now, expires: now.Add(ttl)}
+}
+
+// evict 清理超过 StaleTTL 的过期条目，仍然超出 MaxEntries 时清理最早过期的条目，调用时需要持有锁。
+func (c *Cache) evict(now time.Time) {
+	var oldestKey string
+	var oldest *cacheEntry
+	for key, entry := range c.entries {
+		if now.After(entry.expires.Add(c.StaleTTL)) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == nil || entry.expires.Before(oldest.expires) {
+			oldestKey, oldest = key, entry
+		}
+	}
+	if len(c.entries) >= c.MaxEntries && oldest != nil {
+		delete(c.entries, oldestKey)
+	}
+}
+
+// TTL 计算应答的缓存时间：肯定应答使用应答记录中最小的TTL，
+// NXDOMAIN 和 NODATA 否定应答使用 SOA 记录的TTL和 MINIMUM 字段中较小的一个（RFC 2308 第 5 节），
+// 结果被限制在 MinTTL 和 MaxTTL（否定应答为 NegativeMaxTTL）之间。
+//
+// 参数:
+// msg - DNS应答。
+//
+// 返回值:
+// 缓存时间，以及应答是否可以缓存。被截断的应答、其他错误码以及没有 SOA 记录的否定应答不缓存。
+func (c *Cache) TTL(msg *dns.Msg) (time.Duration, bool) {
+	if msg == nil || msg.Truncated {
+		return 0, false
+	}
+	var negative bool
+	var minimum uint32
+	var found bool
+	switch {
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0:
+		for _, rr := range msg.Answer {
+			if !found || rr.Header().Ttl < minimum {
+				minimum, found = rr.Header().Ttl, true
+			}
+		}
+	case msg.Rcode == dns.RcodeSuccess || msg.Rcode == dns.RcodeNameError:
+		negative = true
+		for _, rr := range msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				minimum, found = min(soa.Hdr.Ttl, soa.Minttl), true
+				break
+			}
+		}
+	}
+	if !found {
+		return 0, false
+	}
+	var ttl = time.Duration(minimum) * time.Second
+	var maxTTL = c.MaxTTL
+	if negative {
+		maxTTL = c.NegativeMaxTTL
+	}
+	if maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	return ttl, ttl > 0
+}
+
+// Len 返回缓存条目的数量，包括已经过期但仍然可以作为过期应答的条目。
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// Clear 清空缓存。
+func (c *Cache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = map[string]*cacheEntry{}
+}
+
+// serverFailure 判断应答是否表示上游服务器无法应答。
+func serverFailure(msg *dns.Msg) bool {
+	return msg == nil || msg.Rcode == dns.RcodeServerFailure || msg.Rcode == dns.RcodeRefused
+}
+
+// answerFromEntry 复制缓存的应答，设置id并把记录的TTL减去已经缓存的时间，
+// staleTTL 大于0时表示返回过期应答，所有记录的TTL都设置为它。调用时需要持有锁。
+func answerFromEntry(entry *cacheEntry, id uint16, now time.Time, staleTTL uint32) *dns.Msg {
+	var response = entry.msg.Copy()
+	response.Id = id
+	var elapsed = uint32(now.Sub(entry.stored) / time.Second)
+	var remaining uint32
+	if now.Before(entry.expires) {
+		remaining = uint32((entry.expires.Sub(now) + time.Second - 1) / time.Second)
+	}
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if staleTTL > 0 {
+				rr.Header().Ttl = staleTTL
+				continue
+			}
+			var ttl uint32
+			if rr.Header().Ttl > elapsed {
+				ttl = rr.Header().Ttl - elapsed
+			}
+			rr.Header().Ttl = min(ttl, remaining)
+		}
+	}
+	return response
+}
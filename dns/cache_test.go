@@ -0,0 +1,210 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream 是返回预设应答并记录查询次数的上游。
+type fakeUpstream struct {
+	mutex   sync.Mutex
+	queries int
+	reply   func(m *dns.Msg) (*dns.Msg, error)
+}
+
+func (f *fakeUpstream) query(m *dns.Msg) (*dns.Msg, error) {
+	f.mutex.Lock()
+	f.queries++
+	var reply = f.reply
+	f.mutex.Unlock()
+	return reply(m)
+}
+
+func (f *fakeUpstream) count() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.queries
+}
+
+func answerA(ttl uint32) func(m *dns.Msg) (*dns.Msg, error) {
+	return func(m *dns.Msg) (*dns.Msg, error) {
+		var r = new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = append(r.Answer,
+			&dns.A{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.ParseIP("192.0.2.1")},
+			&dns.A{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl * 2}, A: net.ParseIP("192.0.2.2")},
+		)
+		return r, nil
+	}
+}
+
+func TestCacheExpiresByMinimumTTL(t *testing.T) {
+	var now = time.Unix(1000, 0)
+	var cache = NewCache(func(o *CacheOptions) {
+		o.Now = func() time.Time { return now }
+		o.PrefetchThreshold = 0
+	})
+	var upstream = &fakeUpstream{reply: answerA(60)}
+	var msg = new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	if _, err := cache.Exchange("server", msg, upstream.query); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(20 * time.Second)
+	msg.Id = 1234
+	response, err := cache.Exchange("server", msg, upstream.query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream.count() != 1 {
+		t.Errorf("expected cache hit, got %d queries", upstream.count())
+	}
+	if response.Id != 1234 {
+		t.Errorf("response id should match the query: %d", response.Id)
+	}
+	/* 两条记录的TTL都减去已经缓存的时间，且不超过按最小TTL计算的剩余时间 */
+	if response.Answer[0].Header().Ttl != 40 || response.Answer[1].Header().Ttl != 40 {
+		t.Errorf("unexpected ttl: %d %d", response.Answer[0].Header().Ttl, response.Answer[1].Header().Ttl)
+	}
+	if _, err := cache.Exchange("other", msg, upstream.query); err != nil || upstream.count() != 2 {
+		t.Errorf("different servers should be cached separately: %v %d", err, upstream.count())
+	}
+	now = now.Add(40 * time.Second)
+	if _, err := cache.Exchange("server", msg, upstream.query); err != nil || upstream.count() != 3 {
+		t.Errorf("expired entry should be queried again: %v %d", err, upstream.count())
+	}
+}
+
+func TestCacheTTLClampsAndNegativeCaching(t *testing.T) {
+	var cache = NewCache(func(o *CacheOptions) {
+		o.MinTTL = 10 * time.Second
+		o.MaxTTL = time.Hour
+		o.NegativeMaxTTL = 5 * time.Minute
+	})
+	var msg = new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	var positive, _ = answerA(1)(msg)
+	if ttl, ok := cache.TTL(positive); !ok || ttl != 10*time.Second {
+		t.Errorf("ttl should be raised to MinTTL: %v %v", ttl, ok)
+	}
+	positive, _ = answerA(86400)(msg)
+	if ttl, ok := cache.TTL(positive); !ok || ttl != time.Hour {
+		t.Errorf("ttl should be lowered to MaxTTL: %v %v", ttl, ok)
+	}
+
+	var nxdomain = new(dns.Msg)
+	nxdomain.SetRcode(msg, dns.RcodeNameError)
+	if _, ok := cache.TTL(nxdomain); ok {
+		t.Error("negative answer without SOA should not be cached")
+	}
+	nxdomain.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 900}, Minttl: 120}}
+	if ttl, ok := cache.TTL(nxdomain); !ok || ttl != 120*time.Second {
+		t.Errorf("negative ttl should be the SOA minimum: %v %v", ttl, ok)
+	}
+	var nodata = nxdomain.Copy()
+	nodata.Rcode = dns.RcodeSuccess
+	nodata.Ns[0].(*dns.SOA).Minttl = 3600
+	if ttl, ok := cache.TTL(nodata); !ok || ttl != 5*time.Minute {
+		t.Errorf("nodata ttl should be lowered to NegativeMaxTTL: %v %v", ttl, ok)
+	}
+	var servfail = new(dns.Msg)
+	servfail.SetRcode(msg, dns.RcodeServerFailure)
+	if _, ok := cache.TTL(servfail); ok {
+		t.Error("servfail should not be cached")
+	}
+}
+
+func TestCacheServesStaleOnFailure(t *testing.T) {
+	var now = time.Unix(1000, 0)
+	var cache = NewCache(func(o *CacheOptions) {
+		o.Now = func() time.Time { return now }
+		o.StaleTTL = time.Hour
+	})
+	var upstream = &fakeUpstream{reply: answerA(60)}
+	var msg = new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := cache.Exchange("server", msg, upstream.query); err != nil {
+		t.Fatal(err)
+	}
+	upstream.reply = func(m *dns.Msg) (*dns.Msg, error) { return nil, errors.New("timeout") }
+	now = now.Add(10 * time.Minute)
+	response, err := cache.Exchange("server", msg, upstream.query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Answer[0].Header().Ttl != 30 {
+		t.Errorf("stale answer should use StaleAnswerTTL: %d", response.Answer[0].Header().Ttl)
+	}
+	upstream.reply = func(m *dns.Msg) (*dns.Msg, error) {
+		var r = new(dns.Msg)
+		r.SetRcode(m, dns.RcodeServerFailure)
+		return r, nil
+	}
+	if response, err := cache.Exchange("server", msg, upstream.query); err != nil || response.Rcode != dns.RcodeSuccess {
+		t.Errorf("servfail should be answered from stale cache: %v %v", response, err)
+	}
+	now = now.Add(time.Hour)
+	if _, err := cache.Exchange("server", msg, func(m *dns.Msg) (*dns.Msg, error) { return nil, errors.New("timeout") }); err == nil {
+		t.Error("answers older than StaleTTL should not be served")
+	}
+}
+
+func TestCachePrefetchesPopularEntries(t *testing.T) {
+	var mutex sync.Mutex
+	var now = time.Unix(1000, 0)
+	var cache = NewCache(func(o *CacheOptions) {
+		o.Now = func() time.Time {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return now
+		}
+	})
+	var prefetched = make(chan struct{}, 1)
+	var upstream = &fakeUpstream{}
+	upstream.reply = func(m *dns.Msg) (*dns.Msg, error) {
+		if upstream.count() > 1 {
+			prefetched <- struct{}{}
+		}
+		return answerA(100)(m)
+	}
+	var msg = new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	if _, err := cache.Exchange("server", msg, upstream.query); err != nil {
+		t.Fatal(err)
+	}
+	/* 剩余时间不多但只命中一次，不预取 */
+	mutex.Lock()
+	now = now.Add(95 * time.Second)
+	mutex.Unlock()
+	cache.Exchange("server", msg, upstream.query)
+	if upstream.count() != 1 {
+		t.Errorf("unpopular entry should not be prefetched: %d", upstream.count())
+	}
+	cache.Exchange("server", msg, upstream.query)
+	select {
+	case <-prefetched:
+	case <-time.After(time.Second):
+		t.Fatal("popular entry should be prefetched")
+	}
+	/* 预取之后条目被刷新，剩余时间重新开始计算 */
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if response, _ := cache.Exchange("server", msg, upstream.query); response.Answer[0].Header().Ttl == 100 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mutex.Lock()
+	now = now.Add(50 * time.Second)
+	mutex.Unlock()
+	cache.Exchange("server", msg, upstream.query)
+	if upstream.count() != 2 {
+		t.Errorf("prefetched entry should be served from cache: %d", upstream.count())
+	}
+}
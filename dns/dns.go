@@ -3,11 +3,7 @@ package dns
 import (
 	// "context"
 	// "time"
-	"context"
-	"crypto/tls"
 	"errors"
-	"net"
-	"time"
 
 	// "crypto/tls"
 	// "fmt"
@@ -17,13 +13,11 @@ import (
 	// "crypto/tls"
 	//	"fmt"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
 
-	doq "github.com/masx200/doq-go/doq"
 	print_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/print"
 	"github.com/miekg/dns"
 )
@@ -101,112 +95,18 @@ func setPortIfMissing(rawURL string) (string, error) {
 // 参数:
 // msg: 代表DNS查询消息的dns.Msg对象。
 // dohServer: 代表DOH服务器的URL字符串。
+// dohip: 可选的连接DOH服务器使用的固定IP地址。
 //
 // 返回值:
 // r: 代表DNS应答消息的dns.Msg对象。
 // err: 如果过程中发生错误，则返回错误信息。
 func DohClient(msg *dns.Msg, dohServerURL string, dohip ...string) (r *dns.Msg, err error) {
-	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	/* 为了doh的缓存,需要设置id为0 ,可以缓存*/
-	msg.Id = 0
-	body, err := msg.Pack()
-	if err != nil {
-		log.Println(dohServerURL, err)
-		return nil, err
-	}
-	req, err := http.NewRequestWithContext(ctx, "POST", dohServerURL, strings.NewReader(string(body)))
-	req.Header.Set("Content-Type", "application/dns-message")
-	//http request doh
-
-	// 创建自定义的 http.Client
-	var client *http.Client
+	var serverIP string
 	if len(dohip) > 0 {
-		serverIP := dohip[0]
-		transport := &http.Transport{
-			ForceAttemptHTTP2: true,
-			// 自定义 DialContext 函数
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				// 解析出原地址中的端口
-				_, port, err := net.SplitHostPort(addr)
-				if err != nil {
-					return nil, err
-				}
-				// 用指定的 IP 地址和原端口创建新地址
-				newAddr := net.JoinHostPort(serverIP, port)
-				// 创建 net.Dialer 实例
-				dialer := &net.Dialer{}
-				// 发起连接
-				return dialer.DialContext(ctx, network, newAddr)
-			},
-			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-
-				// 解析出原地址中的端口
-				address, port, err := net.SplitHostPort(addr)
-				if err != nil {
-					return nil, err
-				}
-				// 用指定的 IP 地址和原端口创建新地址
-				newAddr := net.JoinHostPort(serverIP, port)
-				// 创建 net.Dialer 实例
-				dialer := &net.Dialer{}
-				// 发起连接
-				conn, err := dialer.DialContext(ctx, network, newAddr)
-				if err != nil {
-					return nil, err
-				}
-				tlsConfig := &tls.Config{
-					ServerName: address,
-				}
-				// 创建 TLS 连接
-				tlsConn := tls.Client(conn, tlsConfig)
-				// 进行 TLS 握手
-				err = tlsConn.HandshakeContext(ctx)
-				if err != nil {
-					conn.Close()
-					return nil, err
-				}
-				return tlsConn, nil
-			},
-		}
-		client = &http.Client{
-			Transport: transport,
-		}
-	} else {
-		client = http.DefaultClient
-	}
-
-	res, err := client.Do(req) //Post(dohServerURL, "application/dns-message", strings.NewReader(string(body)))
-	if err != nil {
-		log.Println(dohServerURL, err)
-		return nil, err
-	}
-	//res.status check
-	if res.StatusCode != 200 {
-		log.Println(dohServerURL, "http status code is not 200  "+fmt.Sprintf("status code is %d", res.StatusCode))
-		return nil, errors.New("http status code is not 200 " + fmt.Sprintf("status code is %d", res.StatusCode))
-	}
-
-	//check content-type
-	if res.Header.Get("Content-Type") != "application/dns-message" {
-		log.Println(dohServerURL, "content-type is not application/dns-message "+res.Header.Get("Content-Type"))
-		return nil, errors.New(dohServerURL + "content-type is not application/dns-message " + res.Header.Get("Content-Type"))
-	}
-	//利用ioutil包读取百度服务器返回的数据
-	data, err := io.ReadAll(res.Body)
-	defer res.Body.Close() //一定要记得关闭连接
-	if err != nil {
-		log.Println(dohServerURL, err)
-		return nil, err
-	}
-	// log.Printf("%s", data)
-	resp := &dns.Msg{}
-	err = resp.Unpack(data)
-	if err != nil {
-		log.Println(dohServerURL, err)
-		return nil, err
+		serverIP = dohip[0]
 	}
-	return resp, nil
+	// 使用保持连接的DOH客户端，多个查询复用同一个传输的连接
+	return DoHPersistentClientOf(dohServerURL, serverIP).Exchange(msg)
 }
 
 func PrintResponse(resp *http.Response) {
@@ -242,10 +142,10 @@ func DoQClient(msg *dns.Msg, doQServerURL string) (qA *dns.Msg, err error) {
 	}
 	var addr = fmt.Sprintf("%s:%s", serverName, port) // 格式化服务器地址
 	log.Println("addr", addr)
-	// 创建一个DOQ客户端
-	client := doq.NewClient(addr)
+	// 使用保持连接的DOQ客户端，多个查询复用同一个QUIC连接
+	client := DoQPersistentClientOf(addr)
 	// 发送DNS查询并获取应答
-	respA, err := client.Send(context.Background(), msg)
+	respA, err := client.Exchange(msg)
 	if err != nil {
 		log.Println(doQServerURL, err) // 记录发送时的错误
 		return nil, err                // 如果有错误，返回nil和错误信息
@@ -296,11 +196,10 @@ func DoTClient(msg *dns.Msg, doTServerURL string) (qA *dns.Msg, err error) {
 	}
 	var addr = fmt.Sprintf("%s:%s", serverName, port) // 拼接服务器的地址信息
 	log.Println("addr", addr)
-	// 创建一个支持TCP-TLS的DOQ客户端实例。
-	client := new(dns.Client)
-	client.Net = "tcp-tls"
+	// 使用保持连接的DOT客户端，多个查询在连接池中的连接上流水线发送。
+	client := DoTPersistentClientOf(addr)
 	// 向指定的DNS服务器发送查询请求，并接收应答。
-	respA, _, err := client.Exchange(msg, addr)
+	respA, err := client.Exchange(msg)
 	if err != nil {
 		log.Println(doTServerURL, err) // 记录发送时的错误
 		return nil, err                // 如果有错误，返回nil和错误信息
@@ -0,0 +1,582 @@
+package dns
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/miekg/dns"
+)
+
+// DNSSECResult 是DNSSEC验证的结果（RFC 4035 第 4.3 节）。
+type DNSSECResult int
+
+const (
+	// DNSSECInsecure 表示应答所在的区域没有签名，或者不在信任锚之下，无法验证。
+	DNSSECInsecure DNSSECResult = iota
+	// DNSSECSecure 表示应答中所有的记录集都通过了从信任锚开始的签名链验证。
+	DNSSECSecure
+	// DNSSECBogus 表示应答应该有签名但是签名缺失或者验证失败。
+	DNSSECBogus
+)
+
+// String 返回验证结果的名称。
+func (r DNSSECResult) String() string {
+	switch r {
+	case DNSSECSecure:
+		return "secure"
+	case DNSSECBogus:
+		return "bogus"
+	default:
+		return "insecure"
+	}
+}
+
+// ErrDNSSECBogus 表示应答没有通过DNSSEC验证。
+var ErrDNSSECBogus = errors.New("dnssec: bogus response")
+
+// RootTrustAnchors 是根区域的信任锚，分别是 KSK-2017 和 KSK-2024 的DS记录。
+var RootTrustAnchors = []*dns.DS{
+	{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET}, KeyTag: 20326, Algorithm: dns.RSASHA256, DigestType: dns.SHA256, Digest: "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"},
+	{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeDS, Class: dns.ClassINET}, KeyTag: 38696, Algorithm: dns.RSASHA256, DigestType: dns.SHA256, Digest: "683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16"},
+}
+
+// dnssecUDPSize 是设置DO位时通告的EDNS0 UDP缓冲区大小，签名后的应答通常比较大。
+const dnssecUDPSize = 4096
+
+// DNSSECOptions 是DNSSEC验证器的配置。
+//
+// 字段：
+// TrustAnchors - 信任锚的DS记录，默认为 RootTrustAnchors，也可以是某个内部区域的DS记录。
+// Reject - 为true时验证失败的应答返回 ErrDNSSECBogus，为false时只标记，应答的AD位被清除并通过 OnResult 报告。
+// OnResult - 每个应答验证之后调用的函数，可以为nil。
+// MaxZoneCacheTTL - 已经验证的区域密钥的最长缓存时间，默认为1小时。
+// Now - 获取当前时间的函数，用于检查签名的有效期，便于测试。
+type DNSSECOptions struct {
+	TrustAnchors    []*dns.DS
+	Reject          bool
+	OnResult        func(msg *dns.Msg, result DNSSECResult, err error)
+	MaxZoneCacheTTL time.Duration
+	Now             func() time.Time
+}
+
+// DNSSECValidator 是DNSSEC验证器，查询时设置DO位，然后从信任锚开始逐级获取DS和DNSKEY记录，
+// 验证应答中每个记录集的RRSIG签名。已经验证的区域密钥按照TTL缓存，可以被多个协程同时使用。
+//
+// 没有签名的子区域通过父区域签名的NSEC或者NSEC3记录证明委派没有DS记录（RFC 4035 第 5.2 节）。
+// 否定应答和通配符展开的应答需要权威部分签名的NSEC或者NSEC3记录证明名称或者类型不存在（RFC 4035 第 5.4 节，RFC 5155 第 8 节）。
+type DNSSECValidator struct {
+	DNSSECOptions
+	mutex sync.Mutex
+	zones map[string]*dnssecZone
+}
+
+// dnssecZone 是一个已经验证的名称的状态。
+//
+// 字段：
+// name - 区域的名称。
+// keys - 通过验证的区域密钥，insecure 或者 notCut 时为空。
+// insecure - 区域是没有签名的子区域。
+// notCut - 名称不是区域的分界点，属于父区域。
+// expires - 缓存的过期时间。
+type dnssecZone struct {
+	name     string
+	keys     []*dns.DNSKEY
+	insecure bool
+	notCut   bool
+	expires  time.Time
+}
+
+// NewDNSSECValidator 创建一个DNSSEC验证器。
+//
+// 参数:
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的验证器。
+func NewDNSSECValidator(options ...func(*DNSSECOptions)) *DNSSECValidator {
+	var v = &DNSSECValidator{
+		DNSSECOptions: DNSSECOptions{
+			TrustAnchors:    RootTrustAnchors,
+			Reject:          true,
+			MaxZoneCacheTTL: time.Hour,
+			Now:             time.Now,
+		},
+		zones: map[string]*dnssecZone{},
+	}
+	for _, option := range options {
+		option(&v.DNSSECOptions)
+	}
+	return v
+}
+
+// QueryCallback 返回一个验证应答的查询函数，查询和获取DS、DNSKEY记录都使用 queryCallback。
+// 通过验证的应答设置AD位，没有签名的应答清除AD位。
+func (v *DNSSECValidator) QueryCallback(queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) func(m *dns.Msg) (r *dns.Msg, err error) {
+	return func(m *dns.Msg) (*dns.Msg, error) {
+		return v.Exchange(m, queryCallback)
+	}
+}
+
+// QueryCallbacks 返回验证应答的DNS查询回调函数集合，键在原来的服务器名称后面加上 " dnssec"，验证过的应答与没有验证的应答分开缓存。
+func (v *DNSSECValidator) QueryCallbacks(queryCallbacks generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)]) generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)] {
+	var validating = generic.NewMapImplement[string, func(m *dns.Msg) (r *dns.Msg, err error)]()
+	for _, entry := range queryCallbacks.Entries() {
+		validating.Set(entry.GetFirst()+" dnssec", v.QueryCallback(entry.GetSecond()))
+	}
+	return validating
+}
+
+// Exchange 设置DO位发送查询，并验证应答。
+//
+// 参数:
+// msg - DNS查询。
+// queryCallback - 查询上游的函数。
+//
+// 返回值:
+// 应答，以及查询失败或者 Reject 为true时验证失败的错误。
+func (v *DNSSECValidator) Exchange(msg *dns.Msg, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) (*dns.Msg, error) {
+	resp, err := queryCallback(dnssecQuery(msg))
+	if err != nil {
+		return nil, err
+	}
+	result, err := v.Validate(resp, queryCallback)
+	if v.OnResult != nil {
+		v.OnResult(resp, result, err)
+	}
+	resp.AuthenticatedData = result == DNSSECSecure
+	if result == DNSSECBogus {
+		log.Println("dnssec:", resp.Question, err)
+		if v.Reject {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// dnssecQuery 返回设置了DO位的查询副本。
+func dnssecQuery(msg *dns.Msg) *dns.Msg {
+	var query = msg.Copy()
+	if opt := query.IsEdns0(); opt != nil {
+		opt.SetDo()
+		if opt.UDPSize() < dnssecUDPSize {
+			opt.SetUDPSize(dnssecUDPSize)
+		}
+	} else {
+		query.SetEdns0(dnssecUDPSize, true)
+	}
+	return query
+}
+
+// Validate 验证应答中回答部分和权威部分的所有记录集。
+//
+// 参数:
+// resp - 设置DO位查询得到的应答。
+// queryCallback - 获取DS和DNSKEY记录的查询函数。
+//
+// 返回值:
+// 验证结果，以及结果为 DNSSECBogus 时的原因。
+func (v *DNSSECValidator) Validate(resp *dns.Msg, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) (DNSSECResult, error) {
+	if len(resp.Question) == 0 {
+		return DNSSECBogus, errors.Join(ErrDNSSECBogus, errors.New("response without question"))
+	}
+	var sections = [][]dns.RR{resp.Answer}
+	if len(resp.Answer) == 0 {
+		/* 否定应答的证明在权威部分 */
+		sections = append(sections, resp.Ns)
+	}
+	var result = DNSSECSecure
+	var validated = 0
+	for _, section := range sections {
+		var sets, sigs = groupRRsets(section)
+		for _, set := range sets {
+			setResult, err := v.validateRRset(set, sigs[rrsetKey(set[0].Header().Name, set[0].Header().Rrtype)], queryCallback)
+			if setResult == DNSSECBogus {
+				return DNSSECBogus, err
+			}
+			if setResult == DNSSECInsecure {
+				result = DNSSECInsecure
+			}
+			validated++
+		}
+	}
+	if validated == 0 {
+		/* 没有任何记录的应答，只有在没有签名的区域中才是可以接受的 */
+		zone, err := v.closestZone(resp.Question[0].Name, queryCallback)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if !zone.insecure {
+			return DNSSECBogus, errors.Join(ErrDNSSECBogus, errors.New("missing denial of existence for "+resp.Question[0].Name))
+		}
+		return DNSSECInsecure, nil
+	}
+	if result != DNSSECSecure {
+		return result, nil
+	}
+	if len(resp.Answer) == 0 {
+		return validateDenial(resp)
+	}
+	if err := v.validateWildcardAnswer(resp, queryCallback); err != nil {
+		return DNSSECBogus, err
+	}
+	return result, nil
+}
+
+// validateRRset 验证一个记录集，签名者必须是记录集所在的已验证的区域。
+func (v *DNSSECValidator) validateRRset(set []dns.RR, sigs []*dns.RRSIG, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) (DNSSECResult, error) {
+	var name = set[0].Header().Name
+	if len(sigs) == 0 {
+		zone, err := v.closestZone(name, queryCallback)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if zone.insecure {
+			return DNSSECInsecure, nil
+		}
+		return DNSSECBogus, errors.Join(ErrDNSSECBogus, errors.New("missing rrsig for "+name+" "+dns.TypeToString[set[0].Header().Rrtype]))
+	}
+	var errs []error
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, name) {
+			errs = append(errs, errors.New("signer "+sig.SignerName+" is not an ancestor of "+name))
+			continue
+		}
+		zone, err := v.closestZone(sig.SignerName, queryCallback)
+		if err != nil {
+			return DNSSECBogus, err
+		}
+		if zone.insecure {
+			return DNSSECInsecure, nil
+		}
+		if !strings.EqualFold(zone.name, sig.SignerName) {
+			errs = append(errs, errors.New("signer "+sig.SignerName+" is not a signed zone"))
+			continue
+		}
+		if err := v.verify(set, sig, zone.keys); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return DNSSECSecure, nil
+	}
+	return DNSSECBogus, errors.Join(append([]error{ErrDNSSECBogus}, errs...)...)
+}
+
+// verify 使用区域密钥中与签名的密钥标签和算法一致的密钥验证签名和有效期。
+func (v *DNSSECValidator) verify(set []dns.RR, sig *dns.RRSIG, keys []*dns.DNSKEY) error {
+	if !sig.ValidityPeriod(v.Now()) {
+		return errors.New("rrsig of " + sig.Header().Name + " " + dns.TypeToString[sig.TypeCovered] + " is expired or not yet valid")
+	}
+	var errs []error
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(key, set); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return nil
+	}
+	return errors.Join(append([]error{errors.New("no key verifies rrsig of " + sig.Header().Name + " " + dns.TypeToString[sig.TypeCovered])}, errs...)...)
+}
+
+// closestZone 从覆盖名称的最近的信任锚开始逐级向下查询DS记录，返回包含该名称的最深的已验证区域，
+// 遇到没有签名的子区域时返回该子区域，名称不在任何信任锚之下时返回没有签名的状态。
+func (v *DNSSECValidator) closestZone(name string, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) (*dnssecZone, error) {
+	name = dns.CanonicalName(name)
+	var anchor string
+	for _, ds := range v.TrustAnchors {
+		var anchorName = dns.CanonicalName(ds.Hdr.Name)
+		if dns.IsSubDomain(anchorName, name) && (anchor == "" || dns.CountLabel(anchorName) > dns.CountLabel(anchor)) {
+			anchor = anchorName
+		}
+	}
+	if anchor == "" {
+		return &dnssecZone{name: name, insecure: true}, nil
+	}
+	zone, err := v.anchorZone(anchor, queryCallback)
+	if err != nil {
+		return nil, err
+	}
+	var labels = dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(anchor) - 1; i >= 0; i-- {
+		var child = strings.Join(labels[i:], ".") + "."
+		next, err := v.childZone(zone, child, queryCallback)
+		if err != nil {
+			return nil, err
+		}
+		if next.notCut {
+			continue
+		}
+		if next.insecure {
+			return next, nil
+		}
+		zone = next
+	}
+	return zone, nil
+}
+
+// cached 返回缓存中未过期的区域状态。
+func (v *DNSSECValidator) cached(name string) *dnssecZone {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	var zone = v.zones[name]
+	if zone != nil && v.Now().Before(zone.expires) {
+		return zone
+	}
+	return nil
+}
+
+// store 缓存区域状态，缓存时间为记录的最小TTL，不超过 MaxZoneCacheTTL。
+func (v *DNSSECValidator) store(zone *dnssecZone, rrs []dns.RR) *dnssecZone {
+	var ttl = v.MaxZoneCacheTTL
+	for _, rr := range rrs {
+		ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+	}
+	zone.expires = v.Now().Add(ttl)
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.zones[zone.name] = zone
+	return zone
+}
+
+// anchorZone 返回信任锚区域的已验证密钥。
+func (v *DNSSECValidator) anchorZone(anchor string, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) (*dnssecZone, error) {
+	if zone := v.cached(anchor); zone != nil {
+		return zone, nil
+	}
+	var anchors []*dns.DS
+	for _, ds := range v.TrustAnchors {
+		if dns.CanonicalName(ds.Hdr.Name) == anchor {
+			anchors = append(anchors, ds)
+		}
+	}
+	return v.zoneKeys(anchor, anchors, queryCallback)
+}
+
+// zoneKeys 查询区域的DNSKEY记录，使用与DS记录匹配的密钥验证DNSKEY记录集的签名。
+func (v *DNSSECValidator) zoneKeys(name string, dsSet []*dns.DS, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) (*dnssecZone, error) {
+	resp, err := v.query(name, dns.TypeDNSKEY, queryCallback)
+	if err != nil {
+		return nil, err
+	}
+	var sets, sigs = groupRRsets(resp.Answer)
+	var keys []*dns.DNSKEY
+	var keySet []dns.RR
+	for _, set := range sets {
+		if set[0].Header().Rrtype != dns.TypeDNSKEY || !strings.EqualFold(set[0].Header().Name, name) {
+			continue
+		}
+		keySet = set
+		for _, rr := range set {
+			if key := rr.(*dns.DNSKEY); key.Flags&dns.ZONE != 0 {
+				keys = append(keys, key)
+			}
+		}
+	}
+	var trusted []*dns.DNSKEY
+	for _, key := range keys {
+		for _, ds := range dsSet {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			if digest := key.ToDS(ds.DigestType); digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+				trusted = append(trusted, key)
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, errors.Join(ErrDNSSECBogus, errors.New("no dnskey of "+name+" matches the ds records"))
+	}
+	var errs []error
+	for _, sig := range sigs[rrsetKey(name, dns.TypeDNSKEY)] {
+		if err := v.verify(keySet, sig, trusted); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return v.store(&dnssecZone{name: name, keys: keys}, keySet), nil
+	}
+	return nil, errors.Join(append([]error{ErrDNSSECBogus, errors.New("dnskey rrset of " + name + " is not signed by a trusted key")}, errs...)...)
+}
+
+// childZone 查询名称的DS记录，判断名称是已签名的子区域、没有签名的子区域还是不是区域的分界点。
+func (v *DNSSECValidator) childZone(parent *dnssecZone, child string, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) (*dnssecZone, error) {
+	if zone := v.cached(child); zone != nil {
+		return zone, nil
+	}
+	resp, err := v.query(child, dns.TypeDS, queryCallback)
+	if err != nil {
+		return nil, err
+	}
+	var sets, sigs = groupRRsets(resp.Answer)
+	for _, set := range sets {
+		if set[0].Header().Rrtype != dns.TypeDS || !strings.EqualFold(set[0].Header().Name, child) {
+			continue
+		}
+		if err := v.verifyAny(set, sigs[rrsetKey(child, dns.TypeDS)], parent); err != nil {
+			return nil, errors.Join(ErrDNSSECBogus, errors.New("ds rrset of "+child+" is not signed by "+parent.name), err)
+		}
+		var dsSet []*dns.DS
+		for _, rr := range set {
+			dsSet = append(dsSet, rr.(*dns.DS))
+		}
+		return v.zoneKeys(child, dsSet, queryCallback)
+	}
+
+	/* 没有DS记录，需要父区域签名的NSEC或者NSEC3记录证明 */
+	sets, sigs = groupRRsets(resp.Ns)
+	var proofs []dns.RR
+	var nsec3s []*dns.NSEC3
+	for _, set := range sets {
+		var rrtype = set[0].Header().Rrtype
+		if rrtype != dns.TypeNSEC && rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		if err := v.verifyAny(set, sigs[rrsetKey(set[0].Header().Name, rrtype)], parent); err != nil {
+			return nil, errors.Join(ErrDNSSECBogus, errors.New("denial of ds for "+child+" is not signed by "+parent.name), err)
+		}
+		proofs = append(proofs, set...)
+		for _, rr := range set {
+			if record, ok := rr.(*dns.NSEC3); ok {
+				nsec3s = append(nsec3s, record)
+			}
+		}
+	}
+	for _, rr := range proofs {
+		switch record := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(record.Hdr.Name, child) {
+				zone, err := delegationWithoutDS(child, record.TypeBitMap)
+				if err != nil {
+					return nil, err
+				}
+				return v.store(zone, proofs), nil
+			}
+			if nsecCovers(record, child) {
+				/* 名称不存在，也就不是区域的分界点 */
+				return v.store(&dnssecZone{name: child, notCut: true}, proofs), nil
+			}
+		case *dns.NSEC3:
+			if record.Match(child) {
+				zone, err := delegationWithoutDS(child, record.TypeBitMap)
+				if err != nil {
+					return nil, err
+				}
+				return v.store(zone, proofs), nil
+			}
+		}
+	}
+	if _, nextCloser, ok := nsec3ClosestEncloser(nsec3s, child); ok {
+		/* Opt-Out 的NSEC3覆盖的范围内可能有没有签名的委派（RFC 5155 第 8.6 节） */
+		var optOut = nextCloser.Flags&1 == 1
+		return v.store(&dnssecZone{name: child, insecure: optOut, notCut: !optOut}, proofs), nil
+	}
+	return nil, errors.Join(ErrDNSSECBogus, errors.New("missing denial of existence for ds of "+child))
+}
+
+// delegationWithoutDS 根据与名称相同的NSEC或者NSEC3记录的类型位图，判断名称是没有签名的委派还是不是区域的分界点。
+// 类型位图中有DS记录时，这个记录不能证明没有DS记录，可能是签名的委派的记录被重放。
+func delegationWithoutDS(name string, types []uint16) (*dnssecZone, error) {
+	if !provesNoData(types, dns.TypeDS) {
+		return nil, errors.Join(ErrDNSSECBogus, errors.New("nsec records of "+name+" do not prove the absence of ds"))
+	}
+	if slices.Contains(types, dns.TypeNS) {
+		return &dnssecZone{name: name, insecure: true}, nil
+	}
+	return &dnssecZone{name: name, notCut: true}, nil
+}
+
+// coversName 判断名称是否按照规范顺序位于NSEC记录的所有者和下一个名称之间（RFC 4034 第 6.1 节）。
+func coversName(owner string, next string, name string) bool {
+	var afterOwner = canonicalCompare(owner, name) < 0
+	var beforeNext = canonicalCompare(name, next) < 0
+	if canonicalCompare(owner, next) >= 0 {
+		/* 区域中最后一个NSEC记录的下一个名称是区域的名称 */
+		return afterOwner || beforeNext
+	}
+	return afterOwner && beforeNext
+}
+
+// canonicalCompare 按照DNSSEC的规范顺序比较两个名称，从最右边的标签开始逐个比较小写的标签。
+func canonicalCompare(a string, b string) int {
+	var labelsA = dns.SplitDomainName(dns.CanonicalName(a))
+	var labelsB = dns.SplitDomainName(dns.CanonicalName(b))
+	for i, j := len(labelsA)-1, len(labelsB)-1; i >= 0 || j >= 0; i, j = i-1, j-1 {
+		if i < 0 {
+			return -1
+		}
+		if j < 0 {
+			return 1
+		}
+		if c := strings.Compare(labelsA[i], labelsB[j]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// verifyAny 使用区域的密钥验证记录集的任意一个签名。
+func (v *DNSSECValidator) verifyAny(set []dns.RR, sigs []*dns.RRSIG, zone *dnssecZone) error {
+	var errs = []error{errors.New("missing rrsig")}
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, zone.name) {
+			continue
+		}
+		if err := v.verify(set, sig, zone.keys); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// query 设置DO位查询名称的记录，只接受成功的应答。
+func (v *DNSSECValidator) query(name string, rrtype uint16, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) (*dns.Msg, error) {
+	var msg = new(dns.Msg)
+	msg.SetQuestion(name, rrtype)
+	resp, err := queryCallback(dnssecQuery(msg))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, errors.New("dnssec: query " + name + " " + dns.TypeToString[rrtype] + " failed: " + dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// rrsetKey 返回记录集的键，名称不区分大小写。
+func rrsetKey(name string, rrtype uint16) string {
+	return dns.CanonicalName(name) + " " + dns.TypeToString[rrtype]
+}
+
+// groupRRsets 把记录按照名称和类型分组为记录集，并按照覆盖的记录集分组RRSIG记录，记录集保持出现的顺序。
+func groupRRsets(rrs []dns.RR) ([][]dns.RR, map[string][]*dns.RRSIG) {
+	var sets [][]dns.RR
+	var index = map[string]int{}
+	var sigs = map[string][]*dns.RRSIG{}
+	for _, rr := range rrs {
+		var header = rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			var key = rrsetKey(header.Name, sig.TypeCovered)
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if header.Rrtype == dns.TypeOPT {
+			continue
+		}
+		var key = rrsetKey(header.Name, header.Rrtype)
+		if i, ok := index[key]; ok {
+			sets[i] = append(sets[i], rr)
+			continue
+		}
+		index[key] = len(sets)
+		sets = append(sets, []dns.RR{rr})
+	}
+	return sets, sigs
+}
@@ -0,0 +1,241 @@
+package dns
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// validateDenial 检查否定应答权威部分中已经验证过签名的NSEC或者NSEC3记录是否证明了查询的名称或者类型不存在
+// （RFC 4035 第 5.4 节，RFC 5155 第 8 节），防止把其他名称的否定应答重放为这个名称的应答。
+//
+// 参数:
+// resp - 回答部分为空的应答。
+//
+// 返回值:
+// 验证结果，Opt-Out 的NSEC3记录证明没有DS记录时为 DNSSECInsecure，以及结果为 DNSSECBogus 时的原因。
+func validateDenial(resp *dns.Msg) (DNSSECResult, error) {
+	var question = resp.Question[0]
+	var qname = dns.CanonicalName(question.Name)
+	var nxdomain = resp.Rcode == dns.RcodeNameError
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range resp.Ns {
+		switch record := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, record)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, record)
+		}
+	}
+	if len(nsecs) > 0 && nsecDenial(nsecs, qname, question.Qtype, nxdomain) {
+		return DNSSECSecure, nil
+	}
+	if len(nsec3s) > 0 {
+		if result, ok := nsec3Denial(nsec3s, qname, question.Qtype, nxdomain); ok {
+			return result, nil
+		}
+	}
+	return DNSSECBogus, errors.Join(ErrDNSSECBogus, errors.New("nsec records do not prove the denial of existence for "+question.Name+" "+dns.TypeToString[question.Qtype]))
+}
+
+// nsecDenial 判断NSEC记录是否证明了名称或者类型不存在。
+// NODATA需要与名称相同的NSEC记录，或者覆盖名称的NSEC记录和与通配符名称相同的NSEC记录；
+// NXDOMAIN需要覆盖名称的NSEC记录和覆盖最近祖先的通配符名称的NSEC记录。
+func nsecDenial(nsecs []*dns.NSEC, qname string, qtype uint16, nxdomain bool) bool {
+	if !nxdomain {
+		for _, nsec := range nsecs {
+			if strings.EqualFold(nsec.Hdr.Name, qname) {
+				return provesNoData(nsec.TypeBitMap, qtype)
+			}
+		}
+	}
+	var cover *dns.NSEC
+	for _, nsec := range nsecs {
+		if nsecCovers(nsec, qname) {
+			cover = nsec
+			break
+		}
+	}
+	if cover == nil {
+		return false
+	}
+	/* 最近祖先是名称与NSEC记录的所有者和下一个名称最长的共同祖先 */
+	var encloser = ancestorName(qname, max(dns.CompareDomainName(qname, cover.Hdr.Name), dns.CompareDomainName(qname, cover.NextDomain)))
+	var wildcard = wildcardName(encloser)
+	for _, nsec := range nsecs {
+		if nxdomain && nsecCovers(nsec, wildcard) {
+			return true
+		}
+		if !nxdomain && strings.EqualFold(nsec.Hdr.Name, wildcard) && provesNoData(nsec.TypeBitMap, qtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsec3Denial 判断NSEC3记录是否证明了名称或者类型不存在，第二个返回值为false时没有证明。
+// NODATA需要与名称匹配的NSEC3记录，或者最近祖先证明和与通配符名称匹配的NSEC3记录；
+// NXDOMAIN需要最近祖先证明和覆盖通配符名称的NSEC3记录。
+func nsec3Denial(nsec3s []*dns.NSEC3, qname string, qtype uint16, nxdomain bool) (DNSSECResult, bool) {
+	if !nxdomain {
+		for _, nsec3 := range nsec3s {
+			if nsec3.Match(qname) {
+				return DNSSECSecure, provesNoData(nsec3.TypeBitMap, qtype)
+			}
+		}
+	}
+	encloser, nextCloser, ok := nsec3ClosestEncloser(nsec3s, qname)
+	if !ok {
+		return DNSSECBogus, false
+	}
+	if !nxdomain && qtype == dns.TypeDS && nextCloser.Flags&1 == 1 {
+		/* Opt-Out 的NSEC3覆盖的范围内可能有没有签名的委派（RFC 5155 第 8.6 节） */
+		return DNSSECInsecure, true
+	}
+	var wildcard = wildcardName(encloser)
+	for _, nsec3 := range nsec3s {
+		if nxdomain && nsec3.Cover(wildcard) {
+			return DNSSECSecure, true
+		}
+		if !nxdomain && nsec3.Match(wildcard) && provesNoData(nsec3.TypeBitMap, qtype) {
+			return DNSSECSecure, true
+		}
+	}
+	return DNSSECBogus, false
+}
+
+// nsec3ClosestEncloser 查找最近祖先证明（RFC 5155 第 8.3 节）：与名称最近的存在的祖先匹配的NSEC3记录，
+// 以及覆盖下一个更近的名称的NSEC3记录。
+//
+// 返回值:
+// 最近祖先、覆盖下一个更近的名称的NSEC3记录，以及是否找到了证明。
+func nsec3ClosestEncloser(nsec3s []*dns.NSEC3, qname string) (string, *dns.NSEC3, bool) {
+	var labels = dns.CountLabel(qname)
+	for count := labels - 1; count >= 0; count-- {
+		var encloser = ancestorName(qname, count)
+		if !slices.ContainsFunc(nsec3s, func(nsec3 *dns.NSEC3) bool { return nsec3.Match(encloser) }) {
+			continue
+		}
+		var nextCloser = ancestorName(qname, count+1)
+		for _, nsec3 := range nsec3s {
+			if nsec3.Cover(nextCloser) {
+				return encloser, nsec3, true
+			}
+		}
+		return "", nil, false
+	}
+	return "", nil, false
+}
+
+// validateWildcardAnswer 检查通配符展开得到的肯定应答是否证明了没有更接近的名称（RFC 4035 第 5.3.4 节，RFC 5155 第 8.8 节）。
+// RRSIG的标签数小于所有者名称的标签数时，记录集是通配符展开的结果，权威部分需要覆盖所有者名称的NSEC记录，
+// 或者覆盖下一个更近的名称的NSEC3记录，这些记录的签名同样需要通过验证。
+func (v *DNSSECValidator) validateWildcardAnswer(resp *dns.Msg, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) error {
+	var sets, sigs = groupRRsets(resp.Answer)
+	var proofs []dns.RR
+	var proofsValidated = false
+	for _, set := range sets {
+		var owner = dns.CanonicalName(set[0].Header().Name)
+		var labels = dns.CountLabel(owner)
+		if strings.HasPrefix(owner, "*.") {
+			labels--
+		}
+		var expanded = -1
+		for _, sig := range sigs[rrsetKey(owner, set[0].Header().Rrtype)] {
+			if int(sig.Labels) < labels {
+				expanded = int(sig.Labels)
+			}
+		}
+		if expanded < 0 {
+			continue
+		}
+		if !proofsValidated {
+			var err error
+			if proofs, err = v.validatedProofs(resp.Ns, queryCallback); err != nil {
+				return err
+			}
+			proofsValidated = true
+		}
+		var nextCloser = ancestorName(owner, expanded+1)
+		var proven = slices.ContainsFunc(proofs, func(rr dns.RR) bool {
+			switch record := rr.(type) {
+			case *dns.NSEC:
+				return nsecCovers(record, owner)
+			case *dns.NSEC3:
+				return record.Cover(nextCloser)
+			}
+			return false
+		})
+		if !proven {
+			return errors.Join(ErrDNSSECBogus, errors.New("wildcard answer for "+owner+" without proof that no closer name exists"))
+		}
+	}
+	return nil
+}
+
+// validatedProofs 返回权威部分中签名通过验证的NSEC和NSEC3记录。
+func (v *DNSSECValidator) validatedProofs(section []dns.RR, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) ([]dns.RR, error) {
+	var proofs []dns.RR
+	var sets, sigs = groupRRsets(section)
+	for _, set := range sets {
+		var rrtype = set[0].Header().Rrtype
+		if rrtype != dns.TypeNSEC && rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		result, err := v.validateRRset(set, sigs[rrsetKey(set[0].Header().Name, rrtype)], queryCallback)
+		if result == DNSSECBogus {
+			return nil, err
+		}
+		if result == DNSSECSecure {
+			proofs = append(proofs, set...)
+		}
+	}
+	return proofs, nil
+}
+
+// provesNoData 判断NSEC或者NSEC3记录的类型位图是否证明名称没有该类型的记录。
+// 父区域中委派点的记录只能证明没有DS记录，子区域顶点的记录不能证明没有DS记录。
+func provesNoData(types []uint16, qtype uint16) bool {
+	if slices.Contains(types, qtype) || slices.Contains(types, dns.TypeCNAME) {
+		return false
+	}
+	var delegation = slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA)
+	if qtype == dns.TypeDS {
+		return !slices.Contains(types, dns.TypeSOA)
+	}
+	return !delegation
+}
+
+// nsecCovers 判断NSEC记录是否证明名称不存在。父区域中委派点的NSEC记录不能证明委派之下的名称不存在。
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	if !coversName(nsec.Hdr.Name, nsec.NextDomain, name) {
+		return false
+	}
+	if dns.IsSubDomain(nsec.Hdr.Name, name) && slices.Contains(nsec.TypeBitMap, dns.TypeNS) && !slices.Contains(nsec.TypeBitMap, dns.TypeSOA) {
+		return false
+	}
+	return true
+}
+
+// ancestorName 返回名称最右边 count 个标签组成的祖先名称，count 为0时返回根。
+func ancestorName(name string, count int) string {
+	var labels = dns.SplitDomainName(name)
+	if count <= 0 {
+		return "."
+	}
+	if count >= len(labels) {
+		return dns.CanonicalName(name)
+	}
+	return dns.CanonicalName(strings.Join(labels[len(labels)-count:], "."))
+}
+
+// wildcardName 返回名称下的通配符名称。
+func wildcardName(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
@@ -0,0 +1,320 @@
+package dns
+
+import (
+	"crypto"
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/miekg/dns"
+)
+
+// signedZone 是测试用的签名区域，example. 是信任锚，signed.example. 是签名的子区域，
+// insecure.example. 是没有DS记录的委派。
+type signedZone struct {
+	t       *testing.T
+	keys    map[string]*dns.DNSKEY
+	signers map[string]crypto.Signer
+	records map[string][]dns.RR
+	names   map[string][]uint16
+	forged  map[string]*dns.RRSIG
+}
+
+func newSignedZone(t *testing.T) *signedZone {
+	var z = &signedZone{t: t, keys: map[string]*dns.DNSKEY{}, signers: map[string]crypto.Signer{}, records: map[string][]dns.RR{}, names: map[string][]uint16{}, forged: map[string]*dns.RRSIG{}}
+	for _, zone := range []string{"example.", "signed.example."} {
+		var key = &dns.DNSKEY{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600}, Flags: 257, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+		privateKey, err := key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.keys[zone] = key
+		z.signers[zone] = privateKey.(crypto.Signer)
+		z.add(key)
+	}
+	z.add(z.keys["signed.example."].ToDS(dns.SHA256))
+	z.names["insecure.example."] = []uint16{dns.TypeNS}
+	z.add(z.a("www.example.", "192.0.2.1"))
+	z.add(z.a("host.signed.example.", "192.0.2.2"))
+	z.add(z.a("host.insecure.example.", "192.0.2.3"))
+	z.add(z.a("unsigned.example.", "192.0.2.4"))
+	/* 签名覆盖的是另一个地址 */
+	z.forged["forged.example."] = z.sign([]dns.RR{z.a("forged.example.", "192.0.2.99")})
+	z.add(z.a("forged.example.", "192.0.2.5"))
+	return z
+}
+
+func (z *signedZone) a(name string, ip string) dns.RR {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip)}
+}
+
+func (z *signedZone) add(rr dns.RR) {
+	var header = rr.Header()
+	z.records[rrsetKey(header.Name, header.Rrtype)] = append(z.records[rrsetKey(header.Name, header.Rrtype)], rr)
+	z.names[header.Name] = append(z.names[header.Name], header.Rrtype)
+}
+
+// zoneOf 返回签名记录的区域，DS记录由父区域签名，没有签名的区域返回空字符串。
+func (z *signedZone) zoneOf(name string, rrtype uint16) string {
+	switch {
+	case dns.IsSubDomain("insecure.example.", name) && name != "insecure.example.":
+		return ""
+	case name == "unsigned.example.":
+		return ""
+	case dns.IsSubDomain("signed.example.", name) && !(name == "signed.example." && rrtype == dns.TypeDS):
+		return "signed.example."
+	default:
+		return "example."
+	}
+}
+
+func (z *signedZone) sign(rrset []dns.RR) *dns.RRSIG {
+	var header = rrset[0].Header()
+	return z.signWith(z.zoneOf(header.Name, header.Rrtype), rrset)
+}
+
+// signWith 使用指定区域的密钥签名记录集。
+func (z *signedZone) signWith(zone string, rrset []dns.RR) *dns.RRSIG {
+	var header = rrset[0].Header()
+	var sig = &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: header.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: header.Ttl},
+		TypeCovered: header.Rrtype,
+		Algorithm:   dns.ECDSAP256SHA256,
+		Labels:      uint8(dns.CountLabel(header.Name)),
+		OrigTtl:     header.Ttl,
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      z.keys[zone].KeyTag(),
+		SignerName:  zone,
+	}
+	if err := sig.Sign(z.signers[zone], rrset); err != nil {
+		/* 可能在服务器的协程中调用，不能使用 Fatal */
+		z.t.Error(err)
+	}
+	return sig
+}
+
+// ServeDNS 应答查询，设置DO位时附带签名，记录不存在时返回带有签名的NSEC记录的NODATA应答，
+// nodenial.example. 的否定应答缺少NSEC记录。
+func (z *signedZone) ServeDNS(w dns.ResponseWriter, m *dns.Msg) {
+	var r = new(dns.Msg)
+	r.SetReply(m)
+	var do = m.IsEdns0() != nil && m.IsEdns0().Do()
+	var question = m.Question[0]
+	var name = strings.ToLower(question.Name)
+	var signed = do && z.zoneOf(name, question.Qtype) != ""
+	if rrset := z.records[rrsetKey(name, question.Qtype)]; rrset != nil {
+		r.Answer = append(r.Answer, rrset...)
+		if signed {
+			if sig := z.forged[name]; sig != nil {
+				r.Answer = append(r.Answer, sig)
+			} else {
+				r.Answer = append(r.Answer, z.sign(rrset))
+			}
+		}
+	} else if signed && name != "nodenial.example." {
+		var types = append([]uint16{dns.TypeRRSIG, dns.TypeNSEC}, z.names[name]...)
+		slices.Sort(types)
+		types = slices.Compact(types)
+		var nsec = []dns.RR{&dns.NSEC{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300}, NextDomain: "\\000." + name, TypeBitMap: types}}
+		r.Ns = append(r.Ns, nsec[0], z.sign(nsec))
+	}
+	r.SetEdns0(dnssecUDPSize, do)
+	w.WriteMsg(r)
+}
+
+func TestDNSSECValidator(t *testing.T) {
+	var zone = newSignedZone(t)
+	var client = NewPlainClient(startPlainServers(t, zone))
+	var anchor = zone.keys["example."].ToDS(dns.SHA256)
+	var results []DNSSECResult
+	var validator = NewDNSSECValidator(func(o *DNSSECOptions) {
+		o.TrustAnchors = []*dns.DS{anchor}
+		o.OnResult = func(msg *dns.Msg, result DNSSECResult, err error) { results = append(results, result) }
+	})
+	var query = validator.QueryCallback(client.Exchange)
+
+	for _, test := range []struct {
+		name   string
+		result DNSSECResult
+	}{
+		{"www.example.", DNSSECSecure},
+		{"host.signed.example.", DNSSECSecure},
+		{"host.insecure.example.", DNSSECInsecure},
+		{"unsigned.example.", DNSSECBogus},
+		{"forged.example.", DNSSECBogus},
+		{"nodenial.example.", DNSSECBogus},
+	} {
+		results = nil
+		resp, err := query(new(dns.Msg).SetQuestion(test.name, dns.TypeA))
+		if len(results) != 1 || results[0] != test.result {
+			t.Errorf("%s: expected %s: %v %v", test.name, test.result, results, err)
+		}
+		if test.result == DNSSECBogus {
+			if !errors.Is(err, ErrDNSSECBogus) {
+				t.Errorf("%s: bogus response should be rejected: %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if resp.AuthenticatedData != (test.result == DNSSECSecure) {
+			t.Errorf("%s: unexpected AD bit %v", test.name, resp.AuthenticatedData)
+		}
+	}
+
+	/* NODATA应答由签名的NSEC记录证明 */
+	resp, err := query(new(dns.Msg).SetQuestion("www.example.", dns.TypeAAAA))
+	if err != nil || !resp.AuthenticatedData {
+		t.Errorf("signed nodata response should be secure: %v %v", resp, err)
+	}
+
+	/* 只标记时返回没有AD位的应答 */
+	validator.Reject = false
+	resp, err = query(new(dns.Msg).SetQuestion("forged.example.", dns.TypeA))
+	if err != nil || resp.AuthenticatedData {
+		t.Errorf("flagged bogus response should be returned without AD bit: %v %v", resp, err)
+	}
+
+	/* 名称不在信任锚之下时不验证 */
+	var strict = NewDNSSECValidator(func(o *DNSSECOptions) { o.TrustAnchors = []*dns.DS{anchor} })
+	if result, err := strict.Validate(new(dns.Msg).SetQuestion("www.example.org.", dns.TypeA), client.Exchange); result != DNSSECInsecure || err != nil {
+		t.Errorf("name outside the trust anchor should be insecure: %s %v", result, err)
+	}
+}
+
+func TestDnsResolverMultipleServersDNSSEC(t *testing.T) {
+	var zone = newSignedZone(t)
+	var client = NewPlainClient(startPlainServers(t, zone))
+	var validator = NewDNSSECValidator(func(o *DNSSECOptions) {
+		o.TrustAnchors = []*dns.DS{zone.keys["example."].ToDS(dns.SHA256)}
+	})
+	var queryCallbacks = generic.MapImplementFromMap(map[string]func(m *dns.Msg) (r *dns.Msg, err error){"local": client.Exchange})
+	var options = func(o *DnsResolverOptions) {
+		o.Cache = NewCache()
+		o.DNSSEC = validator
+	}
+	addresses, err := DnsResolverMultipleServers("host.signed.example", queryCallbacks, options)
+	if err != nil || len(addresses) != 1 || addresses[0] != "192.0.2.2" {
+		t.Errorf("expected validated address: %v %v", addresses, err)
+	}
+	if addresses, err := DnsResolverMultipleServers("forged.example", queryCallbacks, options); err == nil {
+		t.Errorf("forged address should be rejected: %v", addresses)
+	}
+
+	/* 验证的回调函数使用不同的名称，不会与没有验证的应答共用缓存 */
+	var validating = validator.QueryCallbacks(queryCallbacks)
+	if !validating.Has("local dnssec") || validating.Size() != 1 {
+		t.Errorf("unexpected validating callbacks: %v", validating.Keys())
+	}
+}
+
+func TestDNSSECValidatorDenial(t *testing.T) {
+	var zone = newSignedZone(t)
+	var client = NewPlainClient(startPlainServers(t, zone))
+	var validator = NewDNSSECValidator(func(o *DNSSECOptions) {
+		o.TrustAnchors = []*dns.DS{zone.keys["example."].ToDS(dns.SHA256)}
+	})
+	var response = func(name string, rcode int, ns ...dns.RR) *dns.Msg {
+		var msg = new(dns.Msg).SetQuestion(name, dns.TypeA)
+		msg.Response = true
+		msg.Rcode = rcode
+		msg.Ns = ns
+		return msg
+	}
+	var signed = func(rr dns.RR) []dns.RR {
+		return []dns.RR{rr, zone.sign([]dns.RR{rr})}
+	}
+	var nsec3 = func(name string, next string) dns.RR {
+		var hash = dns.HashName(name, dns.SHA1, 0, "")
+		if next == "" {
+			next = hash
+		}
+		return &dns.NSEC3{Hdr: dns.RR_Header{Name: hash + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300}, Hash: dns.SHA1, HashLength: 20, NextDomain: next, TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY}}
+	}
+
+	/* 重放另一个名称的NODATA应答中签名的NSEC记录 */
+	query := new(dns.Msg).SetQuestion("www.example.", dns.TypeAAAA)
+	query.SetEdns0(dnssecUDPSize, true)
+	replayed, err := client.Exchange(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed.Ns) == 0 {
+		t.Fatal("missing nsec records")
+	}
+	var wildcard = zone.a("*.example.", "192.0.2.6")
+	var wildcardSig = zone.sign([]dns.RR{wildcard})
+	var expanded = zone.a("wild.example.", "192.0.2.6")
+	wildcardSig.Hdr.Name = "wild.example."
+	var wildcardAnswer = func(ns ...dns.RR) *dns.Msg {
+		var msg = response("wild.example.", dns.RcodeSuccess, ns...)
+		msg.Answer = []dns.RR{expanded, wildcardSig}
+		return msg
+	}
+
+	for _, test := range []struct {
+		name   string
+		msg    *dns.Msg
+		result DNSSECResult
+	}{
+		{"replayed nxdomain", response("missing.example.", dns.RcodeNameError, replayed.Ns...), DNSSECBogus},
+		{"replayed nodata", response("missing.example.", dns.RcodeSuccess, replayed.Ns...), DNSSECBogus},
+		{"nodata", response("www.example.", dns.RcodeSuccess, replayed.Ns...), DNSSECBogus},
+		{"nxdomain", response("missing.example.", dns.RcodeNameError, signed(&dns.NSEC{Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300}, NextDomain: "www.example.", TypeBitMap: []uint16{dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeDNSKEY}})...), DNSSECSecure},
+		{"nxdomain without wildcard proof", response("missing.example.", dns.RcodeNameError, signed(&dns.NSEC{Hdr: dns.RR_Header{Name: "lost.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300}, NextDomain: "www.example.", TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}})...), DNSSECBogus},
+		{"nsec3 nxdomain", response("missing.example.", dns.RcodeNameError, signed(nsec3("example.", ""))...), DNSSECSecure},
+		{"nsec3 without closest encloser", response("missing.example.", dns.RcodeNameError, signed(nsec3("www.example.", ""))...), DNSSECBogus},
+		{"wildcard without proof", wildcardAnswer(), DNSSECBogus},
+		{"wildcard", wildcardAnswer(signed(&dns.NSEC{Hdr: dns.RR_Header{Name: "*.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300}, NextDomain: "www.example.", TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}})...), DNSSECSecure},
+	} {
+		result, err := validator.Validate(test.msg, client.Exchange)
+		if result != test.result {
+			t.Errorf("%s: expected %s: %s %v", test.name, test.result, result, err)
+		}
+		if test.result == DNSSECBogus && !errors.Is(err, ErrDNSSECBogus) {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
+
+func TestDNSSECValidatorReplayedDelegationDenial(t *testing.T) {
+	var zone = newSignedZone(t)
+	/* 父区域签名的 signed.example. 的NSEC记录的类型位图中有DS，不能证明委派没有签名 */
+	var nsec = &dns.NSEC{Hdr: dns.RR_Header{Name: "signed.example.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300}, NextDomain: "unsigned.example.", TypeBitMap: []uint16{dns.TypeNS, dns.TypeDS, dns.TypeRRSIG, dns.TypeNSEC}}
+	/* 只覆盖名称而没有最近祖先证明的 Opt-Out NSEC3 记录，不能证明委派没有签名 */
+	var hash = dns.HashName("www.example.", dns.SHA1, 0, "")
+	var nsec3 = &dns.NSEC3{Hdr: dns.RR_Header{Name: hash + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300}, Hash: dns.SHA1, Flags: 1, HashLength: 20, NextDomain: hash, TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG}}
+	for _, denial := range []dns.RR{nsec, nsec3} {
+		var replayed = []dns.RR{denial, zone.signWith("example.", []dns.RR{denial})}
+		var client = NewPlainClient(startPlainServers(t, dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			var question = m.Question[0]
+			var r = new(dns.Msg)
+			r.SetReply(m)
+			switch {
+			case question.Qtype == dns.TypeDS && strings.EqualFold(question.Name, "signed.example."):
+				r.Ns = replayed
+			case question.Qtype == dns.TypeA && strings.EqualFold(question.Name, "host.signed.example."):
+				/* 伪造的没有签名的应答 */
+				r.Answer = []dns.RR{zone.a("host.signed.example.", "203.0.113.1")}
+			default:
+				zone.ServeDNS(w, m)
+				return
+			}
+			r.SetEdns0(dnssecUDPSize, true)
+			w.WriteMsg(r)
+		})))
+		var validator = NewDNSSECValidator(func(o *DNSSECOptions) {
+			o.TrustAnchors = []*dns.DS{zone.keys["example."].ToDS(dns.SHA256)}
+		})
+		resp, err := validator.QueryCallback(client.Exchange)(new(dns.Msg).SetQuestion("host.signed.example.", dns.TypeA))
+		if !errors.Is(err, ErrDNSSECBogus) {
+			t.Errorf("%s: forged answer under a signed delegation should be rejected: %v %v", dns.TypeToString[denial.Header().Rrtype], resp, err)
+		}
+	}
+}
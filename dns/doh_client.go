@@ -0,0 +1,188 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DoHClientOptions 是保持连接的DoH客户端的配置。
+//
+// 字段：
+// ServerIP - 连接服务器使用的固定IP地址，用于没有其他解析器时引导解析DoH服务器的域名，为空时使用系统解析器。
+// Method - 发送查询使用的HTTP方法，支持 http.MethodPost 和 http.MethodGet，默认为 POST。
+// GET 查询的ID为0，可以被HTTP缓存。
+// Timeout - 每个查询的超时时间，默认为10秒。
+// TLSConfig - TLS配置，为nil时使用默认配置。
+// Transport - 发送请求使用的传输，为nil时创建一个支持HTTP/2的 http.Transport，例如 h3.NewDoHTTP3PersistentClient 使用HTTP/3传输。
+type DoHClientOptions struct {
+	ServerIP  string
+	Method    string
+	Timeout   time.Duration
+	TLSConfig *tls.Config
+	Transport http.RoundTripper
+}
+
+// DoHPersistentClient 是保持连接的DoH客户端（RFC 8484），可以被多个协程同时使用。
+// 客户端持有自己的传输，多个查询复用HTTP/2或者HTTP/3连接，不再使用时需要调用 Close 关闭连接。
+type DoHPersistentClient struct {
+	DoHClientOptions
+	URL string
+}
+
+// NewDoHPersistentClient 创建一个保持连接的DoH客户端。
+//
+// 参数:
+// serverURL - DoH服务器的URL。
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的客户端。
+func NewDoHPersistentClient(serverURL string, options ...func(*DoHClientOptions)) *DoHPersistentClient {
+	var client = &DoHPersistentClient{
+		DoHClientOptions: DoHClientOptions{Method: http.MethodPost, Timeout: 10 * time.Second},
+		URL:              serverURL,
+	}
+	for _, option := range options {
+		option(&client.DoHClientOptions)
+	}
+	if client.Transport == nil {
+		client.Transport = newDoHTransport(client.ServerIP, client.TLSConfig)
+	}
+	return client
+}
+
+// newDoHTransport 创建DoH使用的支持HTTP/2的传输，serverIP 不为空时连接该IP地址，TLS仍然使用URL中的域名。
+func newDoHTransport(serverIP string, tlsConfig *tls.Config) *http.Transport {
+	var transport = http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	/* 同时只建立一个连接，并发的查询等待连接协商出HTTP/2后在同一个连接上复用，而不是每个查询各自建立连接，
+	只支持HTTP/1.1的服务器上查询会依次发送 */
+	transport.MaxConnsPerHost = 1
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+	if serverIP != "" {
+		var dialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// 解析出原地址中的端口
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			// 用指定的 IP 地址和原端口创建新地址
+			return dialer.DialContext(ctx, network, net.JoinHostPort(serverIP, port))
+		}
+	}
+	return transport
+}
+
+// Exchange 发送查询并返回应答，应答的ID与查询相同。
+func (c *DoHPersistentClient) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	return c.ExchangeContext(ctx, msg)
+}
+
+// ExchangeContext 按照配置的HTTP方法发送查询并返回应答。
+func (c *DoHPersistentClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var query = msg.Copy()
+	/* 为了doh的缓存,需要设置id为0 ,可以缓存*/
+	query.Id = 0
+	body, err := query.Pack()
+	if err != nil {
+		log.Println(c.URL, err)
+		return nil, err
+	}
+	var req *http.Request
+	if c.Method == http.MethodGet {
+		serverURL, err := url.Parse(c.URL)
+		if err != nil {
+			return nil, err
+		}
+		var values = serverURL.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(body))
+		serverURL.RawQuery = values.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, serverURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/dns-message")
+	}
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := c.Transport.RoundTrip(req)
+	if err != nil {
+		log.Println(c.URL, err)
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		log.Println(c.URL, "http status code is not 200  "+fmt.Sprintf("status code is %d", res.StatusCode))
+		return nil, errors.New("http status code is not 200 " + fmt.Sprintf("status code is %d", res.StatusCode))
+	}
+	if mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); mediaType != "application/dns-message" {
+		log.Println(c.URL, "content-type is not application/dns-message "+res.Header.Get("Content-Type"))
+		return nil, errors.New(c.URL + "content-type is not application/dns-message " + res.Header.Get("Content-Type"))
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, dns.MaxMsgSize))
+	if err != nil {
+		log.Println(c.URL, err)
+		return nil, err
+	}
+	var resp = new(dns.Msg)
+	if err := resp.Unpack(data); err != nil {
+		log.Println(c.URL, err)
+		return nil, err
+	}
+	resp.Id = msg.Id
+	return resp, nil
+}
+
+// Close 关闭客户端传输的所有连接。
+func (c *DoHPersistentClient) Close() error {
+	switch transport := c.Transport.(type) {
+	case io.Closer:
+		return transport.Close()
+	case interface{ CloseIdleConnections() }:
+		transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+var dohClientsMutex sync.Mutex
+var dohClients = map[string]*DoHPersistentClient{}
+
+// DoHPersistentClientOf 返回服务器URL和固定IP地址对应的共享DoH客户端，第一次使用时创建。
+//
+// 参数:
+// serverURL - DoH服务器的URL。
+// serverIP - 连接服务器使用的固定IP地址，为空时使用系统解析器。
+func DoHPersistentClientOf(serverURL string, serverIP string) *DoHPersistentClient {
+	dohClientsMutex.Lock()
+	defer dohClientsMutex.Unlock()
+	var key = serverURL + "|" + serverIP
+	var client = dohClients[key]
+	if client == nil {
+		client = NewDoHPersistentClient(serverURL, func(o *DoHClientOptions) { o.ServerIP = serverIP })
+		dohClients[key] = client
+	}
+	return client
+}
@@ -0,0 +1,64 @@
+package dns
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/dns_server"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/internal/testcert"
+)
+
+func TestDoHPersistentClient(t *testing.T) {
+	serverConfig, clientConfig := testcert.Configs(t, "dns.example")
+	var handler = dns_server.NewDoHHandler(func(o *dns_server.Options) { o.Query = echoNameQuery })
+	var mutex sync.Mutex
+	var methods = map[string]int{}
+	var server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("expected HTTP/2 request: %s", r.Proto)
+		}
+		mutex.Lock()
+		methods[r.Method]++
+		mutex.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	var connections atomic.Int32
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.EnableHTTP2 = true
+	server.TLS = serverConfig
+	server.StartTLS()
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	/* 使用固定IP地址连接，TLS仍然验证URL中的域名 */
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		var client = NewDoHPersistentClient("https://dns.example:"+port+"/dns-query", func(o *DoHClientOptions) {
+			o.ServerIP = "127.0.0.1"
+			o.TLSConfig = clientConfig
+			o.Method = method
+		})
+		connections.Store(0)
+		exchangeConcurrently(t, client.Exchange)
+		exchangeConcurrently(t, client.Exchange)
+		if n := connections.Load(); n != 1 {
+			t.Errorf("%s queries should share one HTTP/2 connection: %d", method, n)
+		}
+		if err := client.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+	if methods[http.MethodPost] != 40 || methods[http.MethodGet] != 40 {
+		t.Errorf("unexpected request methods: %v", methods)
+	}
+}
@@ -0,0 +1,260 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// PersistentClientOptions 是保持连接的DoQ和DoT客户端的配置。
+//
+// 字段：
+// TLSConfig - TLS配置，ServerName 为空时使用服务器地址中的主机名。
+// IdleTimeout - 连接的空闲超时时间，空闲超过该时间后关闭连接，默认为30秒。
+// Timeout - 每个查询的超时时间，默认为10秒。
+// MaxConnections - DoT连接池的最大连接数，默认为4。
+// MaxPipelined - 每个DoT连接上同时等待应答的最大查询数，超过时使用新的连接，默认为64。
+type PersistentClientOptions struct {
+	TLSConfig      *tls.Config
+	IdleTimeout    time.Duration
+	Timeout        time.Duration
+	MaxConnections int
+	MaxPipelined   int
+}
+
+// defaultPersistentClientOptions 返回默认的配置。
+func defaultPersistentClientOptions() PersistentClientOptions {
+	return PersistentClientOptions{
+		IdleTimeout:    30 * time.Second,
+		Timeout:        10 * time.Second,
+		MaxConnections: 4,
+		MaxPipelined:   64,
+	}
+}
+
+// tlsConfigFor 返回连接服务器使用的TLS配置。
+func (o *PersistentClientOptions) tlsConfigFor(address string, alpn string) (*tls.Config, error) {
+	var conf = new(tls.Config)
+	if o.TLSConfig != nil {
+		conf = o.TLSConfig.Clone()
+	}
+	if conf.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		conf.ServerName = host
+	}
+	conf.NextProtos = []string{alpn}
+	return conf, nil
+}
+
+// pendingDial 是正在进行的拨号。拨号时不持有客户端的锁，拨号期间需要新连接的查询等待同一次拨号的结果。
+type pendingDial[T any] struct {
+	done chan struct{}
+	conn T
+	err  error
+}
+
+// newPendingDial 创建一个正在进行的拨号。
+func newPendingDial[T any]() *pendingDial[T] {
+	return &pendingDial[T]{done: make(chan struct{})}
+}
+
+// finish 记录拨号的结果并唤醒等待的查询。
+func (p *pendingDial[T]) finish(conn T, err error) {
+	p.conn, p.err = conn, err
+	close(p.done)
+}
+
+// wait 等待拨号的结果，ctx 结束时返回 ctx 的错误。
+func (p *pendingDial[T]) wait(ctx context.Context) (T, error) {
+	select {
+	case <-p.done:
+		return p.conn, p.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// DoQPersistentClient 是保持连接的DoQ客户端（RFC 9250），可以被多个协程同时使用。
+// 所有查询复用同一个QUIC连接，每个查询使用一个新的双向流，连接关闭或者空闲超时后在下一次查询时重新连接。
+type DoQPersistentClient struct {
+	PersistentClientOptions
+	Address string
+	mutex   sync.Mutex
+	conn    *quic.Conn
+	dialing *pendingDial[*quic.Conn]
+}
+
+// NewDoQPersistentClient 创建一个保持连接的DoQ客户端。
+//
+// 参数:
+// address - 服务器的地址，格式为 host:port。
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的客户端。
+func NewDoQPersistentClient(address string, options ...func(*PersistentClientOptions)) *DoQPersistentClient {
+	var client = &DoQPersistentClient{PersistentClientOptions: defaultPersistentClientOptions(), Address: address}
+	for _, option := range options {
+		option(&client.PersistentClientOptions)
+	}
+	return client
+}
+
+// connection 返回可用的QUIC连接，没有可用连接时建立新的连接，同时需要新连接的查询共用一次拨号。
+func (c *DoQPersistentClient) connection(ctx context.Context) (*quic.Conn, error) {
+	c.mutex.Lock()
+	if c.conn != nil && c.conn.Context().Err() == nil {
+		c.mutex.Unlock()
+		return c.conn, nil
+	}
+	var pending = c.dialing
+	if pending == nil {
+		pending = newPendingDial[*quic.Conn]()
+		c.dialing = pending
+		go c.dial(pending)
+	}
+	c.mutex.Unlock()
+	return pending.wait(ctx)
+}
+
+// dial 在后台建立新的QUIC连接，拨号不受发起查询的上下文影响，超时时间为 Timeout。
+func (c *DoQPersistentClient) dial(pending *pendingDial[*quic.Conn]) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	conn, err := func() (*quic.Conn, error) {
+		conf, err := c.tlsConfigFor(c.Address, "doq")
+		if err != nil {
+			return nil, err
+		}
+		return quic.DialAddr(ctx, c.Address, conf, &quic.Config{MaxIdleTimeout: c.IdleTimeout})
+	}()
+	if err != nil {
+		log.Println("doq: dial", c.Address, err)
+	} else {
+		log.Println("doq: connected", c.Address, conn.LocalAddr(), conn.RemoteAddr())
+	}
+	c.mutex.Lock()
+	c.dialing = nil
+	if err == nil {
+		c.conn = conn
+	}
+	c.mutex.Unlock()
+	pending.finish(conn, err)
+}
+
+// drop 丢弃已经不可用的连接。
+func (c *DoQPersistentClient) drop(conn *quic.Conn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	conn.CloseWithError(0, "")
+}
+
+// Exchange 发送查询并返回应答，应答的ID与查询相同。
+func (c *DoQPersistentClient) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	return c.ExchangeContext(ctx, msg)
+}
+
+// ExchangeContext 发送查询并返回应答。复用的连接已经失效时使用新的连接重试一次。
+func (c *DoQPersistentClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var query = msg.Copy()
+	/* RFC 9250 第 4.2.1 节：DoQ的消息ID必须为0 */
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, err := c.connection(ctx)
+		if err != nil {
+			return nil, errors.Join(append(errs, err)...)
+		}
+		response, err := doqExchangeStream(ctx, conn, packed)
+		if err == nil {
+			response.Id = msg.Id
+			return response, nil
+		}
+		errs = append(errs, err)
+		if conn.Context().Err() == nil || ctx.Err() != nil {
+			/* 连接仍然可用时是这个查询本身的错误，不需要重新连接 */
+			break
+		}
+		log.Println("doq: reconnect", c.Address, err)
+		c.drop(conn)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Close 关闭客户端的连接，之后的查询会重新连接。
+func (c *DoQPersistentClient) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	var err = c.conn.CloseWithError(0, "")
+	c.conn = nil
+	return err
+}
+
+// doqExchangeStream 在新的流上发送两字节长度前缀的查询，查询后结束发送方向，然后读取应答直到流结束。
+func doqExchangeStream(ctx context.Context, conn *quic.Conn, packed []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	var buffer = binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packed)), uint16(len(packed)))
+	if _, err := stream.Write(append(buffer, packed...)); err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+	stream.Close()
+	data, err := io.ReadAll(io.LimitReader(stream, 2+dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return nil, errors.New("doq: invalid response length")
+	}
+	var response = new(dns.Msg)
+	if err := response.Unpack(data[2:]); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+var doqClientsMutex sync.Mutex
+var doqClients = map[string]*DoQPersistentClient{}
+
+// DoQPersistentClientOf 返回服务器地址对应的共享DoQ客户端，第一次使用时创建。
+func DoQPersistentClientOf(address string) *DoQPersistentClient {
+	doqClientsMutex.Lock()
+	defer doqClientsMutex.Unlock()
+	var client = doqClients[address]
+	if client == nil {
+		client = NewDoQPersistentClient(address)
+		doqClients[address] = client
+	}
+	return client
+}
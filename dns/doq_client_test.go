@@ -0,0 +1,129 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/dns_server"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/internal/testcert"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// echoNameQuery 返回把查询名称放在 TXT 记录中的应答，用于检查应答与查询的对应关系。
+func echoNameQuery(m *dns.Msg) (*dns.Msg, error) {
+	var r = new(dns.Msg)
+	r.SetReply(m)
+	r.Answer = append(r.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{m.Question[0].Name}})
+	return r, nil
+}
+
+// exchangeConcurrently 同时发送多个不同名称的查询，检查每个应答的ID和内容都与查询对应。
+func exchangeConcurrently(t *testing.T, exchange func(*dns.Msg) (*dns.Msg, error)) {
+	var group sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			var msg = new(dns.Msg)
+			msg.SetQuestion(fmt.Sprintf("q%d.example.com.", i), dns.TypeTXT)
+			msg.Id = uint16(1000 + i)
+			response, err := exchange(msg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if response.Id != msg.Id || response.Answer[0].(*dns.TXT).Txt[0] != msg.Question[0].Name {
+				t.Errorf("response does not match query %s: %v", msg.Question[0].Name, response)
+			}
+		}()
+	}
+	group.Wait()
+}
+
+func TestDoQPersistentClient(t *testing.T) {
+	serverConfig, clientConfig := testcert.Configs(t, "dns.example")
+	serverConfig.NextProtos = []string{"doq"}
+	listener, err := quic.ListenAddr("127.0.0.1:0", serverConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server = dns_server.NewDoQServer(func(o *dns_server.Options) { o.Query = echoNameQuery })
+	go server.Serve(listener)
+	defer server.Close()
+
+	var client = NewDoQPersistentClient(listener.Addr().String(), func(o *PersistentClientOptions) {
+		o.TLSConfig = clientConfig
+	})
+	defer client.Close()
+	exchangeConcurrently(t, client.Exchange)
+	var conn = client.conn
+	exchangeConcurrently(t, client.Exchange)
+	if client.conn != conn {
+		t.Error("queries should share one quic connection")
+	}
+
+	/* 连接被关闭后自动重新连接 */
+	conn.CloseWithError(0, "")
+	exchangeConcurrently(t, client.Exchange)
+	if client.conn == conn {
+		t.Error("closed connection should be replaced")
+	}
+
+	if _, err := NewDoQPersistentClient(net.JoinHostPort("127.0.0.1", "1"), func(o *PersistentClientOptions) {
+		o.TLSConfig = clientConfig
+		o.Timeout = 200 * time.Millisecond
+	}).Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); err == nil {
+		t.Error("expected dial error")
+	}
+}
+
+func TestDoQPersistentClientDialOutsideLock(t *testing.T) {
+	/* 服务器收到数据包但是不应答，拨号会一直等到超时 */
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	var received = make(chan struct{}, 1)
+	go func() {
+		var buf = make([]byte, 2048)
+		for {
+			if _, _, err := udpConn.ReadFromUDP(buf); err != nil {
+				return
+			}
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	var client = NewDoQPersistentClient(udpConn.LocalAddr().String(), func(o *PersistentClientOptions) {
+		o.Timeout = 2 * time.Second
+	})
+	var result = make(chan error, 1)
+	go func() {
+		_, err := client.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+		result <- err
+	}()
+	<-received
+	/* 拨号期间不持有客户端的锁，关闭客户端和超时的查询不需要等待拨号结束 */
+	var start = time.Now()
+	client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.ExchangeContext(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("client was blocked by the dial for %v", elapsed)
+	}
+	if err := <-result; err == nil {
+		t.Error("expected dial error")
+	}
+}
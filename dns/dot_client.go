@@ -0,0 +1,305 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// errDoTConnectionClosed 表示DoT连接在收到应答之前已经关闭。
+var errDoTConnectionClosed = errors.New("dot: connection closed")
+
+// DoTPersistentClient 是保持连接的DoT客户端（RFC 7858），可以被多个协程同时使用。
+// 查询在连接池中的连接上流水线发送，应答按照消息ID乱序匹配（RFC 7766 第 6.2.1.1 节），
+// 连接空闲超时或者出错后从连接池中移除，下一次查询时重新连接。
+type DoTPersistentClient struct {
+	PersistentClientOptions
+	Address string
+	mutex   sync.Mutex
+	conns   []*dotConn
+	dialing *pendingDial[*dotConn]
+}
+
+// dotConn 是DoT连接池中的一个连接。
+type dotConn struct {
+	client     *DoTPersistentClient
+	conn       net.Conn
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	pending    map[uint16]chan *dns.Msg
+	closed     bool
+	idleTimer  *time.Timer
+}
+
+// NewDoTPersistentClient 创建一个保持连接的DoT客户端。
+//
+// 参数:
+// address - 服务器的地址，格式为 host:port。
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的客户端。
+func NewDoTPersistentClient(address string, options ...func(*PersistentClientOptions)) *DoTPersistentClient {
+	var client = &DoTPersistentClient{PersistentClientOptions: defaultPersistentClientOptions(), Address: address}
+	for _, option := range options {
+		option(&client.PersistentClientOptions)
+	}
+	return client
+}
+
+// connection 从连接池中选择等待应答的查询最少的连接，所有连接都已满并且连接数没有达到上限时建立新的连接，
+// 同一时间只有一次拨号，拨号期间需要新连接的查询等待这次拨号的结果。
+func (c *DoTPersistentClient) connection(ctx context.Context) (*dotConn, error) {
+	c.mutex.Lock()
+	var best *dotConn
+	var bestPending int
+	for _, conn := range c.conns {
+		var pending = conn.inflight()
+		if best == nil || pending < bestPending {
+			best, bestPending = conn, pending
+		}
+	}
+	if best != nil && (bestPending < c.MaxPipelined || len(c.conns) >= c.MaxConnections) {
+		c.mutex.Unlock()
+		return best, nil
+	}
+	var pending = c.dialing
+	if pending == nil {
+		pending = newPendingDial[*dotConn]()
+		c.dialing = pending
+		go c.dial(pending)
+	}
+	c.mutex.Unlock()
+	return pending.wait(ctx)
+}
+
+// dial 在后台建立新的DoT连接并加入连接池，拨号不受发起查询的上下文影响，超时时间为 Timeout。
+func (c *DoTPersistentClient) dial(pending *pendingDial[*dotConn]) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	conn, err := func() (net.Conn, error) {
+		conf, err := c.tlsConfigFor(c.Address, "dot")
+		if err != nil {
+			return nil, err
+		}
+		var dialer = &tls.Dialer{NetDialer: &net.Dialer{Timeout: c.Timeout}, Config: conf}
+		return dialer.DialContext(ctx, "tcp", c.Address)
+	}()
+	if err != nil {
+		log.Println("dot: dial", c.Address, err)
+		c.mutex.Lock()
+		c.dialing = nil
+		c.mutex.Unlock()
+		pending.finish(nil, err)
+		return
+	}
+	log.Println("dot: connected", c.Address, conn.LocalAddr(), conn.RemoteAddr())
+	var dc = &dotConn{client: c, conn: conn, pending: map[uint16]chan *dns.Msg{}}
+	dc.idleTimer = time.AfterFunc(c.IdleTimeout, dc.closeIfIdle)
+	c.mutex.Lock()
+	c.dialing = nil
+	c.conns = append(c.conns, dc)
+	c.mutex.Unlock()
+	go dc.readLoop()
+	pending.finish(dc, nil)
+}
+
+// remove 从连接池中移除连接。
+func (c *DoTPersistentClient) remove(dc *dotConn) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, conn := range c.conns {
+		if conn == dc {
+			c.conns = append(c.conns[:i], c.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// Exchange 发送查询并返回应答，应答的ID与查询相同。
+func (c *DoTPersistentClient) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	return c.ExchangeContext(ctx, msg)
+}
+
+// ExchangeContext 发送查询并返回应答。复用的连接在收到应答之前关闭时使用其他连接重试一次。
+func (c *DoTPersistentClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var errs []error
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, err := c.connection(ctx)
+		if err != nil {
+			return nil, errors.Join(append(errs, err)...)
+		}
+		response, err := conn.exchange(ctx, msg)
+		if err == nil {
+			return response, nil
+		}
+		errs = append(errs, err)
+		if !errors.Is(err, errDoTConnectionClosed) || ctx.Err() != nil {
+			break
+		}
+		log.Println("dot: reconnect", c.Address, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Close 关闭连接池中的所有连接，之后的查询会重新连接。
+func (c *DoTPersistentClient) Close() error {
+	c.mutex.Lock()
+	var conns = c.conns
+	c.conns = nil
+	c.mutex.Unlock()
+	var errs []error
+	for _, conn := range conns {
+		errs = append(errs, conn.close())
+	}
+	return errors.Join(errs...)
+}
+
+// inflight 返回连接上等待应答的查询数，已经关闭的连接返回最大值。
+func (dc *dotConn) inflight() int {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	if dc.closed {
+		return int(^uint(0) >> 1)
+	}
+	return len(dc.pending)
+}
+
+// exchange 使用连接上没有被占用的消息ID发送查询，等待读取协程按照ID分发的应答。
+func (dc *dotConn) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var query = msg.Copy()
+	var reply = make(chan *dns.Msg, 1)
+	dc.mutex.Lock()
+	if dc.closed {
+		dc.mutex.Unlock()
+		return nil, errDoTConnectionClosed
+	}
+	for {
+		query.Id = uint16(rand.UintN(1 << 16))
+		if _, used := dc.pending[query.Id]; !used {
+			break
+		}
+	}
+	dc.pending[query.Id] = reply
+	dc.idleTimer.Stop()
+	dc.mutex.Unlock()
+	defer dc.release(query.Id)
+
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var buffer = binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packed)), uint16(len(packed)))
+	dc.writeMutex.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		dc.conn.SetWriteDeadline(deadline)
+	}
+	_, err = dc.conn.Write(append(buffer, packed...))
+	dc.writeMutex.Unlock()
+	if err != nil {
+		dc.close()
+		return nil, errors.Join(errDoTConnectionClosed, err)
+	}
+	select {
+	case response, ok := <-reply:
+		if !ok {
+			return nil, errDoTConnectionClosed
+		}
+		response.Id = msg.Id
+		return response, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release 移除等待应答的查询，连接空闲时开始计算空闲超时。
+func (dc *dotConn) release(id uint16) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	delete(dc.pending, id)
+	if len(dc.pending) == 0 && !dc.closed {
+		dc.idleTimer.Reset(dc.client.IdleTimeout)
+	}
+}
+
+// closeIfIdle 在连接空闲超时后关闭连接。
+func (dc *dotConn) closeIfIdle() {
+	dc.mutex.Lock()
+	var idle = len(dc.pending) == 0
+	dc.mutex.Unlock()
+	if idle {
+		dc.close()
+	}
+}
+
+// readLoop 读取连接上的应答并按照消息ID交给等待的查询，连接出错后关闭连接。
+func (dc *dotConn) readLoop() {
+	defer dc.close()
+	var header = make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(dc.conn, header); err != nil {
+			return
+		}
+		var data = make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(dc.conn, data); err != nil {
+			return
+		}
+		var response = new(dns.Msg)
+		if err := response.Unpack(data); err != nil {
+			log.Println("dot: invalid response", dc.client.Address, err)
+			return
+		}
+		dc.mutex.Lock()
+		var reply = dc.pending[response.Id]
+		delete(dc.pending, response.Id)
+		dc.mutex.Unlock()
+		if reply != nil {
+			reply <- response
+		}
+	}
+}
+
+// close 关闭连接，从连接池中移除，并通知所有等待应答的查询。
+func (dc *dotConn) close() error {
+	dc.mutex.Lock()
+	if dc.closed {
+		dc.mutex.Unlock()
+		return nil
+	}
+	dc.closed = true
+	dc.idleTimer.Stop()
+	var pending = dc.pending
+	dc.pending = map[uint16]chan *dns.Msg{}
+	dc.mutex.Unlock()
+	for _, reply := range pending {
+		close(reply)
+	}
+	dc.client.remove(dc)
+	return dc.conn.Close()
+}
+
+var dotClientsMutex sync.Mutex
+var dotClients = map[string]*DoTPersistentClient{}
+
+// DoTPersistentClientOf 返回服务器地址对应的共享DoT客户端，第一次使用时创建。
+func DoTPersistentClientOf(address string) *DoTPersistentClient {
+	dotClientsMutex.Lock()
+	defer dotClientsMutex.Unlock()
+	var client = dotClients[address]
+	if client == nil {
+		client = NewDoTPersistentClient(address)
+		dotClients[address] = client
+	}
+	return client
+}
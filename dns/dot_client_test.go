@@ -0,0 +1,173 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/dns_server"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/internal/testcert"
+	"github.com/miekg/dns"
+)
+
+func TestDoTPersistentClientPool(t *testing.T) {
+	serverConfig, clientConfig := testcert.Configs(t, "dns.example")
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server = dns_server.NewDoTServer(func(o *dns_server.Options) { o.Query = echoNameQuery })
+	go server.Serve(listener)
+	defer server.Close()
+
+	var client = NewDoTPersistentClient(listener.Addr().String(), func(o *PersistentClientOptions) {
+		o.TLSConfig = clientConfig
+		o.MaxConnections = 2
+		o.MaxPipelined = 1
+		o.IdleTimeout = 200 * time.Millisecond
+	})
+	defer client.Close()
+	exchangeConcurrently(t, client.Exchange)
+	client.mutex.Lock()
+	var conns = len(client.conns)
+	client.mutex.Unlock()
+	if conns == 0 || conns > 2 {
+		t.Errorf("pool should hold 1 to MaxConnections connections: %d", conns)
+	}
+
+	/* 空闲的连接超时后被关闭，之后的查询重新连接 */
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		client.mutex.Lock()
+		conns = len(client.conns)
+		client.mutex.Unlock()
+		if conns == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if conns != 0 {
+		t.Errorf("idle connections should be closed: %d", conns)
+	}
+	exchangeConcurrently(t, client.Exchange)
+}
+
+func TestDoTPersistentClientOutOfOrder(t *testing.T) {
+	serverConfig, clientConfig := testcert.Configs(t, "dns.example")
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	/* 服务器读取两个查询后按照相反的顺序应答 */
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var queries []*dns.Msg
+		for len(queries) < 2 {
+			var header = make([]byte, 2)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			var data = make([]byte, binary.BigEndian.Uint16(header))
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return
+			}
+			var msg = new(dns.Msg)
+			if err := msg.Unpack(data); err != nil {
+				return
+			}
+			queries = append(queries, msg)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			response, _ := echoNameQuery(queries[i])
+			packed, _ := response.Pack()
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+		}
+		io.Copy(io.Discard, conn)
+	}()
+
+	var client = NewDoTPersistentClient(listener.Addr().String(), func(o *PersistentClientOptions) {
+		o.TLSConfig = clientConfig
+		o.MaxConnections = 1
+	})
+	defer client.Close()
+	var results = make(chan error, 2)
+	for _, name := range []string{"first.example.com.", "second.example.com."} {
+		go func() {
+			var msg = new(dns.Msg)
+			msg.SetQuestion(name, dns.TypeTXT)
+			response, err := client.Exchange(msg)
+			if err == nil && response.Answer[0].(*dns.TXT).Txt[0] != name {
+				t.Errorf("response for %s matched the wrong query: %v", name, response)
+			}
+			results <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDoTPersistentClientDialOutsideLock(t *testing.T) {
+	/* 服务器接受TCP连接但是不完成TLS握手，拨号会一直等到超时 */
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var accepted = make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	var client = NewDoTPersistentClient(listener.Addr().String(), func(o *PersistentClientOptions) {
+		o.Timeout = 2 * time.Second
+	})
+	var results = make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := client.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			results <- err
+		}()
+	}
+	conn := <-accepted
+	defer conn.Close()
+	/* 拨号期间不持有客户端的锁，关闭客户端和超时的查询不需要等待拨号结束 */
+	var start = time.Now()
+	client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.ExchangeContext(ctx, new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("client was blocked by the dial for %v", elapsed)
+	}
+	select {
+	case extra := <-accepted:
+		extra.Close()
+		t.Error("concurrent queries should share one dial")
+	case <-time.After(100 * time.Millisecond):
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err == nil {
+			t.Error("expected dial error")
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultPaddingBlockSize 是 RFC 8467 推荐的查询填充块大小，填充后的查询长度是它的整数倍。
+const DefaultPaddingBlockSize = 128
+
+// EDNSOptions 是发送给上游的查询中EDNS选项的配置。
+//
+// 字段：
+// ClientSubnet - 是否向上游转发查询中的 EDNS Client Subnet（ECS，RFC 7871）选项，为false时删除该选项，默认为true。
+// IPv4PrefixLength - 转发的IPv4地址ECS选项的最大源前缀长度，更长的前缀被截断以保护客户端的隐私，默认为24。
+// IPv6PrefixLength - 转发的IPv6地址ECS选项的最大源前缀长度，默认为56。
+// Padding - 是否按照 RFC 7830 和 RFC 8467 的块填充策略填充查询，只应该用于加密的传输，默认为false。
+// PaddingBlockSize - 填充的块大小，默认为 DefaultPaddingBlockSize。
+type EDNSOptions struct {
+	ClientSubnet     bool
+	IPv4PrefixLength uint8
+	IPv6PrefixLength uint8
+	Padding          bool
+	PaddingBlockSize int
+}
+
+// EDNS 在查询发送给上游之前按照配置修改其中的ECS选项和填充选项。
+type EDNS struct {
+	EDNSOptions
+}
+
+// NewEDNS 创建查询的EDNS选项配置。
+//
+// 参数:
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的配置。
+func NewEDNS(options ...func(*EDNSOptions)) *EDNS {
+	var e = &EDNS{EDNSOptions: EDNSOptions{
+		ClientSubnet:     true,
+		IPv4PrefixLength: 24,
+		IPv6PrefixLength: 56,
+		PaddingBlockSize: DefaultPaddingBlockSize,
+	}}
+	for _, option := range options {
+		option(&e.EDNSOptions)
+	}
+	return e
+}
+
+// String 返回与默认配置不同的部分，例如 "ecs=16/48 padding=128"，默认配置返回空字符串。
+// 它被加在解析器的名称后面，不同配置的应答分开缓存。
+func (e *EDNS) String() string {
+	var parts []string
+	if !e.ClientSubnet {
+		parts = append(parts, "ecs=off")
+	} else if e.IPv4PrefixLength != 24 || e.IPv6PrefixLength != 56 {
+		parts = append(parts, "ecs="+strconv.Itoa(int(e.IPv4PrefixLength))+"/"+strconv.Itoa(int(e.IPv6PrefixLength)))
+	}
+	if e.Padding {
+		parts = append(parts, "padding="+strconv.Itoa(e.PaddingBlockSize))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Prepare 返回按照配置修改过的查询副本：截断或者删除ECS选项，删除原有的填充选项，开启填充时重新填充。
+func (e *EDNS) Prepare(msg *dns.Msg) *dns.Msg {
+	var query = msg.Copy()
+	if opt := query.IsEdns0(); opt != nil {
+		var options []dns.EDNS0
+		for _, option := range opt.Option {
+			switch option := option.(type) {
+			case *dns.EDNS0_PADDING:
+				continue
+			case *dns.EDNS0_SUBNET:
+				if !e.ClientSubnet {
+					continue
+				}
+				options = append(options, TruncateClientSubnet(option, e.IPv4PrefixLength, e.IPv6PrefixLength))
+			default:
+				options = append(options, option)
+			}
+		}
+		opt.Option = options
+	}
+	if e.Padding {
+		pad(query, e.PaddingBlockSize)
+	}
+	return query
+}
+
+// QueryCallback 返回先按照配置修改查询再调用 queryCallback 的DNS查询回调函数。
+func (e *EDNS) QueryCallback(queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) func(m *dns.Msg) (r *dns.Msg, err error) {
+	return func(m *dns.Msg) (*dns.Msg, error) {
+		return queryCallback(e.Prepare(m))
+	}
+}
+
+// TruncateClientSubnet 返回源前缀长度不超过指定长度的ECS选项副本，地址中超出前缀的位被清零，作用域前缀长度为0。
+//
+// 参数:
+// subnet - 原来的ECS选项。
+// ipv4PrefixLength - IPv4地址的最大源前缀长度。
+// ipv6PrefixLength - IPv6地址的最大源前缀长度。
+//
+// 返回值:
+// 截断后的ECS选项。
+func TruncateClientSubnet(subnet *dns.EDNS0_SUBNET, ipv4PrefixLength uint8, ipv6PrefixLength uint8) *dns.EDNS0_SUBNET {
+	var truncated = *subnet
+	truncated.SourceScope = 0
+	var bits, maxLength = 128, ipv6PrefixLength
+	if subnet.Family == 1 {
+		bits, maxLength = 32, ipv4PrefixLength
+	}
+	truncated.SourceNetmask = min(subnet.SourceNetmask, maxLength, uint8(bits))
+	if address := subnet.Address; address != nil {
+		if bits == 32 {
+			address = address.To4()
+		}
+		if address != nil {
+			truncated.Address = address.Mask(net.CIDRMask(int(truncated.SourceNetmask), bits))
+		}
+	}
+	return &truncated
+}
+
+// pad 在查询的OPT记录中添加填充选项，使查询的长度成为 blockSize 的整数倍，没有OPT记录时先添加。
+func pad(msg *dns.Msg, blockSize int) {
+	if blockSize <= 0 {
+		return
+	}
+	var opt = msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(DefaultUDPSize, false)
+		opt = msg.IsEdns0()
+	}
+	var padding = &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	/* 空的填充选项占用4字节的选项头部 */
+	var length = msg.Len()
+	padding.Padding = make([]byte, (blockSize-length%blockSize)%blockSize)
+}
+
+// withoutPadding 返回删除了填充选项的查询副本，填充不影响应答，不应该参与缓存的键。
+func withoutPadding(msg *dns.Msg) *dns.Msg {
+	var copy = msg.Copy()
+	if opt := copy.IsEdns0(); opt != nil {
+		opt.Option = slices.DeleteFunc(opt.Option, func(option dns.EDNS0) bool {
+			_, ok := option.(*dns.EDNS0_PADDING)
+			return ok
+		})
+	}
+	return copy
+}
@@ -0,0 +1,107 @@
+package dns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// queryWithSubnet 返回带有ECS选项的查询。
+func queryWithSubnet(ip string, sourceNetmask uint8) *dns.Msg {
+	var msg = new(dns.Msg).SetQuestion("cdn.example.com.", dns.TypeA)
+	msg.SetEdns0(DefaultUDPSize, false)
+	var family uint16 = 2
+	if net.ParseIP(ip).To4() != nil {
+		family = 1
+	}
+	msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: sourceNetmask, Address: net.ParseIP(ip)})
+	return msg
+}
+
+func subnetOf(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	for _, option := range msg.IsEdns0().Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+func TestEDNSClientSubnet(t *testing.T) {
+	var edns = NewEDNS()
+	if edns.String() != "" {
+		t.Errorf("default options should have no description: %s", edns.String())
+	}
+	for _, test := range []struct {
+		ip      string
+		netmask uint8
+		address string
+		length  uint8
+	}{
+		{"198.51.100.77", 32, "198.51.100.0", 24},
+		{"198.51.100.77", 16, "198.51.0.0", 16},
+		{"2001:db8:1234:5678::1", 128, "2001:db8:1234:5600::", 56},
+		{"198.51.100.77", 0, "0.0.0.0", 0},
+	} {
+		var msg = queryWithSubnet(test.ip, test.netmask)
+		var subnet = subnetOf(edns.Prepare(msg))
+		if subnet == nil || subnet.SourceNetmask != test.length || !subnet.Address.Equal(net.ParseIP(test.address)) {
+			t.Errorf("%s/%d: expected %s/%d: %v", test.ip, test.netmask, test.address, test.length, subnet)
+		}
+		if subnetOf(msg).SourceNetmask != test.netmask {
+			t.Error("the original query should not be modified")
+		}
+	}
+
+	var off = NewEDNS(func(o *EDNSOptions) { o.ClientSubnet = false })
+	if subnetOf(off.Prepare(queryWithSubnet("198.51.100.77", 32))) != nil || off.String() != "ecs=off" {
+		t.Error("client subnet should be removed")
+	}
+}
+
+func TestEDNSPadding(t *testing.T) {
+	var edns = NewEDNS(func(o *EDNSOptions) { o.Padding = true })
+	if edns.String() != "padding=128" {
+		t.Errorf("unexpected description %s", edns.String())
+	}
+	for _, msg := range []*dns.Msg{
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("a-much-longer-name-that-needs-less-padding.example.com.", dns.TypeHTTPS),
+		/* 已有的填充被替换 */
+		edns.Prepare(queryWithSubnet("198.51.100.77", 32)),
+	} {
+		var padded = edns.Prepare(msg)
+		packed, err := padded.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(packed)%DefaultPaddingBlockSize != 0 {
+			t.Errorf("padded query length %d is not a multiple of %d", len(packed), DefaultPaddingBlockSize)
+		}
+		var paddings = 0
+		for _, option := range padded.IsEdns0().Option {
+			if _, ok := option.(*dns.EDNS0_PADDING); ok {
+				paddings++
+			}
+		}
+		if paddings != 1 {
+			t.Errorf("expected one padding option: %d", paddings)
+		}
+	}
+}
+
+func TestCacheKeyEDNS(t *testing.T) {
+	var padded = NewEDNS(func(o *EDNSOptions) { o.Padding = true })
+	var msg = queryWithSubnet("198.51.100.77", 24)
+	key, err := cacheKey("server", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paddedKey, _ := cacheKey("server", padded.Prepare(msg)); paddedKey != key {
+		t.Error("padding should not change the cache key")
+	}
+	if otherKey, _ := cacheKey("server", queryWithSubnet("203.0.113.77", 24)); otherKey == key {
+		t.Error("different client subnets should be cached separately")
+	}
+}
@@ -0,0 +1,221 @@
+package dns
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// hostsTTL 是覆盖表合成的记录的TTL。
+const hostsTTL = 60
+
+// hostsMaxChain 是覆盖表中CNAME链的最大长度，超过时认为存在循环。
+const hostsMaxChain = 8
+
+// Hosts 是类似 hosts 文件的静态覆盖表，把主机名固定到指定的IP地址（A、AAAA）或者另一个主机名（CNAME）。
+// 名称可以使用 "*.example.com" 形式的通配符匹配所有子域名，精确的名称优先，较长的通配符优先。
+// 覆盖表中的名称只使用表中的记录，不会查询上游，例如只有IPv4地址的名称的 AAAA 和 HTTPS 查询返回空的应答。
+// 可以被多个协程同时使用。
+type Hosts struct {
+	mutex   sync.RWMutex
+	entries map[string]*hostsEntry
+}
+
+// hostsEntry 是覆盖表中一个名称的记录，addresses 和 target 只有一个不为空。
+type hostsEntry struct {
+	addresses []net.IP
+	target    string
+}
+
+// DefaultHosts 是 DnsResolverMultipleServers 默认使用的覆盖表。
+var DefaultHosts = NewHosts()
+
+// NewHosts 创建一个空的覆盖表。
+func NewHosts() *Hosts {
+	return &Hosts{entries: map[string]*hostsEntry{}}
+}
+
+// Add 添加一条覆盖记录，value 为IP地址时添加 A 或者 AAAA 记录，否则添加指向 value 的 CNAME 记录。
+// 同一个名称可以有多个地址，但是 CNAME 记录不能与其他记录共存（RFC 1034 第 3.6.2 节）。
+//
+// 参数:
+// name - 主机名，可以是 "*.example.com" 形式的通配符。
+// value - IP地址或者 CNAME 的目标主机名。
+//
+// 返回值:
+// 名称或者值无效，或者与已有的记录冲突时的错误。
+func (h *Hosts) Add(name string, value string) error {
+	var key = strings.ToLower(dns.Fqdn(name))
+	if _, ok := dns.IsDomainName(strings.TrimPrefix(key, "*.")); !ok || key == "." {
+		return errors.New("invalid hosts name " + name)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var entry = h.entries[key]
+	if entry == nil {
+		entry = &hostsEntry{}
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		if entry.target != "" {
+			return errors.New("hosts name " + name + " already has a cname")
+		}
+		entry.addresses = append(entry.addresses, ip)
+	} else {
+		var target = strings.ToLower(dns.Fqdn(value))
+		if _, ok := dns.IsDomainName(target); !ok || strings.HasPrefix(target, "*.") || target == "." {
+			return errors.New("invalid hosts value " + value)
+		}
+		if len(entry.addresses) > 0 || (entry.target != "" && entry.target != target) {
+			return errors.New("hosts name " + name + " already has other records")
+		}
+		entry.target = target
+	}
+	h.entries[key] = entry
+	return nil
+}
+
+// Load 读取 hosts 文件格式的覆盖表：每行是一个IP地址或者 CNAME 的目标主机名，后面是一个或者多个名称，
+// "#" 之后是注释。例如 "10.0.0.10 api.example.com *.svc.example.com"、"edge.example.net www.example.com"。
+//
+// 参数:
+// reader - 覆盖表的内容。
+//
+// 返回值:
+// 格式错误时带有行号的错误，出错之前的行已经被添加。
+func (h *Hosts) Load(reader io.Reader) error {
+	var scanner = bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		var text, _, _ = strings.Cut(scanner.Text(), "#")
+		var fields = strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return errors.New("hosts line " + strconv.Itoa(line) + ": missing name")
+		}
+		for _, name := range fields[1:] {
+			if err := h.Add(name, fields[0]); err != nil {
+				return errors.New("hosts line " + strconv.Itoa(line) + ": " + err.Error())
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// LoadFile 读取 hosts 文件格式的覆盖表文件，参见 Load。
+func (h *Hosts) LoadFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return h.Load(f)
+}
+
+// Len 返回覆盖表中名称的数量。
+func (h *Hosts) Len() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.entries)
+}
+
+// entry 返回名称匹配的记录，先匹配精确的名称，再从最长的通配符开始匹配。
+func (h *Hosts) entry(name string) *hostsEntry {
+	var key = strings.ToLower(dns.Fqdn(name))
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if entry := h.entries[key]; entry != nil {
+		return entry
+	}
+	for offset, end := dns.NextLabel(key, 0); !end; offset, end = dns.NextLabel(key, offset) {
+		if entry := h.entries["*."+key[offset:]]; entry != nil {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Lookup 在覆盖表中查找主机名，CNAME 记录的目标也在表中时继续查找。
+//
+// 参数:
+// name - 主机名。
+//
+// 返回值:
+// addresses - 表中的IP地址。
+// target - CNAME 链的目标不在表中时为该目标，需要通过DNS解析，否则为空字符串。
+// found - 名称是否在表中。
+func (h *Hosts) Lookup(name string) (addresses []string, target string, found bool) {
+	for range hostsMaxChain {
+		var entry = h.entry(name)
+		if entry == nil {
+			return nil, strings.TrimSuffix(target, "."), found
+		}
+		found = true
+		if entry.target == "" {
+			return ArrayMap(entry.addresses, net.IP.String), "", true
+		}
+		name, target = entry.target, entry.target
+	}
+	return nil, "", true
+}
+
+// QueryCallback 返回先使用覆盖表应答的DNS查询回调函数，名称不在表中时调用 queryCallback。
+// CNAME 记录的目标不在表中时通过 queryCallback 查询目标，应答中包含 CNAME 记录和目标的记录。
+func (h *Hosts) QueryCallback(queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) func(m *dns.Msg) (r *dns.Msg, err error) {
+	return func(m *dns.Msg) (*dns.Msg, error) {
+		if len(m.Question) != 1 {
+			return queryCallback(m)
+		}
+		var response = new(dns.Msg)
+		response.SetReply(m)
+		response.RecursionAvailable = true
+		var question = m.Question[0]
+		var name = question.Name
+		for range hostsMaxChain {
+			var entry = h.entry(name)
+			if entry == nil {
+				if name == question.Name {
+					return queryCallback(m)
+				}
+				/* 查询不在表中的 CNAME 目标，把目标的记录接在 CNAME 记录后面 */
+				var query = m.Copy()
+				query.Question[0].Name = name
+				result, err := queryCallback(query)
+				if err != nil {
+					return nil, err
+				}
+				response.Rcode = result.Rcode
+				response.AuthenticatedData = false
+				response.Answer = append(response.Answer, result.Answer...)
+				response.Ns = result.Ns
+				return response, nil
+			}
+			if entry.target == "" {
+				for _, ip := range entry.addresses {
+					var header = dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: hostsTTL}
+					if ipv4 := ip.To4(); ipv4 != nil && question.Qtype == dns.TypeA {
+						header.Rrtype = dns.TypeA
+						response.Answer = append(response.Answer, &dns.A{Hdr: header, A: ipv4})
+					} else if ipv4 == nil && question.Qtype == dns.TypeAAAA {
+						header.Rrtype = dns.TypeAAAA
+						response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+					}
+				}
+				return response, nil
+			}
+			response.Answer = append(response.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: hostsTTL}, Target: entry.target})
+			if question.Qtype == dns.TypeCNAME {
+				return response, nil
+			}
+			name = entry.target
+		}
+		return nil, errors.New("hosts cname chain too long " + question.Name)
+	}
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/miekg/dns"
+)
+
+const testHosts = `
+# 内网地址
+10.0.0.10 api.example.com   *.svc.example.com
+fd00::10  api.example.com
+10.0.0.20 db.svc.example.com
+api.example.com alias.example.com
+edge.example.net www.example.com # 不在表中的目标
+`
+
+// namesMutex 保护 answerFrom 记录的查询名称，A 和 AAAA 查询是并发的。
+var namesMutex sync.Mutex
+
+// answerFrom 返回应答A记录并记录查询名称的查询函数。
+func answerFrom(ip string, names *[]string) func(m *dns.Msg) (*dns.Msg, error) {
+	return func(m *dns.Msg) (*dns.Msg, error) {
+		namesMutex.Lock()
+		*names = append(*names, m.Question[0].Name)
+		namesMutex.Unlock()
+		var r = new(dns.Msg)
+		r.SetReply(m)
+		if m.Question[0].Qtype == dns.TypeA {
+			r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(ip)})
+		}
+		return r, nil
+	}
+}
+
+func TestHosts(t *testing.T) {
+	var hosts = NewHosts()
+	if err := hosts.Load(strings.NewReader(testHosts)); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name      string
+		addresses []string
+		target    string
+		found     bool
+	}{
+		{"API.example.com", []string{"10.0.0.10", "fd00::10"}, "", true},
+		{"alias.example.com", []string{"10.0.0.10", "fd00::10"}, "", true},
+		{"web.svc.example.com", []string{"10.0.0.10"}, "", true},
+		{"db.svc.example.com", []string{"10.0.0.20"}, "", true},
+		{"svc.example.com", nil, "", false},
+		{"www.example.com", nil, "edge.example.net", true},
+		{"example.com", nil, "", false},
+	} {
+		addresses, target, found := hosts.Lookup(test.name)
+		if !slices.Equal(addresses, test.addresses) || target != test.target || found != test.found {
+			t.Errorf("%s: unexpected lookup %v %q %v", test.name, addresses, target, found)
+		}
+	}
+
+	var names []string
+	var query = hosts.QueryCallback(answerFrom("192.0.2.1", &names))
+	resp, err := query(new(dns.Msg).SetQuestion("alias.example.com.", dns.TypeAAAA))
+	if err != nil || len(resp.Answer) != 2 || resp.Answer[0].(*dns.CNAME).Target != "api.example.com." || !resp.Answer[1].(*dns.AAAA).AAAA.Equal(net.ParseIP("fd00::10")) {
+		t.Errorf("expected cname and pinned address: %v %v", resp, err)
+	}
+	/* 覆盖表中的名称不查询上游 */
+	resp, err = query(new(dns.Msg).SetQuestion("web.svc.example.com.", dns.TypeHTTPS))
+	if err != nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(names) != 0 {
+		t.Errorf("pinned names should answer nodata: %v %v %v", resp, err, names)
+	}
+	resp, err = query(new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA))
+	if err != nil || len(resp.Answer) != 2 || resp.Answer[1].Header().Name != "edge.example.net." || !slices.Equal(names, []string{"edge.example.net."}) {
+		t.Errorf("cname target should be resolved upstream: %v %v %v", resp, err, names)
+	}
+	if _, err := query(new(dns.Msg).SetQuestion("other.example.org.", dns.TypeA)); err != nil || len(names) != 2 {
+		t.Errorf("other names should be resolved upstream: %v %v", err, names)
+	}
+
+	for _, line := range []string{"10.0.0.1", "10.0.0.1 bad..name", "other.example.com api.example.com", "10.0.0.1 alias.example.com"} {
+		if err := hosts.Load(strings.NewReader(line)); err == nil {
+			t.Error("expected error for", line)
+		}
+	}
+}
+
+func TestRoutesAndHostsInDnsResolver(t *testing.T) {
+	var publicNames, internalNames []string
+	var routes = NewRoutes()
+	var internal = generic.MapImplementFromMap(map[string]func(m *dns.Msg) (r *dns.Msg, err error){"internal": answerFrom("10.1.0.1", &internalNames)})
+	if err := routes.Add("*.corp.example", internal); err != nil {
+		t.Fatal(err)
+	}
+	if err := routes.Add("corp.example", generic.NewMapImplement[string, func(m *dns.Msg) (r *dns.Msg, err error)]()); err == nil {
+		t.Error("routes without servers should be rejected")
+	}
+	var hosts = NewHosts()
+	hosts.Add("pinned.example.com", "192.0.2.99")
+	hosts.Add("moved.example.com", "git.corp.example")
+	var public = generic.MapImplementFromMap(map[string]func(m *dns.Msg) (r *dns.Msg, err error){"public": answerFrom("192.0.2.1", &publicNames)})
+	var options = func(o *DnsResolverOptions) {
+		o.Cache = nil
+		o.QueryHTTPS = false
+		o.Hosts = hosts
+		o.Routes = routes
+	}
+
+	for _, test := range []struct {
+		domain  string
+		address string
+	}{
+		{"pinned.example.com", "192.0.2.99"},
+		{"git.CORP.example", "10.1.0.1"},
+		{"moved.example.com", "10.1.0.1"},
+		{"www.example.com", "192.0.2.1"},
+	} {
+		addresses, err := DnsResolverMultipleServers(test.domain, public, options)
+		if err != nil || !slices.Equal(addresses, []string{test.address}) {
+			t.Errorf("%s: expected %s: %v %v", test.domain, test.address, addresses, err)
+		}
+	}
+	for _, name := range publicNames {
+		if dns.IsSubDomain("corp.example.", strings.ToLower(name)) || name == "pinned.example.com." {
+			t.Errorf("%s should not be sent to the public servers", name)
+		}
+	}
+	if len(internalNames) == 0 {
+		t.Error("internal names should be sent to the internal servers")
+	}
+
+	var routed = routes.QueryCallback(answerFrom("192.0.2.1", &publicNames), nil)
+	if resp, err := routed(new(dns.Msg).SetQuestion("corp.example.", dns.TypeA)); err != nil || !resp.Answer[0].(*dns.A).A.Equal(net.ParseIP("10.1.0.1")) {
+		t.Errorf("the suffix itself should be routed: %v %v", resp, err)
+	}
+}
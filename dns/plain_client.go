@@ -0,0 +1,209 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultUDPSize 是普通DNS客户端通告的EDNS0 UDP缓冲区大小，使用 DNS Flag Day 2020 推荐的1232字节，避免IP分片。
+const DefaultUDPSize = 1232
+
+// PlainClientOptions 是普通DNS客户端的配置。
+//
+// 字段：
+// Net - 使用的协议，"udp" 时应答被截断（TC）后使用TCP重新查询，"tcp" 时只使用TCP，默认为 "udp"。
+// UDPSize - 查询中没有EDNS0记录时添加的EDNS0 UDP缓冲区大小，0表示不添加，默认为 DefaultUDPSize。
+// Timeout - 每个查询的超时时间，默认为10秒。
+type PlainClientOptions struct {
+	Net     string
+	UDPSize uint16
+	Timeout time.Duration
+}
+
+// PlainClient 是不加密的DNS客户端（RFC 1035），可以被多个协程同时使用。
+// 每个UDP查询使用一个新的套接字，源端口由系统随机分配，查询ID随机生成，
+// ID或者问题与查询不一致的应答被忽略，以抵抗伪造应答。
+type PlainClient struct {
+	PlainClientOptions
+	Address string
+}
+
+// NewPlainClient 创建一个普通DNS客户端。
+//
+// 参数:
+// address - 服务器的地址，格式为 host:port。
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的客户端。
+func NewPlainClient(address string, options ...func(*PlainClientOptions)) *PlainClient {
+	var client = &PlainClient{
+		PlainClientOptions: PlainClientOptions{Net: "udp", UDPSize: DefaultUDPSize, Timeout: 10 * time.Second},
+		Address:            address,
+	}
+	for _, option := range options {
+		option(&client.PlainClientOptions)
+	}
+	return client
+}
+
+// Exchange 发送查询并返回应答，应答的ID与查询相同。
+func (c *PlainClient) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	return c.ExchangeContext(ctx, msg)
+}
+
+// ExchangeContext 发送查询并返回应答，UDP应答被截断时使用TCP重新查询。
+func (c *PlainClient) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var query = msg.Copy()
+	query.Id = uint16(rand.UintN(1 << 16))
+	var bufferSize = dns.MinMsgSize
+	if opt := query.IsEdns0(); opt != nil {
+		bufferSize = max(bufferSize, int(opt.UDPSize()))
+	} else if c.UDPSize > 0 {
+		query.SetEdns0(c.UDPSize, false)
+		bufferSize = max(bufferSize, int(c.UDPSize))
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	var response *dns.Msg
+	if c.Net != "tcp" {
+		response, err = c.exchangeUDP(ctx, query, packed, bufferSize)
+		if err != nil {
+			log.Println("dns: udp", c.Address, err)
+			return nil, err
+		}
+		if !response.Truncated {
+			response.Id = msg.Id
+			return response, nil
+		}
+		log.Println("dns: truncated response, retry over tcp", c.Address, query.Question)
+	}
+	response, err = c.exchangeTCP(ctx, query, packed)
+	if err != nil {
+		log.Println("dns: tcp", c.Address, err)
+		return nil, err
+	}
+	response.Id = msg.Id
+	return response, nil
+}
+
+// exchangeUDP 使用新的UDP套接字发送查询，忽略ID或者问题不一致的应答，直到收到匹配的应答或者超时。
+func (c *PlainClient) exchangeUDP(ctx context.Context, query *dns.Msg, packed []byte, bufferSize int) (*dns.Msg, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, "udp", c.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	if _, err := conn.Write(packed); err != nil {
+		return nil, err
+	}
+	var buffer = make([]byte, bufferSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, errors.Join(ctx.Err(), err)
+		}
+		var response = new(dns.Msg)
+		if err := response.Unpack(buffer[:n]); err != nil {
+			/* 被截断的应答可能无法完整解析，只要头部有效并且设置了TC就使用TCP重新查询 */
+			if err := response.Unpack(buffer[:min(n, 12)]); err == nil && response.Truncated && response.Id == query.Id {
+				return response, nil
+			}
+			log.Println("dns: ignore invalid udp response", c.Address, err)
+			continue
+		}
+		if !matchesQuery(query, response) {
+			log.Println("dns: ignore mismatched udp response", c.Address, response.Id, response.Question)
+			continue
+		}
+		return response, nil
+	}
+}
+
+// exchangeTCP 使用新的TCP连接发送两字节长度前缀的查询并读取应答。
+func (c *PlainClient) exchangeTCP(ctx context.Context, query *dns.Msg, packed []byte) (*dns.Msg, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, "tcp", c.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	var buffer = binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packed)), uint16(len(packed)))
+	if _, err := conn.Write(append(buffer, packed...)); err != nil {
+		return nil, err
+	}
+	var header = make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, errors.Join(ctx.Err(), err)
+	}
+	var data = make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, errors.Join(ctx.Err(), err)
+	}
+	var response = new(dns.Msg)
+	if err := response.Unpack(data); err != nil {
+		return nil, err
+	}
+	if !matchesQuery(query, response) {
+		return nil, errors.New("dns: tcp response does not match the query")
+	}
+	return response, nil
+}
+
+// matchesQuery 检查应答的ID和问题是否与查询一致，名称不区分大小写。
+func matchesQuery(query *dns.Msg, response *dns.Msg) bool {
+	if response.Id != query.Id || !response.Response || len(response.Question) != len(query.Question) {
+		return false
+	}
+	for i, question := range query.Question {
+		var answered = response.Question[i]
+		if answered.Qtype != question.Qtype || answered.Qclass != question.Qclass || !strings.EqualFold(answered.Name, question.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// PlainClientOfURL 根据 udp:// 或者 tcp:// 地址创建普通DNS客户端，没有端口时使用53端口。
+//
+// 参数:
+// serverURL - DNS服务器的URL，例如 "udp://223.5.5.5"、"tcp://[2400:3200::1]:53"。
+//
+// 返回值:
+// 新创建的客户端，以及URL无效时的错误。
+func PlainClientOfURL(serverURL string) (*PlainClient, error) {
+	var network, address, found = strings.Cut(serverURL, "://")
+	if !found || (network != "udp" && network != "tcp") {
+		return nil, errors.New("dns server url must start with 'udp://' or 'tcp://' " + serverURL)
+	}
+	address = strings.TrimSuffix(address, "/")
+	if address == "" {
+		return nil, errors.New("missing dns server host " + serverURL)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "53")
+	}
+	return NewPlainClient(address, func(o *PlainClientOptions) { o.Net = network }), nil
+}
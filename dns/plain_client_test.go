@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startPlainServers 在同一个端口上启动UDP和TCP的DNS服务器，返回服务器地址。
+func startPlainServers(t *testing.T, handler dns.Handler) string {
+	for attempt := 0; attempt < 10; attempt++ {
+		packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+		if err != nil {
+			/* TCP端口已经被占用时换一个端口 */
+			packetConn.Close()
+			continue
+		}
+		var udpServer = &dns.Server{PacketConn: packetConn, Handler: handler}
+		var tcpServer = &dns.Server{Listener: listener, Handler: handler}
+		go udpServer.ActivateAndServe()
+		go tcpServer.ActivateAndServe()
+		t.Cleanup(func() {
+			udpServer.Shutdown()
+			tcpServer.Shutdown()
+		})
+		return packetConn.LocalAddr().String()
+	}
+	t.Fatal("no free port for udp and tcp")
+	return ""
+}
+
+func TestPlainClientTruncatedRetry(t *testing.T) {
+	var udpSizes = make(chan uint16, 10)
+	var address = startPlainServers(t, dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		var r = new(dns.Msg)
+		r.SetReply(m)
+		for i := 0; i < 100; i++ {
+			r.Answer = append(r.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{fmt.Sprintf("record %d of a large response", i)}})
+		}
+		if w.LocalAddr().Network() == "udp" {
+			udpSizes <- m.IsEdns0().UDPSize()
+			/* 超过客户端缓冲区大小的应答被截断 */
+			r.Truncate(int(m.IsEdns0().UDPSize()))
+		}
+		w.WriteMsg(r)
+	}))
+
+	var client = NewPlainClient(address)
+	var msg = new(dns.Msg).SetQuestion("large.example.com.", dns.TypeTXT)
+	msg.Id = 4321
+	response, err := client.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := <-udpSizes; size != DefaultUDPSize {
+		t.Errorf("expected edns0 udp size %d: %d", DefaultUDPSize, size)
+	}
+	if response.Truncated || len(response.Answer) != 100 || response.Id != msg.Id {
+		t.Errorf("expected full response over tcp: truncated=%v answers=%d id=%d", response.Truncated, len(response.Answer), response.Id)
+	}
+
+	tcpClient, err := PlainClientOfURL("tcp://" + address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = tcpClient.Exchange(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Answer) != 100 || len(udpSizes) != 0 {
+		t.Error("tcp client should only use tcp")
+	}
+}
+
+func TestPlainClientIgnoresMismatchedResponses(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packetConn.Close()
+	go func() {
+		var buffer = make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := packetConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			var query = new(dns.Msg)
+			if err := query.Unpack(buffer[:n]); err != nil {
+				continue
+			}
+			/* 先发送ID错误和问题错误的伪造应答，再发送正确的应答 */
+			var forged = new(dns.Msg).SetReply(query)
+			forged.Id = query.Id + 1
+			forged.Answer = append(forged.Answer, &dns.A{Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("203.0.113.1")})
+			var wrongQuestion = new(dns.Msg).SetReply(query)
+			wrongQuestion.Question[0].Name = "other.example.com."
+			var reply = new(dns.Msg).SetReply(query)
+			reply.Answer = append(reply.Answer, &dns.A{Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+			for _, m := range []*dns.Msg{forged, wrongQuestion, reply} {
+				packed, _ := m.Pack()
+				packetConn.WriteTo(packed, addr)
+			}
+		}
+	}()
+
+	client, err := PlainClientOfURL("udp://" + packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := client.Exchange(new(dns.Msg).SetQuestion("Example.COM.", dns.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Answer) != 1 || !response.Answer[0].(*dns.A).A.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("forged responses should be ignored: %v", response.Answer)
+	}
+
+	for _, serverURL := range []string{"https://dns.example", "udp://"} {
+		if _, err := PlainClientOfURL(serverURL); err == nil {
+			t.Error("expected error for", serverURL)
+		}
+	}
+	if client, err := PlainClientOfURL("udp://[2001:db8::1]"); err != nil || client.Address != "[2001:db8::1]:53" {
+		t.Errorf("expected default port: %v %v", client, err)
+	}
+}
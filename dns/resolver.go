@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"strings"
 	"sync"
 
@@ -33,12 +34,32 @@ func DnsResolverMultipleServers(domain string, queryCallbacks generic.MapInterfa
 		QueryCallback: queryCallbacks,
 		Domain:        domain,
 		DnsCache:      NewMapImplementSynchronous[string, cache.ICache](),
+		Cache:         DefaultCache,
 		HttpsPort:     443,
 		QueryHTTPS:    true,
+		Hosts:         DefaultHosts,
+		Routes:        DefaultRoutes,
 	}
 	for _, optionsCallBack := range optionsCallBacks {
 		optionsCallBack(options)
 	}
+	if options.Hosts != nil {
+		if addresses, target, found := options.Hosts.Lookup(domain); found {
+			if target == "" {
+				if len(addresses) == 0 {
+					return nil, errors.New("hosts cname chain too long " + domain)
+				}
+				return addresses, nil
+			}
+			/* CNAME 的目标不在覆盖表中，通过DNS解析目标 */
+			domain = target
+		}
+	}
+	if options.Routes != nil {
+		if routed, ok := options.Routes.Match(domain); ok {
+			queryCallbacks = routed
+		}
+	}
 	var wg sync.WaitGroup
 	var resultsMutex sync.Mutex
 	var cacheMutex sync.Mutex
@@ -50,7 +71,16 @@ func DnsResolverMultipleServers(domain string, queryCallbacks generic.MapInterfa
 		wg.Add(1)
 		go func(queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) {
 			defer wg.Done()
-			res, err := DnsResolver(func(m *dns.Msg) (*dns.Msg, error) {
+			var s = s
+			if options.DNSSEC != nil {
+				/* 验证过的应答与没有验证的应答分开缓存 */
+				queryCallback = options.DNSSEC.QueryCallback(queryCallback)
+				s = s + " dnssec"
+			}
+			var query = func(m *dns.Msg) (*dns.Msg, error) {
+				if options.Cache != nil {
+					return options.Cache.Exchange(s, m, queryCallback)
+				}
 				a := GetOrCreateDNSCacheForString(&cacheMutex, options.DnsCache, s)
 				var copy = m.Copy()
 				/* 为了缓存,需要设置id为0,计算的hash会相同 */
@@ -76,7 +106,12 @@ func DnsResolverMultipleServers(domain string, queryCallbacks generic.MapInterfa
 				a.Set(hash, result)
 				log.Println(s, "cache miss", hash)
 				return result, nil
-			}, domain, options.HttpsPort, options)
+			}
+			if options.Hosts != nil {
+				/* CNAME 和 HTTPS 别名的目标也可能在覆盖表中 */
+				query = options.Hosts.QueryCallback(query)
+			}
+			res, err := DnsResolver(query, domain, options.HttpsPort, options)
 			if err != nil {
 				log.Printf("Error resolving domain %s: %v\n", domain, err)
 				return
@@ -122,9 +157,13 @@ func GetOrCreateDNSCacheForString(cacheMutex *sync.Mutex, DnsCache generic.MapIn
 type DnsResolverOptions struct {
 	QueryCallback generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)] // QueryCallback 是一个回调函数，用于自定义DNS查询逻辑。接收一个dns.Msg类型的参数，返回一个dns.Msg类型和error类型的值。
 	Domain        string                                                                 // Domain 是需要进行DNS解析的域名。
-	DnsCache      generic.MapInterface[string, cache.ICache]
-	HttpsPort     int // HttpsPort 是HTTPS服务监听的端口号。
+	DnsCache      generic.MapInterface[string, cache.ICache]                             // DnsCache 是没有过期时间的旧缓存，仅在 Cache 为nil时使用。
+	Cache         *Cache                                                                 // Cache 是按照记录TTL过期的缓存，默认为 DefaultCache。
+	HttpsPort     int                                                                    // HttpsPort 是HTTPS服务监听的端口号。
 	QueryHTTPS    bool
+	DNSSEC        *DNSSECValidator // DNSSEC 不为nil时验证每个服务器的应答，Reject 为true时没有通过验证的应答被丢弃。
+	Hosts         *Hosts           // Hosts 是优先于DNS服务器的静态覆盖表，默认为 DefaultHosts，为nil时不使用。
+	Routes        *Routes          // Routes 按照域名后缀选择DNS服务器，默认为 DefaultRoutes，为nil时不使用。
 }
 
 // DnsResolver 是一个用于解析特定域名下多种类型记录的函数，例如A记录、AAAA记录和HTTPS记录。
@@ -133,6 +172,12 @@ type DnsResolverOptions struct {
 // optionsCallBacks 是一个可选参数列表，用于修改查询选项。
 // 返回解析到的地址列表和可能发生的错误。
 func DnsResolver(queryCallback func(m *dns.Msg) (r *dns.Msg, err error), domain string, HttpsPort int, options *DnsResolverOptions) ([]string, error) {
+	return dnsResolver(queryCallback, domain, HttpsPort, options, nil)
+}
+
+// dnsResolver 解析域名的地址，chain 是跟随 CNAME 和 AliasMode 记录到达这个域名之前经过的名称。
+func dnsResolver(queryCallback func(m *dns.Msg) (r *dns.Msg, err error), domain string, HttpsPort int, options *DnsResolverOptions, chain []string) ([]string, error) {
+	chain = append(slices.Clone(chain), dns.CanonicalName(domain))
 	var errs []error
 	var resultsMutex sync.Mutex
 	var results []string
@@ -141,7 +186,7 @@ func DnsResolver(queryCallback func(m *dns.Msg) (r *dns.Msg, err error), domain
 		func() {
 			defer wg.Done()
 
-			res, err := resolve(dns.TypeA, queryCallback, domain, HttpsPort, options)
+			res, err := resolve(dns.TypeA, queryCallback, domain, HttpsPort, options, chain)
 			resultsMutex.Lock()
 			defer resultsMutex.Unlock()
 			if err != nil {
@@ -154,7 +199,7 @@ func DnsResolver(queryCallback func(m *dns.Msg) (r *dns.Msg, err error), domain
 
 		}, func() {
 			defer wg.Done()
-			res, err := resolve(dns.TypeAAAA, queryCallback, domain, HttpsPort, options)
+			res, err := resolve(dns.TypeAAAA, queryCallback, domain, HttpsPort, options, chain)
 			resultsMutex.Lock()
 			defer resultsMutex.Unlock()
 			if err != nil {
@@ -169,7 +214,7 @@ func DnsResolver(queryCallback func(m *dns.Msg) (r *dns.Msg, err error), domain
 			if !options.QueryHTTPS {
 				return
 			}
-			res, err := resolve(dns.TypeHTTPS, queryCallback, domain, HttpsPort, options)
+			res, err := resolve(dns.TypeHTTPS, queryCallback, domain, HttpsPort, options, chain)
 			resultsMutex.Lock()
 			defer resultsMutex.Unlock()
 			if err != nil {
@@ -198,8 +243,9 @@ func DnsResolver(queryCallback func(m *dns.Msg) (r *dns.Msg, err error), domain
 } // resolve 是一个用于解析特定域名下指定类型记录的函数。
 // options: 指定DNS解析器的选项，包含域名、端口和其他配置。
 // recordType: 指定需要查询的记录类型（如A记录、AAAA记录等）。
+// chain: 跟随 CNAME 和 AliasMode 记录经过的名称，用于限制别名链的长度和发现循环。
 // 返回值为解析到的记录值字符串数组和可能发生的错误。
-func resolve(recordType uint16, QueryCallback func(m *dns.Msg) (r *dns.Msg, err error), domain string, HttpsPort int, options *DnsResolverOptions) ([]string, error) {
+func resolve(recordType uint16, QueryCallback func(m *dns.Msg) (r *dns.Msg, err error), domain string, HttpsPort int, options *DnsResolverOptions, chain []string) ([]string, error) {
 	m := &dns.Msg{}
 	if recordType == dns.TypeHTTPS && HttpsPort != 443 {
 
@@ -232,23 +278,28 @@ func resolve(recordType uint16, QueryCallback func(m *dns.Msg) (r *dns.Msg, err
 		case *dns.AAAA:
 			results = append(results, (record.AAAA.String()))
 		case *dns.HTTPS:
-			{
-				if record.Priority != 0 {
-					for _, value := range record.Value {
-						if value.Key().String() == "ipv4hint" {
-							var addresses = strings.Split(value.String(), ",")
-							results = append(results, addresses...)
-
-						} else if value.Key().String() == "ipv6hint" {
-							var addresses = strings.Split(value.String(), ",")
-							results = append(results, addresses...)
-						}
-					}
+			var binding = ParseServiceBinding(&record.SVCB)
+			if !binding.AliasMode() {
+				results = append(results, binding.Hints()...)
+			} else if binding.Target != "." {
+				/* AliasMode 记录把服务指向另一个名称，解析该名称的地址 */
+				if err := checkAliasChain(chain, binding.Target); err != nil {
+					log.Println(err)
+					continue
+				}
+				res, err := dnsResolver(QueryCallback, strings.TrimSuffix(binding.Target, "."), HttpsPort, options, chain)
+				if err != nil {
+					log.Println(err)
+					continue
 				}
+				results = append(results, res...)
 			}
 		case *dns.CNAME:
 			// results = append(results, fmt.Sprintf("CNAME: %s", record.Target))
-			res, err := DnsResolver(QueryCallback, record.Target, HttpsPort, options)
+			if err := checkAliasChain(chain, record.Target); err != nil {
+				return nil, err
+			}
+			res, err := dnsResolver(QueryCallback, record.Target, HttpsPort, options, chain)
 			if err != nil {
 				return nil, err
 			}
@@ -259,7 +310,20 @@ func resolve(recordType uint16, QueryCallback func(m *dns.Msg) (r *dns.Msg, err
 		return nil, errors.New("no results found for " + domain)
 	}
 	return removeDuplicates(results), nil
-} // removeDuplicates 函数用于移除一个可比较类型切片中的重复元素。
+}
+
+// checkAliasChain 检查是否可以跟随 CNAME 或者 AliasMode 记录到达目标名称：别名链的长度不超过 maxAliasChain，并且目标不是已经经过的名称。
+func checkAliasChain(chain []string, target string) error {
+	if len(chain) > maxAliasChain {
+		return errors.New("alias chain too long at " + target)
+	}
+	if slices.Contains(chain, dns.CanonicalName(target)) {
+		return errors.New("alias loop at " + target)
+	}
+	return nil
+}
+
+// removeDuplicates 函数用于移除一个可比较类型切片中的重复元素。
 // 参数 arr 是待处理的切片，函数返回一个不包含重复元素的新切片。
 // [T comparable] 使用了泛型 T，限制 T 必须是可比较的类型。
 func removeDuplicates[T comparable](arr []T) []T {
@@ -290,3 +354,44 @@ func ArrayMap[T any, U any](arr []T, fn func(T) U) []U {
 
 	return result
 }
+
+// UpstreamQueryCallback 返回解析上游主机使用的查询函数：先使用 DefaultHosts 覆盖表和 DefaultRoutes 分流规则，
+// 再依次尝试多个DNS查询回调函数，应答使用 DefaultCache 缓存。
+func UpstreamQueryCallback(queryCallbacks generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)]) func(m *dns.Msg) (r *dns.Msg, err error) {
+	return DefaultHosts.QueryCallback(DefaultRoutes.QueryCallback(QueryCallbackOfServers(queryCallbacks, DefaultCache), DefaultCache))
+}
+
+// QueryCallbackOfServers 返回一个依次尝试多个DNS查询回调函数的查询函数，第一个成功的应答被返回。
+//
+// 参数:
+// queryCallbacks - DNS查询回调函数，键为服务器的名称。
+// cache - 缓存应答的DNS缓存，为nil时不缓存。
+//
+// 返回值:
+// 查询函数，所有服务器都失败时返回所有的错误。
+func QueryCallbackOfServers(queryCallbacks generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)], cache *Cache) func(m *dns.Msg) (r *dns.Msg, err error) {
+	return func(m *dns.Msg) (*dns.Msg, error) {
+		var errs []error
+		for _, entry := range queryCallbacks.Entries() {
+			var server, queryCallback = entry.GetFirst(), entry.GetSecond()
+			var resp *dns.Msg
+			var err error
+			if cache != nil {
+				resp, err = cache.Exchange(server, m, queryCallback)
+			} else {
+				resp, err = queryCallback(m)
+			}
+			if err == nil && resp != nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused {
+				return resp, nil
+			}
+			if err == nil {
+				err = errors.New(server + " dns server response error:" + dns.RcodeToString[resp.Rcode])
+			}
+			errs = append(errs, err)
+		}
+		if len(errs) == 0 {
+			return nil, errors.New("no query callbacks provided")
+		}
+		return nil, errors.Join(errs...)
+	}
+}
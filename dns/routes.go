@@ -0,0 +1,86 @@
+package dns
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/miekg/dns"
+)
+
+// Routes 是按照域名后缀选择DNS服务器的分流规则（split-horizon），例如把内网域名发送给内网的DNS服务器。
+// 名称匹配多个后缀时使用最长的后缀，不匹配任何后缀的名称使用原来的DNS服务器。可以被多个协程同时使用。
+type Routes struct {
+	mutex  sync.RWMutex
+	routes map[string]generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)]
+}
+
+// DefaultRoutes 是 DnsResolverMultipleServers 默认使用的分流规则。
+var DefaultRoutes = NewRoutes()
+
+// NewRoutes 创建一组空的分流规则。
+func NewRoutes() *Routes {
+	return &Routes{routes: map[string]generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)]{}}
+}
+
+// Add 添加一条分流规则，同一个后缀的规则被替换。
+//
+// 参数:
+// suffix - 域名后缀，匹配该名称本身和所有子域名，可以写成 "*.example.com" 的形式。
+// queryCallbacks - 解析匹配的名称使用的DNS查询回调函数，键为服务器的名称。
+//
+// 返回值:
+// 后缀无效或者没有查询回调函数时的错误。
+func (r *Routes) Add(suffix string, queryCallbacks generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)]) error {
+	var key = strings.ToLower(dns.Fqdn(strings.TrimPrefix(suffix, "*.")))
+	if _, ok := dns.IsDomainName(key); !ok || key == "." {
+		return errors.New("invalid route suffix " + suffix)
+	}
+	if queryCallbacks == nil || queryCallbacks.Size() == 0 {
+		return errors.New("no dns servers for route suffix " + suffix)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.routes[key] = queryCallbacks
+	return nil
+}
+
+// Len 返回分流规则的数量。
+func (r *Routes) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.routes)
+}
+
+// Match 返回名称匹配的最长后缀的DNS查询回调函数。
+//
+// 参数:
+// name - 需要解析的名称。
+//
+// 返回值:
+// 匹配的DNS查询回调函数，以及是否有匹配的规则。
+func (r *Routes) Match(name string) (generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)], bool) {
+	var key = strings.ToLower(dns.Fqdn(name))
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(key, offset) {
+		if queryCallbacks, ok := r.routes[key[offset:]]; ok {
+			return queryCallbacks, true
+		}
+	}
+	return nil, false
+}
+
+// QueryCallback 返回按照分流规则选择DNS服务器的查询回调函数，匹配的查询依次尝试规则中的服务器并使用 cache 缓存，
+// 其他查询调用 queryCallback。
+func (r *Routes) QueryCallback(queryCallback func(m *dns.Msg) (r *dns.Msg, err error), cache *Cache) func(m *dns.Msg) (r *dns.Msg, err error) {
+	return func(m *dns.Msg) (*dns.Msg, error) {
+		if len(m.Question) == 1 {
+			if queryCallbacks, ok := r.Match(m.Question[0].Name); ok {
+				return QueryCallbackOfServers(queryCallbacks, cache)(m)
+			}
+		}
+		return queryCallback(m)
+	}
+}
@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SRVTarget 是 SRV 记录（RFC 2782）指向的一个服务实例。
+//
+// 字段：
+// Target - 服务实例的主机名，不带末尾的点。
+// Port - 服务实例的端口。
+// Priority - 优先级，数值小的优先使用，数值大的实例只在数值小的实例都不可用时使用。
+// Weight - 同一优先级内分配请求的相对权重。
+type SRVTarget struct {
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+// LookupSRV 查询 SRV 记录，返回按照优先级排序的服务实例。
+//
+// 参数:
+// name - SRV 记录的名称，格式为 _service._proto.name，例如 "_https._tcp.example.com"。
+// queryCallback - DNS查询回调函数。
+//
+// 返回值:
+// 服务实例、应答中 SRV 记录的最小TTL，以及查询失败、没有记录或者服务明确不可用（唯一的记录目标为"."）时的错误。
+func LookupSRV(name string, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) ([]SRVTarget, time.Duration, error) {
+	var m = new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeSRV)
+	resp, err := queryCallback(m)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, 0, errors.New("dns server response error " + dns.RcodeToString[resp.Rcode] + " " + name)
+	}
+	var targets []SRVTarget
+	var ttl uint32
+	var found bool
+	for _, answer := range resp.Answer {
+		record, ok := answer.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		if !found || record.Hdr.Ttl < ttl {
+			ttl = record.Hdr.Ttl
+		}
+		found = true
+		if record.Target == "." {
+			continue
+		}
+		targets = append(targets, SRVTarget{
+			Target:   strings.TrimSuffix(record.Target, "."),
+			Port:     record.Port,
+			Priority: record.Priority,
+			Weight:   record.Weight,
+		})
+	}
+	if !found {
+		return nil, 0, errors.New("no srv records found for " + name)
+	}
+	if len(targets) == 0 {
+		return nil, time.Duration(ttl) * time.Second, errors.New("service not available " + name)
+	}
+	slices.SortStableFunc(targets, func(a, b SRVTarget) int {
+		return int(a.Priority) - int(b.Priority)
+	})
+	return targets, time.Duration(ttl) * time.Second, nil
+}
@@ -0,0 +1,55 @@
+package dns
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// answerSRV 返回应答指定 SRV 记录的查询函数。
+func answerSRV(records ...string) func(m *dns.Msg) (*dns.Msg, error) {
+	return func(m *dns.Msg) (*dns.Msg, error) {
+		var r = new(dns.Msg)
+		r.SetReply(m)
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				return nil, err
+			}
+			r.Answer = append(r.Answer, rr)
+		}
+		return r, nil
+	}
+}
+
+func TestLookupSRV(t *testing.T) {
+	targets, ttl, err := LookupSRV("_https._tcp.example.com", answerSRV(
+		"_https._tcp.example.com. 300 IN SRV 20 10 443 backup.example.net.",
+		"_https._tcp.example.com. 60 IN SRV 10 60 8443 a.example.net.",
+		"_https._tcp.example.com. 120 IN SRV 10 40 443 b.example.net.",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []SRVTarget{
+		{Target: "a.example.net", Port: 8443, Priority: 10, Weight: 60},
+		{Target: "b.example.net", Port: 443, Priority: 10, Weight: 40},
+		{Target: "backup.example.net", Port: 443, Priority: 20, Weight: 10},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("unexpected targets: %v", targets)
+	}
+	if ttl != time.Minute {
+		t.Errorf("ttl should be the minimum of the records: %v", ttl)
+	}
+
+	/* 目标为"."表示服务明确不可用 */
+	if _, _, err := LookupSRV("_https._tcp.example.com", answerSRV("_https._tcp.example.com. 60 IN SRV 0 0 0 .")); err == nil {
+		t.Error("expected error for unavailable service")
+	}
+	if _, _, err := LookupSRV("_https._tcp.example.com", answerSRV()); err == nil {
+		t.Error("expected error for empty answer")
+	}
+}
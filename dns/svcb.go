@@ -0,0 +1,258 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxAliasChain 是跟随 AliasMode 记录的最大次数（RFC 9460 第 3 节建议限制别名链的长度）。
+const maxAliasChain = 8
+
+// ServiceBinding 是解析后的 SVCB 或 HTTPS 记录（RFC 9460）。
+//
+// 字段：
+// Priority - 记录的优先级，0 表示 AliasMode，数值越小越优先。
+// Target - 目标名称，"." 在 ServiceMode 下表示记录的所有者名称，在 AliasMode 下表示服务不存在。
+// ALPN - alpn 参数中的应用层协议列表。
+// NoDefaultALPN - 是否设置了 no-default-alpn，设置时不包含默认协议 http/1.1。
+// Port - port 参数，为0时使用原来的端口。
+// IPv4Hint - ipv4hint 参数中的地址。
+// IPv6Hint - ipv6hint 参数中的地址。
+// ECH - ech 参数中的 ECHConfigList。
+// TTL - 记录的TTL，单位为秒。
+type ServiceBinding struct {
+	Priority      uint16
+	Target        string
+	ALPN          []string
+	NoDefaultALPN bool
+	Port          uint16
+	IPv4Hint      []net.IP
+	IPv6Hint      []net.IP
+	ECH           []byte
+	TTL           uint32
+}
+
+// ParseServiceBinding 把 SVCB 记录解析为 ServiceBinding，AliasMode 记录的参数会被忽略。
+func ParseServiceBinding(record *dns.SVCB) ServiceBinding {
+	var binding = ServiceBinding{Priority: record.Priority, Target: record.Target, TTL: record.Hdr.Ttl}
+	if binding.AliasMode() {
+		return binding
+	}
+	for _, value := range record.Value {
+		switch value := value.(type) {
+		case *dns.SVCBAlpn:
+			binding.ALPN = append(binding.ALPN, value.Alpn...)
+		case *dns.SVCBNoDefaultAlpn:
+			binding.NoDefaultALPN = true
+		case *dns.SVCBPort:
+			binding.Port = value.Port
+		case *dns.SVCBIPv4Hint:
+			binding.IPv4Hint = append(binding.IPv4Hint, value.Hint...)
+		case *dns.SVCBIPv6Hint:
+			binding.IPv6Hint = append(binding.IPv6Hint, value.Hint...)
+		case *dns.SVCBECHConfig:
+			binding.ECH = append([]byte(nil), value.ECH...)
+		}
+	}
+	return binding
+}
+
+// AliasMode 判断记录是否为 AliasMode 记录。
+func (s ServiceBinding) AliasMode() bool {
+	return s.Priority == 0
+}
+
+// TargetName 返回记录指向的主机名，ServiceMode 下目标为 "." 时返回记录的所有者名称。
+//
+// 参数:
+// owner - 记录的所有者名称。
+func (s ServiceBinding) TargetName(owner string) string {
+	if s.Target == "." && !s.AliasMode() {
+		return dns.Fqdn(owner)
+	}
+	return dns.Fqdn(s.Target)
+}
+
+// Protocols 返回该服务端点支持的应用层协议（RFC 9460 第 7.1.2 节），
+// 没有设置 no-default-alpn 时包含 HTTPS 记录的默认协议 http/1.1。
+func (s ServiceBinding) Protocols() []string {
+	var protocols = append([]string(nil), s.ALPN...)
+	if !s.NoDefaultALPN && !slices.Contains(protocols, "http/1.1") {
+		protocols = append(protocols, "http/1.1")
+	}
+	return protocols
+}
+
+// Hints 返回 ipv6hint 和 ipv4hint 参数中的地址。
+func (s ServiceBinding) Hints() []string {
+	var hints []string
+	for _, ip := range s.IPv6Hint {
+		hints = append(hints, ip.String())
+	}
+	for _, ip := range s.IPv4Hint {
+		hints = append(hints, ip.String())
+	}
+	return hints
+}
+
+// ServiceBindingsFromMsg 从DNS应答中取出 SVCB 和 HTTPS 记录，按照优先级排序，
+// 同一优先级保持应答中的顺序。记录集中包含 AliasMode 记录时忽略 ServiceMode 记录（RFC 9460 第 2.4.2 节）。
+func ServiceBindingsFromMsg(msg *dns.Msg) []ServiceBinding {
+	var bindings []ServiceBinding
+	for _, answer := range msg.Answer {
+		switch record := answer.(type) {
+		case *dns.HTTPS:
+			bindings = append(bindings, ParseServiceBinding(&record.SVCB))
+		case *dns.SVCB:
+			bindings = append(bindings, ParseServiceBinding(record))
+		}
+	}
+	for _, binding := range bindings {
+		if binding.AliasMode() {
+			return []ServiceBinding{binding}
+		}
+	}
+	sort.SliceStable(bindings, func(i, j int) bool {
+		return bindings[i].Priority < bindings[j].Priority
+	})
+	return bindings
+}
+
+// ServiceEndpoint 是根据 HTTPS 记录确定的一个可以连接的服务端点。
+//
+// 字段：
+// Priority - 端点的优先级，数值越小越优先，来自 HTTPS 记录时不为0。
+// Host - 需要连接的主机名，TLS 的服务器名称仍然使用原来的域名。
+// Port - 需要连接的端口。
+// Protocols - 端点支持的应用层协议，为空时表示没有 HTTPS 记录，协议未知。
+// ECH - 端点的 ECHConfigList。
+// Addresses - 端点的IP地址，来自目标名称的 A 和 AAAA 记录，解析失败时使用地址提示。
+// TTL - 端点信息的有效时间，单位为秒。
+type ServiceEndpoint struct {
+	Priority  uint16
+	Host      string
+	Port      int
+	Protocols []string
+	ECH       []byte
+	Addresses []string
+	TTL       uint32
+}
+
+// Supports 判断端点是否支持指定的应用层协议。
+func (e ServiceEndpoint) Supports(protocol string) bool {
+	return slices.Contains(e.Protocols, protocol)
+}
+
+// serviceBindingName 返回查询 HTTPS 记录使用的名称，非默认端口时加上端口前缀（RFC 9460 第 9.1 节）。
+func serviceBindingName(domain string, port int) string {
+	if port != 443 && port != 0 {
+		return fmt.Sprintf("_%d._https.", port) + dns.Fqdn(domain)
+	}
+	return dns.Fqdn(domain)
+}
+
+// lookupRecords 查询一种记录类型并返回应答。
+func lookupRecords(name string, recordType uint16, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) (*dns.Msg, error) {
+	var msg = new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), recordType)
+	resp, err := queryCallback(msg)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, errors.New("dns server response error not success:" + dns.RcodeToString[resp.Rcode] + " " + msg.Question[0].String())
+	}
+	return resp, nil
+}
+
+// lookupTargetAddresses 解析目标名称的 A 和 AAAA 记录。
+func lookupTargetAddresses(target string, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) []string {
+	var addresses []string
+	for _, recordType := range []uint16{dns.TypeAAAA, dns.TypeA} {
+		resp, err := lookupRecords(target, recordType, queryCallback)
+		if err != nil {
+			log.Println(target, err)
+			continue
+		}
+		for _, answer := range resp.Answer {
+			switch record := answer.(type) {
+			case *dns.A:
+				addresses = append(addresses, record.A.String())
+			case *dns.AAAA:
+				addresses = append(addresses, record.AAAA.String())
+			}
+		}
+	}
+	return addresses
+}
+
+// ResolveServiceEndpoints 按照 RFC 9460 第 3 节的客户端流程解析 HTTPS 记录：
+// 跟随 AliasMode 记录，按照优先级返回 ServiceMode 记录描述的端点，
+// 每个端点使用记录中的端口（没有时使用原来的端口）和目标名称的地址（解析失败时使用地址提示）。
+// 没有 HTTPS 记录时返回原来的域名和端口作为唯一的端点，其 Protocols 为空。
+//
+// 参数:
+// domain - 需要连接的域名。
+// port - 需要连接的端口。
+// queryCallback - DNS查询回调函数。
+//
+// 返回值:
+// 按照优先级排列的端点，以及查询时遇到的错误。
+func ResolveServiceEndpoints(domain string, port int, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) ([]ServiceEndpoint, error) {
+	var name = serviceBindingName(domain, port)
+	var fallback = []ServiceEndpoint{{Host: strings.TrimSuffix(dns.Fqdn(domain), "."), Port: port}}
+	for i := 0; i <= maxAliasChain; i++ {
+		resp, err := lookupRecords(name, dns.TypeHTTPS, queryCallback)
+		if err != nil {
+			return nil, err
+		}
+		var bindings = ServiceBindingsFromMsg(resp)
+		if len(bindings) == 0 {
+			return fallback, nil
+		}
+		if bindings[0].AliasMode() {
+			if bindings[0].Target == "." {
+				return nil, errors.New("service not available for " + domain)
+			}
+			name = bindings[0].TargetName(name)
+			/* 别名目标本身也可能没有 HTTPS 记录，此时连接别名目标 */
+			fallback = []ServiceEndpoint{{Host: strings.TrimSuffix(name, "."), Port: port, Addresses: lookupTargetAddresses(name, queryCallback)}}
+			continue
+		}
+		var endpoints []ServiceEndpoint
+		for _, binding := range bindings {
+			var target = binding.TargetName(name)
+			var endpoint = ServiceEndpoint{
+				Priority:  binding.Priority,
+				Host:      strings.TrimSuffix(target, "."),
+				Port:      port,
+				Protocols: binding.Protocols(),
+				ECH:       binding.ECH,
+				TTL:       binding.TTL,
+			}
+			if binding.Port != 0 {
+				endpoint.Port = int(binding.Port)
+			}
+			/* 目标为 "." 且使用了端口前缀时，地址属于原来的域名而不是带前缀的名称 */
+			var addressName = target
+			if binding.Target == "." && name == serviceBindingName(domain, port) {
+				addressName = dns.Fqdn(domain)
+				endpoint.Host = strings.TrimSuffix(addressName, ".")
+			}
+			endpoint.Addresses = lookupTargetAddresses(addressName, queryCallback)
+			if len(endpoint.Addresses) == 0 {
+				endpoint.Addresses = binding.Hints()
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		return endpoints, nil
+	}
+	return nil, errors.New("too many alias records for " + domain)
+}
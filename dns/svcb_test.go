@@ -0,0 +1,160 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// zoneQueryCallback 返回根据预设记录应答的查询函数，没有记录时返回 NODATA。
+func zoneQueryCallback(t *testing.T, zone string) func(m *dns.Msg) (*dns.Msg, error) {
+	var records []dns.RR
+	var parser = dns.NewZoneParser(strings.NewReader(zone), "", "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		records = append(records, rr)
+	}
+	if err := parser.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return func(m *dns.Msg) (*dns.Msg, error) {
+		var r = new(dns.Msg)
+		r.SetReply(m)
+		for _, rr := range records {
+			if rr.Header().Name == m.Question[0].Name && rr.Header().Rrtype == m.Question[0].Qtype {
+				r.Answer = append(r.Answer, rr)
+			}
+		}
+		return r, nil
+	}
+}
+
+func TestParseServiceBinding(t *testing.T) {
+	rr, err := dns.NewRR(`example.com. 300 IN HTTPS 1 . alpn="h3,h2" no-default-alpn port=8443 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1 ech="AEX+DQBBAQAgACAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAEAAEAAQAAAA1leGFtcGxlLmNvbQAAAA=="`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var binding = ParseServiceBinding(&rr.(*dns.HTTPS).SVCB)
+	if binding.AliasMode() || binding.Port != 8443 || binding.TTL != 300 || len(binding.ECH) == 0 {
+		t.Errorf("unexpected binding: %+v", binding)
+	}
+	if protocols := binding.Protocols(); !reflect.DeepEqual(protocols, []string{"h3", "h2"}) {
+		t.Errorf("no-default-alpn should drop http/1.1: %v", protocols)
+	}
+	if hints := binding.Hints(); !reflect.DeepEqual(hints, []string{"2001:db8::1", "192.0.2.1"}) {
+		t.Errorf("unexpected hints: %v", hints)
+	}
+	if target := binding.TargetName("example.com"); target != "example.com." {
+		t.Errorf("service mode target \".\" should be the owner: %s", target)
+	}
+	binding.NoDefaultALPN = false
+	if protocols := binding.Protocols(); !reflect.DeepEqual(protocols, []string{"h3", "h2", "http/1.1"}) {
+		t.Errorf("default alpn should be added: %v", protocols)
+	}
+}
+
+func TestResolveServiceEndpoints(t *testing.T) {
+	var query = zoneQueryCallback(t, `
+example.com. 300 IN HTTPS 0 svc.example.net.
+example.com. 300 IN HTTPS 1 . alpn=h3
+svc.example.net. 60 IN HTTPS 2 backup.example.net. alpn=h2
+svc.example.net. 120 IN HTTPS 1 . alpn=h3 port=8443 ipv4hint=192.0.2.9
+svc.example.net. 60 IN A 192.0.2.1
+backup.example.net. 60 IN AAAA 2001:db8::2
+_8080._https.api.example.com. 60 IN HTTPS 1 . alpn=h2 ipv4hint=192.0.2.3
+api.example.com. 60 IN A 192.0.2.4
+plain.example.com. 60 IN A 192.0.2.5
+`)
+	/* 记录集中有 AliasMode 记录时忽略 ServiceMode 记录，跟随别名后按照优先级排序 */
+	endpoints, err := ResolveServiceEndpoints("example.com", 443, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected = []ServiceEndpoint{
+		{Priority: 1, Host: "svc.example.net", Port: 8443, Protocols: []string{"h3", "http/1.1"}, Addresses: []string{"192.0.2.1"}, TTL: 120},
+		{Priority: 2, Host: "backup.example.net", Port: 443, Protocols: []string{"h2", "http/1.1"}, Addresses: []string{"2001:db8::2"}, TTL: 60},
+	}
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("unexpected endpoints:\n%+v\n%+v", endpoints, expected)
+	}
+
+	/* 非默认端口查询带前缀的名称，目标 "." 的地址属于原来的域名 */
+	endpoints, err = ResolveServiceEndpoints("api.example.com", 8080, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0].Host != "api.example.com" || endpoints[0].Port != 8080 || !reflect.DeepEqual(endpoints[0].Addresses, []string{"192.0.2.4"}) {
+		t.Errorf("unexpected endpoints: %+v", endpoints)
+	}
+
+	/* 没有 HTTPS 记录时使用原来的域名和端口，协议未知 */
+	endpoints, err = ResolveServiceEndpoints("plain.example.com", 443, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0].Host != "plain.example.com" || endpoints[0].Port != 443 || len(endpoints[0].Protocols) != 0 {
+		t.Errorf("unexpected fallback endpoint: %+v", endpoints)
+	}
+
+	if _, err := ResolveServiceEndpoints("example.com", 443, func(m *dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("timeout")
+	}); err == nil {
+		t.Error("expected query error")
+	}
+}
+
+func TestResolveServiceEndpointsUsesHints(t *testing.T) {
+	var query = zoneQueryCallback(t, `
+example.org. 300 IN HTTPS 1 . alpn=h3 ipv6hint=2001:db8::7
+`)
+	endpoints, err := ResolveServiceEndpoints("example.org", 443, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || !reflect.DeepEqual(endpoints[0].Addresses, []string{net.ParseIP("2001:db8::7").String()}) {
+		t.Errorf("hints should be used when the target has no addresses: %+v", endpoints)
+	}
+}
+
+func TestDnsResolverAliasLoop(t *testing.T) {
+	var zone = zoneQueryCallback(t, `
+loop.example. 300 IN HTTPS 0 loop.example.
+loop.example. 300 IN A 192.0.2.1
+a.example. 300 IN HTTPS 0 b.example.
+b.example. 300 IN HTTPS 0 a.example.
+`+func() string {
+		var chain strings.Builder
+		for i := range 20 {
+			chain.WriteString("c" + strconv.Itoa(i) + ".example. 300 IN HTTPS 0 c" + strconv.Itoa(i+1) + ".example.\n")
+		}
+		return chain.String()
+	}())
+	var queries atomic.Int32
+	var query = func(m *dns.Msg) (*dns.Msg, error) {
+		queries.Add(1)
+		return zone(m)
+	}
+	var options = &DnsResolverOptions{QueryHTTPS: true}
+
+	/* 指向自己的 AliasMode 记录不会被反复跟随 */
+	addresses, err := DnsResolver(query, "loop.example", 443, options)
+	if err != nil || !reflect.DeepEqual(addresses, []string{"192.0.2.1"}) {
+		t.Errorf("unexpected addresses: %v %v", addresses, err)
+	}
+	if _, err := DnsResolver(query, "a.example", 443, options); err == nil {
+		t.Error("alias loop without addresses should fail")
+	}
+	/* 别名链的长度不超过 maxAliasChain */
+	queries.Store(0)
+	if _, err := DnsResolver(query, "c0.example", 443, options); err == nil {
+		t.Error("alias chain without addresses should fail")
+	}
+	if count := queries.Load(); count > 3*(maxAliasChain+1) {
+		t.Errorf("too many queries for a long alias chain: %d", count)
+	}
+}
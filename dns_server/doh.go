@@ -0,0 +1,196 @@
+package dns_server
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSMessageContentType 是 RFC 8484 规定的DNS消息的媒体类型。
+const DNSMessageContentType = "application/dns-message"
+
+// DefaultPath 是DoH服务的默认路径。
+const DefaultPath = "/dns-query"
+
+// DefaultIdleTimeout 是DoQ和DoT连接默认的空闲超时时间。
+const DefaultIdleTimeout = 30 * time.Second
+
+// ErrNoQuery 表示请求中没有DNS查询。
+var ErrNoQuery = errors.New("dns_server: missing dns query")
+
+// Options 是DoH、DoQ和DoT服务的配置。
+//
+// 字段：
+// Path - DoH处理DNS查询的路径，默认为 DefaultPath。
+// Query - 解析DNS查询的函数，例如 dns.QueryCallbackOfServers 返回的多服务器查询函数。
+// MaxMessageSize - DoH的 POST 请求中DNS消息的最大长度，默认为 dns.MaxMsgSize。
+// IdleTimeout - DoQ和DoT连接的空闲超时时间，默认为 DefaultIdleTimeout。
+// ClientSubnet - 是否为没有ECS选项的查询添加客户端地址的 EDNS Client Subnet 选项（RFC 7871），默认为false。
+// ClientSubnetIPv4PrefixLength - 添加的ECS选项中IPv4地址的源前缀长度，默认为24。
+// ClientSubnetIPv6PrefixLength - 添加的ECS选项中IPv6地址的源前缀长度，默认为56。
+type Options struct {
+	Path                         string
+	Query                        func(m *dns.Msg) (r *dns.Msg, err error)
+	MaxMessageSize               int64
+	IdleTimeout                  time.Duration
+	ClientSubnet                 bool
+	ClientSubnetIPv4PrefixLength uint8
+	ClientSubnetIPv6PrefixLength uint8
+}
+
+// defaultOptions 返回默认的配置。
+func defaultOptions() Options {
+	return Options{
+		Path:                         DefaultPath,
+		MaxMessageSize:               dns.MaxMsgSize,
+		IdleTimeout:                  DefaultIdleTimeout,
+		ClientSubnetIPv4PrefixLength: 24,
+		ClientSubnetIPv6PrefixLength: 56,
+	}
+}
+
+// DoHHandler 是按照 RFC 8484 处理 DNS over HTTPS 请求的处理器，
+// 同时适用于HTTP/1.1、HTTP/2和HTTP/3监听器。
+type DoHHandler struct {
+	Options
+}
+
+// NewDoHHandler 创建一个DoH处理器。
+//
+// 参数:
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的处理器。
+func NewDoHHandler(options ...func(*Options)) *DoHHandler {
+	var handler = &DoHHandler{Options: defaultOptions()}
+	for _, option := range options {
+		option(&handler.Options)
+	}
+	return handler
+}
+
+// IsDNSQuery 判断请求的路径是否为DoH服务的路径。
+func (h *DoHHandler) IsDNSQuery(r *http.Request) bool {
+	return r.URL.Path == h.Path
+}
+
+// ServeHTTP 实现了 http.Handler 接口。GET 请求从 base64url 编码的 dns 参数读取查询，
+// POST 请求从 application/dns-message 类型的请求体读取查询，解析结果按照记录的TTL设置 Cache-Control。
+func (h *DoHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var packed []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		packed, err = queryFromGet(r)
+	case http.MethodPost:
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != DNSMessageContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		packed, err = io.ReadAll(io.LimitReader(r.Body, h.MaxMessageSize+1))
+		if err == nil && int64(len(packed)) > h.MaxMessageSize {
+			http.Error(w, "dns message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Println("dns_server: read query", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var msg = new(dns.Msg)
+	if err := msg.Unpack(packed); err != nil || len(msg.Question) != 1 || msg.Response {
+		log.Println("dns_server: invalid query", err)
+		http.Error(w, "invalid dns query", http.StatusBadRequest)
+		return
+	}
+	var response = h.resolveClient(msg, r.RemoteAddr)
+	body, err := response.Pack()
+	if err != nil {
+		log.Println("dns_server: pack response", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", DNSMessageContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if maxAge, ok := MaxAge(response); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(maxAge), 10))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// resolve 使用查询函数解析查询并返回应答，应答的ID与查询相同。解析失败时返回 SERVFAIL 应答。
+func resolve(query func(m *dns.Msg) (r *dns.Msg, err error), msg *dns.Msg) *dns.Msg {
+	var id = msg.Id
+	var response *dns.Msg
+	var err error
+	if query != nil {
+		response, err = query(msg.Copy())
+	} else {
+		err = errors.New("dns_server: no query function")
+	}
+	if err != nil || response == nil {
+		log.Println("dns_server: resolve", msg.Question[0].String(), err)
+		response = new(dns.Msg)
+		response.SetRcode(msg, dns.RcodeServerFailure)
+		return response
+	}
+	response = response.Copy()
+	response.Id = id
+	return response
+}
+
+// queryFromGet 读取 GET 请求中 base64url 编码的 dns 参数，兼容带有填充的编码。
+func queryFromGet(r *http.Request) ([]byte, error) {
+	var encoded = r.URL.Query().Get("dns")
+	if encoded == "" {
+		return nil, ErrNoQuery
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+}
+
+// MaxAge 返回应答可以被缓存的秒数（RFC 8484 第 5.1 节）：所有记录TTL中的最小值，
+// 否定应答使用 SOA 记录的TTL和 MINIMUM 字段中的较小值。应答没有可以确定有效期的记录或者是错误应答时返回false。
+func MaxAge(msg *dns.Msg) (uint32, bool) {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+	var maxAge uint32
+	var found bool
+	var update = func(ttl uint32) {
+		if !found || ttl < maxAge {
+			maxAge = ttl
+		}
+		found = true
+	}
+	for _, sections := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range sections {
+			switch record := rr.(type) {
+			case *dns.OPT:
+				/* OPT 记录的TTL字段不是有效期 */
+				continue
+			case *dns.SOA:
+				update(min(record.Hdr.Ttl, record.Minttl))
+			default:
+				update(rr.Header().Ttl)
+			}
+		}
+	}
+	return maxAge, found
+}
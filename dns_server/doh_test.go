@@ -0,0 +1,139 @@
+package dns_server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answerQuery 返回一个对 A 查询给出两条记录的查询函数。
+func answerQuery(m *dns.Msg) (*dns.Msg, error) {
+	var r = new(dns.Msg)
+	r.SetReply(m)
+	r.Id = 4321
+	r.Answer = append(r.Answer,
+		&dns.A{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP("192.0.2.1")},
+		&dns.A{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}, A: net.ParseIP("192.0.2.2")},
+	)
+	r.SetEdns0(1232, false)
+	return r, nil
+}
+
+func packedQuery(t *testing.T, id uint16) []byte {
+	var msg = new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Id = id
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func readResponse(t *testing.T, recorder *httptest.ResponseRecorder) *dns.Msg {
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get("Content-Type") != DNSMessageContentType {
+		t.Errorf("unexpected content type: %s", recorder.Header().Get("Content-Type"))
+	}
+	var msg = new(dns.Msg)
+	if err := msg.Unpack(recorder.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDoHHandlerGetAndPost(t *testing.T) {
+	var handler = NewDoHHandler(func(o *Options) { o.Query = answerQuery })
+
+	var request = httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(packedQuery(t, 0)), nil)
+	if !handler.IsDNSQuery(request) {
+		t.Fatal("/dns-query should be handled")
+	}
+	var recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	var response = readResponse(t, recorder)
+	if response.Id != 0 || len(response.Answer) != 2 {
+		t.Errorf("unexpected response: %v", response)
+	}
+	/* max-age 是所有记录TTL中的最小值，OPT 记录不参与计算 */
+	if cacheControl := recorder.Header().Get("Cache-Control"); cacheControl != "max-age=120" {
+		t.Errorf("unexpected cache control: %s", cacheControl)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packedQuery(t, 99)))
+	request.Header.Set("Content-Type", DNSMessageContentType)
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if response := readResponse(t, recorder); response.Id != 99 {
+		t.Errorf("response id should match the query: %d", response.Id)
+	}
+}
+
+func TestDoHHandlerRejectsBadRequests(t *testing.T) {
+	var handler = NewDoHHandler(func(o *Options) {
+		o.Query = answerQuery
+		o.MaxMessageSize = 64
+	})
+	var tests = []struct {
+		name    string
+		request *http.Request
+		status  int
+	}{
+		{"missing dns parameter", httptest.NewRequest(http.MethodGet, "/dns-query", nil), http.StatusBadRequest},
+		{"invalid base64url", httptest.NewRequest(http.MethodGet, "/dns-query?dns=***", nil), http.StatusBadRequest},
+		{"invalid message", httptest.NewRequest(http.MethodGet, "/dns-query?dns=AAAA", nil), http.StatusBadRequest},
+		{"wrong content type", httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packedQuery(t, 1))), http.StatusUnsupportedMediaType},
+		{"method", httptest.NewRequest(http.MethodPut, "/dns-query", nil), http.StatusMethodNotAllowed},
+	}
+	var large = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(make([]byte, 100)))
+	large.Header.Set("Content-Type", DNSMessageContentType)
+	tests = append(tests, struct {
+		name    string
+		request *http.Request
+		status  int
+	}{"too large", large, http.StatusRequestEntityTooLarge})
+	for _, test := range tests {
+		var recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, test.request)
+		if recorder.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, recorder.Code)
+		}
+	}
+}
+
+func TestDoHHandlerServerFailure(t *testing.T) {
+	var handler = NewDoHHandler(func(o *Options) {
+		o.Query = func(m *dns.Msg) (*dns.Msg, error) { return nil, errors.New("timeout") }
+	})
+	var request = httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(packedQuery(t, 7)), nil)
+	var recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	var response = readResponse(t, recorder)
+	if response.Rcode != dns.RcodeServerFailure || response.Id != 7 {
+		t.Errorf("resolve errors should be answered with SERVFAIL: %v", response)
+	}
+	if cacheControl := recorder.Header().Get("Cache-Control"); cacheControl != "no-cache" {
+		t.Errorf("failures should not be cached: %s", cacheControl)
+	}
+}
+
+func TestMaxAgeOfNegativeAnswer(t *testing.T) {
+	var msg = new(dns.Msg)
+	msg.SetQuestion("missing.example.com.", dns.TypeA)
+	msg.SetRcode(msg, dns.RcodeNameError)
+	if _, ok := MaxAge(msg); ok {
+		t.Error("negative answer without SOA has no max-age")
+	}
+	msg.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600}, Minttl: 60}}
+	if maxAge, ok := MaxAge(msg); !ok || maxAge != 60 {
+		t.Errorf("negative max-age should be the SOA minimum: %d %v", maxAge, ok)
+	}
+}
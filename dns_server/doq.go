@@ -0,0 +1,164 @@
+package dns_server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// DoQ 的应用层协议名称和错误码（RFC 9250 第 4.1 节和第 4.3 节）。
+const (
+	DoQALPN                                        = "doq"
+	DoQNoError           quic.ApplicationErrorCode = 0x0
+	DoQInternalError     quic.ApplicationErrorCode = 0x1
+	DoQProtocolError     quic.ApplicationErrorCode = 0x2
+	DoQRequestCancelled  quic.StreamErrorCode      = 0x3
+	doqMaxStreamDataSize                           = 2 + dns.MaxMsgSize
+)
+
+// ErrServerClosed 表示服务器已经关闭。
+var ErrServerClosed = errors.New("dns_server: server closed")
+
+// DoQServer 是按照 RFC 9250 处理 DNS over QUIC 查询的服务器。
+// 每个查询使用一个双向流，流上是两字节长度前缀的DNS消息，查询的ID必须为0。
+type DoQServer struct {
+	Options
+	mutex    sync.Mutex
+	listener *quic.Listener
+	closed   bool
+}
+
+// NewDoQServer 创建一个DoQ服务器。
+//
+// 参数:
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的服务器。
+func NewDoQServer(options ...func(*Options)) *DoQServer {
+	var server = &DoQServer{Options: defaultOptions()}
+	for _, option := range options {
+		option(&server.Options)
+	}
+	return server
+}
+
+// ListenAndServe 在指定的UDP地址上监听并处理DoQ查询，TLS配置的应用层协议会被设置为 "doq"。
+//
+// 参数:
+// addr - 监听的地址。
+// tlsConfig - 包含证书的TLS配置。
+//
+// 返回值:
+// 服务器停止的原因，调用 Close 后返回 ErrServerClosed。
+func (s *DoQServer) ListenAndServe(addr string, tlsConfig *tls.Config) error {
+	var conf = tlsConfig.Clone()
+	conf.NextProtos = []string{DoQALPN}
+	listener, err := quic.ListenAddr(addr, conf, &quic.Config{MaxIdleTimeout: s.IdleTimeout})
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve 在已经建立的QUIC监听器上处理DoQ查询。
+func (s *DoQServer) Serve(listener *quic.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mutex.Unlock()
+	log.Println("dns_server: doq listening on", listener.Addr())
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close 关闭服务器的监听器。
+func (s *DoQServer) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// serveConn 处理一个QUIC连接上的所有查询流。
+func (s *DoQServer) serveConn(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go s.serveStream(conn, stream)
+	}
+}
+
+// serveStream 读取流上的查询，查询结束于流的结束，应答写入同一个流后结束该流。
+func (s *DoQServer) serveStream(conn *quic.Conn, stream *quic.Stream) {
+	data, err := io.ReadAll(io.LimitReader(stream, doqMaxStreamDataSize+1))
+	if err != nil {
+		stream.CancelWrite(DoQRequestCancelled)
+		return
+	}
+	msg, err := unpackDoQMessage(data)
+	if err != nil {
+		log.Println("dns_server: doq", conn.RemoteAddr(), err)
+		conn.CloseWithError(DoQProtocolError, err.Error())
+		return
+	}
+	var response = s.resolveClient(msg, conn.RemoteAddr().String())
+	/* RFC 9250 第 4.2.1 节：应答的ID也必须为0 */
+	response.Id = 0
+	packed, err := response.Pack()
+	if err != nil {
+		log.Println("dns_server: doq pack response", err)
+		stream.CancelWrite(quic.StreamErrorCode(DoQInternalError))
+		return
+	}
+	var buffer = binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packed)), uint16(len(packed)))
+	if _, err := stream.Write(append(buffer, packed...)); err != nil {
+		log.Println("dns_server: doq write response", err)
+		return
+	}
+	stream.Close()
+}
+
+// unpackDoQMessage 解析DoQ流上两字节长度前缀的查询，长度不一致或者ID不为0属于协议错误。
+func unpackDoQMessage(data []byte) (*dns.Msg, error) {
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return nil, errors.New("invalid doq message length")
+	}
+	var msg = new(dns.Msg)
+	if err := msg.Unpack(data[2:]); err != nil {
+		return nil, err
+	}
+	if msg.Id != 0 {
+		return nil, errors.New("doq message id must be 0")
+	}
+	if len(msg.Question) != 1 || msg.Response {
+		return nil, errors.New("invalid doq query")
+	}
+	return msg, nil
+}
@@ -0,0 +1,90 @@
+package dns_server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/internal/testcert"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqExchange 在一个新的流上发送两字节长度前缀的查询并读取应答。
+func doqExchange(ctx context.Context, conn *quic.Conn, msg *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...)); err != nil {
+		return nil, err
+	}
+	stream.Close()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 2 || int(binary.BigEndian.Uint16(data)) != len(data)-2 {
+		return nil, errors.New("invalid response length")
+	}
+	var response = new(dns.Msg)
+	return response, response.Unpack(data[2:])
+}
+
+func TestDoQServer(t *testing.T) {
+	serverConfig, clientConfig := testcert.Configs(t, "dns.example")
+	serverConfig.NextProtos = []string{DoQALPN}
+	listener, err := quic.ListenAddr("127.0.0.1:0", serverConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server = NewDoQServer(func(o *Options) { o.Query = answerQuery })
+	var served = make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	defer func() {
+		server.Close()
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("expected ErrServerClosed, got %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clientConfig.NextProtos = []string{DoQALPN}
+	conn, err := quic.DialAddr(ctx, listener.Addr().String(), clientConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(DoQNoError, "")
+	var msg = new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Id = 0
+	/* 一个连接上的多个查询各自使用一个流 */
+	for i := 0; i < 2; i++ {
+		response, err := doqExchange(ctx, conn, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Id != 0 || len(response.Answer) != 2 {
+			t.Errorf("unexpected response: %v", response)
+		}
+	}
+
+	/* ID不为0的查询是协议错误，服务器关闭连接 */
+	msg.Id = 1
+	if _, err := doqExchange(ctx, conn, msg); err == nil {
+		t.Error("non-zero message id should be rejected")
+	}
+	var applicationError *quic.ApplicationError
+	<-conn.Context().Done()
+	if err := context.Cause(conn.Context()); !errors.As(err, &applicationError) || applicationError.ErrorCode != DoQProtocolError {
+		t.Errorf("connection should be closed with DOQ_PROTOCOL_ERROR: %v", err)
+	}
+}
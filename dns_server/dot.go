@@ -0,0 +1,109 @@
+package dns_server
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DoTALPN 是DoT的应用层协议名称（RFC 7858 和 RFC 8310）。
+const DoTALPN = "dot"
+
+// DoTServer 是按照 RFC 7858 处理 DNS over TLS 查询的服务器，
+// 一个连接上可以发送多个两字节长度前缀的查询，连接空闲超过 IdleTimeout 后关闭。
+type DoTServer struct {
+	Options
+	mutex  sync.Mutex
+	server *dns.Server
+	closed bool
+}
+
+// NewDoTServer 创建一个DoT服务器。
+//
+// 参数:
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的服务器。
+func NewDoTServer(options ...func(*Options)) *DoTServer {
+	var server = &DoTServer{Options: defaultOptions()}
+	for _, option := range options {
+		option(&server.Options)
+	}
+	return server
+}
+
+// ListenAndServe 在指定的TCP地址上监听并处理DoT查询，TLS配置的应用层协议会被设置为 "dot"。
+//
+// 参数:
+// addr - 监听的地址。
+// tlsConfig - 包含证书的TLS配置。
+//
+// 返回值:
+// 服务器停止的原因，调用 Close 后返回 ErrServerClosed。
+func (s *DoTServer) ListenAndServe(addr string, tlsConfig *tls.Config) error {
+	var conf = tlsConfig.Clone()
+	conf.NextProtos = []string{DoTALPN}
+	listener, err := tls.Listen("tcp", addr, conf)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve 在已经建立的TLS监听器上处理DoT查询。
+func (s *DoTServer) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.server = &dns.Server{
+		Net:      "tcp-tls",
+		Listener: listener,
+		Handler:  dns.HandlerFunc(s.ServeDNS),
+		IdleTimeout: func() time.Duration {
+			return s.IdleTimeout
+		},
+	}
+	var server = s.server
+	s.mutex.Unlock()
+	log.Println("dns_server: dot listening on", listener.Addr())
+	var err = server.ActivateAndServe()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Close 关闭服务器的监听器和所有连接。
+func (s *DoTServer) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	if s.server != nil {
+		return s.server.Shutdown()
+	}
+	return nil
+}
+
+// ServeDNS 实现了 dns.Handler 接口，解析查询并写入应答。
+func (s *DoTServer) ServeDNS(w dns.ResponseWriter, msg *dns.Msg) {
+	var response *dns.Msg
+	if len(msg.Question) != 1 || msg.Response {
+		response = new(dns.Msg)
+		response.SetRcode(msg, dns.RcodeFormatError)
+	} else {
+		response = s.resolveClient(msg, w.RemoteAddr().String())
+	}
+	if err := w.WriteMsg(response); err != nil {
+		log.Println("dns_server: dot write response", w.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,48 @@
+package dns_server
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/internal/testcert"
+	"github.com/miekg/dns"
+)
+
+func TestDoTServer(t *testing.T) {
+	serverConfig, clientConfig := testcert.Configs(t, "dns.example")
+	serverConfig.NextProtos = []string{DoTALPN}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var server = NewDoTServer(func(o *Options) { o.Query = answerQuery })
+	var served = make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	defer func() {
+		server.Close()
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("expected ErrServerClosed, got %v", err)
+		}
+	}()
+
+	var client = &dns.Client{Net: "tcp-tls", TLSConfig: clientConfig}
+	conn, err := client.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	/* 一个连接上可以发送多个查询 */
+	for _, id := range []uint16{11, 12} {
+		var msg = new(dns.Msg)
+		msg.SetQuestion("example.com.", dns.TypeA)
+		msg.Id = id
+		response, _, err := client.ExchangeWithConn(msg, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Id != id || len(response.Answer) != 2 {
+			t.Errorf("unexpected response: %v", response)
+		}
+	}
+}
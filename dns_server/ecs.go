@@ -0,0 +1,83 @@
+package dns_server
+
+import (
+	"net"
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// resolveClient 解析客户端的查询。开启 ClientSubnet 并且查询中没有ECS选项时，
+// 添加按照配置的前缀长度截断的客户端地址，客户端没有发送ECS选项时应答中也不返回该选项（RFC 7871 第 7.2.2 节）。
+//
+// 参数:
+// msg - 客户端的查询。
+// remoteAddr - 客户端的地址，格式为 host:port。
+//
+// 返回值:
+// 应答，其ID与查询相同。
+func (o *Options) resolveClient(msg *dns.Msg, remoteAddr string) *dns.Msg {
+	if !o.ClientSubnet || clientSubnetOf(msg) != nil {
+		return resolve(o.Query, msg)
+	}
+	var subnet = o.clientSubnet(remoteAddr)
+	if subnet == nil {
+		return resolve(o.Query, msg)
+	}
+	var query = msg.Copy()
+	var withoutOPT = query.IsEdns0() == nil
+	if withoutOPT {
+		query.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	var opt = query.IsEdns0()
+	opt.Option = append(opt.Option, subnet)
+	var response = resolve(o.Query, query)
+	/* 客户端没有发送OPT记录时应答中也不能有OPT记录（RFC 6891 第 7 节） */
+	response.Extra = slices.DeleteFunc(response.Extra, func(rr dns.RR) bool {
+		_, ok := rr.(*dns.OPT)
+		return ok && withoutOPT
+	})
+	if opt := response.IsEdns0(); opt != nil {
+		opt.Option = slices.DeleteFunc(opt.Option, func(option dns.EDNS0) bool {
+			_, ok := option.(*dns.EDNS0_SUBNET)
+			return ok
+		})
+	}
+	return response
+}
+
+// clientSubnet 返回客户端地址截断到配置的前缀长度的ECS选项，地址无效或者不是公网地址时返回nil，
+// 内网地址对上游没有意义，也不应该泄露给上游。
+func (o *Options) clientSubnet(remoteAddr string) *dns.EDNS0_SUBNET {
+	var host, _, err = net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	var ip = net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil
+	}
+	var subnet = &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		subnet.Family = 1
+		subnet.SourceNetmask = min(o.ClientSubnetIPv4PrefixLength, 32)
+		subnet.Address = ipv4.Mask(net.CIDRMask(int(subnet.SourceNetmask), 32))
+	} else {
+		subnet.Family = 2
+		subnet.SourceNetmask = min(o.ClientSubnetIPv6PrefixLength, 128)
+		subnet.Address = ip.Mask(net.CIDRMask(int(subnet.SourceNetmask), 128))
+	}
+	return subnet
+}
+
+// clientSubnetOf 返回查询中的ECS选项，没有时返回nil。
+func clientSubnetOf(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return subnet
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package dns_server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolveClientSubnet(t *testing.T) {
+	var subnets []*dns.EDNS0_SUBNET
+	var options = Options{
+		Query: func(m *dns.Msg) (*dns.Msg, error) {
+			subnets = append(subnets, clientSubnetOf(m))
+			var r, err = answerQuery(m)
+			if subnet := clientSubnetOf(m); subnet != nil {
+				var scoped = *subnet
+				scoped.SourceScope = subnet.SourceNetmask
+				r.IsEdns0().Option = append(r.IsEdns0().Option, &scoped)
+			}
+			return r, err
+		},
+		ClientSubnet:                 true,
+		ClientSubnetIPv4PrefixLength: 24,
+		ClientSubnetIPv6PrefixLength: 48,
+	}
+
+	var msg = new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	var response = options.resolveClient(msg, "198.51.100.77:5353")
+	if subnet := subnets[0]; subnet == nil || subnet.SourceNetmask != 24 || !subnet.Address.Equal(net.ParseIP("198.51.100.0")) {
+		t.Errorf("expected truncated client subnet: %v", subnet)
+	}
+	if response.IsEdns0() != nil || msg.IsEdns0() != nil {
+		t.Errorf("client without edns should not get an opt record: %v", response)
+	}
+
+	msg.SetEdns0(1232, false)
+	response = options.resolveClient(msg, "[2001:db8:1234:5678::1]:443")
+	if subnet := subnets[1]; subnet == nil || subnet.SourceNetmask != 48 || !subnet.Address.Equal(net.ParseIP("2001:db8:1234::")) {
+		t.Errorf("expected truncated ipv6 client subnet: %v", subnet)
+	}
+	if response.IsEdns0() == nil || clientSubnetOf(response) != nil {
+		t.Errorf("added client subnet should not be returned: %v", response)
+	}
+
+	/* 客户端自己的ECS选项和内网地址不被替换 */
+	options.resolveClient(msg, "10.0.0.1:5353")
+	var own = msg.Copy()
+	own.IsEdns0().Option = append(own.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 0, Address: net.IPv4zero})
+	if response := options.resolveClient(own, "198.51.100.77:5353"); clientSubnetOf(response) == nil {
+		t.Error("client subnet sent by the client should be answered")
+	}
+	if subnets[2] != nil || subnets[3].SourceNetmask != 0 {
+		t.Errorf("unexpected client subnets: %v %v", subnets[2], subnets[3])
+	}
+}
@@ -0,0 +1,194 @@
+package ech
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+)
+
+// ErrECHRequired 表示严格模式下没有可用的 ECH 配置，或者服务器拒绝了 ECH。
+var ErrECHRequired = errors.New("ech: encrypted client hello required but not available")
+
+// Options 是 ECH 客户端的配置。
+//
+// 字段：
+// ConfigList - 获取服务器 ECHConfigList 的函数，例如 HTTPSRecordConfigList，返回空列表时不使用 ECH。
+// Strict - 严格模式，没有 ECH 配置或者服务器拒绝 ECH 时不建立连接。
+// OnResult - 每次握手完成后调用，用于报告 ECH 是否被接受。
+type Options struct {
+	ConfigList func(host string, port string) ([]byte, error)
+	Strict     bool
+	OnResult   func(Result)
+}
+
+// Result 是一次握手的 ECH 结果。
+//
+// 字段：
+// ServerName - TLS 的服务器名称。
+// Offered - 握手时是否使用了 ECH。
+// Accepted - 服务器是否接受了 ECH。
+// Retried - 服务器拒绝 ECH 后是否使用服务器提供的重试配置或者不使用 ECH 重新握手。
+type Result struct {
+	ServerName string
+	Offered    bool
+	Accepted   bool
+	Retried    bool
+}
+
+// Client 为上游的TLS和QUIC连接配置 Encrypted Client Hello，
+// 处理服务器拒绝 ECH 时返回的重试配置，并记录每个服务器最近一次的 ECH 结果。
+type Client struct {
+	Options
+	mutex        sync.Mutex
+	retryConfigs map[string][]byte
+	results      map[string]Result
+}
+
+// NewClient 创建一个 ECH 客户端。
+//
+// 参数:
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的客户端。
+func NewClient(options ...func(*Options)) *Client {
+	var client = &Client{
+		retryConfigs: map[string][]byte{},
+		results:      map[string]Result{},
+	}
+	for _, option := range options {
+		option(&client.Options)
+	}
+	return client
+}
+
+// Result 返回服务器最近一次握手的 ECH 结果。
+func (c *Client) Result(serverName string) (Result, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	result, ok := c.results[serverName]
+	return result, ok
+}
+
+// configList 返回服务器的 ECHConfigList，服务器之前提供过重试配置时优先使用重试配置。
+func (c *Client) configList(serverName string, port string) ([]byte, error) {
+	c.mutex.Lock()
+	var retry = c.retryConfigs[net.JoinHostPort(serverName, port)]
+	c.mutex.Unlock()
+	if len(retry) > 0 {
+		return retry, nil
+	}
+	if c.ConfigList == nil {
+		return nil, nil
+	}
+	return c.ConfigList(serverName, port)
+}
+
+// report 记录并报告握手的 ECH 结果。
+func (c *Client) report(result Result) {
+	c.mutex.Lock()
+	c.results[result.ServerName] = result
+	c.mutex.Unlock()
+	log.Println("ech: handshake", result.ServerName, "offered", result.Offered, "accepted", result.Accepted, "retried", result.Retried)
+	if c.OnResult != nil {
+		c.OnResult(result)
+	}
+}
+
+// Handshake 使用 ECH 建立TLS或QUIC连接。服务器拒绝 ECH 并提供重试配置时使用重试配置重新握手一次；
+// 服务器拒绝 ECH 且没有提供重试配置时，非严格模式下不使用 ECH 重新握手，严格模式下返回错误。
+// client 为nil时直接使用 tlsConf 握手。
+//
+// 参数:
+// ctx - 连接的上下文。
+// client - ECH 客户端。
+// port - 服务器的端口，用于获取 ECH 配置。
+// tlsConf - TLS配置，ServerName 必须是服务器的名称。
+// handshake - 使用给定的TLS配置建立连接并完成握手的函数。
+// state - 返回连接的TLS状态的函数。
+//
+// 返回值:
+// 建立的连接和握手时遇到的错误。
+func Handshake[T any](ctx context.Context, client *Client, port string, tlsConf *tls.Config, handshake func(ctx context.Context, tlsConf *tls.Config) (T, error), state func(T) tls.ConnectionState) (T, error) {
+	if client == nil {
+		return handshake(ctx, tlsConf)
+	}
+	var zero T
+	var serverName = tlsConf.ServerName
+	configList, err := client.configList(serverName, port)
+	if err != nil {
+		log.Println("ech: lookup config", serverName, err)
+		if client.Strict {
+			return zero, errors.Join(ErrECHRequired, err)
+		}
+	}
+	if len(configList) == 0 && client.Strict {
+		return zero, ErrECHRequired
+	}
+	var conf = tlsConf.Clone()
+	if len(configList) > 0 {
+		conf.EncryptedClientHelloConfigList = configList
+		conf.MinVersion = tls.VersionTLS13
+	}
+	var result = Result{ServerName: serverName, Offered: len(configList) > 0}
+	conn, err := handshake(ctx, conf)
+	var rejection *tls.ECHRejectionError
+	if err != nil && result.Offered && errors.As(err, &rejection) {
+		result.Retried = true
+		if len(rejection.RetryConfigList) > 0 {
+			/* 服务器的 ECH 密钥已经更换，记住服务器提供的重试配置 */
+			client.mutex.Lock()
+			client.retryConfigs[net.JoinHostPort(serverName, port)] = rejection.RetryConfigList
+			client.mutex.Unlock()
+			conf.EncryptedClientHelloConfigList = rejection.RetryConfigList
+		} else if client.Strict {
+			client.report(result)
+			return zero, errors.Join(ErrECHRequired, err)
+		} else {
+			/* 服务器安全地关闭了 ECH，不使用 ECH 重新握手 */
+			conf = tlsConf.Clone()
+			result.Offered = false
+		}
+		log.Println("ech: server rejected ech, retrying", serverName, "retry configs", len(rejection.RetryConfigList) > 0)
+		conn, err = handshake(ctx, conf)
+		if err != nil && errors.As(err, &rejection) && client.Strict {
+			err = errors.Join(ErrECHRequired, err)
+		}
+	}
+	if err != nil {
+		return zero, err
+	}
+	result.Accepted = state(conn).ECHAccepted
+	client.report(result)
+	return conn, nil
+}
+
+// HTTPSRecordConfigList 返回从服务器的 HTTPS 记录中获取 ECHConfigList 的函数，可以作为 Options.ConfigList。
+//
+// 参数:
+// lookup - 解析 HTTPS 记录的函数，参见 dns.ResolveServiceEndpoints。
+func HTTPSRecordConfigList(lookup func(host string, port int) ([]dns_experiment.ServiceEndpoint, error)) func(host string, port string) ([]byte, error) {
+	return func(host string, port string) ([]byte, error) {
+		portNumber, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+		endpoints, err := lookup(host, portNumber)
+		if err != nil {
+			return nil, err
+		}
+		/* 按照优先级使用第一个发布了 ECH 配置的端点 */
+		for _, endpoint := range endpoints {
+			if len(endpoint.ECH) > 0 {
+				return endpoint.ECH, nil
+			}
+		}
+		return nil, nil
+	}
+}
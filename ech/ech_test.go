@@ -0,0 +1,190 @@
+package ech
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// echKey 生成一个 X25519 的 ECH 密钥，返回服务器的密钥和只包含该配置的 ECHConfigList。
+func echKey(t *testing.T, configID uint8) (tls.EncryptedClientHelloKey, []byte) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var publicKey = key.PublicKey().Bytes()
+	var publicName = "public.example"
+	/* ECHConfigContents: config_id, kem_id, public_key, cipher_suites, maximum_name_length, public_name, extensions */
+	var contents = []byte{configID, 0x00, 0x20}
+	contents = binary.BigEndian.AppendUint16(contents, uint16(len(publicKey)))
+	contents = append(contents, publicKey...)
+	contents = append(contents, 0x00, 0x04, 0x00, 0x01, 0x00, 0x01)
+	contents = append(contents, 0x00, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = append(contents, 0x00, 0x00)
+	var config = []byte{0xfe, 0x0d}
+	config = binary.BigEndian.AppendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+	var list = binary.BigEndian.AppendUint16(nil, uint16(len(config)))
+	list = append(list, config...)
+	return tls.EncryptedClientHelloKey{Config: config, PrivateKey: key.Bytes(), SendAsRetry: true}, list
+}
+
+// testServer 启动一个使用给定 ECH 密钥的TLS服务器，返回地址和信任服务器证书的根证书池。
+func testServer(t *testing.T, keys []tls.EncryptedClientHelloKey) (string, *x509.CertPool) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template = &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "upstream.example"},
+		DNSNames:     []string{"upstream.example", "public.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pool = x509.NewCertPool()
+	pool.AddCert(certificate)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates:             []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: privateKey}},
+		EncryptedClientHelloKeys: keys,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return listener.Addr().String(), pool
+}
+
+// handshake 返回连接测试服务器并完成TLS握手的函数。
+func handshake(t *testing.T, address string) func(ctx context.Context, conf *tls.Config) (*tls.Conn, error) {
+	return func(ctx context.Context, conf *tls.Config) (*tls.Conn, error) {
+		var dialer tls.Dialer
+		dialer.Config = conf
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn.(*tls.Conn), nil
+	}
+}
+
+func TestHandshakeAcceptsECH(t *testing.T) {
+	key, configList := echKey(t, 1)
+	address, pool := testServer(t, []tls.EncryptedClientHelloKey{key})
+	var results []Result
+	var client = NewClient(func(o *Options) {
+		o.ConfigList = func(host string, port string) ([]byte, error) { return configList, nil }
+		o.OnResult = func(r Result) { results = append(results, r) }
+	})
+	conn, err := Handshake(context.Background(), client, "443", &tls.Config{ServerName: "upstream.example", RootCAs: pool}, handshake(t, address), (*tls.Conn).ConnectionState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conn.ConnectionState().ECHAccepted {
+		t.Error("ech should be accepted")
+	}
+	if len(results) != 1 || !results[0].Offered || !results[0].Accepted || results[0].Retried {
+		t.Errorf("unexpected results: %+v", results)
+	}
+	if result, ok := client.Result("upstream.example"); !ok || !result.Accepted {
+		t.Errorf("result should be recorded: %+v", result)
+	}
+}
+
+func TestHandshakeUsesRetryConfigs(t *testing.T) {
+	key, _ := echKey(t, 1)
+	_, staleConfigList := echKey(t, 2)
+	address, pool := testServer(t, []tls.EncryptedClientHelloKey{key})
+	var lookups int
+	var client = NewClient(func(o *Options) {
+		o.Strict = true
+		o.ConfigList = func(host string, port string) ([]byte, error) {
+			lookups++
+			return staleConfigList, nil
+		}
+	})
+	var conf = &tls.Config{ServerName: "upstream.example", RootCAs: pool}
+	for i := 0; i < 2; i++ {
+		conn, err := Handshake(context.Background(), client, "443", conf, handshake(t, address), (*tls.Conn).ConnectionState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !conn.ConnectionState().ECHAccepted {
+			t.Error("ech should be accepted with the retry configs")
+		}
+	}
+	result, _ := client.Result("upstream.example")
+	/* 第二次连接直接使用保存的重试配置 */
+	if lookups != 1 || result.Retried {
+		t.Errorf("retry configs should be remembered: lookups %d result %+v", lookups, result)
+	}
+}
+
+func TestHandshakeWithoutECH(t *testing.T) {
+	address, pool := testServer(t, nil)
+	_, configList := echKey(t, 1)
+	var conf = &tls.Config{ServerName: "upstream.example", RootCAs: pool}
+
+	/* 没有 ECH 配置时，严格模式不建立连接 */
+	var strict = NewClient(func(o *Options) { o.Strict = true })
+	if _, err := Handshake(context.Background(), strict, "443", conf, handshake(t, address), (*tls.Conn).ConnectionState); !errors.Is(err, ErrECHRequired) {
+		t.Errorf("expected ErrECHRequired, got %v", err)
+	}
+
+	/* 服务器不支持 ECH 时不会提供重试配置，非严格模式下不使用 ECH 重新握手 */
+	var client = NewClient(func(o *Options) {
+		o.ConfigList = func(host string, port string) ([]byte, error) { return configList, nil }
+	})
+	conn, err := Handshake(context.Background(), client, "443", conf, handshake(t, address), (*tls.Conn).ConnectionState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.ConnectionState().ECHAccepted {
+		t.Error("ech should not be accepted")
+	}
+	if result, _ := client.Result("upstream.example"); result.Offered || !result.Retried {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	strict.ConfigList = client.ConfigList
+	if _, err := Handshake(context.Background(), strict, "443", conf, handshake(t, address), (*tls.Conn).ConnectionState); !errors.Is(err, ErrECHRequired) {
+		t.Errorf("strict mode should not fall back without ech: %v", err)
+	}
+
+	/* 没有 ECH 客户端时直接握手 */
+	if _, err := Handshake(context.Background(), nil, "443", conf, handshake(t, address), (*tls.Conn).ConnectionState); err != nil {
+		t.Fatal(err)
+	}
+}
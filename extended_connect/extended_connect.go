@@ -0,0 +1,30 @@
+// Package extended_connect 启用 HTTP/2 的扩展 CONNECT 协议（RFC 8441）。
+//
+// 标准库 net/http 和 golang.org/x/net/http2 默认关闭扩展 CONNECT，只在初始化时读取 GODEBUG 环境变量中的
+// http2xconnect=1 来开启，因此本包只依赖 os 和 strings，并在它们的 init 之前修改环境变量。
+// Go 按照导入路径的字典序初始化已经就绪的包，github.com 下的本包总是先于 golang.org 和 net/http 初始化。
+// 这个设置不是运行时登记的 GODEBUG 设置，工具链会拒绝 //go:debug http2xconnect=1 指令和 go.mod 的 godebug 块，
+// 而且两者只读取环境变量，所以只能在初始化时修改环境变量。
+// 使用方式是在 main 包中匿名导入本包，并在启动时调用 websocket_proxy.CheckExtendedConnect 确认设置已经生效。
+package extended_connect
+
+import (
+	"os"
+	"strings"
+)
+
+// GODEBUGSetting 是开启 HTTP/2 扩展 CONNECT 协议的 GODEBUG 设置。
+const GODEBUGSetting = "http2xconnect=1"
+
+func init() {
+	var value = os.Getenv("GODEBUG")
+	if strings.Contains(value, "http2xconnect=") {
+		/* 尊重用户显式的设置 */
+		return
+	}
+	if value == "" {
+		os.Setenv("GODEBUG", GODEBUGSetting)
+	} else {
+		os.Setenv("GODEBUG", value+","+GODEBUGSetting)
+	}
+}
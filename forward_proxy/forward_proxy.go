@@ -0,0 +1,244 @@
+package forward_proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/acl"
+	h12_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/h12"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/tunnel"
+)
+
+// ErrTargetNotAllowed 表示CONNECT的目标地址被访问控制列表拒绝。
+var ErrTargetNotAllowed = errors.New("forward_proxy: target not allowed")
+
+// Options 是正向代理的配置。
+//
+// 字段：
+// AllowList - 允许访问的目标地址列表，为空时拒绝所有目标。
+// DenyList - 拒绝访问的目标地址列表，优先于 AllowList。
+// Username - 代理认证的用户名，为空时不要求认证。
+// Password - 代理认证的密码。
+// Realm - 代理认证的领域名称。
+// IdleTimeout - 隧道的空闲超时时间，小于等于0时不限制。
+// LookupIP - 解析目标主机的函数，默认使用系统解析器。
+type Options struct {
+	AllowList   []acl.Rule
+	DenyList    []acl.Rule
+	Username    string
+	Password    string
+	Realm       string
+	IdleTimeout time.Duration
+	LookupIP    func(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// Proxy 是处理 CONNECT 请求的正向代理，支持HTTP/1.1、HTTP/2和HTTP/3。
+// HTTP/1.1 下通过劫持连接建立隧道，HTTP/2 和 HTTP/3 下在请求流上建立隧道。
+type Proxy struct {
+	Options
+}
+
+// NewProxy 创建一个正向代理。
+//
+// 参数:
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的代理。
+func NewProxy(options ...func(*Options)) *Proxy {
+	var proxy = &Proxy{
+		Options: Options{
+			Realm:       "proxy",
+			IdleTimeout: 5 * time.Minute,
+			LookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+				return net.DefaultResolver.LookupIP(ctx, "ip", host)
+			},
+		},
+	}
+	for _, option := range options {
+		option(&proxy.Options)
+	}
+	return proxy
+}
+
+// IsConnect 判断请求是否为普通的 CONNECT 请求，扩展CONNECT请求（带有 :protocol 伪头部）不包括在内。
+func IsConnect(r *http.Request) bool {
+	if r.Method != http.MethodConnect {
+		return false
+	}
+	switch r.ProtoMajor {
+	case 2:
+		return r.Header.Get(":protocol") == ""
+	case 3:
+		/* quic-go 将扩展CONNECT的 :protocol 伪头部保存在 Proto 字段中 */
+		return r.Proto == "HTTP/3.0"
+	}
+	return true
+}
+
+// authorized 校验 Proxy-Authorization 头部中的 Basic 认证信息。
+func (p *Proxy) authorized(r *http.Request) bool {
+	if p.Username == "" {
+		return true
+	}
+	scheme, credentials, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(p.Username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(p.Password)) == 1
+}
+
+// resolve 解析目标主机，返回所有被访问控制列表允许的IP地址。
+// 拒绝列表匹配任意规则即拒绝，允许列表默认拒绝回环、私有网络和链路本地地址，
+// 防止公网主机名解析到内部地址时绕过访问控制。
+func (p *Proxy) resolve(ctx context.Context, host string, port int) ([]string, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		var err error
+		ips, err = p.LookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var allowed []string
+	for _, ip := range ips {
+		if acl.Match(p.DenyList, host, ip, port) {
+			continue
+		}
+		if acl.Allowed(p.AllowList, host, ip, port) {
+			allowed = append(allowed, ip.String())
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, ErrTargetNotAllowed
+	}
+	return allowed, nil
+}
+
+// Dial 检查访问控制列表后，使用 h12 包的自定义IP拨号逻辑连接目标地址，
+// 目标主机解析到多个地址时按照 RFC 8305 交替地址族依次尝试。
+//
+// 参数:
+// ctx - 拨号的上下文。
+// address - 目标地址，格式为 主机:端口。
+//
+// 返回值:
+// 与目标地址建立的TCP连接和拨号时遇到的错误，目标被拒绝时返回 ErrTargetNotAllowed。
+func (p *Proxy) Dial(ctx context.Context, address string) (net.Conn, error) {
+	_, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, errors.New("forward_proxy: invalid port " + portString)
+	}
+	return h12_experiment.CreateTCPDialerWithIPGetter(func(host string) ([]string, error) {
+		return p.resolve(ctx, host, port)
+	})(ctx, "tcp", address)
+}
+
+// ServeHTTP 实现了 http.Handler 接口，处理 CONNECT 请求并建立隧道。
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsConnect(r) {
+		http.Error(w, "forward_proxy: expected CONNECT request", http.StatusMethodNotAllowed)
+		return
+	}
+	if !p.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", "Basic realm="+strconv.Quote(p.Realm))
+		http.Error(w, "forward_proxy: proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	var address = r.Host
+	if r.ProtoMajor == 1 && r.RequestURI != "" {
+		address = r.RequestURI
+	}
+	upstream, err := p.Dial(r.Context(), address)
+	if errors.Is(err, ErrTargetNotAllowed) {
+		log.Println("forward_proxy: target not allowed", address)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Println("forward_proxy: dial target", address, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	var downstream io.ReadWriteCloser
+	if r.ProtoMajor == 1 {
+		downstream, err = hijack(w)
+		if err != nil {
+			upstream.Close()
+			log.Println("forward_proxy: hijack", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			upstream.Close()
+			http.Error(w, "forward_proxy: response writer does not support flushing", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		downstream = &tunnel.StreamConn{Body: r.Body, Writer: w, Flusher: flusher}
+	}
+
+	var start = time.Now()
+	stats, err := tunnel.Pipe(downstream, upstream, p.IdleTimeout)
+	log.Println("forward_proxy: tunnel closed", r.Proto, r.RemoteAddr, address,
+		"client->target", stats.LeftToRight, "target->client", stats.RightToLeft,
+		"idle timeout", stats.IdleTimeout, "duration", time.Since(start), "error", err)
+}
+
+// bufferedConn 在读取连接之前先读取劫持时已经被缓冲的数据。
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// hijack 接管HTTP/1.1连接并向客户端返回200响应。
+func hijack(w http.ResponseWriter) (io.ReadWriteCloser, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("forward_proxy: response writer does not support hijacking")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := buffered.WriteString("HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := buffered.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &bufferedConn{Conn: conn, reader: buffered.Reader}, nil
+}
@@ -0,0 +1,228 @@
+package forward_proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/acl"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newTCPEcho 启动一个原样回显数据的TCP服务器。
+func newTCPEcho(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// newTestProxy 创建只允许访问 echo 服务器的正向代理。
+func newTestProxy(t *testing.T, echo net.Listener, options ...func(*Options)) *Proxy {
+	rules, err := acl.Parse(echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewProxy(append([]func(*Options){func(o *Options) {
+		o.AllowList = rules
+		o.IdleTimeout = time.Second
+	}}, options...)...)
+}
+
+// connectHTTP1 通过HTTP/1.1向代理发送CONNECT请求。
+func connectHTTP1(t *testing.T, proxyAddress string, target string, header string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n" + header + "\r\n"))
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, response
+}
+
+func TestConnectHTTP1(t *testing.T) {
+	echo := newTCPEcho(t)
+	proxy := httptest.NewServer(newTestProxy(t, echo, func(o *Options) {
+		o.Username = "user"
+		o.Password = "secret"
+	}))
+	defer proxy.Close()
+	var address = proxy.Listener.Addr().String()
+
+	conn, _, response := connectHTTP1(t, address, echo.Addr().String(), "")
+	conn.Close()
+	if response.StatusCode != http.StatusProxyAuthRequired || response.Header.Get("Proxy-Authenticate") == "" {
+		t.Errorf("expected proxy authentication, got status %d", response.StatusCode)
+	}
+
+	var authorization = "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret")) + "\r\n"
+	conn, _, response = connectHTTP1(t, address, "127.0.0.1:9", authorization)
+	conn.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("expected forbidden target, got status %d", response.StatusCode)
+	}
+
+	conn, reader, response := connectHTTP1(t, address, echo.Addr().String(), authorization)
+	defer conn.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", response.StatusCode)
+	}
+	conn.Write([]byte("hello"))
+	var buf = make([]byte, 5)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected echo: %q", buf)
+	}
+}
+
+func TestConnectHTTP3(t *testing.T) {
+	echo := newTCPEcho(t)
+	proxy := newTestProxy(t, echo)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* 借用 httptest 的自签名证书 */
+	certificate := httptest.NewTLSServer(nil)
+	certificate.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate.Certificate())
+	server := &http3.Server{
+		Handler:   proxy,
+		TLSConfig: http3.ConfigureTLSConfig(certificate.TLS.Clone()),
+	}
+	go server.Serve(udpConn)
+	defer udpConn.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, udpConn.LocalAddr().String(), &tls.Config{RootCAs: pool, NextProtos: []string{http3.NextProtoH3}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	stream, err := (&http3.Transport{}).NewClientConn(conn).OpenRequestStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var target = echo.Addr().String()
+	if err := stream.SendRequestHeader(&http.Request{
+		Method: http.MethodConnect,
+		Host:   target,
+		Header: http.Header{},
+		URL:    &url.URL{Host: target},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	response, err := stream.ReadResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", response.StatusCode)
+	}
+	stream.Write([]byte("hello"))
+	var buf = make([]byte, 5)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected echo: %q", buf)
+	}
+	stream.Close()
+}
+
+func TestResolveRestricted(t *testing.T) {
+	allowList, err := acl.Parse("*:443, 10.0.0.0/8:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	denyList, err := acl.Parse("*.blocked.test:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(func(o *Options) {
+		o.AllowList = allowList
+		o.DenyList = denyList
+		o.LookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+			return map[string][]net.IP{
+				"rebind.test":    {net.ParseIP("127.0.0.1"), net.ParseIP("192.0.2.1")},
+				"internal.test":  {net.ParseIP("192.168.0.1"), net.ParseIP("fe80::1")},
+				"ten.test":       {net.ParseIP("10.0.0.1")},
+				"a.blocked.test": {net.ParseIP("10.0.0.1")},
+			}[host], nil
+		}
+	})
+	for _, c := range []struct {
+		host     string
+		expected []string
+	}{
+		/* 解析到内部地址的主机名只保留公网地址 */
+		{"rebind.test", []string{"192.0.2.1"}},
+		{"internal.test", nil},
+		{"127.0.0.1", nil},
+		/* 显式的网段规则可以允许内部地址，拒绝列表仍然优先 */
+		{"ten.test", []string{"10.0.0.1"}},
+		{"a.blocked.test", nil},
+	} {
+		addresses, err := proxy.resolve(context.Background(), c.host, 443)
+		if c.expected == nil {
+			if err != ErrTargetNotAllowed {
+				t.Errorf("%s: expected target not allowed, got %v %v", c.host, addresses, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(addresses, c.expected) {
+			t.Errorf("%s: unexpected addresses %v %v", c.host, addresses, err)
+		}
+	}
+}
+
+func TestIsConnect(t *testing.T) {
+	req := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	if !IsConnect(req) {
+		t.Error("http1 connect not detected")
+	}
+	req.ProtoMajor = 2
+	req.Header.Set(":protocol", "websocket")
+	if IsConnect(req) {
+		t.Error("extended connect detected as connect")
+	}
+	req.ProtoMajor = 3
+	req.Proto = "connect-udp"
+	if IsConnect(req) {
+		t.Error("connect-udp detected as connect")
+	}
+}
@@ -0,0 +1,269 @@
+package forwarded
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+)
+
+// Element 表示 Forwarded 头部 (RFC 7239) 中的一个 forwarded-element。
+//
+// 字段：
+// For - 发起请求的客户端节点标识。
+// By - 接收请求的代理节点标识。
+// Host - 原始请求的 Host 头部。
+// Proto - 原始请求使用的协议（http 或 https）。
+// Extensions - 除上述四个参数以外的扩展参数，按出现顺序保存。
+type Element struct {
+	For        string
+	By         string
+	Host       string
+	Proto      string
+	Extensions []generic.PairInterface[string, string]
+}
+
+// String 将转发元素序列化为符合 RFC 7239 的字符串，必要时对参数值加引号。
+func (e Element) String() string {
+	var pairs []string
+	if e.For != "" {
+		pairs = append(pairs, "for="+QuoteValue(e.For))
+	}
+	if e.By != "" {
+		pairs = append(pairs, "by="+QuoteValue(e.By))
+	}
+	if e.Host != "" {
+		pairs = append(pairs, "host="+QuoteValue(e.Host))
+	}
+	if e.Proto != "" {
+		pairs = append(pairs, "proto="+QuoteValue(e.Proto))
+	}
+	for _, extension := range e.Extensions {
+		pairs = append(pairs, extension.GetFirst()+"="+QuoteValue(extension.GetSecond()))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// Format 将多个转发元素序列化为一个 Forwarded 头部的值，元素之间使用 ", " 分隔。
+func Format(elements []Element) string {
+	var parts = make([]string, 0, len(elements))
+	for _, element := range elements {
+		parts = append(parts, element.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// isTchar 判断字符是否属于 RFC 7230 中定义的 token 字符。
+func isTchar(c byte) bool {
+	if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// isToken 判断字符串是否为非空的 token。
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTchar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// QuoteValue 在参数值不是合法 token 时将其转换为 quoted-string，
+// 例如包含冒号的 IPv6 地址或带端口的节点标识。
+func QuoteValue(value string) string {
+	if isToken(value) {
+		return value
+	}
+	var builder strings.Builder
+	builder.WriteByte('"')
+	for i := 0; i < len(value); i++ {
+		if value[i] == '"' || value[i] == '\\' {
+			builder.WriteByte('\\')
+		}
+		builder.WriteByte(value[i])
+	}
+	builder.WriteByte('"')
+	return builder.String()
+}
+
+// FormatNode 按照 RFC 7239 第 6 节构造节点标识。
+// IPv6 地址会被放入方括号中，port 为空时省略端口部分。
+func FormatNode(host string, port string) string {
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + ip.String() + "]"
+	}
+	if port == "" {
+		return host
+	}
+	return host + ":" + port
+}
+
+// ParseNode 将节点标识拆分为主机和端口，能够处理带方括号的 IPv6 地址。
+func ParseNode(node string) (host string, port string) {
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return node, ""
+		}
+		host = node[1:end]
+		if rest := node[end+1:]; strings.HasPrefix(rest, ":") {
+			port = rest[1:]
+		}
+		return host, port
+	}
+	if index := strings.LastIndexByte(node, ':'); index >= 0 {
+		return node[:index], node[index+1:]
+	}
+	return node, ""
+}
+
+// parser 是 Forwarded 头部的解析器状态。
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) skipWhitespace() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *parser) token() string {
+	start := p.pos
+	for p.pos < len(p.input) && isTchar(p.input[p.pos]) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *parser) quotedString() (string, error) {
+	// 跳过起始的引号
+	p.pos++
+	var builder strings.Builder
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return builder.String(), nil
+		case '\\':
+			if p.pos+1 >= len(p.input) {
+				return "", errors.New("forwarded: unterminated quoted-pair")
+			}
+			builder.WriteByte(p.input[p.pos+1])
+			p.pos += 2
+		default:
+			builder.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", errors.New("forwarded: unterminated quoted-string")
+}
+
+func (p *parser) value() (string, error) {
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		return p.quotedString()
+	}
+	value := p.token()
+	if value == "" {
+		return "", errors.New("forwarded: empty parameter value at offset " + strconv.Itoa(p.pos))
+	}
+	return value, nil
+}
+
+// Parse 按照 RFC 7239 的语法解析一个或多个 Forwarded 头部的值。
+// 参数值可以是 token 或 quoted-string，quoted-string 中的逗号和分号不会被当作分隔符。
+// 返回值: 按顺序排列的转发元素切片，以及遇到语法错误时的错误信息。
+func Parse(headerValues []string) ([]Element, error) {
+	var elements []Element
+	for _, headerValue := range headerValues {
+		p := &parser{input: headerValue}
+		for {
+			p.skipWhitespace()
+			if p.pos >= len(p.input) {
+				break
+			}
+			element, err := p.element()
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, element)
+			p.skipWhitespace()
+			if p.pos >= len(p.input) {
+				break
+			}
+			if p.input[p.pos] != ',' {
+				return nil, errors.New("forwarded: unexpected character '" + string(p.input[p.pos]) + "' at offset " + strconv.Itoa(p.pos))
+			}
+			p.pos++
+		}
+	}
+	return elements, nil
+}
+
+// element 解析一个由分号分隔的 forwarded-element。
+func (p *parser) element() (Element, error) {
+	var element Element
+	var seen = map[string]bool{}
+	for {
+		p.skipWhitespace()
+		if p.pos < len(p.input) && p.input[p.pos] != ';' && p.input[p.pos] != ',' {
+			name := p.token()
+			if name == "" {
+				return element, errors.New("forwarded: invalid parameter name at offset " + strconv.Itoa(p.pos))
+			}
+			if p.pos >= len(p.input) || p.input[p.pos] != '=' {
+				return element, errors.New("forwarded: missing '=' after parameter " + name)
+			}
+			p.pos++
+			value, err := p.value()
+			if err != nil {
+				return element, err
+			}
+			var key = strings.ToLower(name)
+			if seen[key] {
+				return element, errors.New("forwarded: duplicate parameter " + key + " in one element")
+			}
+			seen[key] = true
+			switch key {
+			case "for":
+				element.For = value
+			case "by":
+				element.By = value
+			case "host":
+				element.Host = value
+			case "proto":
+				element.Proto = value
+			default:
+				element.Extensions = append(element.Extensions, generic.NewPairImplement(key, value))
+			}
+			p.skipWhitespace()
+		}
+		if p.pos < len(p.input) && p.input[p.pos] == ';' {
+			p.pos++
+			continue
+		}
+		return element, nil
+	}
+}
+
+// NewInstanceID 生成一个随机的代理实例标识，格式为 "_" 加 16 个十六进制字符，
+// 符合 RFC 7239 第 6.3 节的混淆标识符语法，可同时用于 Forwarded 的 by= 参数和 Via 头部。
+func NewInstanceID() string {
+	var buf = make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return "_" + hex.EncodeToString(buf)
+}
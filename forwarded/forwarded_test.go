@@ -0,0 +1,202 @@
+package forwarded
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseQuotedValues(t *testing.T) {
+	elements, err := Parse([]string{
+		`for="[2001:db8::1]:4711";by=_proxy1;proto=https, for=192.0.2.60;host="example.com,x";secret="a\"b"`,
+		`For=unknown`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elements) != 3 {
+		t.Fatalf("expected 3 elements, got %d", len(elements))
+	}
+	if elements[0].For != "[2001:db8::1]:4711" || elements[0].By != "_proxy1" || elements[0].Proto != "https" {
+		t.Errorf("unexpected first element: %+v", elements[0])
+	}
+	if elements[1].Host != "example.com,x" {
+		t.Errorf("unexpected host: %q", elements[1].Host)
+	}
+	if len(elements[1].Extensions) != 1 || elements[1].Extensions[0].GetSecond() != `a"b` {
+		t.Errorf("unexpected extensions: %+v", elements[1].Extensions)
+	}
+	if elements[2].For != "unknown" {
+		t.Errorf("unexpected third element: %+v", elements[2])
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, value := range []string{
+		`for=`,
+		`for="unterminated`,
+		`for=a;for=b`,
+		`for`,
+		`for=a b`,
+	} {
+		if _, err := Parse([]string{value}); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	var elements = []Element{
+		{For: FormatNode("2001:db8::1", ""), By: "_proxy", Host: "example.com:8443", Proto: "https"},
+		{For: FormatNode("192.0.2.1", "")},
+	}
+	var header = Format(elements)
+	if header != `for="[2001:db8::1]";by=_proxy;host="example.com:8443";proto=https, for=192.0.2.1` {
+		t.Fatalf("unexpected header: %s", header)
+	}
+	parsed, err := Parse([]string{header})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 || parsed[0].For != "[2001:db8::1]" || parsed[0].Host != "example.com:8443" {
+		t.Errorf("unexpected round trip result: %+v", parsed)
+	}
+	if host, port := ParseNode(parsed[0].For); host != "2001:db8::1" || port != "" {
+		t.Errorf("unexpected node: %s %s", host, port)
+	}
+}
+
+func TestApplyTrustPolicy(t *testing.T) {
+	trusted, err := ParseCIDRList("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var options = &Options{
+		TrustedProxies:  trusted,
+		TrustedAction:   ActionAppend,
+		UntrustedAction: ActionDiscard,
+		EmitXForwarded:  true,
+		ProxyIdentifier: "_edge",
+	}
+
+	var newRequest = func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("Forwarded", "for=198.51.100.7;by=_upstream")
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		req.Header.Set("X-Forwarded-Host", "origin.example")
+		req.Header.Set("Via", "1.1 _spoofed")
+		return req
+	}
+
+	req := newRequest()
+	if err := Apply(req, "10.1.2.3", options); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Forwarded"); got != "for=198.51.100.7;by=_upstream, for=10.1.2.3;by=_edge;host=example.com;proto=http" {
+		t.Errorf("unexpected trusted Forwarded: %s", got)
+	}
+	if got := req.Header.Get("X-Forwarded-For"); got != "198.51.100.7, 10.1.2.3" {
+		t.Errorf("unexpected trusted X-Forwarded-For: %s", got)
+	}
+	if got := req.Header.Get("X-Forwarded-Host"); got != "origin.example" {
+		t.Errorf("unexpected trusted X-Forwarded-Host: %s", got)
+	}
+
+	req = newRequest()
+	if err := Apply(req, "2001:db8::9", options); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Forwarded"); got != `for="[2001:db8::9]";by=_edge;host=example.com;proto=http` {
+		t.Errorf("unexpected untrusted Forwarded: %s", got)
+	}
+	if got := req.Header.Get("X-Forwarded-For"); got != "2001:db8::9" {
+		t.Errorf("unexpected untrusted X-Forwarded-For: %s", got)
+	}
+	if got := req.Header.Get("X-Forwarded-Host"); got != "example.com" {
+		t.Errorf("unexpected untrusted X-Forwarded-Host: %s", got)
+	}
+	/* 不受信任的对端传入的 Via 条目被丢弃，只保留本代理的条目 */
+	AppendVia(req, "_edge")
+	if got := req.Header.Values("Via"); len(got) != 1 || got[0] != "1.1 _edge" {
+		t.Errorf("unexpected untrusted Via: %v", got)
+	}
+
+	options.TrustedAction = ActionKeep
+	req = newRequest()
+	if err := Apply(req, "192.0.2.1", options); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Forwarded"); got != "for=198.51.100.7;by=_upstream" {
+		t.Errorf("unexpected kept Forwarded: %s", got)
+	}
+}
+
+func TestApplyInvalidHeader(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Forwarded", `for="broken`)
+	var options = &Options{TrustedAction: ActionAppend, UntrustedAction: ActionDiscard, ProxyIdentifier: "_edge"}
+	if err := Apply(req, "127.0.0.1", options); err == nil {
+		t.Fatal("expected parse error")
+	}
+	if got := req.Header.Get("Forwarded"); got != `for="broken` {
+		t.Errorf("header should be unchanged, got %s", got)
+	}
+}
+
+func TestInspectLoop(t *testing.T) {
+	var id = NewInstanceID()
+	if len(id) != 17 || id[0] != '_' {
+		t.Fatalf("unexpected instance id: %s", id)
+	}
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	var options = &Options{TrustedProxies: []*net.IPNet{trusted}, TrustedAction: ActionAppend, UntrustedAction: ActionDiscard, ProxyIdentifier: id}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Forwarded", "for=192.0.2.1;by=_a, for=192.0.2.2;by=_b")
+	req.Header.Set("Via", "1.1 _a (comment, with comma), 2 _b")
+	info, err := InspectLoop(req, "10.0.0.1", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContainsSelf || info.Hops != 2 {
+		t.Errorf("unexpected loop info: %+v", info)
+	}
+
+	AppendVia(req, id)
+	if got := req.Header.Get("Via"); got != "1.1 _a (comment, with comma), 2 _b, 1.1 "+id {
+		t.Errorf("unexpected Via: %s", got)
+	}
+	info, err = InspectLoop(req, "10.0.0.1", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ContainsSelf || info.Hops != 3 {
+		t.Errorf("expected loop through Via, got %+v", info)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Forwarded", "for=192.0.2.1;by="+id)
+	if info, err = InspectLoop(req, "10.0.0.1", options); err != nil || !info.ContainsSelf {
+		t.Errorf("expected loop through Forwarded, got %+v %v", info, err)
+	}
+
+	/* 多个代理使用 unknown 或者相同的混淆标识不是环路 */
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Forwarded", "for=192.0.2.1;by=unknown, for=192.0.2.2;by=unknown, for=192.0.2.3;by=_x, for=192.0.2.4;by=_x")
+	if info, err = InspectLoop(req, "10.0.0.1", options); err != nil || info.ContainsSelf || info.Hops != 4 {
+		t.Errorf("duplicate by should not be a loop, got %+v %v", info, err)
+	}
+
+	/* 不受信任的对端的转发头部会被丢弃，不计入跳数，无法解析时也不报错 */
+	if info, err = InspectLoop(req, "192.0.2.9", options); err != nil || info.Hops != 0 {
+		t.Errorf("untrusted headers should not count, got %+v %v", info, err)
+	}
+	req.Header.Set("Forwarded", `for="broken`)
+	if _, err = InspectLoop(req, "192.0.2.9", options); err != nil {
+		t.Errorf("discarded header should not be parsed, got %v", err)
+	}
+	if _, err = InspectLoop(req, "10.0.0.1", options); err == nil {
+		t.Error("expected parse error for trusted proxy")
+	}
+}
@@ -0,0 +1,118 @@
+package forwarded
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ViaEntry 表示 Via 头部 (RFC 9110 第 7.6.3 节) 中的一个条目。
+//
+// 字段：
+// Protocol - 接收请求时使用的协议版本，例如 "1.1" 或 "HTTP/2"。
+// ReceivedBy - 中间节点的主机名或假名。
+type ViaEntry struct {
+	Protocol   string
+	ReceivedBy string
+}
+
+// ParseVia 解析一个或多个 Via 头部的值，忽略条目中的注释部分。
+// 注释中的逗号不会被当作分隔符。
+func ParseVia(headerValues []string) []ViaEntry {
+	var entries []ViaEntry
+	for _, headerValue := range headerValues {
+		var depth = 0
+		var start = 0
+		var parts []string
+		for i := 0; i < len(headerValue); i++ {
+			switch headerValue[i] {
+			case '(':
+				depth++
+			case ')':
+				if depth > 0 {
+					depth--
+				}
+			case ',':
+				if depth == 0 {
+					parts = append(parts, headerValue[start:i])
+					start = i + 1
+				}
+			}
+		}
+		parts = append(parts, headerValue[start:])
+		for _, part := range parts {
+			if index := strings.IndexByte(part, '('); index >= 0 {
+				part = part[:index]
+			}
+			fields := strings.Fields(part)
+			if len(fields) < 2 {
+				continue
+			}
+			entries = append(entries, ViaEntry{Protocol: fields[0], ReceivedBy: fields[1]})
+		}
+	}
+	return entries
+}
+
+// viaProtocol 根据请求的协议版本返回写入 Via 头部的 received-protocol。
+func viaProtocol(req *http.Request) string {
+	if req.ProtoMajor >= 2 {
+		return strconv.Itoa(req.ProtoMajor)
+	}
+	return strconv.Itoa(req.ProtoMajor) + "." + strconv.Itoa(req.ProtoMinor)
+}
+
+// AppendVia 在请求的 Via 头部末尾追加本代理实例的条目。
+func AppendVia(req *http.Request, identifier string) {
+	var entry = viaProtocol(req) + " " + identifier
+	if prior := req.Header.Values("Via"); len(prior) > 0 {
+		req.Header.Set("Via", strings.Join(prior, ", ")+", "+entry)
+	} else {
+		req.Header.Set("Via", entry)
+	}
+}
+
+// LoopInfo 描述了从请求的 Forwarded 与 Via 头部中得到的转发路径信息。
+//
+// 字段：
+// Hops - 请求已经经过的代理数量，取受信任代理策略保留的 Forwarded 元素数量和 Via 条目数量中的较大值。
+// ContainsSelf - 转发路径中是否已经包含本代理实例的标识。
+type LoopInfo struct {
+	Hops         int
+	ContainsSelf bool
+}
+
+// InspectLoop 检查请求的转发路径，用于防环检测和最大跳数限制。
+// 多个代理都可能使用 "unknown" 或者相同的混淆标识作为 by= 参数，所以只根据本实例的标识判断环路。
+// 对端的转发头部会被策略丢弃时不计入跳数，避免任意客户端伪造转发头部触发 508 响应。
+//
+// 参数:
+// req - 下游传入的请求。
+// clientIP - 直接连接到本代理的对端 IP 地址。
+// opts - 转发头部处理配置，其中的 ProxyIdentifier 为本代理实例的标识。
+//
+// 返回值:
+// 转发路径信息，以及需要保留的 Forwarded 头部无法解析时的错误。
+func InspectLoop(req *http.Request, clientIP string, opts *Options) (LoopInfo, error) {
+	var info LoopInfo
+	var discard = opts.action(clientIP) == ActionDiscard
+	elements, err := Parse(req.Header.Values("Forwarded"))
+	if err != nil && !discard {
+		return info, err
+	}
+	for _, element := range elements {
+		if element.By == opts.ProxyIdentifier {
+			info.ContainsSelf = true
+		}
+	}
+	var via = ParseVia(req.Header.Values("Via"))
+	for _, entry := range via {
+		if entry.ReceivedBy == opts.ProxyIdentifier {
+			info.ContainsSelf = true
+		}
+	}
+	if !discard {
+		info.Hops = max(len(elements), len(via))
+	}
+	return info, nil
+}
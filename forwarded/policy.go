@@ -0,0 +1,172 @@
+package forwarded
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Action 表示对下游传入的转发头部（Forwarded 与 X-Forwarded-*）的处理方式。
+// 丢弃时 Via 头部也一并删除，本代理的 Via 条目由 AppendVia 重新写入。
+type Action string
+
+const (
+	// ActionAppend 保留已有的转发头部，并在末尾追加本代理的转发元素。
+	ActionAppend Action = "append"
+	// ActionKeep 原样保留已有的转发头部，不追加任何内容。
+	ActionKeep Action = "keep"
+	// ActionDiscard 丢弃已有的转发头部和 Via 头部，只写入本代理的转发元素。
+	ActionDiscard Action = "discard"
+)
+
+// ParseAction 将字符串解析为 Action，支持 append、keep 和 discard（不区分大小写）。
+func ParseAction(s string) (Action, error) {
+	switch Action(strings.ToLower(strings.TrimSpace(s))) {
+	case ActionAppend:
+		return ActionAppend, nil
+	case ActionKeep:
+		return ActionKeep, nil
+	case ActionDiscard:
+		return ActionDiscard, nil
+	}
+	return "", errors.New("forwarded: unknown action " + s + ", supports (append,keep,discard)")
+}
+
+// Options 是 Apply 使用的转发头部处理配置。
+//
+// 字段：
+// TrustedProxies - 受信任的对端地址范围，为空时所有对端均视为受信任。
+// TrustedAction - 对端受信任时对已有转发头部的处理方式。
+// UntrustedAction - 对端不受信任时对已有转发头部的处理方式。
+// EmitXForwarded - 是否同时写入 X-Forwarded-For/Proto/Host 头部。
+// ProxyIdentifier - 写入 by= 参数的本代理标识。
+type Options struct {
+	TrustedProxies  []*net.IPNet
+	TrustedAction   Action
+	UntrustedAction Action
+	EmitXForwarded  bool
+	ProxyIdentifier string
+}
+
+// ParseCIDRList 解析以逗号分隔的 CIDR 列表，单独的 IP 地址会被视为 /32 或 /128 的网段。
+func ParseCIDRList(s string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("forwarded: invalid trusted proxy address " + item)
+			}
+			var bits = 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// IsTrusted 判断对端 IP 是否属于受信任的代理。
+// 为了与旧版本行为保持兼容，未配置任何受信任网段时所有对端都视为受信任。
+func (o *Options) IsTrusted(clientIP string) bool {
+	if len(o.TrustedProxies) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, network := range o.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// action 返回对端传入的转发头部的处理方式。
+func (o *Options) action(clientIP string) Action {
+	if o.IsTrusted(clientIP) {
+		return o.TrustedAction
+	}
+	return o.UntrustedAction
+}
+
+// xForwardedHeaders 是 Apply 管理的 X-Forwarded-* 头部名称。
+var xForwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host"}
+
+// discardedHeaders 是丢弃转发头部时删除的头部名称，不受信任的对端传入的 Via 条目同样不可信。
+var discardedHeaders = append([]string{"Forwarded", "Via"}, xForwardedHeaders...)
+
+// Apply 根据对端是否受信任处理请求中的转发头部，并按需追加本代理的转发元素。
+//
+// 参数:
+// req - 将被转发到上游的请求。
+// clientIP - 直接连接到本代理的对端 IP 地址。
+// opts - 转发头部处理配置。
+//
+// 返回值:
+// 已有的 Forwarded 头部无法解析并且需要在其后追加时返回错误，此时请求头部不会被修改。
+func Apply(req *http.Request, clientIP string, opts *Options) error {
+	var action = opts.action(clientIP)
+	if action == ActionKeep {
+		return nil
+	}
+
+	var proto = "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	var host = req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	var current = Element{
+		For:   FormatNode(clientIP, ""),
+		By:    opts.ProxyIdentifier,
+		Host:  host,
+		Proto: proto,
+	}
+
+	var elements []Element
+	if action == ActionAppend {
+		existing, err := Parse(req.Header.Values("Forwarded"))
+		if err != nil {
+			return err
+		}
+		elements = existing
+	} else {
+		for _, name := range discardedHeaders {
+			req.Header.Del(name)
+		}
+	}
+	req.Header.Set("Forwarded", Format(append(elements, current)))
+
+	if opts.EmitXForwarded {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			req.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+		} else {
+			req.Header.Set("X-Forwarded-For", clientIP)
+		}
+		if req.Header.Get("X-Forwarded-Proto") == "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if req.Header.Get("X-Forwarded-Host") == "" {
+			req.Header.Set("X-Forwarded-Host", host)
+		}
+	}
+	return nil
+}
@@ -6,12 +6,7 @@ toolchain go1.24.1
 
 replace github.com/quic-go/quic-go => github.com/quic-go/quic-go v0.55.0
 
-replace github.com/masx200/doq-go => github.com/masx200/doq-go v0.55.0
-
-require (
-	github.com/masx200/doq-go v0.55.0
-	github.com/quic-go/quic-go v0.55.0
-)
+require github.com/quic-go/quic-go v0.55.0
 
 require (
 	github.com/bytedance/sonic/loader v0.1.1 // indirect
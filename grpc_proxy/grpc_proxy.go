@@ -0,0 +1,251 @@
+package grpc_proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC 状态码（https://github.com/grpc/grpc/blob/master/doc/statuscodes.md）。
+const (
+	CodeOK                = 0
+	CodeCanceled          = 1
+	CodeUnknown           = 2
+	CodeDeadlineExceeded  = 4
+	CodePermissionDenied  = 7
+	CodeResourceExhausted = 8
+	CodeUnimplemented     = 12
+	CodeInternal          = 13
+	CodeUnavailable       = 14
+	CodeUnauthenticated   = 16
+)
+
+// hopHeaders 是逐跳头部，不应当被转发（RFC 9110 第 7.6.1 节）。
+// gRPC 要求的 "TE: trailers" 会被单独保留。
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// IsGRPCContentType 判断内容类型是否为 gRPC，即 "application/grpc" 或 "application/grpc+格式"，不包括 gRPC-Web。
+func IsGRPCContentType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "application/grpc" {
+		return true
+	}
+	return strings.HasPrefix(contentType, "application/grpc+") || strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// IsGRPC 判断请求是否为通过HTTP/2或HTTP/3发送的 gRPC 请求。
+func IsGRPC(r *http.Request) bool {
+	return r.ProtoMajor >= 2 && r.Method == http.MethodPost && IsGRPCContentType(r.Header.Get("Content-Type"))
+}
+
+// CodeFromHTTPStatus 按照 gRPC 的规范将上游的非200 HTTP状态码映射为 gRPC 状态码
+// （https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md）。
+func CodeFromHTTPStatus(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeInternal
+	case http.StatusUnauthorized:
+		return CodeUnauthenticated
+	case http.StatusForbidden:
+		return CodePermissionDenied
+	case http.StatusNotFound:
+		return CodeUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return CodeUnavailable
+	}
+	return CodeUnknown
+}
+
+// CodeFromError 将连接上游时遇到的错误映射为 gRPC 状态码。
+func CodeFromError(err error) int {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeDeadlineExceeded
+	}
+	return CodeUnavailable
+}
+
+const upperHex = "0123456789ABCDEF"
+
+// EncodeMessage 按照 gRPC 的规范对 grpc-message 进行百分号编码。
+func EncodeMessage(message string) string {
+	var builder strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= 0x20 && c <= 0x7e && c != '%' {
+			builder.WriteByte(c)
+			continue
+		}
+		builder.WriteByte('%')
+		builder.WriteByte(upperHex[c>>4])
+		builder.WriteByte(upperHex[c&0xf])
+	}
+	return builder.String()
+}
+
+// Status 返回响应中的 grpc-status，优先读取尾部，其次读取头部（Trailers-Only 响应）。
+// 尾部只有在响应体读取完毕之后才可用。
+func Status(response *http.Response) (int, bool) {
+	var value = response.Trailer.Get("Grpc-Status")
+	if value == "" {
+		value = response.Header.Get("Grpc-Status")
+	}
+	if value == "" {
+		return 0, false
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return CodeUnknown, true
+	}
+	return code, true
+}
+
+// WriteError 向下游写入只包含头部的 gRPC 错误响应（Trailers-Only）。
+func WriteError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", EncodeMessage(message))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ParseTimeout 解析 grpc-timeout 头部，例如 "100m" 表示100毫秒。
+func ParseTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || amount < 0 {
+		return 0, false
+	}
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+	return time.Duration(amount) * unit, true
+}
+
+// flushWriter 每次写入后立即刷新，保证流式消息不会被缓冲。
+type flushWriter struct {
+	writer  io.Writer
+	flusher http.Flusher
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.writer.Write(p)
+	if err == nil && f.flusher != nil {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
+// newUpstreamRequest 根据下游请求创建发往上游的 gRPC 请求，删除逐跳头部，
+// 并按照 grpc-timeout 设置请求的超时时间。
+func newUpstreamRequest(r *http.Request) (*http.Request, context.CancelFunc) {
+	var ctx, cancel = context.WithCancel(r.Context())
+	if timeout, ok := ParseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		cancel()
+		ctx, cancel = context.WithTimeout(r.Context(), timeout)
+	}
+	outreq := r.Clone(ctx)
+	outreq.RequestURI = ""
+	outreq.ContentLength = -1
+	for _, name := range hopHeaders {
+		outreq.Header.Del(name)
+	}
+	outreq.Header.Set("Te", "trailers")
+	return outreq, cancel
+}
+
+// Serve 将 gRPC 请求转发到上游，请求体和响应体都以流的方式双向转发而不缓冲，
+// 上游的尾部（grpc-status、grpc-message 等）会被转发给下游。
+// 连接上游失败或者上游返回非200状态码时，会向下游返回对应 gRPC 状态码的错误响应。
+//
+// 参数:
+// w - 下游的响应写入器，需要支持HTTP尾部（HTTP/2或HTTP/3）。
+// r - 下游的 gRPC 请求。
+// roundTrip - 向上游发送请求的函数，上游需要使用HTTP/2或HTTP/3。
+func Serve(w http.ResponseWriter, r *http.Request, roundTrip func(*http.Request) (*http.Response, error)) {
+	outreq, cancel := newUpstreamRequest(r)
+	defer cancel()
+
+	var start = time.Now()
+	response, err := roundTrip(outreq)
+	if err != nil {
+		log.Println("grpc_proxy: upstream error", r.URL.Path, err)
+		WriteError(w, CodeFromError(err), err.Error())
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		log.Println("grpc_proxy: upstream returned status", r.URL.Path, response.StatusCode)
+		WriteError(w, CodeFromHTTPStatus(response.StatusCode), "upstream returned HTTP status "+strconv.Itoa(response.StatusCode))
+		return
+	}
+
+	for _, name := range hopHeaders {
+		response.Header.Del(name)
+	}
+	response.Header.Del("Content-Length")
+	for k, vv := range response.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	_, err = io.Copy(&flushWriter{writer: w, flusher: flusher}, response.Body)
+	for k, vv := range response.Trailer {
+		for _, v := range vv {
+			w.Header().Add(http.TrailerPrefix+k, v)
+		}
+	}
+	code, ok := Status(response)
+	if !ok {
+		/* 上游没有返回状态，说明响应被中断，由代理补充状态 */
+		code = CodeInternal
+		var message = "upstream response ended without grpc-status"
+		if err != nil {
+			code = CodeFromError(err)
+			message = err.Error()
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", EncodeMessage(message))
+	}
+	log.Println("grpc_proxy: call finished", r.Proto, r.URL.Path, "grpc-status", code, "duration", time.Since(start), "error", err)
+}
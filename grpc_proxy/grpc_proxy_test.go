@@ -0,0 +1,177 @@
+package grpc_proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP2Server 启动一个使用HTTP/2的TLS测试服务器。
+func newHTTP2Server(handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	return server
+}
+
+// echoHandler 原样回显请求消息并在尾部返回 grpc-status 的 gRPC 上游处理器。
+func echoHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Te") != "trailers" {
+			t.Error("missing TE: trailers")
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		var buf = make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				break
+			}
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	})
+}
+
+func TestServeStreamsAndForwardsTrailers(t *testing.T) {
+	upstream := newHTTP2Server(echoHandler(t))
+	defer upstream.Close()
+	proxy := newHTTP2Server(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsGRPC(r) {
+			t.Error("grpc request not detected")
+		}
+		r.URL.Scheme = "https"
+		r.URL.Host = upstream.Listener.Addr().String()
+		Serve(w, r, upstream.Client().Transport.RoundTrip)
+	}))
+	defer proxy.Close()
+
+	reader, writer := io.Pipe()
+	request, err := http.NewRequest(http.MethodPost, proxy.URL+"/echo.Echo/Stream", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	response, err := proxy.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	/* 在请求体结束之前就应当收到回显，说明双向都没有被缓冲 */
+	writer.Write([]byte("ping"))
+	var buf = make([]byte, 4)
+	if _, err := io.ReadFull(response.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("unexpected echo: %q", buf)
+	}
+	writer.Close()
+	if _, err := io.ReadAll(response.Body); err != nil {
+		t.Fatal(err)
+	}
+	if code, ok := Status(response); !ok || code != CodeOK {
+		t.Errorf("unexpected grpc-status: %d %v", code, ok)
+	}
+	if response.Trailer.Get("Grpc-Message") != "done" {
+		t.Errorf("unexpected grpc-message trailer: %q", response.Trailer.Get("Grpc-Message"))
+	}
+}
+
+func TestServeMapsUpstreamFailures(t *testing.T) {
+	notFound := newHTTP2Server(http.NotFoundHandler())
+	defer notFound.Close()
+	for _, c := range []struct {
+		name      string
+		roundTrip func(*http.Request) (*http.Response, error)
+		code      int
+	}{
+		{"connection error", func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}, CodeUnavailable},
+		{"http status", func(r *http.Request) (*http.Response, error) {
+			r.URL.Scheme = "https"
+			r.URL.Host = notFound.Listener.Addr().String()
+			return notFound.Client().Transport.RoundTrip(r)
+		}, CodeUnimplemented},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "https://example.com/svc/Method", nil)
+		request.Proto, request.ProtoMajor = "HTTP/2.0", 2
+		request.Header.Set("Content-Type", "application/grpc+proto")
+		recorder := httptest.NewRecorder()
+		Serve(recorder, request, c.roundTrip)
+		response := recorder.Result()
+		if code, ok := Status(response); !ok || code != c.code {
+			t.Errorf("%s: unexpected grpc-status %d %v", c.name, code, ok)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected http status %d", c.name, response.StatusCode)
+		}
+	}
+}
+
+func TestParseTimeoutAndEncodeMessage(t *testing.T) {
+	if timeout, ok := ParseTimeout("250m"); !ok || timeout != 250*time.Millisecond {
+		t.Errorf("unexpected timeout: %v %v", timeout, ok)
+	}
+	if _, ok := ParseTimeout("10x"); ok {
+		t.Error("invalid unit accepted")
+	}
+	if message := EncodeMessage("a 100% \n"); message != "a 100%25 %0A" {
+		t.Errorf("unexpected encoded message: %q", message)
+	}
+}
+
+func TestServeHTTP3UpstreamTrailers(t *testing.T) {
+	/* 借用 httptest 的自签名证书 */
+	certificate := newHTTP2Server(nil)
+	certificate.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate.Certificate())
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	upstream := &http3.Server{
+		Handler:   echoHandler(t),
+		TLSConfig: http3.ConfigureTLSConfig(certificate.TLS.Clone()),
+	}
+	go upstream.Serve(conn)
+	defer upstream.Close()
+	transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	defer transport.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "https://example.com/echo.Echo/Unary", strings.NewReader("pong"))
+	request.Proto, request.ProtoMajor = "HTTP/3.0", 3
+	request.Header.Set("Content-Type", "application/grpc")
+	recorder := httptest.NewRecorder()
+	Serve(recorder, request, func(r *http.Request) (*http.Response, error) {
+		r.URL.Host = conn.LocalAddr().String()
+		return transport.RoundTrip(r)
+	})
+	response := recorder.Result()
+	body, _ := io.ReadAll(response.Body)
+	if string(body) != "pong" {
+		t.Errorf("unexpected body: %q", body)
+	}
+	if code, ok := Status(response); !ok || code != CodeOK {
+		t.Errorf("unexpected grpc-status: %d %v", code, ok)
+	}
+}
@@ -0,0 +1,329 @@
+package grpc_proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcWebTrailerFlag 是 gRPC-Web 响应体中尾部帧的标志位。
+const grpcWebTrailerFlag = 0x80
+
+// defaultAllowedHeaders 是 gRPC-Web 预检请求默认允许的请求头部。
+var defaultAllowedHeaders = []string{"content-type", "x-grpc-web", "x-user-agent", "grpc-timeout", "authorization"}
+
+// exposedHeaders 是需要暴露给浏览器脚本的 gRPC 响应头部。
+var exposedHeaders = "grpc-status, grpc-message, grpc-status-details-bin"
+
+// GRPCWebOptions 是 gRPC-Web 转换的配置。
+//
+// 字段：
+// AllowedOrigins - 允许跨域访问的来源，包含 "*" 时允许所有来源但不允许携带凭据，只有显式列出的来源可以携带凭据。
+// MaxAge - 预检请求结果的缓存时间。
+type GRPCWebOptions struct {
+	AllowedOrigins []string
+	MaxAge         time.Duration
+}
+
+// GRPCWeb 将浏览器发送的 gRPC-Web 请求（application/grpc-web 和 application/grpc-web-text）
+// 转换为原生 gRPC 请求发往HTTP/2或HTTP/3上游，并把上游的尾部编码到响应体中，同时处理跨域预检请求。
+type GRPCWeb struct {
+	GRPCWebOptions
+}
+
+// NewGRPCWeb 创建一个 gRPC-Web 转换器。
+//
+// 参数:
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的转换器。
+func NewGRPCWeb(options ...func(*GRPCWebOptions)) *GRPCWeb {
+	var web = &GRPCWeb{GRPCWebOptions: GRPCWebOptions{
+		AllowedOrigins: []string{"*"},
+		MaxAge:         24 * time.Hour,
+	}}
+	for _, option := range options {
+		option(&web.GRPCWebOptions)
+	}
+	return web
+}
+
+// IsGRPCWebContentType 判断内容类型是否为 gRPC-Web，返回是否为 gRPC-Web 以及是否为 base64 编码的文本格式。
+func IsGRPCWebContentType(contentType string) (bool, bool) {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if index := strings.IndexByte(contentType, ';'); index >= 0 {
+		contentType = strings.TrimSpace(contentType[:index])
+	}
+	for _, prefix := range []string{"application/grpc-web-text", "application/grpc-web"} {
+		if contentType == prefix || strings.HasPrefix(contentType, prefix+"+") {
+			return true, prefix == "application/grpc-web-text"
+		}
+	}
+	return false, false
+}
+
+// IsGRPCWeb 判断请求是否为 gRPC-Web 请求。
+func IsGRPCWeb(r *http.Request) bool {
+	ok, _ := IsGRPCWebContentType(r.Header.Get("Content-Type"))
+	return r.Method == http.MethodPost && ok
+}
+
+// IsGRPCWebPreflight 判断请求是否为 gRPC-Web 的跨域预检请求，即请求头部列表中包含 x-grpc-web 的 OPTIONS 请求。
+func IsGRPCWebPreflight(r *http.Request) bool {
+	if r.Method != http.MethodOptions || r.Header.Get("Origin") == "" || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "x-grpc-web") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowOrigin 返回 Access-Control-Allow-Origin 的值以及是否允许携带凭据，不允许时返回空字符串。
+// 显式列出的来源会原样返回并允许携带凭据，只匹配 "*" 时返回 "*" 且不允许携带凭据，
+// 防止任意网站以用户的身份发送跨域请求。
+func (g *GRPCWeb) allowOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	var wildcard bool
+	for _, allowed := range g.AllowedOrigins {
+		if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+		wildcard = wildcard || allowed == "*"
+	}
+	if wildcard {
+		return "*", false
+	}
+	return "", false
+}
+
+// setAllowOrigin 设置跨域响应的来源和凭据头部，来源不被允许时返回false。
+func (g *GRPCWeb) setAllowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin, credentials := g.allowOrigin(r.Header.Get("Origin"))
+	if origin == "" {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Add("Vary", "Origin")
+	}
+	return true
+}
+
+// ServePreflight 响应 gRPC-Web 的跨域预检请求。
+func (g *GRPCWeb) ServePreflight(w http.ResponseWriter, r *http.Request) {
+	if !g.setAllowOrigin(w, r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var allowedHeaders = strings.Join(defaultAllowedHeaders, ", ")
+	if requested := strings.Join(r.Header.Values("Access-Control-Request-Headers"), ", "); requested != "" {
+		allowedHeaders = requested
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", allowedHeaders)
+	w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(g.MaxAge.Seconds())))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// base64ChunkReader 解码 grpc-web-text 的请求体，每4个字符单独解码，
+// 因此可以处理由多段各自带有填充的base64数据拼接而成的流。
+type base64ChunkReader struct {
+	reader  io.Reader
+	pending []byte
+	quantum [4]byte
+	filled  int
+}
+
+func (b *base64ChunkReader) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		n, err := b.reader.Read(b.quantum[b.filled:])
+		for _, c := range b.quantum[b.filled : b.filled+n] {
+			/* 忽略换行等空白字符 */
+			if c == '\r' || c == '\n' || c == ' ' || c == '\t' {
+				continue
+			}
+			b.quantum[b.filled] = c
+			b.filled++
+		}
+		if b.filled == 4 {
+			decoded, decodeErr := base64.StdEncoding.DecodeString(string(b.quantum[:]))
+			if decodeErr != nil {
+				return 0, decodeErr
+			}
+			b.pending = decoded
+			b.filled = 0
+		}
+		if err != nil {
+			if len(b.pending) > 0 {
+				break
+			}
+			if err == io.EOF && b.filled != 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+// base64ChunkWriter 将每次写入的数据单独编码为带填充的base64数据。
+type base64ChunkWriter struct {
+	writer io.Writer
+}
+
+func (b *base64ChunkWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(b.writer, base64.StdEncoding.EncodeToString(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// readCloser 组合读取器和关闭函数。
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// encodeTrailerFrame 将尾部编码为 gRPC-Web 的尾部帧，名称使用小写。
+func encodeTrailerFrame(trailer http.Header) []byte {
+	var keys = make([]string, 0, len(trailer))
+	for k := range trailer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var block bytes.Buffer
+	for _, k := range keys {
+		for _, v := range trailer[k] {
+			block.WriteString(strings.ToLower(k) + ": " + v + "\r\n")
+		}
+	}
+	var frame = make([]byte, 5, 5+block.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(block.Len()))
+	return append(frame, block.Bytes()...)
+}
+
+// Serve 将 gRPC-Web 请求转换为原生 gRPC 请求并转发到上游，
+// 响应体以流的方式转发，上游的尾部会被编码为响应体末尾的尾部帧。
+//
+// 参数:
+// w - 下游的响应写入器。
+// r - 下游的 gRPC-Web 请求。
+// roundTrip - 向上游发送请求的函数，上游需要使用HTTP/2或HTTP/3。
+func (g *GRPCWeb) Serve(w http.ResponseWriter, r *http.Request, roundTrip func(*http.Request) (*http.Response, error)) {
+	var contentType = r.Header.Get("Content-Type")
+	_, text := IsGRPCWebContentType(contentType)
+	if g.setAllowOrigin(w, r) {
+		w.Header().Set("Access-Control-Expose-Headers", exposedHeaders)
+	}
+	/* 响应使用与请求相同的内容类型 */
+	w.Header().Set("Content-Type", contentType)
+
+	outreq, cancel := newUpstreamRequest(r)
+	defer cancel()
+	outreq.Header.Set("Content-Type", "application/grpc"+grpcWebFormat(contentType))
+	outreq.Header.Del("X-Grpc-Web")
+	outreq.Header.Del("Content-Length")
+	if text {
+		outreq.Body = &readCloser{Reader: &base64ChunkReader{reader: r.Body}, Closer: r.Body}
+	}
+
+	/* HTTP/1.1 下需要开启全双工，才能在写入响应之后继续读取请求体 */
+	http.NewResponseController(w).EnableFullDuplex()
+
+	var start = time.Now()
+	response, err := roundTrip(outreq)
+	if err != nil {
+		log.Println("grpc_proxy: grpc-web upstream error", r.URL.Path, err)
+		writeWebError(w, CodeFromError(err), err.Error())
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		log.Println("grpc_proxy: grpc-web upstream returned status", r.URL.Path, response.StatusCode)
+		writeWebError(w, CodeFromHTTPStatus(response.StatusCode), "upstream returned HTTP status "+strconv.Itoa(response.StatusCode))
+		return
+	}
+	for _, name := range hopHeaders {
+		response.Header.Del(name)
+	}
+	response.Header.Del("Content-Length")
+	response.Header.Del("Content-Type")
+	for k, vv := range response.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	var body io.Writer = &flushWriter{writer: w, flusher: flusher}
+	if text {
+		body = &base64ChunkWriter{writer: body}
+	}
+	_, err = io.Copy(body, response.Body)
+	var trailer = response.Trailer.Clone()
+	if trailer == nil {
+		trailer = http.Header{}
+	}
+	code, ok := Status(response)
+	if !ok {
+		code = CodeInternal
+		var message = "upstream response ended without grpc-status"
+		if err != nil {
+			code = CodeFromError(err)
+			message = err.Error()
+		}
+		trailer.Set("Grpc-Status", strconv.Itoa(code))
+		trailer.Set("Grpc-Message", EncodeMessage(message))
+	}
+	/* Trailers-Only 响应的状态已经在头部中，不需要尾部帧 */
+	if response.Header.Get("Grpc-Status") == "" || len(response.Trailer) > 0 {
+		if _, err := body.Write(encodeTrailerFrame(trailer)); err != nil {
+			log.Println("grpc_proxy: write grpc-web trailers:", err)
+		}
+	}
+	log.Println("grpc_proxy: grpc-web call finished", r.Proto, r.URL.Path, "grpc-status", code, "duration", time.Since(start), "error", err)
+}
+
+// grpcWebFormat 返回 gRPC-Web 内容类型中的消息格式后缀，例如 "+proto"。
+func grpcWebFormat(contentType string) string {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if index := strings.IndexByte(contentType, ';'); index >= 0 {
+		contentType = strings.TrimSpace(contentType[:index])
+	}
+	if index := strings.IndexByte(contentType, '+'); index >= 0 {
+		return contentType[index:]
+	}
+	return ""
+}
+
+// writeWebError 向下游写入只包含头部的 gRPC-Web 错误响应。
+func writeWebError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", EncodeMessage(message))
+	}
+	w.WriteHeader(http.StatusOK)
+}
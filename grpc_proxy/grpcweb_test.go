@@ -0,0 +1,131 @@
+package grpc_proxy
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGRPCWebTextTranslation(t *testing.T) {
+	upstream := newHTTP2Server(echoHandler(t))
+	defer upstream.Close()
+	web := NewGRPCWeb(func(o *GRPCWebOptions) {
+		o.AllowedOrigins = []string{"https://app.example.com"}
+	})
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsGRPCWebPreflight(r) {
+			web.ServePreflight(w, r)
+			return
+		}
+		if !IsGRPCWeb(r) {
+			t.Error("grpc-web request not detected")
+		}
+		r.URL.Scheme = "https"
+		r.URL.Host = upstream.Listener.Addr().String()
+		web.Serve(w, r, func(r *http.Request) (*http.Response, error) {
+			if r.Header.Get("Content-Type") != "application/grpc+proto" {
+				t.Errorf("unexpected upstream content type: %q", r.Header.Get("Content-Type"))
+			}
+			return upstream.Client().Transport.RoundTrip(r)
+		})
+	}))
+	defer proxy.Close()
+
+	preflight, _ := http.NewRequest(http.MethodOptions, proxy.URL+"/echo.Echo/Unary", nil)
+	preflight.Header.Set("Origin", "https://app.example.com")
+	preflight.Header.Set("Access-Control-Request-Method", "POST")
+	preflight.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+	response, err := http.DefaultClient.Do(preflight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent || response.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" || response.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("unexpected preflight response: %d %v", response.StatusCode, response.Header)
+	}
+
+	/* 两段各自带有填充的base64数据拼接在一起 */
+	var message = "\x00\x00\x00\x00\x04ping"
+	var body = base64.StdEncoding.EncodeToString([]byte(message[:2])) + base64.StdEncoding.EncodeToString([]byte(message[2:]))
+	request, _ := http.NewRequest(http.MethodPost, proxy.URL+"/echo.Echo/Unary", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/grpc-web-text+proto")
+	request.Header.Set("X-Grpc-Web", "1")
+	request.Header.Set("Origin", "https://app.example.com")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.Header.Get("Content-Type") != "application/grpc-web-text+proto" {
+		t.Errorf("unexpected content type: %q", response.Header.Get("Content-Type"))
+	}
+	if !strings.Contains(response.Header.Get("Access-Control-Expose-Headers"), "grpc-status") {
+		t.Error("grpc-status not exposed to browsers")
+	}
+	decoded, err := io.ReadAll(&base64ChunkReader{reader: response.Body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trailer = "grpc-message: done\r\ngrpc-status: 0\r\n"
+	var expected = message + "\x80\x00\x00\x00" + string(rune(len(trailer))) + trailer
+	if string(decoded) != expected {
+		t.Errorf("unexpected body: %q", decoded)
+	}
+}
+
+func TestGRPCWebAllowOrigin(t *testing.T) {
+	for _, c := range []struct {
+		allowed     []string
+		origin      string
+		expected    string
+		credentials string
+	}{
+		/* "*" 不反射来源，也不允许携带凭据 */
+		{[]string{"*"}, "https://evil.example", "*", ""},
+		{[]string{"https://app.example.com"}, "https://app.example.com", "https://app.example.com", "true"},
+		{[]string{"*", "https://app.example.com"}, "https://app.example.com", "https://app.example.com", "true"},
+		{[]string{"https://app.example.com"}, "https://evil.example", "", ""},
+	} {
+		web := NewGRPCWeb(func(o *GRPCWebOptions) {
+			o.AllowedOrigins = c.allowed
+		})
+		request := httptest.NewRequest(http.MethodOptions, "http://proxy.example/echo.Echo/Unary", nil)
+		request.Header.Set("Origin", c.origin)
+		request.Header.Set("Access-Control-Request-Method", "POST")
+		request.Header.Set("Access-Control-Request-Headers", "x-grpc-web")
+		recorder := httptest.NewRecorder()
+		web.ServePreflight(recorder, request)
+		if origin := recorder.Header().Get("Access-Control-Allow-Origin"); origin != c.expected {
+			t.Errorf("%v %s: unexpected allow origin %q", c.allowed, c.origin, origin)
+		}
+		if credentials := recorder.Header().Get("Access-Control-Allow-Credentials"); credentials != c.credentials {
+			t.Errorf("%v %s: unexpected allow credentials %q", c.allowed, c.origin, credentials)
+		}
+		if c.expected == "" && recorder.Code != http.StatusForbidden {
+			t.Errorf("%v %s: expected forbidden, got %d", c.allowed, c.origin, recorder.Code)
+		}
+	}
+}
+
+func TestGRPCWebContentType(t *testing.T) {
+	for _, c := range []struct {
+		contentType string
+		web, text   bool
+	}{
+		{"application/grpc-web", true, false},
+		{"application/grpc-web+proto", true, false},
+		{"application/grpc-web-text; charset=utf-8", true, true},
+		{"application/grpc", false, false},
+	} {
+		web, text := IsGRPCWebContentType(c.contentType)
+		if web != c.web || text != c.text {
+			t.Errorf("IsGRPCWebContentType(%q) = %v, %v", c.contentType, web, text)
+		}
+	}
+	if IsGRPCContentType("application/grpc-web") {
+		t.Error("grpc-web detected as native grpc")
+	}
+}
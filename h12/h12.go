@@ -6,9 +6,12 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/masx200/http3-reverse-proxy-server-experiment/adapter"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/happy_eyeballs"
 	"golang.org/x/net/http2"
 	// "golang.org/x/net/http2"
 )
@@ -76,9 +79,14 @@ func CreateHTTP12TransportWithIP(ip string) http.RoundTripper {
 }
 
 // CreateHTTP12TransportWithIPGetter 创建一个自定义的http.Transport实例，该实例允许通过getter函数动态获取IP地址来进行连接，适用于需要手动指定连接IP的场景。
-// getter: 一个函数，用于获取要使用的IP地址。该函数会在每次建立连接时被调用。
+// getter: 一个函数，用于获取要使用的IP地址列表，多个地址按照 RFC 8305 交替地址族依次尝试连接。该函数会在每次建立连接时被调用。
+// getECHClient: 一个函数，返回建立TLS连接时使用的 ECH 客户端，为nil或者返回nil时不使用 ECH。
+// nextProtos: TLS握手时通过ALPN协商的协议列表，为空时使用 h2 和 http/1.1。
 // 返回值: 配置好的http.RoundTripper接口，即http.Transport实例，可直接用于http.Client中。
-func CreateHTTP12TransportWithIPGetter(getter func() string) adapter.HTTPRoundTripperAndCloserInterface {
+func CreateHTTP12TransportWithIPGetter(getter func() []string, getECHClient func() *ech.Client, nextProtos ...string) adapter.HTTPRoundTripperAndCloserInterface {
+	if len(nextProtos) == 0 {
+		nextProtos = []string{"h2", "http/1.1"}
+	}
 	/* 需要把connection保存起来,防止一个请求一个连接的情况速度会很慢 */
 	dialer := &net.Dialer{
 		Timeout:   30 * time.Second, // 设置拨号超时时间为30秒
@@ -94,10 +102,13 @@ func CreateHTTP12TransportWithIPGetter(getter func() string) adapter.HTTPRoundTr
 			if err != nil {
 				return nil, err
 			}
-			var cfg *tls.Config = &tls.Config{NextProtos: []string{"h2", "http/1.1"}, ServerName: host}
+			var cfg *tls.Config = &tls.Config{NextProtos: slices.Clone(nextProtos), ServerName: host}
+			if echClient := echClientOf(getECHClient); echClient != nil {
+				return dialTLSWithECH(ctx, dialer, network, getter, port, cfg, echClient)
+			}
 			// 拨号并配置TLS连接
-			var ip = getter()
-			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			var ips = getter()
+			conn, err := dialAddresses(ctx, dialer, network, ips, port)
 			if err != nil {
 				log.Println("连接失败http2", host, port)
 				return nil, err
@@ -115,9 +126,9 @@ func CreateHTTP12TransportWithIPGetter(getter func() string) adapter.HTTPRoundTr
 			if err != nil {
 				return nil, err
 			}
-			var ip = getter()
+			var ips = getter()
 			// 使用指定的IP地址拨号连接
-			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			conn, err := dialAddresses(ctx, dialer, network, ips, port)
 			if err != nil {
 				log.Println("连接失败http1", host, port)
 				return nil, err
@@ -145,9 +156,10 @@ func CreateHTTP12TransportWithIPGetter(getter func() string) adapter.HTTPRoundTr
 }
 
 // CreateHTTP12TransportWithIPGetter 创建一个自定义的http.Transport实例，该实例允许通过getter函数动态获取IP地址来进行连接，适用于需要手动指定连接IP的场景。
-// getter: 一个函数，用于获取要使用的IP地址。该函数会在每次建立连接时被调用。
+// getter: 一个函数，用于获取要使用的IP地址列表，多个地址按照 RFC 8305 交替地址族依次尝试连接。该函数会在每次建立连接时被调用。
+// getECHClient: 一个函数，返回建立TLS连接时使用的 ECH 客户端，为nil或者返回nil时不使用 ECH。
 // 返回值: 配置好的http.RoundTripper接口，即http.Transport实例，可直接用于http.Client中。
-func CreateHTTP2TransportWithIPGetter(getter func() string) http.RoundTripper {
+func CreateHTTP2TransportWithIPGetter(getter func() []string, getECHClient func() *ech.Client) http.RoundTripper {
 	/* 需要把connection保存起来,防止一个请求一个连接的情况速度会很慢 */
 	dialer := &net.Dialer{
 		Timeout:   30 * time.Second, // 设置拨号超时时间为30秒
@@ -162,9 +174,12 @@ func CreateHTTP2TransportWithIPGetter(getter func() string) http.RoundTripper {
 			if err != nil {
 				return nil, err
 			}
+			if echClient := echClientOf(getECHClient); echClient != nil {
+				return dialTLSWithECH(ctx, dialer, network, getter, port, cfg, echClient)
+			}
 			// 拨号并配置TLS连接
-			var ip = getter()
-			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			var ips = getter()
+			conn, err := dialAddresses(ctx, dialer, network, ips, port)
 			if err != nil {
 				log.Println("连接失败http2", host, port)
 				return nil, err
@@ -180,3 +195,127 @@ func CreateHTTP2TransportWithIPGetter(getter func() string) http.RoundTripper {
 	}
 
 }
+
+// CreateHTTP1TransportWithIPGetter 创建一个只使用HTTP/1.1协议的http.Transport实例，通过getter函数动态获取IP地址来进行连接。
+// 由于协议升级（例如WebSocket）只能在HTTP/1.1上进行，TLS握手时只协商 "http/1.1"。
+// getter: 一个函数，用于获取要使用的IP地址列表，多个地址按照 RFC 8305 交替地址族依次尝试连接。该函数会在每次建立连接时被调用。
+// getECHClient: 一个函数，返回建立TLS连接时使用的 ECH 客户端，为nil或者返回nil时不使用 ECH。
+// 返回值: 配置好的http.RoundTripper接口和关闭空闲连接的Closer。
+func CreateHTTP1TransportWithIPGetter(getter func() []string, getECHClient func() *ech.Client) adapter.HTTPRoundTripperAndCloserInterface {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second, // 设置拨号超时时间为30秒
+		KeepAlive: 30 * time.Second, // 设置保持活动状态的间隔为30秒
+	}
+
+	var roundTripper = &http.Transport{
+		ForceAttemptHTTP2: false,
+		TLSNextProto:      map[string]func(authority string, c *tls.Conn) http.RoundTripper{},
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr) // TLS连接时同样分解地址
+			if err != nil {
+				return nil, err
+			}
+			var cfg *tls.Config = &tls.Config{NextProtos: []string{"http/1.1"}, ServerName: host}
+			if echClient := echClientOf(getECHClient); echClient != nil {
+				return dialTLSWithECH(ctx, dialer, network, getter, port, cfg, echClient)
+			}
+			var ips = getter()
+			conn, err := dialAddresses(ctx, dialer, network, ips, port)
+			if err != nil {
+				log.Println("连接失败http1", host, port)
+				return nil, err
+			}
+			log.Println("连接成功http1", host, port, conn.LocalAddr(), conn.RemoteAddr())
+			return tls.Client(conn, cfg), nil
+		},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr) // 从地址中分解出主机和端口
+			if err != nil {
+				return nil, err
+			}
+			var ips = getter()
+			conn, err := dialAddresses(ctx, dialer, network, ips, port)
+			if err != nil {
+				log.Println("连接失败http1", host, port)
+				return nil, err
+			}
+			log.Println("连接成功http1", host, port, conn.LocalAddr(), conn.RemoteAddr())
+			return conn, err
+		},
+	}
+	return &adapter.HTTPRoundTripperAndCloserImplement{RoundTripper: (func(r *http.Request) (*http.Response, error) {
+		return roundTripper.RoundTrip(r)
+	}), Closer: func() error {
+		roundTripper.CloseIdleConnections()
+		return nil
+	}}
+}
+
+// CreateTCPDialerWithIPGetter 创建一个TCP拨号函数，通过getter函数根据目标主机动态获取要连接的IP地址，
+// 适用于目标主机不固定的场景，例如正向代理的CONNECT隧道。
+// getter: 一个函数，根据目标主机返回要使用的IP地址列表，多个地址按照 RFC 8305 交替地址族依次尝试连接。该函数会在每次建立连接时被调用。
+// 返回值: 与 net.Dialer.DialContext 签名相同的拨号函数。
+func CreateTCPDialerWithIPGetter(getter func(host string) ([]string, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second, // 设置拨号超时时间为30秒
+		KeepAlive: 30 * time.Second, // 设置保持活动状态的间隔为30秒
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr) // 从地址中分解出主机和端口
+		if err != nil {
+			return nil, err
+		}
+		ips, err := getter(host)
+		if err != nil {
+			log.Println("连接失败tcp", host, port, err)
+			return nil, err
+		}
+		conn, err := dialAddresses(ctx, dialer, network, ips, port)
+		if err != nil {
+			log.Println("连接失败tcp", host, port, err)
+			return nil, err
+		}
+		log.Println("连接成功tcp", host, port, conn.LocalAddr(), conn.RemoteAddr())
+		return conn, nil
+	}
+}
+
+// dialAddresses 按照 RFC 8305 对地址排序后，每隔 happy_eyeballs.DefaultAttemptDelay 依次尝试连接，返回第一个成功的连接。
+func dialAddresses(ctx context.Context, dialer *net.Dialer, network string, ips []string, port string) (net.Conn, error) {
+	return happy_eyeballs.Dial(ctx, happy_eyeballs.SortAddresses(ips), happy_eyeballs.DefaultAttemptDelay, func(ctx context.Context, ip string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+	}, func(conn net.Conn) {
+		conn.Close()
+	})
+}
+
+// echClientOf 返回 getECHClient 提供的 ECH 客户端，getECHClient 为nil时返回nil。
+func echClientOf(getECHClient func() *ech.Client) *ech.Client {
+	if getECHClient == nil {
+		return nil
+	}
+	return getECHClient()
+}
+
+// dialTLSWithECH 使用 ECH 建立TLS连接并完成握手。服务器拒绝 ECH 后重新握手时需要重新建立TCP连接。
+func dialTLSWithECH(ctx context.Context, dialer *net.Dialer, network string, getter func() []string, port string, cfg *tls.Config, echClient *ech.Client) (net.Conn, error) {
+	conn, err := ech.Handshake(ctx, echClient, port, cfg, func(ctx context.Context, cfg *tls.Config) (*tls.Conn, error) {
+		conn, err := dialAddresses(ctx, dialer, network, getter(), port)
+		if err != nil {
+			log.Println("连接失败tls", cfg.ServerName, port, err)
+			return nil, err
+		}
+		var tlsConn = tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			log.Println("握手失败tls", cfg.ServerName, port, err)
+			conn.Close()
+			return nil, err
+		}
+		log.Println("连接成功tls", cfg.ServerName, port, conn.LocalAddr(), conn.RemoteAddr(), "ech", tlsConn.ConnectionState().ECHAccepted)
+		return tlsConn, nil
+	}, (*tls.Conn).ConnectionState)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -2,15 +2,17 @@ package h12
 
 import (
 	// "context"
-	// "crypto/tls"
-
+	"crypto/tls"
 	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
 
 	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
 
 	// "net"
-	// "net/http"
 	"testing"
 )
 
@@ -105,3 +107,42 @@ func TestHttp2ViaIP(t *testing.T) {
 	}
 	log.Println("http2 Success:", success)
 }
+
+// TestHttp12TransportNextProtos 检查自定义TLS握手时客户端提供的ALPN协议列表。
+func TestHttp12TransportNextProtos(t *testing.T) {
+	var offered = make(chan []string, 1)
+	var server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		offered <- hello.SupportedProtos
+		return nil, nil
+	}}
+	server.StartTLS()
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var getter = func() []string { return []string{serverURL.Hostname()} }
+
+	for _, c := range []struct {
+		nextProtos []string
+		expected   []string
+	}{
+		{nil, []string{"h2", "http/1.1"}},
+		{[]string{"http/1.1"}, []string{"http/1.1"}},
+	} {
+		var transport = CreateHTTP12TransportWithIPGetter(getter, nil, c.nextProtos...)
+		/* 测试服务器的证书不受信任，握手失败，但是服务器已经收到了客户端提供的协议 */
+		req, err := http.NewRequest(http.MethodGet, "https://localhost:"+serverURL.Port()+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := transport.RoundTrip(req); err == nil {
+			resp.Body.Close()
+		}
+		transport.Close()
+		if protos := <-offered; !reflect.DeepEqual(protos, c.expected) {
+			t.Errorf("nextProtos %v: offered %v, expected %v", c.nextProtos, protos, c.expected)
+		}
+	}
+}
@@ -9,7 +9,7 @@ import (
 
 	// "net"
 	"net/http"
-	"strings"
+	"strconv"
 
 	// "testing"
 
@@ -93,24 +93,22 @@ func CheckHttp3ViaHttp2(domain string, port string) (bool, error) {
 // DOHServer: DNS-over-HTTPS服务器的地址。
 // 返回值: 支持H3协议返回true，否则返回false。如果出现错误，将返回错误信息。
 func CheckHttp3ViaDNS(domain string, port string, DOHServer string) (bool, error) {
-	var records, err = dns_experiment.DNSQueryHTTPS(domain, port, DOHServer)
-
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		log.Println(err)
+		return false, err
+	}
+	/* 按照 RFC 9460 跟随 AliasMode 记录，并考虑 ServiceMode 记录的 alpn 和 no-default-alpn */
+	endpoints, err := dns_experiment.ResolveServiceEndpoints(domain, portNumber, func(m *dns.Msg) (*dns.Msg, error) {
+		return dns_experiment.DohClient(m, DOHServer)
+	})
 	if err != nil {
 		log.Println(err)
 		return false, err
 	}
-	for _, record := range records {
-
-		if record.Priority != 0 {
-			for _, value := range record.Value {
-				if value.Key().String() == "alpn" {
-					var protocols = strings.Split(value.String(), ",")
-
-					if ContainsGeneric(protocols, "h3") {
-						return true, nil
-					}
-				}
-			}
+	for _, endpoint := range endpoints {
+		if endpoint.Supports("h3") {
+			return true, nil
 		}
 	}
 	return false, errors.New("no H3 alpn records found")
@@ -0,0 +1,102 @@
+package h3
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/adapter"
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// NewDoHTTP3PersistentClient 创建一个使用HTTP/3的保持连接的DoH客户端。
+// 客户端持有一个 http3.Transport，多个查询复用同一个QUIC连接，固定IP地址时所有连接共用一个UDP套接字。
+//
+// 参数:
+// serverURL - DoH服务器的URL。
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的客户端，不再使用时需要调用 Close 关闭连接和UDP套接字。
+func NewDoHTTP3PersistentClient(serverURL string, options ...func(*dns_experiment.DoHClientOptions)) *dns_experiment.DoHPersistentClient {
+	return dns_experiment.NewDoHPersistentClient(serverURL, append(options, func(o *dns_experiment.DoHClientOptions) {
+		if o.Transport == nil {
+			o.Transport = newDoHTTP3Transport(o.ServerIP, o.TLSConfig)
+		}
+	})...)
+}
+
+// newDoHTTP3Transport 创建DoH使用的HTTP/3传输，serverIP 不为空时连接该IP地址，TLS仍然使用URL中的域名。
+func newDoHTTP3Transport(serverIP string, tlsConfig *tls.Config) http.RoundTripper {
+	var roundTripper = &http3.Transport{TLSClientConfig: tlsConfig}
+	if serverIP == "" {
+		return roundTripper
+	}
+	var mutex sync.Mutex
+	var transportquic *quic.Transport
+	roundTripper.Dial = func(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (*quic.Conn, error) {
+		// 分解地址并替换为指定的IP地址。
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		a, err := net.ResolveUDPAddr("udp", net.JoinHostPort(serverIP, port))
+		if err != nil {
+			return nil, err
+		}
+		/* 所有连接共用一个UDP套接字，第一次连接时创建 */
+		mutex.Lock()
+		if transportquic == nil {
+			udpConn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				mutex.Unlock()
+				return nil, err
+			}
+			transportquic = &quic.Transport{Conn: udpConn}
+		}
+		var tr = transportquic
+		mutex.Unlock()
+		conn, err := tr.DialEarly(ctx, a, tlsConf, quicConf)
+		if err != nil {
+			log.Println("http3连接失败", host, port, err)
+			return nil, err
+		}
+		log.Println("http3连接成功", host, port, conn.LocalAddr(), conn.RemoteAddr())
+		return conn, nil
+	}
+	return &adapter.HTTPRoundTripperAndCloserImplement{RoundTripper: roundTripper.RoundTrip, Closer: func() error {
+		var err = roundTripper.Close()
+		mutex.Lock()
+		defer mutex.Unlock()
+		if transportquic != nil {
+			transportquic.Close()
+			transportquic = nil
+		}
+		return err
+	}}
+}
+
+var doh3ClientsMutex sync.Mutex
+var doh3Clients = map[string]*dns_experiment.DoHPersistentClient{}
+
+// DoHTTP3PersistentClientOf 返回服务器URL和固定IP地址对应的共享HTTP/3 DoH客户端，第一次使用时创建。
+//
+// 参数:
+// serverURL - DoH服务器的URL。
+// serverIP - 连接服务器使用的固定IP地址，为空时使用系统解析器。
+func DoHTTP3PersistentClientOf(serverURL string, serverIP string) *dns_experiment.DoHPersistentClient {
+	doh3ClientsMutex.Lock()
+	defer doh3ClientsMutex.Unlock()
+	var key = serverURL + "|" + serverIP
+	var client = doh3Clients[key]
+	if client == nil {
+		client = NewDoHTTP3PersistentClient(serverURL, func(o *dns_experiment.DoHClientOptions) { o.ServerIP = serverIP })
+		doh3Clients[key] = client
+	}
+	return client
+}
@@ -0,0 +1,73 @@
+package h3
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/dns_server"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/internal/testcert"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestDoHTTP3PersistentClient(t *testing.T) {
+	serverConfig, clientConfig := testcert.Configs(t, "dns.example")
+	var handler = dns_server.NewDoHHandler(func(o *dns_server.Options) {
+		o.Query = func(m *dns.Msg) (*dns.Msg, error) {
+			var r = new(dns.Msg)
+			r.SetReply(m)
+			r.Answer = append(r.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{m.Question[0].Name}})
+			return r, nil
+		}
+	})
+	var mutex sync.Mutex
+	var remotes = map[string]bool{}
+	var server = &http3.Server{TLSConfig: http3.ConfigureTLSConfig(serverConfig), Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		remotes[r.RemoteAddr] = true
+		mutex.Unlock()
+		handler.ServeHTTP(w, r)
+	})}
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(udpConn)
+	defer server.Close()
+
+	/* 使用固定IP地址连接，TLS仍然验证URL中的域名 */
+	var client = NewDoHTTP3PersistentClient(fmt.Sprintf("https://dns.example:%d/dns-query", udpConn.LocalAddr().(*net.UDPAddr).Port), func(o *dns_experiment.DoHClientOptions) {
+		o.ServerIP = "127.0.0.1"
+		o.TLSConfig = clientConfig
+		o.Method = http.MethodGet
+	})
+	defer client.Close()
+	for round := 0; round < 2; round++ {
+		var group sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				var msg = new(dns.Msg)
+				msg.SetQuestion(fmt.Sprintf("q%d.example.com.", i), dns.TypeTXT)
+				msg.Id = uint16(1000 + i)
+				response, err := client.Exchange(msg)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if response.Id != msg.Id || response.Answer[0].(*dns.TXT).Txt[0] != msg.Question[0].Name {
+					t.Errorf("response does not match query %s: %v", msg.Question[0].Name, response)
+				}
+			}()
+		}
+		group.Wait()
+	}
+	if len(remotes) != 1 {
+		t.Errorf("queries should share one quic connection: %v", remotes)
+	}
+}
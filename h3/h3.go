@@ -3,17 +3,14 @@ package h3
 import (
 	"context"
 	"crypto/tls"
-	"errors"
-	"fmt"
-	"io"
 	"log"
 	"net"
 	"net/http"
-	"strings"
 	"sync"
-	"time"
 
 	"github.com/masx200/http3-reverse-proxy-server-experiment/adapter"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/happy_eyeballs"
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
@@ -72,11 +69,12 @@ func CreateHTTP3TransportWithIP(ip string) http.RoundTripper {
 // 此函数允许在每次HTTP请求时动态指定IP地址，用于建立QUIC连接。
 //
 // 参数:
-// getter func() string - 一个函数，返回一个字符串形式的IP地址。
+// getter func() ([]string, error) - 一个函数，返回字符串形式的IP地址列表，多个地址按照 RFC 8305 交替地址族依次尝试连接。
+// getECHClient func() *ech.Client - 一个函数，返回建立QUIC连接时使用的 ECH 客户端，为nil或者返回nil时不使用 ECH。
 //
 // 返回值:
 // http.RoundTripper - 符合HTTP运输接口的定制HTTP/3传输器。
-func CreateHTTP3TransportWithIPGetter(getter func() (string, error)) adapter.HTTPRoundTripperAndCloserInterface {
+func CreateHTTP3TransportWithIPGetter(getter func() ([]string, error), getECHClient func() *ech.Client) adapter.HTTPRoundTripperAndCloserInterface {
 	var transportquic *quic.Transport
 	var mutex sync.Mutex
 	var roundTripper = /*  &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
@@ -117,20 +115,35 @@ func CreateHTTP3TransportWithIPGetter(getter func() (string, error)) adapter.HTT
 			if err != nil {
 				return nil, err
 			}
-			var ip, err2 = getter()
+			var ips, err2 = getter()
 			if err2 != nil {
-				return nil, err
-			}
-			addr2 := net.JoinHostPort(ip, port)
-			a, err := net.ResolveUDPAddr("udp", addr2)
-			if err != nil {
-				return nil, err
+				return nil, err2
 			}
 
-			// 使用替换后的地址尝试建立QUIC连接。
-			conn, err := transportquic.DialEarly(ctx, a, tlsConf, quicConf)
+			var echClient *ech.Client
+			if getECHClient != nil {
+				echClient = getECHClient()
+			}
+			// 按照 RFC 8305 交替地址族，依次使用替换后的地址尝试建立QUIC连接。
+			conn, err := ech.Handshake(ctx, echClient, port, tlsConf, func(ctx context.Context, tlsConf *tls.Config) (*quic.Conn, error) {
+				return happy_eyeballs.Dial(ctx, happy_eyeballs.SortAddresses(ips), happy_eyeballs.DefaultAttemptDelay, func(ctx context.Context, ip string) (*quic.Conn, error) {
+					a, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ip, port))
+					if err != nil {
+						return nil, err
+					}
+					if echClient != nil {
+						/* 需要完成握手才能知道服务器是否接受了 ECH */
+						return transportquic.Dial(ctx, a, tlsConf, quicConf)
+					}
+					return transportquic.DialEarly(ctx, a, tlsConf, quicConf)
+				}, func(conn *quic.Conn) {
+					conn.CloseWithError(0, "")
+				})
+			}, func(conn *quic.Conn) tls.ConnectionState {
+				return conn.ConnectionState().TLS
+			})
 			if err != nil {
-				log.Println("http3连接失败", ServerName, host, port /*  conn.LocalAddr(), conn.RemoteAddr() */)
+				log.Println("http3连接失败", ServerName, host, port, err)
 				return nil, err
 			}
 			log.Println("http3连接成功", ServerName, host, port, conn.LocalAddr(), conn.RemoteAddr())
@@ -167,61 +180,10 @@ func CreateHTTP3TransportWithIPGetter(getter func() (string, error)) adapter.HTT
 // r: 代表DNS应答消息的dns.Msg对象。
 // err: 如果过程中发生错误，则返回错误信息。
 func DoHTTP3Client(msg *dns.Msg, dohttp3ServerURL string, dohip ...string) (r *dns.Msg, err error) {
-	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	/* 为了doh的缓存,需要设置id为0 ,可以缓存*/
-	msg.Id = 0
-	var client *http.Client
+	var serverIP string
 	if len(dohip) > 0 {
-		// 如果有指定的 IP 地址，使用该 IP 地址创建 HTTP/3 传输
-		transport := CreateHTTP3TransportWithIP(dohip[0])
-		client = &http.Client{
-			Transport: transport,
-		}
-	} else {
-		// 没有指定 IP 地址，使用默认的 HTTP/3 传输
-		client = &http.Client{
-			Transport: &http3.Transport{},
-		}
-	}
-
-	body, err := msg.Pack()
-	if err != nil {
-		log.Println(dohttp3ServerURL, err)
-		return nil, err
-	}
-	req, err := http.NewRequestWithContext(ctx, "POST", dohttp3ServerURL, strings.NewReader(string(body)))
-	req.Header.Set("Content-Type", "application/dns-message")
-	//http request doh
-	res, err := client.Do(req) //Post(dohttp3ServerURL, "application/dns-message", strings.NewReader(string(body)))
-	if err != nil {
-		log.Println(dohttp3ServerURL, err)
-		return nil, err
-	}
-	//res.status check
-	if res.StatusCode != 200 {
-		log.Println(dohttp3ServerURL, "http status code is not 200  "+fmt.Sprintf("status code is %d", res.StatusCode))
-		return nil, errors.New("http status code is not 200 " + fmt.Sprintf("status code is %d", res.StatusCode))
-	}
-
-	//check content-type
-	if res.Header.Get("Content-Type") != "application/dns-message" {
-		log.Println(dohttp3ServerURL, "content-type is not application/dns-message "+res.Header.Get("Content-Type"))
-		return nil, errors.New("content-type is not application/dns-message " + res.Header.Get("Content-Type"))
-	}
-	//利用ioutil包读取百度服务器返回的数据
-	data, err := io.ReadAll(res.Body)
-	defer res.Body.Close() //一定要记得关闭连接
-	if err != nil {
-		log.Println(dohttp3ServerURL, err)
-		return nil, err
-	}
-	// log.Printf("%s", data)
-	resp := &dns.Msg{}
-	err = resp.Unpack(data)
-	if err != nil {
-		log.Println(dohttp3ServerURL, err)
-		return nil, err
+		serverIP = dohip[0]
 	}
-	return resp, nil
+	// 使用保持连接的HTTP/3 DOH客户端，多个查询复用同一个QUIC连接
+	return DoHTTP3PersistentClientOf(dohttp3ServerURL, serverIP).Exchange(msg)
 }
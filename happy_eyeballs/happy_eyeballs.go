@@ -0,0 +1,142 @@
+package happy_eyeballs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultAttemptDelay 是两次连接尝试之间的默认间隔（RFC 8305 第 5 节推荐的 250 毫秒）。
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// ErrNoAddresses 表示没有可以连接的地址。
+var ErrNoAddresses = errors.New("happy_eyeballs: no addresses")
+
+// SortAddresses 按照 RFC 8305 第 4 节对地址排序：去除重复地址后，IPv6 和 IPv4 交替排列，IPv6 优先，
+// 同一地址族内保持原有顺序，无法解析为IP的地址（例如主机名）排在最后。
+//
+// 参数:
+// addresses - 解析得到的地址列表。
+//
+// 返回值:
+// 排序后的新地址列表。
+func SortAddresses(addresses []string) []string {
+	var seen = map[string]bool{}
+	var ipv6, ipv4, others []string
+	for _, address := range addresses {
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		var ip = net.ParseIP(address)
+		switch {
+		case ip == nil:
+			others = append(others, address)
+		case ip.To4() != nil:
+			ipv4 = append(ipv4, address)
+		default:
+			ipv6 = append(ipv6, address)
+		}
+	}
+	var result = make([]string, 0, len(ipv6)+len(ipv4)+len(others))
+	for i := 0; i < len(ipv6) || i < len(ipv4); i++ {
+		if i < len(ipv6) {
+			result = append(result, ipv6[i])
+		}
+		if i < len(ipv4) {
+			result = append(result, ipv4[i])
+		}
+	}
+	return append(result, others...)
+}
+
+// LookupAddresses 使用系统解析器解析主机的 A 和 AAAA 记录，并按照 SortAddresses 排序。
+// 主机本身就是IP地址时直接返回。
+func LookupAddresses(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return SortAddresses(addresses), nil
+}
+
+// Dial 按照 RFC 8305 的方式依次向多个地址发起连接：每隔 attemptDelay 开始下一次尝试，
+// 某次尝试失败时立即开始下一次尝试，第一个成功的连接被返回，其余尝试被取消，
+// 取消之前已经成功的多余连接会交给 discard 关闭。
+//
+// 参数:
+// ctx - 连接的上下文。
+// addresses - 按优先顺序排列的地址，参见 SortAddresses。
+// attemptDelay - 两次连接尝试之间的间隔。
+// dial - 连接单个地址的函数。
+// discard - 关闭多余连接的函数。
+//
+// 返回值:
+// 第一个成功的连接，全部失败时返回所有尝试的错误。
+func Dial[T any](ctx context.Context, addresses []string, attemptDelay time.Duration, dial func(ctx context.Context, address string) (T, error), discard func(T)) (T, error) {
+	var zero T
+	if len(addresses) == 0 {
+		return zero, ErrNoAddresses
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		address string
+		value   T
+		err     error
+	}
+	var results = make(chan result, len(addresses))
+	var next, pending int
+	var start = func() {
+		var address = addresses[next]
+		next++
+		pending++
+		go func() {
+			value, err := dial(ctx, address)
+			results <- result{address: address, value: value, err: err}
+		}()
+	}
+	var errs []error
+	start()
+	for pending > 0 {
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if next < len(addresses) {
+			timer = time.NewTimer(attemptDelay)
+			timeout = timer.C
+		}
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				/* 其余尝试被取消后，仍然可能有已经成功的连接，需要在后台关闭 */
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.err == nil && discard != nil {
+							discard(late.value)
+						}
+					}
+				}(pending)
+				return r.value, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", r.address, r.err))
+			if next < len(addresses) {
+				start()
+			}
+		case <-timeout:
+			start()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return zero, errors.Join(errs...)
+}
@@ -0,0 +1,76 @@
+package happy_eyeballs
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSortAddresses(t *testing.T) {
+	var sorted = SortAddresses([]string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "example.com", "192.0.2.3", "2001:db8::2", "192.0.2.1"})
+	var expected = []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3", "example.com"}
+	if !reflect.DeepEqual(sorted, expected) {
+		t.Errorf("unexpected order: %v", sorted)
+	}
+}
+
+func TestDialStaggersAttempts(t *testing.T) {
+	var started = time.Now()
+	var discarded atomic.Int32
+	value, err := Dial(context.Background(), []string{"hang", "slow", "fast"}, 50*time.Millisecond, func(ctx context.Context, address string) (string, error) {
+		switch address {
+		case "hang":
+			<-ctx.Done()
+			return "", ctx.Err()
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+			return address, nil
+		}
+		return address, nil
+	}, func(string) { discarded.Add(1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	/* 第三个地址在两个间隔之后开始并最先成功 */
+	if value != "fast" {
+		t.Errorf("unexpected winner: %s", value)
+	}
+	if elapsed := time.Since(started); elapsed < 100*time.Millisecond || elapsed > 180*time.Millisecond {
+		t.Errorf("unexpected elapsed time: %v", elapsed)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if discarded.Load() != 1 {
+		t.Errorf("late connection should be discarded, got %d", discarded.Load())
+	}
+}
+
+func TestDialStartsNextAttemptOnFailure(t *testing.T) {
+	var started = time.Now()
+	value, err := Dial(context.Background(), []string{"refused", "ok"}, time.Hour, func(ctx context.Context, address string) (string, error) {
+		if address == "refused" {
+			return "", errors.New("connection refused")
+		}
+		return address, nil
+	}, nil)
+	if err != nil || value != "ok" {
+		t.Fatalf("unexpected result: %q %v", value, err)
+	}
+	if time.Since(started) > time.Second {
+		t.Error("failure should start the next attempt immediately")
+	}
+
+	_, err = Dial(context.Background(), []string{"a", "b"}, time.Hour, func(ctx context.Context, address string) (string, error) {
+		return "", errors.New("unreachable")
+	}, nil)
+	if err == nil || err.Error() != "a: unreachable\nb: unreachable" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := Dial(context.Background(), nil, time.Millisecond, func(ctx context.Context, address string) (string, error) {
+		return address, nil
+	}, nil); !errors.Is(err, ErrNoAddresses) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
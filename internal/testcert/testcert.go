@@ -0,0 +1,68 @@
+// Package testcert 为测试生成自签名证书。
+package testcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// New 生成一个前后一小时内有效的自签名证书。
+//
+// 参数:
+// t - 测试，生成失败时终止测试。
+// names - 证书中的主机名或IP地址，第一个名称同时作为证书的 CommonName。
+//
+// 返回值:
+// 服务器使用的证书和信任该证书的证书池。
+func New(t testing.TB, names ...string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template = &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if len(names) > 0 {
+		template.Subject = pkix.Name{CommonName: names[0]}
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pool = x509.NewCertPool()
+	pool.AddCert(certificate)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: privateKey}, pool
+}
+
+// Configs 生成主机名为 serverName 的自签名证书。
+//
+// 返回值:
+// 服务器的TLS配置和信任该证书的客户端TLS配置。
+func Configs(t testing.TB, serverName string) (*tls.Config, *tls.Config) {
+	t.Helper()
+	certificate, pool := New(t, serverName)
+	return &tls.Config{Certificates: []tls.Certificate{certificate}},
+		&tls.Config{ServerName: serverName, RootCAs: pool}
+}
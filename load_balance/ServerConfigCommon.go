@@ -83,4 +83,16 @@ type ServerConfigCommon interface {
 
 	OnUpstreamFailure()
 	OnUpstreamHealthy()
+
+	// AcquireUpgradeConnection 在建立协议升级连接（如WebSocket）之前占用一个连接名额。
+	// 返回值：bool - 是否占用成功，当前连接数已达到上限时返回false
+	AcquireUpgradeConnection() bool
+	// ReleaseUpgradeConnection 在协议升级连接关闭后释放一个连接名额
+	ReleaseUpgradeConnection()
+	// GetUpgradeConnectionCount 返回当前协议升级连接的数量
+	GetUpgradeConnectionCount() int64
+	// SetUpgradeConnectionMaxCount 设置协议升级连接数量的上限，小于等于0表示不限制
+	SetUpgradeConnectionMaxCount(int64)
+	// GetUpgradeConnectionMaxCount 返回协议升级连接数量的上限
+	GetUpgradeConnectionMaxCount() int64
 }
@@ -0,0 +1,59 @@
+package load_balance
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/grpc_proxy"
+)
+
+// GRPCUnhealthyStatus 判断 gRPC 状态码是否表示上游服务不健康。
+// 只有 UNAVAILABLE 表示服务本身不可用，其他状态码通常是业务错误。
+func GRPCUnhealthyStatus(code int) bool {
+	return code == grpc_proxy.CodeUnavailable
+}
+
+// GRPCResponseCheck 检查 gRPC 响应头部中的 grpc-status（Trailers-Only 响应）。
+// 非 gRPC 响应和没有在头部中返回 grpc-status 的响应视为健康，尾部中的状态由 grpcStatusBody 在响应体读取完毕后检查。
+func GRPCResponseCheck(response *http.Response) (bool, error) {
+	if !grpc_proxy.IsGRPCContentType(response.Header.Get("Content-Type")) {
+		return true, nil
+	}
+	code, ok := grpc_proxy.Status(response)
+	if ok && GRPCUnhealthyStatus(code) {
+		return false, errors.New("grpc-status " + strconv.Itoa(code) + " means upstream unavailable")
+	}
+	return true, nil
+}
+
+// grpcStatusBody 包装 gRPC 响应体，在读取到结尾时检查尾部中的 grpc-status，
+// 表示上游不健康时调用一次 onUnhealthy。
+type grpcStatusBody struct {
+	io.ReadCloser
+	response    *http.Response
+	once        sync.Once
+	onUnhealthy func(error)
+}
+
+func (g *grpcStatusBody) Read(p []byte) (int, error) {
+	n, err := g.ReadCloser.Read(p)
+	if err == io.EOF {
+		g.once.Do(func() {
+			if ok, err := GRPCResponseCheck(g.response); !ok {
+				g.onUnhealthy(err)
+			}
+		})
+	}
+	return n, err
+}
+
+// watchGRPCStatus 在 gRPC 响应的响应体读取完毕后根据尾部中的 grpc-status 执行被动健康检查。
+func watchGRPCStatus(response *http.Response, onUnhealthy func(error)) {
+	if !grpc_proxy.IsGRPCContentType(response.Header.Get("Content-Type")) {
+		return
+	}
+	response.Body = &grpcStatusBody{ReadCloser: response.Body, response: response, onUnhealthy: onUnhealthy}
+}
@@ -0,0 +1,51 @@
+package load_balance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/grpc_proxy"
+)
+
+func TestGRPCStatusPassiveHealthCheck(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", "14")
+	}))
+	defer upstream.Close()
+
+	balancer, err := NewSingleHostHTTP3HTTP2LoadBalancerOfAddress("grpc-test", upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer balancer.Close()
+	var service = balancer.GetLoadBalanceService().Unwrap()
+	service.SetActiveHealthyCheckEnabled(false)
+	service.SetPassiveHealthyCheckEnabled(true)
+	/* 测试服务器只支持HTTP/1.1，只保留HTTP/2的子上游 */
+	service.GetUpStreams().Delete("http3-" + upstream.URL)
+	child, ok := service.GetUpStreams().Get("http2-" + upstream.URL)
+	if !ok {
+		t.Fatal("missing http2 upstream")
+	}
+	child.GetServerConfigCommon().SetPassiveHealthyCheckEnabled(true)
+	child.GetServerConfigCommon().SetUnHealthyFailMaxCount(1)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/test.Service/Method", strings.NewReader("\x00\x00\x00\x00\x00"))
+	req.Header.Set("Content-Type", "application/grpc")
+	recorder := httptest.NewRecorder()
+	grpc_proxy.Serve(recorder, req, balancer.RoundTrip)
+
+	if status := recorder.Header().Get(http.TrailerPrefix + "Grpc-Status"); status != "14" {
+		t.Errorf("unexpected grpc-status: %q", status)
+	}
+	/* grpc-status 为 UNAVAILABLE 的响应读取完毕后，上游被标记为不健康 */
+	if child.GetServerConfigCommon().GetHealthy() {
+		t.Error("upstream should be marked unhealthy after grpc-status 14")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"sync"
 	// "net/url"
 
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
 	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
 	h12_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/h12"
 	print_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/print"
@@ -92,11 +93,12 @@ func NewSingleHostHTTP12ClientOfAddress(Identifier string, UpStreamServerURL str
 
 	m := &SingleHostHTTP12ClientOfAddress{
 		Identifier:              Identifier,
-		ActiveHealthyChecker:    ActiveHealthyCheckDefault,              // 使用默认的主动健康检查器
-		PassiveUnHealthyChecker: HealthyResponseCheckDefault,            // 使用默认的健康响应检查器
-		UpStreamServerURL:       UpStreamServerURL,                      // 设置上游服务器URL
-		GetServerAddress:        func() string { return ServerAddress }, // 设置服务端地址
-		IsHealthy:               true,                                   // 初始状态设为健康
+		ActiveHealthyChecker:    ActiveHealthyCheckDefault,                                       // 使用默认的主动健康检查器
+		PassiveUnHealthyChecker: HealthyResponseCheckDefault,                                     // 使用默认的健康响应检查器
+		UpStreamServerURL:       UpStreamServerURL,                                               // 设置上游服务器URL
+		GetServerAddresses:      func() []string { return LookupServerAddresses(ServerAddress) }, // 设置服务端地址
+		GetECHClient:            func() *ech.Client { return nil },                               // 默认不使用 ECH
+		IsHealthy:               true,                                                            // 初始状态设为健康
 		// RoundTripper:           transport,                   // 使用默认的传输器
 		HealthCheckIntervalMs:   HealthCheckIntervalMsDefault,
 		unHealthyFailDurationMs: unHealthyFailDurationMsDefault,
@@ -107,16 +109,31 @@ func NewSingleHostHTTP12ClientOfAddress(Identifier string, UpStreamServerURL str
 
 	// if strings.HasPrefix(m.UpStreamServerURL, "https") {
 	/* 按照加密和不加密进行选择http2还是http1 */
-	var h2rtcl = h12_experiment.CreateHTTP12TransportWithIPGetter(func() string {
-		return m.GetServerAddress()
-	})
+	var getECHClient = func() *ech.Client {
+		return m.GetECHClient()
+	}
+	var h2rtcl = h12_experiment.CreateHTTP12TransportWithIPGetter(func() []string {
+		return m.GetServerAddresses()
+	}, getECHClient)
 	m.RoundTripper = h2rtcl
+	/* 协议升级只能在HTTP/1.1上进行,需要单独的传输 */
+	var h1rtcl = h12_experiment.CreateHTTP1TransportWithIPGetter(func() []string {
+		return m.GetServerAddresses()
+	}, getECHClient)
+	m.UpgradeRoundTripper = h1rtcl
+	/* HTTP/2扩展CONNECT需要使用golang.org/x/net/http2的传输 */
+	var xconnectrt, xconnectclose = createExtendedConnectRoundTripper(func() []string {
+		return m.GetServerAddresses()
+	}, getECHClient)
+	m.ExtendedConnectRoundTripper = xconnectrt
 	m.Closer = func() error {
+		xconnectclose()
+		h1rtcl.Close()
 		return h2rtcl.Close()
 	}
 	// } else {
 	// 	m.RoundTripper = h12_experiment.CreateHTTP1TransportWithIPGetter(func() string {
-	// 		return m.GetServerAddress()
+	// 		return m.GetServerAddresses()
 	// 	})
 	// }
 
@@ -133,7 +150,8 @@ type SingleHostHTTP12ClientOfAddress struct {
 	ServerConfigCommon      ServerConfigCommon
 	unHealthyFailDurationMs int64
 	HealthCheckIntervalMs   int64
-	GetServerAddress        func() string                                                                                                       // 服务器地址，指定客户端要连接的HTTP服务器的地址。
+	GetServerAddresses      func() []string                                                                                                     // 服务器地址列表，指定客户端要连接的HTTP服务器的地址，多个地址按照 RFC 8305 交替地址族依次尝试连接。
+	GetECHClient            func() *ech.Client                                                                                                  // 返回建立TLS和QUIC连接时使用的 ECH 客户端，返回nil时不使用 ECH。
 	ActiveHealthyChecker    func(RoundTripper http.RoundTripper, url string, method string, statusCodeMin int, statusCodeMax int) (bool, error) // 活跃健康检查函数，用于检查给定的传输和URL是否健康。
 	Identifier              string                                                                                                              // 标识符，用于标识此HTTP客户端的唯一字符串。
 	HealthMutex             sync.Mutex
@@ -143,6 +161,10 @@ type SingleHostHTTP12ClientOfAddress struct {
 	UpStreamServerURL       string                                                                                      // 上游服务器URL，指定客户端将请求转发到的上游服务器的地址。
 	UnHealthyFailMaxCount   int64
 	Closer                  func() error
+	UpgradeRoundTripper     http.RoundTripper // 只使用HTTP/1.1的传输，用于WebSocket等协议升级请求。
+	// 只使用HTTP/2的传输，用于扩展CONNECT请求（RFC 8441）。
+	ExtendedConnectRoundTripper http.RoundTripper
+	extendedConnect             extendedConnectState
 }
 
 // GetActiveHealthyCheckEnabled implements LoadBalanceAndUpStream.
@@ -269,7 +291,8 @@ func HealthyResponseCheckDefault(response *http.Response, UnHealthyStatusMin int
 	if response.StatusCode >= UnHealthyStatusMin && response.StatusCode < UnHealthyStatusMax {
 		return false, errors.New("StatusCode " + fmt.Sprint(response.StatusCode) + "   is greater than 500")
 	}
-	return true, nil
+	/* gRPC 的错误通过 grpc-status 返回，HTTP状态码始终为200 */
+	return GRPCResponseCheck(response)
 } // SingleHostHTTPClientOfAddress 是一个针对单个主机地址的HTTP客户端实现，
 // 实现了LoadBalanceAndUpStream接口，用于负载均衡和上游服务管理。
 
@@ -0,0 +1,146 @@
+package load_balance
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+)
+
+// refreshingLoadBalancer 是通过DNS发现子上游的负载均衡器的公共部分：第一次使用时启动定期刷新，
+// 刷新时按照新的子上游标识符列表添加和移除子上游，关闭时停止定期刷新。
+// ResolvingLoadBalancerOfHostname 和 SRVLoadBalancer 嵌入它，只提供刷新一次的函数和刷新间隔。
+type refreshingLoadBalancer struct {
+	*SingleHostHTTP3HTTP2LoadBalancerOfAddress
+
+	refresh  func()               // 刷新一次子上游，并记录遇到的错误。
+	interval func() time.Duration // 下一次刷新的间隔。
+
+	resolveMutex sync.Mutex
+	resolveTimer *time.Timer
+	resolveStop  chan struct{}
+}
+
+// newRefreshingLoadBalancer 创建子上游集合是线程安全的负载均衡器，子上游在后台刷新时被添加和移除。
+func newRefreshingLoadBalancer(Identifier string, UpStreamServerURL string, Hostname string) *refreshingLoadBalancer {
+	return &refreshingLoadBalancer{
+		SingleHostHTTP3HTTP2LoadBalancerOfAddress: newSingleHostHTTP3HTTP2LoadBalancer(Identifier, UpStreamServerURL, Hostname, dns_experiment.NewMapImplementSynchronous[string, LoadBalanceAndUpStream]()),
+	}
+}
+
+// reconcileChildren 使子上游的集合与标识符列表一致：为新出现的标识符创建子上游，移除并关闭不在列表中的子上游。
+// 调用者需要保证同一时间只有一次调用。
+//
+// 参数:
+// identifiers - 需要的子上游的标识符。
+// newChild - 创建子上游的函数。
+//
+// 返回值:
+// 现有的子上游的标识符集合，不包括创建失败的标识符，以及创建子上游时遇到的错误。
+func (r *refreshingLoadBalancer) reconcileChildren(identifiers []string, newChild func(identifier string) (LoadBalanceAndUpStream, error)) (map[string]bool, error) {
+	var wanted = map[string]bool{}
+	var errs []error
+	for _, identifier := range identifiers {
+		if wanted[identifier] {
+			continue
+		}
+		if r.UpStreams.Has(identifier) {
+			wanted[identifier] = true
+			continue
+		}
+		child, err := newChild(identifier)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		wanted[identifier] = true
+		log.Println("add upstream", identifier)
+		r.UpStreams.Set(identifier, child)
+		/* 健康检查已经启动时，新的子上游也需要启动健康检查 */
+		if r.LoadBalanceService.HealthyCheckRunning() {
+			child.GetLoadBalanceService().IfSome(func(v LoadBalanceService) {
+				go v.HealthyCheckStart()
+			})
+		}
+	}
+	for _, identifier := range r.UpStreams.Keys() {
+		if wanted[identifier] {
+			continue
+		}
+		child, ok := r.UpStreams.Get(identifier)
+		r.UpStreams.Delete(identifier)
+		if !ok {
+			continue
+		}
+		log.Println("remove upstream", identifier)
+		if err := child.Close(); err != nil {
+			log.Println("Close", err)
+		}
+	}
+	return wanted, errors.Join(errs...)
+}
+
+// ResolveStart 启动定期刷新子上游，已经启动时不做任何事情。
+func (r *refreshingLoadBalancer) ResolveStart() {
+	r.resolveMutex.Lock()
+	defer r.resolveMutex.Unlock()
+	if r.resolveTimer != nil {
+		return
+	}
+	interval := r.interval()
+	r.resolveTimer = time.NewTimer(interval)
+	r.resolveStop = make(chan struct{})
+	go func(timer *time.Timer, stop chan struct{}) {
+		for {
+			select {
+			case <-timer.C:
+				r.refresh()
+				timer.Reset(r.interval())
+			case <-stop:
+				return
+			}
+		}
+	}(r.resolveTimer, r.resolveStop)
+	log.Printf("定期刷新上游已启动，间隔时间为 %v "+r.GetIdentifier(), interval)
+}
+
+// ResolveStop 停止定期刷新子上游。
+func (r *refreshingLoadBalancer) ResolveStop() {
+	r.resolveMutex.Lock()
+	defer r.resolveMutex.Unlock()
+	if r.resolveTimer == nil {
+		return
+	}
+	r.resolveTimer.Stop()
+	close(r.resolveStop)
+	r.resolveTimer = nil
+	r.resolveStop = nil
+}
+
+// Close implements LoadBalanceAndUpStream.
+func (r *refreshingLoadBalancer) Close() error {
+	r.ResolveStop()
+	return r.SingleHostHTTP3HTTP2LoadBalancerOfAddress.Close()
+}
+
+// RoundTrip 实现了LoadBalanceAndUpStream接口的RoundTrip方法，第一次使用时启动定期刷新。
+func (r *refreshingLoadBalancer) RoundTrip(request *http.Request) (*http.Response, error) {
+	r.ResolveStart()
+	return r.SingleHostHTTP3HTTP2LoadBalancerOfAddress.RoundTrip(request)
+}
+
+// Upgrade 实现了 UpgradeUpStream 接口，第一次使用时启动定期刷新。
+func (r *refreshingLoadBalancer) Upgrade(request *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+	r.ResolveStart()
+	return r.SingleHostHTTP3HTTP2LoadBalancerOfAddress.Upgrade(request)
+}
+
+// DialWebSocket 实现了 WebSocketUpStream 接口，第一次使用时启动定期刷新。
+func (r *refreshingLoadBalancer) DialWebSocket(request *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+	r.ResolveStart()
+	return r.SingleHostHTTP3HTTP2LoadBalancerOfAddress.DialWebSocket(request)
+}
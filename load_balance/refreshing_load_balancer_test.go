@@ -0,0 +1,48 @@
+package load_balance
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/miekg/dns"
+)
+
+func TestRefreshingLoadBalancerLifecycle(t *testing.T) {
+	var lookups atomic.Int32
+	upstream, err := NewResolvingLoadBalancerOfHostname("resolving", "https://example.com/", generic.NewMapImplement[string, func(m *dns.Msg) (r *dns.Msg, err error)](), func(r *ResolvingLoadBalancerOfHostname) {
+		r.ResolveIntervalMs = 10
+		r.ResolveAddresses = func(host string) ([]string, error) {
+			lookups.Add(1)
+			return []string{"192.0.2.1"}, nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resolving = upstream.(*ResolvingLoadBalancerOfHostname)
+	/* 创建时解析一次，使用前不定期刷新 */
+	time.Sleep(50 * time.Millisecond)
+	if count := lookups.Load(); count != 1 {
+		t.Fatalf("unexpected lookups before start: %d", count)
+	}
+	resolving.ResolveStart()
+	resolving.ResolveStart()
+	var deadline = time.Now().Add(5 * time.Second)
+	for lookups.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := lookups.Load(); count < 3 {
+		t.Fatalf("refresh should run periodically: %d", count)
+	}
+	/* 关闭后不再刷新 */
+	if err := upstream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var stopped = lookups.Load()
+	time.Sleep(50 * time.Millisecond)
+	if count := lookups.Load(); count > stopped+1 {
+		t.Errorf("refresh should stop after close: %d %d", stopped, count)
+	}
+}
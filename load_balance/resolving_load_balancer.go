@@ -0,0 +1,131 @@
+package load_balance
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/happy_eyeballs"
+	"github.com/miekg/dns"
+)
+
+// ResolveIntervalMsDefault 是重新解析上游主机名的默认间隔，单位为毫秒。
+const ResolveIntervalMsDefault = 60 * 1000
+
+// ResolvingLoadBalancerOfHostname 是一个按IP地址负载均衡的上游：它定期通过DNS解析上游主机名，
+// 为每个解析到的IP地址创建一个子上游，每个子上游有自己的健康状态，
+// DNS应答变化时添加新的子上游，并移除和关闭已经消失的IP地址对应的子上游。
+type ResolvingLoadBalancerOfHostname struct {
+	*refreshingLoadBalancer
+
+	Hostname string // 需要解析的上游主机名。
+	//毫秒
+	ResolveIntervalMs int64
+	ResolveAddresses  func(host string) ([]string, error)                // 解析主机名的函数，默认使用配置的DNS查询回调函数。
+	ChildOptions      []func(*SingleHostHTTP3HTTP2LoadBalancerOfAddress) // 创建子上游时使用的选项。
+
+	refreshMutex sync.Mutex
+	addresses    []string
+}
+
+// NewResolvingLoadBalancerOfHostname 创建一个按IP地址负载均衡的上游，并立即解析一次上游主机名。
+//
+// 参数:
+// Identifier - 负载均衡器的标识符，子上游的标识符为 Identifier-IP地址。
+// UpStreamServerURL - 上游服务器的URL。
+// queryCallbacks - DNS查询回调函数，例如 DoH、DoH3、DoQ 或 DoT 客户端，参见 DNSQueryCallbacksFromURLs。
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的负载均衡器，以及解析上游URL时遇到的错误。
+func NewResolvingLoadBalancerOfHostname(Identifier string, UpStreamServerURL string, queryCallbacks generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)], options ...func(*ResolvingLoadBalancerOfHostname)) (LoadBalanceAndUpStream, error) {
+	var Hostname, err = ExtractHostname(UpStreamServerURL)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	var m = &ResolvingLoadBalancerOfHostname{
+		refreshingLoadBalancer: newRefreshingLoadBalancer(Identifier, UpStreamServerURL, Hostname),
+		Hostname:               Hostname,
+		ResolveIntervalMs:      ResolveIntervalMsDefault,
+		ResolveAddresses: func(host string) ([]string, error) {
+			return dns_experiment.DnsResolverMultipleServers(host, queryCallbacks)
+		},
+	}
+	m.GetServerAddresses = m.GetAddresses
+	m.refresh = func() {
+		if err := m.Refresh(); err != nil {
+			log.Println("resolve upstream addresses", m.Hostname, err)
+		}
+	}
+	m.interval = func() time.Duration {
+		return time.Duration(m.ResolveIntervalMs) * time.Millisecond
+	}
+	for _, option := range options {
+		option(m)
+	}
+	m.refresh()
+	return m, nil
+}
+
+// GetAddresses 返回最近一次解析得到的IP地址列表。
+func (r *ResolvingLoadBalancerOfHostname) GetAddresses() []string {
+	r.refreshMutex.Lock()
+	defer r.refreshMutex.Unlock()
+	return append([]string(nil), r.addresses...)
+}
+
+// childIdentifier 返回IP地址对应的子上游的标识符。
+func (r *ResolvingLoadBalancerOfHostname) childIdentifier(address string) string {
+	return r.Identifier + "-" + address
+}
+
+// Refresh 解析一次上游主机名，为新出现的IP地址创建子上游，移除并关闭已经消失的IP地址对应的子上游。
+// 解析失败或者没有得到任何地址时保留现有的子上游。
+//
+// 返回值:
+// 解析或创建子上游时遇到的错误。
+func (r *ResolvingLoadBalancerOfHostname) Refresh() error {
+	addresses, err := r.ResolveAddresses(r.Hostname)
+	if err != nil {
+		return err
+	}
+	addresses = happy_eyeballs.SortAddresses(addresses)
+	if len(addresses) == 0 {
+		return errors.New("no addresses resolved for " + r.Hostname)
+	}
+	r.refreshMutex.Lock()
+	defer r.refreshMutex.Unlock()
+
+	var children = map[string]string{}
+	var identifiers = make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		var identifier = r.childIdentifier(address)
+		children[identifier] = address
+		identifiers = append(identifiers, identifier)
+	}
+	_, err = r.reconcileChildren(identifiers, func(identifier string) (LoadBalanceAndUpStream, error) {
+		return r.newChild(identifier, children[identifier])
+	})
+	r.addresses = addresses
+	return err
+}
+
+// newChild 创建只连接一个IP地址的子上游。
+func (r *ResolvingLoadBalancerOfHostname) newChild(identifier string, address string) (LoadBalanceAndUpStream, error) {
+	var options = append([]func(*SingleHostHTTP3HTTP2LoadBalancerOfAddress){func(m *SingleHostHTTP3HTTP2LoadBalancerOfAddress) {
+		m.GetServerAddresses = func() []string {
+			return []string{address}
+		}
+		m.GetECHClient = func() *ech.Client {
+			return r.GetECHClient()
+		}
+		m.SetActiveHealthyCheckEnabled(r.GetActiveHealthyCheckEnabled())
+		m.SetPassiveHealthyCheckEnabled(r.GetPassiveHealthyCheckEnabled())
+	}}, r.ChildOptions...)
+	return NewSingleHostHTTP3HTTP2LoadBalancerOfAddress(identifier, r.UpStreamServerURL, options...)
+}
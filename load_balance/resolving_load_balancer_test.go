@@ -0,0 +1,79 @@
+package load_balance
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/miekg/dns"
+)
+
+func TestResolvingLoadBalancerRefresh(t *testing.T) {
+	var mutex sync.Mutex
+	var answers = []string{"192.0.2.1", "192.0.2.2"}
+	var resolveErr error
+	upstream, err := NewResolvingLoadBalancerOfHostname("resolving", "https://example.com/", generic.NewMapImplement[string, func(m *dns.Msg) (r *dns.Msg, err error)](), func(r *ResolvingLoadBalancerOfHostname) {
+		r.ResolveAddresses = func(host string) ([]string, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if host != "example.com" {
+				t.Errorf("unexpected host: %s", host)
+			}
+			return answers, resolveErr
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	var resolving = upstream.(*ResolvingLoadBalancerOfHostname)
+	var keys = func() []string {
+		var keys = resolving.GetUpStreams().Keys()
+		sort.Strings(keys)
+		return keys
+	}
+	if expected := []string{"resolving-192.0.2.1", "resolving-192.0.2.2"}; !reflect.DeepEqual(keys(), expected) {
+		t.Fatalf("unexpected upstreams: %v", keys())
+	}
+	first, _ := resolving.GetUpStreams().Get("resolving-192.0.2.1")
+	if addresses := first.(*SingleHostHTTP3HTTP2LoadBalancerOfAddress).GetServerAddresses(); !reflect.DeepEqual(addresses, []string{"192.0.2.1"}) {
+		t.Errorf("child should only connect to its address: %v", addresses)
+	}
+
+	/* DNS应答变化时添加新的地址并移除消失的地址，保留的子上游不会被重新创建 */
+	mutex.Lock()
+	answers = []string{"192.0.2.1", "2001:db8::1"}
+	mutex.Unlock()
+	if err := resolving.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"resolving-192.0.2.1", "resolving-2001:db8::1"}; !reflect.DeepEqual(keys(), expected) {
+		t.Fatalf("unexpected upstreams: %v", keys())
+	}
+	if kept, _ := resolving.GetUpStreams().Get("resolving-192.0.2.1"); kept != first {
+		t.Error("existing upstream should be kept")
+	}
+	if addresses := resolving.GetAddresses(); !reflect.DeepEqual(addresses, []string{"2001:db8::1", "192.0.2.1"}) {
+		t.Errorf("unexpected addresses: %v", addresses)
+	}
+
+	/* 解析失败或者没有地址时保留现有的子上游 */
+	mutex.Lock()
+	resolveErr = errors.New("servfail")
+	mutex.Unlock()
+	if err := resolving.Refresh(); err == nil {
+		t.Error("expected resolve error")
+	}
+	mutex.Lock()
+	answers, resolveErr = nil, nil
+	mutex.Unlock()
+	if err := resolving.Refresh(); err == nil {
+		t.Error("expected error for empty answer")
+	}
+	if len(keys()) != 2 {
+		t.Errorf("upstreams should be kept: %v", keys())
+	}
+}
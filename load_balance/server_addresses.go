@@ -0,0 +1,115 @@
+package load_balance
+
+import (
+	"context"
+	"log"
+	"time"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/happy_eyeballs"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/resolver"
+	"github.com/miekg/dns"
+)
+
+// serverAddressesLookupTimeout 是解析上游服务器地址的超时时间。
+const serverAddressesLookupTimeout = 10 * time.Second
+
+// LookupServerAddresses 使用系统解析器解析上游服务器的 A 和 AAAA 记录，返回按照 RFC 8305 排序的地址列表。
+// dns.DefaultHosts 覆盖表中的主机名使用表中的地址，匹配 dns.DefaultRoutes 分流规则的主机名使用规则中的DNS服务器解析。
+// 解析失败时返回主机名本身，由拨号时再次解析。
+func LookupServerAddresses(host string) []string {
+	if addresses, target, found := dns_experiment.DefaultHosts.Lookup(host); found {
+		if target == "" {
+			if len(addresses) == 0 {
+				log.Println("lookup server addresses", host, "hosts cname chain too long")
+				return []string{host}
+			}
+			return happy_eyeballs.SortAddresses(addresses)
+		}
+		host = target
+	}
+	if queryCallbacks, ok := dns_experiment.DefaultRoutes.Match(host); ok {
+		addresses, err := dns_experiment.DnsResolverMultipleServers(host, queryCallbacks)
+		if err == nil {
+			return happy_eyeballs.SortAddresses(addresses)
+		}
+		log.Println("lookup server addresses", host, err)
+		return []string{host}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), serverAddressesLookupTimeout)
+	defer cancel()
+	addresses, err := happy_eyeballs.LookupAddresses(ctx, host)
+	if err != nil {
+		log.Println("lookup server addresses", host, err)
+		return []string{host}
+	}
+	return addresses
+}
+
+// WithDNSServerAddresses 返回一个选项，使负载均衡器通过 dns 包的解析器获取上游服务器的地址，
+// 地址来自 A、AAAA 记录以及 HTTPS 记录中的 ipv4hint 和 ipv6hint，并按照 RFC 8305 排序。
+//
+// 参数:
+// queryCallbacks - DNS查询回调函数，例如 DoH、DoQ 或 DoT 客户端。
+// optionsCallBacks - 用于定制DNS解析器的选项。
+//
+// 返回值:
+// NewSingleHostHTTP3HTTP2LoadBalancerOfAddress 的选项。
+func WithDNSServerAddresses(queryCallbacks generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)], optionsCallBacks ...func(*dns_experiment.DnsResolverOptions)) func(*SingleHostHTTP3HTTP2LoadBalancerOfAddress) {
+	return func(m *SingleHostHTTP3HTTP2LoadBalancerOfAddress) {
+		m.GetServerAddresses = func() []string {
+			host, err := ExtractHostname(m.UpStreamServerURL)
+			if err != nil {
+				log.Println(err)
+				return nil
+			}
+			addresses, err := dns_experiment.DnsResolverMultipleServers(host, queryCallbacks, optionsCallBacks...)
+			if err != nil {
+				log.Println("resolve server addresses", host, err)
+				return LookupServerAddresses(host)
+			}
+			return happy_eyeballs.SortAddresses(addresses)
+		}
+	}
+}
+
+// DNSQueryOptions 是 DNSQueryCallbacksFromURLs 的配置。
+//
+// 字段：
+// Strategy - 选择服务器的策略，不为空时所有服务器组合成一个按照该策略查询的解析器，参见 resolver.NewGroup。
+// EDNS - 用于修改所有服务器默认EDNS配置的函数，URL片段中的配置优先，参见 resolver.FromURL。
+type DNSQueryOptions struct {
+	Strategy resolver.Strategy
+	EDNS     []func(*dns_experiment.EDNSOptions)
+}
+
+// DNSQueryCallbacksFromURLs 根据DNS服务器的URL创建DNS查询回调函数，可以传给 WithDNSServerAddresses 或 NewResolvingLoadBalancerOfHostname。
+// 支持的协议：https:// 使用 DoH，h3:// 使用基于HTTP/3的 DoH，quic:// 使用 DoQ，tls:// 使用 DoT，udp:// 和 tcp:// 使用普通DNS，参见 resolver.FromURL。
+//
+// 参数:
+// urls - DNS服务器的URL列表，例如 "https://dns.alidns.com/dns-query"、"h3://dns.alidns.com/dns-query"、"quic://dns.alidns.com"、"tls://dns.alidns.com"。
+// options - 用于修改默认配置的函数，参见 DNSQueryOptions。
+//
+// 返回值:
+// 以解析器名称为键的DNS查询回调函数集合，以及遇到不支持的协议或者策略时的错误。
+func DNSQueryCallbacksFromURLs(urls []string, options ...func(*DNSQueryOptions)) (generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)], error) {
+	var o DNSQueryOptions
+	for _, option := range options {
+		option(&o)
+	}
+	resolvers, err := resolver.FromURLs(urls, o.EDNS...)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if o.Strategy != "" {
+		group, err := resolver.NewGroup(resolvers, func(g *resolver.GroupOptions) { g.Strategy = o.Strategy })
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		resolvers = []resolver.Resolver{group}
+	}
+	return resolver.QueryCallbacks(resolvers...), nil
+}
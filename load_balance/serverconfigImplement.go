@@ -34,6 +34,10 @@ type ServerConfigImplement struct {
 	ActiveHealthyCheckURL             string
 
 	PassiveUnHealthyCheckStatusCodeRange generic.PairInterface[int, int]
+
+	UpgradeConnectionMutex    sync.Mutex
+	UpgradeConnectionCount    int64
+	upgradeConnectionMaxCount int64
 }
 
 // GetActiveHealthyCheckEnabled implements ServerConfigCommon.
@@ -230,3 +234,44 @@ func (s *ServerConfigImplement) SetUnHealthyFailMaxCount(count int64) {
 func (s *ServerConfigImplement) GetUnHealthyFailMaxCount() int64 {
 	return s.unHealthyFailMaxCount
 }
+
+// AcquireUpgradeConnection implements ServerConfigCommon.
+func (s *ServerConfigImplement) AcquireUpgradeConnection() bool {
+	s.UpgradeConnectionMutex.Lock()
+	defer s.UpgradeConnectionMutex.Unlock()
+	if s.upgradeConnectionMaxCount > 0 && s.UpgradeConnectionCount >= s.upgradeConnectionMaxCount {
+		return false
+	}
+	s.UpgradeConnectionCount += 1
+	return true
+}
+
+// ReleaseUpgradeConnection implements ServerConfigCommon.
+func (s *ServerConfigImplement) ReleaseUpgradeConnection() {
+	s.UpgradeConnectionMutex.Lock()
+	defer s.UpgradeConnectionMutex.Unlock()
+	if s.UpgradeConnectionCount > 0 {
+		s.UpgradeConnectionCount -= 1
+	}
+}
+
+// GetUpgradeConnectionCount implements ServerConfigCommon.
+func (s *ServerConfigImplement) GetUpgradeConnectionCount() int64 {
+	s.UpgradeConnectionMutex.Lock()
+	defer s.UpgradeConnectionMutex.Unlock()
+	return s.UpgradeConnectionCount
+}
+
+// SetUpgradeConnectionMaxCount implements ServerConfigCommon.
+func (s *ServerConfigImplement) SetUpgradeConnectionMaxCount(count int64) {
+	s.UpgradeConnectionMutex.Lock()
+	defer s.UpgradeConnectionMutex.Unlock()
+	s.upgradeConnectionMaxCount = count
+}
+
+// GetUpgradeConnectionMaxCount implements ServerConfigCommon.
+func (s *ServerConfigImplement) GetUpgradeConnectionMaxCount() int64 {
+	s.UpgradeConnectionMutex.Lock()
+	defer s.UpgradeConnectionMutex.Unlock()
+	return s.upgradeConnectionMaxCount
+}
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"sync"
 
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
 	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
 
 	// "net/url"
@@ -51,19 +52,22 @@ func NewSingleHostHTTP3ClientOfAddress(Identifier string, UpStreamServerURL stri
 	m := &SingleHostHTTP3ClientOfAddress{
 		HealthCheckIntervalMs:   HealthCheckIntervalMsDefault, // 使用默认的健康缓存时间
 		Identifier:              Identifier,
-		ActiveHealthyChecker:    ActiveHealthyCheckDefault,              // 使用默认的主动健康检查器
-		PassiveUnHealthyChecker: HealthyResponseCheckDefault,            // 使用默认的健康响应检查器
-		UpStreamServerURL:       UpStreamServerURL,                      // 设置上游服务器URL
-		GetServerAddress:        func() string { return ServerAddress }, // 设置服务端地址
-		IsHealthy:               true,                                   // 初始状态设为健康
+		ActiveHealthyChecker:    ActiveHealthyCheckDefault,                                       // 使用默认的主动健康检查器
+		PassiveUnHealthyChecker: HealthyResponseCheckDefault,                                     // 使用默认的健康响应检查器
+		UpStreamServerURL:       UpStreamServerURL,                                               // 设置上游服务器URL
+		GetServerAddresses:      func() []string { return LookupServerAddresses(ServerAddress) }, // 设置服务端地址
+		GetECHClient:            func() *ech.Client { return nil },                               // 默认不使用 ECH
+		IsHealthy:               true,                                                            // 初始状态设为健康
 		// RoundTripper:           transport,                   // 使用默认的传输器
 		unHealthyFailDurationMs: unHealthyFailDurationMsDefault,
 		UnHealthyFailMaxCount:   UnHealthyFailMaxCountDefault,
 	}
 	m.ServerConfigCommon = ServerConfigImplementConstructor(m.Identifier, m.UpStreamServerURL, m)
 	/* 需要把transport保存起来,防止一个请求一个连接的情况速度会很慢 */
-	h3rtcl := h3_experiment.CreateHTTP3TransportWithIPGetter(func() (string, error) {
-		return m.GetServerAddress(), nil
+	h3rtcl := h3_experiment.CreateHTTP3TransportWithIPGetter(func() ([]string, error) {
+		return m.GetServerAddresses(), nil
+	}, func() *ech.Client {
+		return m.GetECHClient()
 	})
 	m.RoundTripper = h3rtcl
 	m.Closer = func() error { return h3rtcl.Close() }
@@ -82,7 +86,8 @@ type SingleHostHTTP3ClientOfAddress struct {
 	HealthMutex             sync.Mutex
 	unHealthyFailDurationMs int64
 	HealthCheckIntervalMs   int64
-	GetServerAddress        func() string                                                                                                       // 服务器地址，指定客户端要连接的HTTP服务器的地址。
+	GetServerAddresses      func() []string                                                                                                     // 服务器地址列表，指定客户端要连接的HTTP服务器的地址，多个地址按照 RFC 8305 交替地址族依次尝试连接。
+	GetECHClient            func() *ech.Client                                                                                                  // 返回建立TLS和QUIC连接时使用的 ECH 客户端，返回nil时不使用 ECH。
 	ActiveHealthyChecker    func(RoundTripper http.RoundTripper, url string, method string, statusCodeMin int, statusCodeMax int) (bool, error) // 活跃健康检查函数，用于检查给定的传输和URL是否健康。
 	Identifier              string                                                                                                              // 标识符，用于标识此HTTP客户端的唯一字符串。
 	IsHealthy               bool                                                                                                                // 健康状态，标识当前客户端是否被视为健康。
@@ -228,7 +233,7 @@ func (l *SingleHostHTTP3ClientOfAddress) RoundTrip(req *http.Request) (*http.Res
 	PrintRequest(req)
 	/* 需要把transport保存起来,防止一个请求一个连接的情况速度会很慢 */
 	return l.RoundTripper.RoundTrip(req) /* h3_experiment.CreateHTTP3TransportWithIPGetter(func() string {
-		return l.GetServerAddress()
+		return l.GetServerAddresses()
 	}) */
 }
 
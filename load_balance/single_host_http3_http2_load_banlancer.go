@@ -15,6 +15,7 @@ import (
 
 	// "sync/atomic"
 	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
 	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
 	"time"
 
@@ -64,19 +65,7 @@ func NewSingleHostHTTP3HTTP2LoadBalancerOfAddress(Identifier string, UpStreamSer
 	// 初始化SingleHostHTTPClientOfAddress实例，并设置其属性值。
 	upstreammapinstance := generic.NewMapImplement[string, LoadBalanceAndUpStream]()
 
-	var m = &SingleHostHTTP3HTTP2LoadBalancerOfAddress{
-		Identifier:              Identifier,
-		ActiveHealthyChecker:    ActiveHealthyCheckDefault,              // 使用默认的主动健康检查器
-		PassiveUnHealthyChecker: HealthyResponseCheckDefault,            // 使用默认的健康响应检查器
-		UpStreamServerURL:       UpStreamServerURL,                      // 设置上游服务器URL
-		GetServerAddress:        func() string { return ServerAddress }, //      ServerAddress,               // 设置服务端地址
-		IsHealthy:               true,                                   // 初始状态设为健康
-		// RoundTripper:         transport  , // 使用默认的传输器
-		HealthCheckIntervalMs:   HealthCheckIntervalMsDefault,
-		UpStreams:               (upstreammapinstance),
-		unHealthyFailDurationMs: unHealthyFailDurationMsDefault,
-		UnHealthyFailMaxCount:   UnHealthyFailMaxCountDefault,
-	}
+	var m = newSingleHostHTTP3HTTP2LoadBalancer(Identifier, UpStreamServerURL, ServerAddress, upstreammapinstance)
 	// m.IsHealthy.Store(true)
 	// parsedURL2, err := url.Parse(UpStreamServerURL)
 	// if err != nil {
@@ -91,14 +80,19 @@ func NewSingleHostHTTP3HTTP2LoadBalancerOfAddress(Identifier string, UpStreamSer
 	var http2identifier = "http2-" + UpStreamServerURL
 	var http3identifier = "http3-" + UpStreamServerURL
 	var http2upstream, err1 = NewSingleHostHTTP12ClientOfAddress(http2identifier, UpStreamServerURL, func(shhcoa *SingleHostHTTP12ClientOfAddress) {
-		shhcoa.GetServerAddress = func() string {
-			return m.GetServerAddress()
+		shhcoa.GetServerAddresses = func() []string {
+			return m.GetServerAddresses()
+		}
+		shhcoa.GetECHClient = func() *ech.Client {
+			return m.GetECHClient()
 		}
-
 	})
 	var http3upstream, err2 = NewSingleHostHTTP3ClientOfAddress(http3identifier, UpStreamServerURL, func(shhcoa *SingleHostHTTP3ClientOfAddress) {
-		shhcoa.GetServerAddress = func() string {
-			return m.GetServerAddress()
+		shhcoa.GetServerAddresses = func() []string {
+			return m.GetServerAddresses()
+		}
+		shhcoa.GetECHClient = func() *ech.Client {
+			return m.GetECHClient()
 		}
 	})
 	if err1 != nil {
@@ -112,6 +106,35 @@ func NewSingleHostHTTP3HTTP2LoadBalancerOfAddress(Identifier string, UpStreamSer
 	upstreammapinstance.Set(http2identifier, http2upstream)
 	upstreammapinstance.Set(http3identifier, http3upstream)
 
+	for _, option := range options {
+		option(m)
+	}
+	return m, nil
+}
+
+// newSingleHostHTTP3HTTP2LoadBalancer 创建一个还没有上游的单主机负载均衡器，并设置其负载均衡服务。
+//
+// 参数:
+//
+//	Identifier string - 负载均衡器的标识符。
+//	UpStreamServerURL string - 上游服务器的URL。
+//	ServerAddress string - 上游服务器的主机名。
+//	upstreammapinstance - 保存上游的集合，负载均衡服务从中选择上游。
+func newSingleHostHTTP3HTTP2LoadBalancer(Identifier string, UpStreamServerURL string, ServerAddress string, upstreammapinstance generic.MapInterface[string, LoadBalanceAndUpStream]) *SingleHostHTTP3HTTP2LoadBalancerOfAddress {
+	var m = &SingleHostHTTP3HTTP2LoadBalancerOfAddress{
+		Identifier:              Identifier,
+		ActiveHealthyChecker:    ActiveHealthyCheckDefault,                                       // 使用默认的主动健康检查器
+		PassiveUnHealthyChecker: HealthyResponseCheckDefault,                                     // 使用默认的健康响应检查器
+		UpStreamServerURL:       UpStreamServerURL,                                               // 设置上游服务器URL
+		GetServerAddresses:      func() []string { return LookupServerAddresses(ServerAddress) }, //      ServerAddress,               // 设置服务端地址
+		GetECHClient:            func() *ech.Client { return nil },                               // 默认不使用 ECH
+		IsHealthy:               true,                                                            // 初始状态设为健康
+		// RoundTripper:         transport  , // 使用默认的传输器
+		HealthCheckIntervalMs:   HealthCheckIntervalMsDefault,
+		UpStreams:               (upstreammapinstance),
+		unHealthyFailDurationMs: unHealthyFailDurationMsDefault,
+		UnHealthyFailMaxCount:   UnHealthyFailMaxCountDefault,
+	}
 	var LoadBalanceServiceInstance *HTTP3HTTP2LoadBalancer = &HTTP3HTTP2LoadBalancer{
 		Identifier: Identifier,
 		UpStreamsGetter: func() generic.MapInterface[string, LoadBalanceAndUpStream] {
@@ -139,10 +162,7 @@ func NewSingleHostHTTP3HTTP2LoadBalancerOfAddress(Identifier string, UpStreamSer
 
 	m.LoadBalanceService = LoadBalanceServiceInstance
 	m.ServerConfigCommon = ServerConfigImplementConstructor(m.Identifier, m.UpStreamServerURL, m)
-	for _, option := range options {
-		option(m)
-	}
-	return m, nil
+	return m
 }
 
 // SingleHostHTTPClientOfAddress 是一个针对单个主机的HTTP客户端结构体，用于管理与特定地址的HTTP通信。
@@ -151,7 +171,8 @@ type SingleHostHTTP3HTTP2LoadBalancerOfAddress struct {
 	//毫秒
 	HealthCheckIntervalMs   int64
 	unHealthyFailDurationMs int64
-	GetServerAddress        func() string                                                                                                       // 服务器地址，指定客户端要连接的HTTP服务器的地址。
+	GetServerAddresses      func() []string                                                                                                     // 服务器地址列表，指定客户端要连接的HTTP服务器的地址，多个地址按照 RFC 8305 交替地址族依次尝试连接。
+	GetECHClient            func() *ech.Client                                                                                                  // 返回建立TLS和QUIC连接时使用的 ECH 客户端，返回nil时不使用 ECH。
 	ActiveHealthyChecker    func(RoundTripper http.RoundTripper, url string, method string, statusCodeMin int, statusCodeMax int) (bool, error) // 活跃健康检查函数，用于检查给定的传输和URL是否健康。
 	HealthMutex             sync.Mutex
 	Identifier              string                                                                                      // 标识符，用于标识此HTTP客户端的唯一字符串。
@@ -364,6 +385,10 @@ func (l *SingleHostHTTP3HTTP2LoadBalancerOfAddress) RoundTrip(request *http.Requ
 					return nil, err
 				}
 			}
+			watchGRPCStatus(response, func(err error) {
+				log.Println("OnUpstreamFailure", err)
+				l.OnUpstreamFailure(value)
+			})
 			return response, nil
 		}
 
@@ -424,6 +449,7 @@ type HTTP3HTTP2LoadBalancer struct {
 	healthCheckRunning          bool
 	mu                          sync.Mutex // 添加互斥锁，确保并发安全
 	Identifier                  string
+	OrderUpStreams              func(upstreams []LoadBalanceAndUpStream) []LoadBalanceAndUpStream // 决定依次尝试健康上游的顺序，为nil时随机排列。
 }
 
 // Close implements LoadBalanceService.
@@ -462,6 +488,9 @@ func (h *HTTP3HTTP2LoadBalancer) LoadBalancePolicySelector() ([]LoadBalanceAndUp
 		return nil, err
 	}
 
+	if h.OrderUpStreams != nil {
+		return h.OrderUpStreams(upstreams), nil
+	}
 	return generic.RandomShuffle(upstreams), nil
 
 }
@@ -0,0 +1,226 @@
+package load_balance
+
+import (
+	"log"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/happy_eyeballs"
+	"github.com/miekg/dns"
+)
+
+// MinRefreshIntervalMsDefault 是按照 SRV 记录的TTL重新查询的最小间隔，单位为毫秒。
+const MinRefreshIntervalMsDefault = 5 * 1000
+
+// SRVLoadBalancer 是通过 SRV 记录（RFC 2782）发现服务实例的上游：它查询 _service._proto.name 的 SRV 记录，
+// 为每个目标主机和端口创建一个子上游，优先使用优先级数值最小的一组实例，同一优先级内按照权重分配请求，
+// 一组实例都失败时再尝试下一个优先级。记录的TTL过期时重新查询，添加新的实例，移除并关闭已经消失的实例。
+// 子上游的请求仍然使用上游URL中的主机名作为 Host 和 TLS 的 SNI，只是连接到目标主机的地址和 SRV 记录的端口。
+type SRVLoadBalancer struct {
+	*refreshingLoadBalancer
+
+	SRVName string // SRV 记录的名称，例如 "_https._tcp.example.com"。
+	//毫秒
+	ResolveIntervalMs int64 // 查询失败时重新查询的间隔。
+	//毫秒
+	MinRefreshIntervalMs int64                                                                // 记录的TTL很小时重新查询的最小间隔。
+	LookupSRV            func(name string) ([]dns_experiment.SRVTarget, time.Duration, error) // 查询 SRV 记录的函数，默认使用配置的DNS查询回调函数。
+	ResolveAddresses     func(host string) ([]string, error)                                  // 解析目标主机的函数，默认使用配置的DNS查询回调函数。
+	ChildOptions         []func(*SingleHostHTTP3HTTP2LoadBalancerOfAddress)                   // 创建子上游时使用的选项。
+
+	refreshMutex sync.Mutex
+	targets      map[string]dns_experiment.SRVTarget
+	ttl          time.Duration
+}
+
+// NewSRVLoadBalancer 创建一个通过 SRV 记录发现服务实例的上游，并立即查询一次 SRV 记录。
+//
+// 参数:
+// Identifier - 负载均衡器的标识符，子上游的标识符为 Identifier-目标主机:端口。
+// UpStreamServerURL - 上游服务器的URL，子上游的URL使用 SRV 记录的端口替换其中的端口。
+// SRVName - SRV 记录的名称，格式为 _service._proto.name，例如 "_https._tcp.example.com"。
+// queryCallbacks - DNS查询回调函数，例如 DoH、DoH3、DoQ 或 DoT 客户端，参见 DNSQueryCallbacksFromURLs。
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的负载均衡器，以及解析上游URL时遇到的错误。
+func NewSRVLoadBalancer(Identifier string, UpStreamServerURL string, SRVName string, queryCallbacks generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)], options ...func(*SRVLoadBalancer)) (LoadBalanceAndUpStream, error) {
+	var Hostname, err = ExtractHostname(UpStreamServerURL)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	var queryCallback = dns_experiment.UpstreamQueryCallback(queryCallbacks)
+	var m = &SRVLoadBalancer{
+		refreshingLoadBalancer: newRefreshingLoadBalancer(Identifier, UpStreamServerURL, Hostname),
+		SRVName:                SRVName,
+		ResolveIntervalMs:      ResolveIntervalMsDefault,
+		MinRefreshIntervalMs:   MinRefreshIntervalMsDefault,
+		LookupSRV: func(name string) ([]dns_experiment.SRVTarget, time.Duration, error) {
+			return dns_experiment.LookupSRV(name, queryCallback)
+		},
+		ResolveAddresses: func(host string) ([]string, error) {
+			return dns_experiment.DnsResolverMultipleServers(host, queryCallbacks)
+		},
+		targets: map[string]dns_experiment.SRVTarget{},
+	}
+	m.LoadBalanceService.OrderUpStreams = m.orderUpStreams
+	m.refresh = func() {
+		if err := m.Refresh(); err != nil {
+			log.Println("lookup upstream srv records", m.SRVName, err)
+		}
+	}
+	m.interval = m.refreshInterval
+	for _, option := range options {
+		option(m)
+	}
+	m.refresh()
+	return m, nil
+}
+
+// GetTargets 返回最近一次查询得到的服务实例，按照优先级排序。
+func (r *SRVLoadBalancer) GetTargets() []dns_experiment.SRVTarget {
+	r.refreshMutex.Lock()
+	defer r.refreshMutex.Unlock()
+	var targets = make([]dns_experiment.SRVTarget, 0, len(r.targets))
+	for _, target := range r.targets {
+		targets = append(targets, target)
+	}
+	slices.SortFunc(targets, func(a, b dns_experiment.SRVTarget) int {
+		if a.Priority != b.Priority {
+			return int(a.Priority) - int(b.Priority)
+		}
+		return int(b.Weight) - int(a.Weight)
+	})
+	return targets
+}
+
+// childIdentifier 返回服务实例对应的子上游的标识符。
+func (r *SRVLoadBalancer) childIdentifier(target dns_experiment.SRVTarget) string {
+	return r.Identifier + "-" + net.JoinHostPort(target.Target, strconv.Itoa(int(target.Port)))
+}
+
+// Refresh 查询一次 SRV 记录，为新出现的服务实例创建子上游，更新已有实例的优先级和权重，移除并关闭已经消失的实例。
+// 查询失败或者没有得到任何实例时保留现有的子上游。
+//
+// 返回值:
+// 查询或创建子上游时遇到的错误。
+func (r *SRVLoadBalancer) Refresh() error {
+	targets, ttl, err := r.LookupSRV(r.SRVName)
+	r.refreshMutex.Lock()
+	defer r.refreshMutex.Unlock()
+	if err != nil {
+		r.ttl = -1
+		return err
+	}
+	r.ttl = ttl
+
+	var children = map[string]dns_experiment.SRVTarget{}
+	var identifiers = make([]string, 0, len(targets))
+	for _, target := range targets {
+		var identifier = r.childIdentifier(target)
+		if _, ok := children[identifier]; !ok {
+			children[identifier] = target
+		}
+		identifiers = append(identifiers, identifier)
+	}
+	existing, err := r.reconcileChildren(identifiers, func(identifier string) (LoadBalanceAndUpStream, error) {
+		return r.newChild(identifier, children[identifier])
+	})
+	r.targets = map[string]dns_experiment.SRVTarget{}
+	for identifier := range existing {
+		r.targets[identifier] = children[identifier]
+	}
+	return err
+}
+
+// newChild 创建连接一个服务实例的子上游。
+func (r *SRVLoadBalancer) newChild(identifier string, target dns_experiment.SRVTarget) (LoadBalanceAndUpStream, error) {
+	upstreamURL, err := url.Parse(r.UpStreamServerURL)
+	if err != nil {
+		return nil, err
+	}
+	upstreamURL.Host = net.JoinHostPort(upstreamURL.Hostname(), strconv.Itoa(int(target.Port)))
+	var options = append([]func(*SingleHostHTTP3HTTP2LoadBalancerOfAddress){func(m *SingleHostHTTP3HTTP2LoadBalancerOfAddress) {
+		m.GetServerAddresses = func() []string {
+			addresses, err := r.ResolveAddresses(target.Target)
+			if err != nil {
+				log.Println("resolve srv target addresses", target.Target, err)
+				return LookupServerAddresses(target.Target)
+			}
+			return happy_eyeballs.SortAddresses(addresses)
+		}
+		m.GetECHClient = func() *ech.Client {
+			return r.GetECHClient()
+		}
+		m.SetActiveHealthyCheckEnabled(r.GetActiveHealthyCheckEnabled())
+		m.SetPassiveHealthyCheckEnabled(r.GetPassiveHealthyCheckEnabled())
+	}}, r.ChildOptions...)
+	return NewSingleHostHTTP3HTTP2LoadBalancerOfAddress(identifier, upstreamURL.String(), options...)
+}
+
+// orderUpStreams 按照 SRV 记录的优先级从小到大排列健康的子上游，同一优先级内按照权重随机排列（RFC 2782）：
+// 每次以权重占剩余权重之和的比例选出下一个子上游，权重为0的子上游随机排在同一优先级的最后。
+func (r *SRVLoadBalancer) orderUpStreams(upstreams []LoadBalanceAndUpStream) []LoadBalanceAndUpStream {
+	r.refreshMutex.Lock()
+	var tiers = map[uint16][]LoadBalanceAndUpStream{}
+	var weights = map[LoadBalanceAndUpStream]int{}
+	var unknown []LoadBalanceAndUpStream
+	for _, upstream := range upstreams {
+		target, ok := r.targets[upstream.GetServerConfigCommon().GetIdentifier()]
+		if !ok {
+			unknown = append(unknown, upstream)
+			continue
+		}
+		tiers[target.Priority] = append(tiers[target.Priority], upstream)
+		weights[upstream] = int(target.Weight)
+	}
+	r.refreshMutex.Unlock()
+
+	var ordered = make([]LoadBalanceAndUpStream, 0, len(upstreams))
+	for _, priority := range slices.Sorted(maps.Keys(tiers)) {
+		var weighted, zero []LoadBalanceAndUpStream
+		var total int
+		for _, upstream := range tiers[priority] {
+			if weights[upstream] > 0 {
+				weighted = append(weighted, upstream)
+				total += weights[upstream]
+			} else {
+				zero = append(zero, upstream)
+			}
+		}
+		for len(weighted) > 0 {
+			var pick = rand.IntN(total)
+			for i, upstream := range weighted {
+				if pick < weights[upstream] {
+					ordered = append(ordered, upstream)
+					total -= weights[upstream]
+					weighted = slices.Delete(weighted, i, i+1)
+					break
+				}
+				pick -= weights[upstream]
+			}
+		}
+		ordered = append(ordered, generic.RandomShuffle(zero)...)
+	}
+	return append(ordered, generic.RandomShuffle(unknown)...)
+}
+
+// refreshInterval 返回下一次查询 SRV 记录的间隔：记录的TTL，但是不小于 MinRefreshIntervalMs，查询失败时为 ResolveIntervalMs。
+func (r *SRVLoadBalancer) refreshInterval() time.Duration {
+	r.refreshMutex.Lock()
+	defer r.refreshMutex.Unlock()
+	if r.ttl < 0 {
+		return time.Duration(r.ResolveIntervalMs) * time.Millisecond
+	}
+	return max(r.ttl, time.Duration(r.MinRefreshIntervalMs)*time.Millisecond)
+}
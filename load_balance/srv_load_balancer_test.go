@@ -0,0 +1,145 @@
+package load_balance
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/miekg/dns"
+)
+
+func TestSRVLoadBalancerRefresh(t *testing.T) {
+	var mutex sync.Mutex
+	var targets = []dns_experiment.SRVTarget{
+		{Target: "a.example.net", Port: 8443, Priority: 10, Weight: 60},
+		{Target: "b.example.net", Port: 443, Priority: 20, Weight: 0},
+	}
+	var ttl = 30 * time.Second
+	var lookupErr error
+	upstream, err := NewSRVLoadBalancer("srv", "https://example.com/path", "_https._tcp.example.com", generic.NewMapImplement[string, func(m *dns.Msg) (r *dns.Msg, err error)](), func(r *SRVLoadBalancer) {
+		r.LookupSRV = func(name string) ([]dns_experiment.SRVTarget, time.Duration, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if name != "_https._tcp.example.com" {
+				t.Errorf("unexpected name: %s", name)
+			}
+			return targets, ttl, lookupErr
+		}
+		r.ResolveAddresses = func(host string) ([]string, error) {
+			return map[string][]string{"a.example.net": {"192.0.2.1"}, "b.example.net": {"192.0.2.2"}, "c.example.net": {"2001:db8::3"}}[host], nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	var srv = upstream.(*SRVLoadBalancer)
+	if err := srv.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	var keys = func() []string {
+		var keys = srv.GetUpStreams().Keys()
+		sort.Strings(keys)
+		return keys
+	}
+	if expected := []string{"srv-a.example.net:8443", "srv-b.example.net:443"}; !reflect.DeepEqual(keys(), expected) {
+		t.Fatalf("unexpected upstreams: %v", keys())
+	}
+	first, _ := srv.GetUpStreams().Get("srv-a.example.net:8443")
+	var child = first.(*SingleHostHTTP3HTTP2LoadBalancerOfAddress)
+	if addresses := child.GetServerAddresses(); !reflect.DeepEqual(addresses, []string{"192.0.2.1"}) {
+		t.Errorf("child should connect to the srv target: %v", addresses)
+	}
+	/* 子上游保留原来的主机名作为 Host 和 SNI，只替换端口 */
+	if url := child.GetServerConfigCommon().GetUpStreamServerURL(); url != "https://example.com:8443/path" {
+		t.Errorf("unexpected child url: %s", url)
+	}
+	if interval := srv.refreshInterval(); interval != 30*time.Second {
+		t.Errorf("unexpected refresh interval: %v", interval)
+	}
+
+	/* 记录变化时添加新的实例并移除消失的实例，保留的子上游不会被重新创建 */
+	mutex.Lock()
+	targets = []dns_experiment.SRVTarget{
+		{Target: "a.example.net", Port: 8443, Priority: 10, Weight: 60},
+		{Target: "c.example.net", Port: 443, Priority: 10, Weight: 40},
+	}
+	ttl = time.Second
+	mutex.Unlock()
+	if err := srv.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"srv-a.example.net:8443", "srv-c.example.net:443"}; !reflect.DeepEqual(keys(), expected) {
+		t.Fatalf("unexpected upstreams: %v", keys())
+	}
+	if kept, _ := srv.GetUpStreams().Get("srv-a.example.net:8443"); kept != first {
+		t.Error("existing upstream should be kept")
+	}
+	if interval := srv.refreshInterval(); interval != MinRefreshIntervalMsDefault*time.Millisecond {
+		t.Errorf("refresh interval should not be shorter than the minimum: %v", interval)
+	}
+
+	/* 查询失败时保留现有的子上游，并按照 ResolveIntervalMs 重试 */
+	mutex.Lock()
+	lookupErr = errors.New("servfail")
+	mutex.Unlock()
+	if err := srv.Refresh(); err == nil {
+		t.Error("expected lookup error")
+	}
+	if len(keys()) != 2 {
+		t.Errorf("upstreams should be kept: %v", keys())
+	}
+	if interval := srv.refreshInterval(); interval != ResolveIntervalMsDefault*time.Millisecond {
+		t.Errorf("unexpected retry interval: %v", interval)
+	}
+	if targets := srv.GetTargets(); len(targets) != 2 || targets[0].Target != "a.example.net" {
+		t.Errorf("unexpected targets: %v", targets)
+	}
+}
+
+func TestSRVLoadBalancerOrder(t *testing.T) {
+	upstream, err := NewSRVLoadBalancer("srv", "https://example.com/", "_https._tcp.example.com", generic.NewMapImplement[string, func(m *dns.Msg) (r *dns.Msg, err error)](), func(r *SRVLoadBalancer) {
+		r.LookupSRV = func(name string) ([]dns_experiment.SRVTarget, time.Duration, error) {
+			return []dns_experiment.SRVTarget{
+				{Target: "backup.example.net", Port: 443, Priority: 20, Weight: 10},
+				{Target: "heavy.example.net", Port: 443, Priority: 10, Weight: 90},
+				{Target: "light.example.net", Port: 443, Priority: 10, Weight: 10},
+				{Target: "zero.example.net", Port: 443, Priority: 10, Weight: 0},
+			}, time.Minute, nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	var srv = upstream.(*SRVLoadBalancer)
+	var upstreams = srv.GetUpStreams().Values()
+	var heavyFirst int
+	for range 1000 {
+		var ordered = srv.orderUpStreams(append([]LoadBalanceAndUpStream(nil), upstreams...))
+		var identifiers = identifiersOf(ordered)
+		/* 优先级数值小的实例在前，权重为0的实例排在同一优先级的最后 */
+		if identifiers[2] != "srv-zero.example.net:443" || identifiers[3] != "srv-backup.example.net:443" {
+			t.Fatalf("unexpected order: %v", identifiers)
+		}
+		if identifiers[0] == "srv-heavy.example.net:443" {
+			heavyFirst++
+		}
+	}
+	/* 同一优先级内按照权重的比例选择第一个实例 */
+	if heavyFirst < 800 || heavyFirst > 980 {
+		t.Errorf("heavy target should be chosen first about 90%% of the time: %d", heavyFirst)
+	}
+}
+
+// identifiersOf 返回上游的标识符。
+func identifiersOf(upstreams []LoadBalanceAndUpStream) []string {
+	return dns_experiment.ArrayMap(upstreams, func(upstream LoadBalanceAndUpStream) string {
+		return upstream.GetServerConfigCommon().GetIdentifier()
+	})
+}
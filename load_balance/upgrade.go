@@ -0,0 +1,145 @@
+package load_balance
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+)
+
+// ErrUpgradeConnectionLimit 表示上游服务的协议升级连接数量已经达到上限。
+var ErrUpgradeConnectionLimit = errors.New("upgrade connection limit reached")
+
+// UpgradeUpStream 是支持协议升级（如WebSocket）的上游服务接口。
+type UpgradeUpStream interface {
+	// Upgrade 向上游发送协议升级请求。
+	// 参数：
+	//   *http.Request: 包含 Connection: Upgrade 和 Upgrade 头部的请求
+	// 返回值：
+	//   *http.Response: 上游的响应
+	//   io.ReadWriteCloser: 上游返回101状态码时升级后的双向连接，否则为nil，此时应当按普通响应处理
+	//   error: 请求过程中遇到的错误
+	Upgrade(*http.Request) (*http.Response, io.ReadWriteCloser, error)
+}
+
+// upgradeConnection 包装升级后的连接，在关闭时释放上游的连接名额。
+type upgradeConnection struct {
+	io.ReadWriteCloser
+	once    sync.Once
+	release func()
+}
+
+func (u *upgradeConnection) Close() error {
+	var err = u.ReadWriteCloser.Close()
+	u.once.Do(u.release)
+	return err
+}
+
+// Upgrade 实现了UpgradeUpStream接口，通过只使用HTTP/1.1的传输向上游发送协议升级请求，
+// 并统计该上游的协议升级连接数量。
+func (l *SingleHostHTTP12ClientOfAddress) Upgrade(request *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+	var config = l.GetServerConfigCommon()
+	if !config.AcquireUpgradeConnection() {
+		return nil, nil, ErrUpgradeConnectionLimit
+	}
+	upurl, err := url.Parse(l.UpStreamServerURL)
+	if err != nil {
+		config.ReleaseUpgradeConnection()
+		return nil, nil, err
+	}
+	/* 修改副本，故障转移时下一个上游仍然使用原始的请求 */
+	var req = request.Clone(request.Context())
+	req.URL.Scheme = upurl.Scheme
+	req.URL.Host = upurl.Host
+	req.Host = upurl.Host
+	PrintRequest(req)
+	response, err := l.UpgradeRoundTripper.RoundTrip(req)
+	if err != nil {
+		config.ReleaseUpgradeConnection()
+		return nil, nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		config.ReleaseUpgradeConnection()
+		return response, nil, nil
+	}
+	conn, ok := response.Body.(io.ReadWriteCloser)
+	if !ok {
+		response.Body.Close()
+		config.ReleaseUpgradeConnection()
+		return nil, nil, errors.New("upstream switching protocols response body is not writable")
+	}
+	log.Println("upgrade connection established", l.GetIdentifier(), config.GetUpgradeConnectionCount())
+	return response, &upgradeConnection{ReadWriteCloser: conn, release: config.ReleaseUpgradeConnection}, nil
+}
+
+// Upgrade 实现了UpgradeUpStream接口，按照负载均衡策略选择一个健康并且支持协议升级的上游服务发送协议升级请求，
+// 失败时根据故障转移策略尝试下一个上游服务。
+func (l *SingleHostHTTP3HTTP2LoadBalancerOfAddress) Upgrade(request *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+	return l.upgradeWithFailover(request, func(value LoadBalanceAndUpStream) (func(*http.Request) (*http.Response, io.ReadWriteCloser, error), bool) {
+		upstream, ok := value.(UpgradeUpStream)
+		if !ok {
+			return nil, false
+		}
+		return upstream.Upgrade, true
+	})
+}
+
+// upgradeWithFailover 按照负载均衡策略依次尝试健康的上游服务建立升级连接。
+// 参数 dialer 返回上游服务对应的连接函数，上游服务不支持时返回false并被跳过。
+// 连接数量达到上限的上游服务会被跳过，但不会被计入失败次数。
+func (l *SingleHostHTTP3HTTP2LoadBalancerOfAddress) upgradeWithFailover(request *http.Request, dialer func(LoadBalanceAndUpStream) (func(*http.Request) (*http.Response, io.ReadWriteCloser, error), bool)) (*http.Response, io.ReadWriteCloser, error) {
+	if !l.LoadBalanceService.healthCheckRunning {
+		go l.LoadBalanceService.HealthyCheckStart()
+	}
+	x3 := l.LoadBalanceService
+	x, x1 := x3.LoadBalancePolicySelector()
+	if x1 != nil {
+		return nil, nil, x1
+	}
+	var erros = []error{}
+	var limited = 0
+	for _, value := range x {
+		dial, ok := dialer(value)
+		if !ok || !value.GetServerConfigCommon().GetHealthy() {
+			continue
+		}
+		/* 每次尝试使用请求的副本，上游会修改请求的URL、Host和头部 */
+		response, conn, err := dial(request.Clone(request.Context()))
+		if errors.Is(err, ErrUpgradeConnectionLimit) {
+			limited++
+			erros = append(erros, err)
+			continue
+		}
+		if err != nil {
+			erros = append(erros, err)
+			log.Println("OnUpstreamFailure", err)
+			l.OnUpstreamFailure(value)
+			if x3.FailoverAttemptStrategy(request) {
+				continue
+			}
+			return nil, nil, err
+		}
+		if conn == nil && x3.GetPassiveHealthyCheckEnabled() {
+			if ok, err := l.PassiveUnHealthyCheck(response); err != nil || !ok {
+				erros = append(erros, err)
+				log.Println("OnUpstreamFailure", err)
+				l.OnUpstreamFailure(value)
+				if x3.FailoverAttemptStrategy(request) {
+					response.Body.Close()
+					continue
+				}
+				return response, nil, nil
+			}
+		}
+		return response, conn, nil
+	}
+	if limited > 0 && limited == len(erros) {
+		return nil, nil, ErrUpgradeConnectionLimit
+	}
+	return nil, nil, errors.New("bad Gateway: no healthy upstreams support upgrade" + "\n" + strings.Join(dns_experiment.ArrayMap(erros, func(err error) string { return err.Error() }), "\n"))
+}
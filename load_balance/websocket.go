@@ -0,0 +1,227 @@
+package load_balance
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
+	h12_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/h12"
+)
+
+// ErrExtendedConnectNotSupported 表示上游不支持扩展CONNECT协议（RFC 8441/RFC 9220）。
+var ErrExtendedConnectNotSupported = errors.New("extended CONNECT not supported by upstream")
+
+// extendedConnectRetryDelay 是HTTP/2扩展CONNECT失败后重新尝试之前改用HTTP/1.1升级的时间。
+const extendedConnectRetryDelay = 5 * time.Minute
+
+// webSocketGUID 是计算 Sec-WebSocket-Accept 时使用的固定GUID（RFC 6455 第 1.3 节）。
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ExtendedConnectUpStream 是支持扩展CONNECT协议的上游服务接口。
+type ExtendedConnectUpStream interface {
+	// ExtendedConnect 向上游发送带有 :protocol 伪头部的CONNECT请求。
+	// 参数：
+	//   *http.Request: 待发送的请求，方法和请求体会被替换
+	//   string: :protocol 伪头部的值，例如 "websocket"
+	// 返回值：
+	//   *http.Response: 上游的响应
+	//   io.ReadWriteCloser: 上游返回2xx状态码时建立的双向数据流，否则为nil
+	//   error: 请求过程中遇到的错误
+	ExtendedConnect(*http.Request, string) (*http.Response, io.ReadWriteCloser, error)
+}
+
+// WebSocketUpStream 是能够以任意协议建立WebSocket连接的上游服务接口。
+//
+// DialWebSocket 接收与协议无关的WebSocket握手请求（GET方法，不包含 Connection、Upgrade 和 Sec-WebSocket-Key 头部），
+// 上游接受WebSocket时返回状态码为200的响应和双向连接，响应中不包含 Sec-WebSocket-Accept 头部；
+// 上游拒绝时返回上游的原始响应和nil连接。
+type WebSocketUpStream interface {
+	DialWebSocket(*http.Request) (*http.Response, io.ReadWriteCloser, error)
+}
+
+// streamConnection 将扩展CONNECT的响应体和请求体组合为一个双向连接。
+type streamConnection struct {
+	body   io.ReadCloser
+	writer *io.PipeWriter
+}
+
+func (s *streamConnection) Read(p []byte) (int, error) {
+	return s.body.Read(p)
+}
+
+func (s *streamConnection) Write(p []byte) (int, error) {
+	return s.writer.Write(p)
+}
+
+func (s *streamConnection) Close() error {
+	s.writer.Close()
+	return s.body.Close()
+}
+
+// extendedConnect 通过给定的传输发送扩展CONNECT请求，并统计上游的协议升级连接数量。
+// setProtocol 负责按照具体协议设置 :protocol 伪头部。
+func extendedConnect(roundTripper http.RoundTripper, config ServerConfigCommon, upStreamServerURL string, request *http.Request, setProtocol func(*http.Request)) (*http.Response, io.ReadWriteCloser, error) {
+	if !config.AcquireUpgradeConnection() {
+		return nil, nil, ErrUpgradeConnectionLimit
+	}
+	upurl, err := url.Parse(upStreamServerURL)
+	if err != nil {
+		config.ReleaseUpgradeConnection()
+		return nil, nil, err
+	}
+	reader, writer := io.Pipe()
+	var req = request.Clone(request.Context())
+	req.Method = http.MethodConnect
+	req.URL.Scheme = upurl.Scheme
+	req.URL.Host = upurl.Host
+	req.Host = upurl.Host
+	req.Body = reader
+	req.ContentLength = -1
+	setProtocol(req)
+	PrintRequest(req)
+	response, err := roundTripper.RoundTrip(req)
+	if err != nil {
+		writer.Close()
+		config.ReleaseUpgradeConnection()
+		return nil, nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		writer.Close()
+		config.ReleaseUpgradeConnection()
+		return response, nil, nil
+	}
+	var conn = &streamConnection{body: response.Body, writer: writer}
+	log.Println("extended connect established", config.GetIdentifier(), config.GetUpgradeConnectionCount())
+	return response, &upgradeConnection{ReadWriteCloser: conn, release: config.ReleaseUpgradeConnection}, nil
+}
+
+// computeWebSocketAccept 根据 Sec-WebSocket-Key 计算 Sec-WebSocket-Accept（RFC 6455 第 4.2.2 节）。
+func computeWebSocketAccept(key string) string {
+	var sum = sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// upgradeWebSocket 将与协议无关的WebSocket握手请求转换为HTTP/1.1的协议升级请求，
+// 生成 Sec-WebSocket-Key 并校验上游返回的 Sec-WebSocket-Accept。
+func upgradeWebSocket(upstream UpgradeUpStream, request *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+	var nonce = make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	var key = base64.StdEncoding.EncodeToString(nonce)
+	var req = request.Clone(request.Context())
+	req.Method = http.MethodGet
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if req.Header.Get("Sec-WebSocket-Version") == "" {
+		req.Header.Set("Sec-WebSocket-Version", "13")
+	}
+	response, conn, err := upstream.Upgrade(req)
+	if err != nil || conn == nil {
+		return response, conn, err
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != computeWebSocketAccept(key) {
+		conn.Close()
+		return nil, nil, errors.New("upstream returned invalid Sec-WebSocket-Accept")
+	}
+	response.StatusCode = http.StatusOK
+	response.Status = "200 OK"
+	response.Header.Del("Connection")
+	response.Header.Del("Upgrade")
+	response.Header.Del("Sec-WebSocket-Accept")
+	return response, conn, nil
+}
+
+// ExtendedConnect 实现了ExtendedConnectUpStream接口，通过HTTP/2发送扩展CONNECT请求（RFC 8441）。
+// 只有https上游才会协商HTTP/2，其他情况返回ErrExtendedConnectNotSupported。
+func (l *SingleHostHTTP12ClientOfAddress) ExtendedConnect(request *http.Request, protocol string) (*http.Response, io.ReadWriteCloser, error) {
+	upurl, err := url.Parse(l.UpStreamServerURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if upurl.Scheme != "https" || l.ExtendedConnectRoundTripper == nil {
+		return nil, nil, ErrExtendedConnectNotSupported
+	}
+	return extendedConnect(l.ExtendedConnectRoundTripper, l.GetServerConfigCommon(), l.UpStreamServerURL, request, func(r *http.Request) {
+		r.Header.Set(":protocol", protocol)
+	})
+}
+
+// DialWebSocket 实现了WebSocketUpStream接口，优先使用HTTP/2扩展CONNECT建立WebSocket，
+// 上游不支持时改用HTTP/1.1协议升级，并在一段时间内不再尝试HTTP/2。
+func (l *SingleHostHTTP12ClientOfAddress) DialWebSocket(request *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+	if !l.extendedConnectUnsupported() {
+		response, conn, err := l.ExtendedConnect(request, "websocket")
+		if err == nil || errors.Is(err, ErrUpgradeConnectionLimit) {
+			return response, conn, err
+		}
+		if !errors.Is(err, ErrExtendedConnectNotSupported) {
+			log.Println("http2 extended connect failed, falling back to http1 upgrade", l.GetIdentifier(), err)
+		}
+		l.markExtendedConnectUnsupported()
+	}
+	return upgradeWebSocket(l, request)
+}
+
+// extendedConnectState 记录HTTP/2扩展CONNECT最近一次失败的时间。
+type extendedConnectState struct {
+	mutex       sync.Mutex
+	unsupported time.Time
+}
+
+func (l *SingleHostHTTP12ClientOfAddress) extendedConnectUnsupported() bool {
+	l.extendedConnect.mutex.Lock()
+	defer l.extendedConnect.mutex.Unlock()
+	return !l.extendedConnect.unsupported.IsZero() && time.Since(l.extendedConnect.unsupported) < extendedConnectRetryDelay
+}
+
+func (l *SingleHostHTTP12ClientOfAddress) markExtendedConnectUnsupported() {
+	l.extendedConnect.mutex.Lock()
+	defer l.extendedConnect.mutex.Unlock()
+	l.extendedConnect.unsupported = time.Now()
+}
+
+// createExtendedConnectRoundTripper 创建用于HTTP/2扩展CONNECT的传输和对应的关闭函数。
+func createExtendedConnectRoundTripper(getter func() []string, getECHClient func() *ech.Client) (http.RoundTripper, func()) {
+	var roundTripper = h12_experiment.CreateHTTP2TransportWithIPGetter(getter, getECHClient)
+	return roundTripper, func() {
+		if closer, ok := roundTripper.(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+	}
+}
+
+// ExtendedConnect 实现了ExtendedConnectUpStream接口，通过HTTP/3发送扩展CONNECT请求（RFC 9220）。
+func (l *SingleHostHTTP3ClientOfAddress) ExtendedConnect(request *http.Request, protocol string) (*http.Response, io.ReadWriteCloser, error) {
+	return extendedConnect(l.RoundTripper, l.GetServerConfigCommon(), l.UpStreamServerURL, request, func(r *http.Request) {
+		/* quic-go 使用CONNECT请求的Proto字段作为 :protocol 伪头部 */
+		r.Proto = protocol
+	})
+}
+
+// DialWebSocket 实现了WebSocketUpStream接口，通过HTTP/3扩展CONNECT建立WebSocket。
+func (l *SingleHostHTTP3ClientOfAddress) DialWebSocket(request *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+	return l.ExtendedConnect(request, "websocket")
+}
+
+// DialWebSocket 实现了WebSocketUpStream接口，按照负载均衡策略选择一个健康的上游服务，
+// 使用该上游支持的协议（HTTP/3或HTTP/2扩展CONNECT，或者HTTP/1.1协议升级）建立WebSocket连接，
+// 失败时根据故障转移策略尝试下一个上游服务。
+func (l *SingleHostHTTP3HTTP2LoadBalancerOfAddress) DialWebSocket(request *http.Request) (*http.Response, io.ReadWriteCloser, error) {
+	return l.upgradeWithFailover(request, func(value LoadBalanceAndUpStream) (func(*http.Request) (*http.Response, io.ReadWriteCloser, error), bool) {
+		upstream, ok := value.(WebSocketUpStream)
+		if !ok {
+			return nil, false
+		}
+		return upstream.DialWebSocket, true
+	})
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"runtime"
 	"sync"
@@ -32,10 +34,26 @@ import (
 
 	// "github.com/masx200/http3-reverse-proxy-server-experiment/adapter"
 	// "github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/acl"
 	"github.com/masx200/http3-reverse-proxy-server-experiment/adapter"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/alt_svc"
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/dns_server"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/ech"
+	_ "github.com/masx200/http3-reverse-proxy-server-experiment/extended_connect"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/forward_proxy"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/forwarded"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/grpc_proxy"
+	h12_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/h12"
 	h3_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/h3"
 	"github.com/masx200/http3-reverse-proxy-server-experiment/http2_only"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/load_balance"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/masque"
 	print_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/print"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/resolver"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/websocket_proxy"
+	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/net/http2"
@@ -83,7 +101,7 @@ func main() {
 	strArgupstreamServer := flag.String("upstream-server", "", "upstream-server,example \"https://workers.cloudflare.com/\"")
 	intArghttpPort := flag.Int("http-port", 18080, "http-port")
 	int2ArghttpsPort := flag.Int("https-port", 18443, "https-port")
-	StringArgprotocol := flag.String("upstream-protocol", "h3", "upstream-protocol,supports (h3,h2,h2c,http/1.1)")
+	StringArgprotocol := flag.String("upstream-protocol", "h3", "upstream-protocol,supports (auto,h3,h2,h2c,http/1.1),auto starts with h2 and upgrades to h3 via Alt-Svc,upstream-srv overrides it and upstream-resolvers overrides values other than auto,both use h3 with h2 fallback per address")
 	tlscertArg := flag.String("tls-cert", "cert.crt", "tls-cert")
 	tlskeyArg := flag.String("tls-key", "key.pem", "tls-key")
 	Arglistenhostname := flag.String("listen-hostname", "0.0.0.0", "listen-hostname")
@@ -92,6 +110,42 @@ func main() {
 	Arglistenh2c := flag.Bool("listen-h2c", true, "listen-h2c")
 	Arglistenhttp3 := flag.Bool("listen-http3", true, "listen-http3")
 	Arg_debug_pprof := flag.Bool("debug-pprof", false, "debug-pprof")
+	ArgtrustedProxies := flag.String("trusted-proxies", "", "trusted-proxies,comma separated CIDR list of trusted downstream proxies,empty means trust all")
+	ArgforwardedTrustedAction := flag.String("forwarded-trusted-action", "append", "forwarded-trusted-action,action for forwarding headers from trusted proxies,supports (append,keep,discard)")
+	ArgforwardedUntrustedAction := flag.String("forwarded-untrusted-action", "discard", "forwarded-untrusted-action,action for forwarding headers from untrusted clients,supports (append,keep,discard)")
+	ArgxForwarded := flag.Bool("x-forwarded", false, "x-forwarded,also emit X-Forwarded-For/Proto/Host headers")
+	ArgproxyIdentifier := flag.String("proxy-identifier", "", "proxy-identifier,unique id of this proxy instance used in Forwarded by= and Via headers,generated randomly if empty")
+	ArgwebsocketIdleTimeoutMs := flag.Int64("websocket-idle-timeout-ms", 300000, "websocket-idle-timeout-ms,close websocket tunnels idle for longer than this,0 means never")
+	ArgwebsocketMaxConnections := flag.Int64("websocket-max-connections", 0, "websocket-max-connections,maximum websocket connections per upstream,0 means unlimited")
+	ArgmaxHops := flag.Int("max-hops", 10, "max-hops,maximum number of proxies a request may have passed through as counted from the forwarding headers kept by the trusted proxy policy,0 means unlimited")
+	ArgforwardProxy := flag.Bool("forward-proxy", false, "forward-proxy,accept CONNECT requests over http/1.1,h2 and h3 and tunnel them to the target")
+	ArgforwardProxyAllowedTargets := flag.String("forward-proxy-allowed-targets", "", "forward-proxy-allowed-targets,comma separated host:port list of allowed CONNECT targets,example \"*:443,*.example.com:*\",empty means deny all,loopback private shared(100.64.0.0/10) link-local and multicast addresses are denied unless allowed by an ip or cidr rule")
+	ArgforwardProxyDeniedTargets := flag.String("forward-proxy-denied-targets", "", "forward-proxy-denied-targets,comma separated host:port list of denied CONNECT targets,takes precedence over the allowed targets")
+	ArgforwardProxyAuth := flag.String("forward-proxy-auth", "", "forward-proxy-auth,username:password required in Proxy-Authorization,empty means no authentication")
+	ArgforwardProxyIdleTimeoutMs := flag.Int64("forward-proxy-idle-timeout-ms", 300000, "forward-proxy-idle-timeout-ms,close CONNECT tunnels idle for longer than this,0 means never")
+	ArggrpcWeb := flag.Bool("grpc-web", false, "grpc-web,translate grpc-web and grpc-web-text requests into native grpc toward the upstream")
+	ArggrpcWebAllowedOrigins := flag.String("grpc-web-allowed-origins", "*", "grpc-web-allowed-origins,comma separated list of origins allowed to send cross-origin grpc-web requests,\"*\" allows any origin without credentials")
+	Argmasque := flag.Bool("masque", false, "masque,accept MASQUE CONNECT-UDP requests on the http3 listener")
+	ArgmasqueAllowedTargets := flag.String("masque-allowed-targets", "", "masque-allowed-targets,comma separated host:port list of allowed CONNECT-UDP targets,example \"*:53,*.example.com:443,10.0.0.0/8:*\",empty means deny all,loopback private shared(100.64.0.0/10) link-local and multicast addresses are denied unless allowed by an ip or cidr rule")
+	ArgmasqueMaxSessionsPerClient := flag.Int("masque-max-sessions-per-client", 16, "masque-max-sessions-per-client,maximum concurrent CONNECT-UDP sessions per client ip,0 means unlimited")
+	ArgmasqueIdleTimeoutMs := flag.Int64("masque-idle-timeout-ms", 120000, "masque-idle-timeout-ms,close CONNECT-UDP sessions idle for longer than this,0 means never")
+	ArgupstreamRace := flag.Bool("upstream-race", false, "upstream-race,with upstream-protocol auto race a quic handshake against a tcp+tls handshake and use the winner")
+	ArgupstreamQuicHeadStartMs := flag.Int64("upstream-quic-head-start-ms", 300, "upstream-quic-head-start-ms,head start given to the preferred protocol when racing upstream connections")
+	ArgupstreamSRV := flag.String("upstream-srv", "", "upstream-srv,discover upstream instances from _service._proto.name srv records such as _https._tcp.example.com with upstream-resolvers,lower priorities are used first and weights balance requests within a priority,takes precedence over upstream-resolvers address balancing and upstream-protocol,every target uses h3 with h2 fallback,empty means disabled")
+	ArgupstreamResolvers := flag.String("upstream-resolvers", "", "upstream-resolvers,comma separated dns servers used to resolve every address of the upstream host and balance across them,takes precedence over upstream-protocol except auto,every address uses h3 with h2 fallback,with upstream-protocol auto regular requests still follow Alt-Svc and the https records of the upstream while websockets and grpc use the addresses,supports (https://,h3://,quic://,tls://,udp://,tcp://),example \"https://dns.alidns.com/dns-query,quic://dns.alidns.com\",empty means use one address")
+	ArgupstreamResolveIntervalMs := flag.Int64("upstream-resolve-interval-ms", 60000, "upstream-resolve-interval-ms,interval between re-resolving the upstream host with upstream-resolvers")
+	ArgdohServer := flag.Bool("doh-server", false, "doh-server,answer RFC 8484 dns over https queries on the http,h2c,https and http3 listeners")
+	ArgdohServerPath := flag.String("doh-server-path", "/dns-query", "doh-server-path,path of the dns over https endpoint")
+	ArgdoqServerPort := flag.Int("doq-server-port", 0, "doq-server-port,udp port to answer RFC 9250 dns over quic queries on with the tls-cert certificate,0 means disabled,the standard port is 853")
+	ArgdotServerPort := flag.Int("dot-server-port", 0, "dot-server-port,tcp port to answer RFC 7858 dns over tls queries on with the tls-cert certificate,0 means disabled,the standard port is 853")
+	ArgdnsServerResolvers := flag.String("dns-server-resolvers", "", "dns-server-resolvers,comma separated dns servers used to answer doh-server,doq-server and dot-server queries,supports (https://,h3://,quic://,tls://,udp://,tcp://),empty means use upstream-resolvers")
+	ArgresolverStrategy := flag.String("resolver-strategy", "", "resolver-strategy,how upstream-resolvers and dns-server-resolvers pick dns servers,supports (fastest,failover,random,union),empty means resolve upstream addresses from every server and answer dns-server queries from the first working server")
+	ArgresolverPadding := flag.Bool("resolver-padding", false, "resolver-padding,pad queries sent to encrypted upstream-resolvers and dns-server-resolvers to multiples of 128 bytes (RFC 8467),a server url fragment such as #padding=off or #ecs=16/48 overrides the edns options of that server")
+	ArgdnsServerECS := flag.String("dns-server-ecs", "", "dns-server-ecs,add the client subnet (RFC 7871) truncated to the ipv4/ipv6 prefix lengths such as 24/56 to doh-server,doq-server and dot-server queries without one,empty means disabled")
+	ArghostsFile := flag.String("hosts-file", "", "hosts-file,hosts file style table pinning upstream hostnames to ip addresses or cname targets,each line is an address or cname target followed by names,names may be wildcards such as *.example.com,empty means disabled")
+	ArgresolverRoutes := flag.String("resolver-routes", "", "resolver-routes,comma separated domain suffix rules resolving matching upstream hostnames with specific dns servers,example \"corp.example=udp://10.0.0.53|tls://10.0.0.54,*.lab.example=https://10.1.0.1/dns-query\",empty means disabled")
+	ArgupstreamDNSSEC := flag.String("upstream-dnssec", "off", "upstream-dnssec,validate the answers of upstream-resolvers with dnssec from the root trust anchor,supports (off,flag,reject),flag logs bogus answers and uses them without the ad bit,reject drops them")
+	ArgupstreamECH := flag.String("upstream-ech", "off", "upstream-ech,use encrypted client hello with the ech configs published in the https records of the upstream,requires upstream-resolvers,supports (off,on,strict),strict refuses to connect without ech")
 	// 解析命令行参数
 	flag.Parse()
 
@@ -108,25 +162,253 @@ func main() {
 	log.Printf("https-port argument: %d\n", *int2ArghttpsPort)
 	log.Printf("upstream-protocol argument: %v\n", *StringArgprotocol)
 	log.Printf("listen-tls argument: %v\n", *tlsboolArg)
+	log.Printf("trusted-proxies argument: %s\n", *ArgtrustedProxies)
+	log.Printf("forwarded-trusted-action argument: %s\n", *ArgforwardedTrustedAction)
+	log.Printf("forwarded-untrusted-action argument: %s\n", *ArgforwardedUntrustedAction)
+	log.Printf("x-forwarded argument: %v\n", *ArgxForwarded)
+	log.Printf("proxy-identifier argument: %s\n", *ArgproxyIdentifier)
+	log.Printf("max-hops argument: %d\n", *ArgmaxHops)
+	log.Printf("websocket-idle-timeout-ms argument: %d\n", *ArgwebsocketIdleTimeoutMs)
+	log.Printf("websocket-max-connections argument: %d\n", *ArgwebsocketMaxConnections)
+	log.Printf("forward-proxy argument: %v\n", *ArgforwardProxy)
+	log.Printf("forward-proxy-allowed-targets argument: %s\n", *ArgforwardProxyAllowedTargets)
+	log.Printf("forward-proxy-denied-targets argument: %s\n", *ArgforwardProxyDeniedTargets)
+	log.Printf("forward-proxy-auth argument: %v\n", *ArgforwardProxyAuth != "")
+	log.Printf("forward-proxy-idle-timeout-ms argument: %d\n", *ArgforwardProxyIdleTimeoutMs)
+	log.Printf("grpc-web argument: %v\n", *ArggrpcWeb)
+	log.Printf("grpc-web-allowed-origins argument: %s\n", *ArggrpcWebAllowedOrigins)
+	log.Printf("masque argument: %v\n", *Argmasque)
+	log.Printf("masque-allowed-targets argument: %s\n", *ArgmasqueAllowedTargets)
+	log.Printf("masque-max-sessions-per-client argument: %d\n", *ArgmasqueMaxSessionsPerClient)
+	log.Printf("masque-idle-timeout-ms argument: %d\n", *ArgmasqueIdleTimeoutMs)
+	log.Printf("upstream-race argument: %v\n", *ArgupstreamRace)
+	log.Printf("upstream-quic-head-start-ms argument: %d\n", *ArgupstreamQuicHeadStartMs)
+	log.Printf("upstream-srv argument: %s\n", *ArgupstreamSRV)
+	log.Printf("upstream-resolvers argument: %s\n", *ArgupstreamResolvers)
+	log.Printf("upstream-resolve-interval-ms argument: %d\n", *ArgupstreamResolveIntervalMs)
+	log.Printf("upstream-ech argument: %s\n", *ArgupstreamECH)
+	log.Printf("doh-server argument: %v\n", *ArgdohServer)
+	log.Printf("doh-server-path argument: %s\n", *ArgdohServerPath)
+	log.Printf("doq-server-port argument: %d\n", *ArgdoqServerPort)
+	log.Printf("dot-server-port argument: %d\n", *ArgdotServerPort)
+	log.Printf("dns-server-resolvers argument: %s\n", *ArgdnsServerResolvers)
+	log.Printf("resolver-strategy argument: %s\n", *ArgresolverStrategy)
+	log.Printf("upstream-dnssec argument: %s\n", *ArgupstreamDNSSEC)
+	log.Printf("resolver-padding argument: %v\n", *ArgresolverPadding)
+	log.Printf("dns-server-ecs argument: %s\n", *ArgdnsServerECS)
+	log.Printf("hosts-file argument: %s\n", *ArghostsFile)
+	log.Printf("resolver-routes argument: %s\n", *ArgresolverRoutes)
+	/* 所有上游DNS服务器的公共配置，服务器URL的片段可以单独修改EDNS配置 */
+	var dnsQueryOptions = func(o *load_balance.DNSQueryOptions) {
+		o.Strategy = resolver.Strategy(*ArgresolverStrategy)
+		o.EDNS = append(o.EDNS, func(o *dns_experiment.EDNSOptions) {
+			o.Padding = *ArgresolverPadding
+		})
+	}
 	var upstreamServer = *strArgupstreamServer
 	if len(upstreamServer) == 0 {
 		log.Fatal("error :upstream-server is empty")
 	}
 	var upstreamServerDefaultTransport http.RoundTripper
+	var upstreamQueryCallbacks generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)]
+	if *ArgupstreamResolvers != "" {
+		var err error
+		upstreamQueryCallbacks, err = load_balance.DNSQueryCallbacksFromURLs(strings.Split(*ArgupstreamResolvers, ","), dnsQueryOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var upstreamDNSSEC *dns_experiment.DNSSECValidator
+	switch *ArgupstreamDNSSEC {
+	case "off":
+	case "flag", "reject":
+		if upstreamQueryCallbacks == nil {
+			log.Fatal("error :upstream-dnssec requires upstream-resolvers")
+		}
+		/* 上游主机的地址、HTTPS 记录和 ECH 配置都使用验证过的应答 */
+		upstreamDNSSEC = dns_experiment.NewDNSSECValidator(func(o *dns_experiment.DNSSECOptions) {
+			o.Reject = *ArgupstreamDNSSEC == "reject"
+		})
+		upstreamQueryCallbacks = upstreamDNSSEC.QueryCallbacks(upstreamQueryCallbacks)
+	default:
+		log.Fatal("error :upstream-dnssec must be one of off,flag,reject")
+	}
+	/* 所有获取上游地址的方式都先使用覆盖表和分流规则 */
+	if *ArghostsFile != "" {
+		if err := dns_experiment.DefaultHosts.LoadFile(*ArghostsFile); err != nil {
+			log.Fatal("error :hosts-file ", err)
+		}
+	}
+	for _, rule := range strings.Split(*ArgresolverRoutes, ",") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		var suffix, urls, found = strings.Cut(rule, "=")
+		if !found {
+			log.Fatal("error :resolver-routes rule must be suffix=dns-server-urls " + rule)
+		}
+		queryCallbacks, err := load_balance.DNSQueryCallbacksFromURLs(strings.Split(urls, "|"), dnsQueryOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if upstreamDNSSEC != nil {
+			queryCallbacks = upstreamDNSSEC.QueryCallbacks(queryCallbacks)
+		}
+		if err := dns_experiment.DefaultRoutes.Add(strings.TrimSpace(suffix), queryCallbacks); err != nil {
+			log.Fatal("error :resolver-routes ", err)
+		}
+	}
+	var upstreamQuery func(m *dns.Msg) (r *dns.Msg, err error)
+	if upstreamQueryCallbacks != nil {
+		upstreamQuery = dns_experiment.UpstreamQueryCallback(upstreamQueryCallbacks)
+	}
+	/* 从上游的 HTTPS 记录中获取 ECH 配置 */
+	var upstreamECHClient *ech.Client
+	switch *ArgupstreamECH {
+	case "off":
+	case "on", "strict":
+		if upstreamQueryCallbacks == nil {
+			log.Fatal("error :upstream-ech requires upstream-resolvers")
+		}
+		upstreamECHClient = ech.NewClient(func(o *ech.Options) {
+			o.Strict = *ArgupstreamECH == "strict"
+			o.ConfigList = ech.HTTPSRecordConfigList(func(host string, port int) ([]dns_experiment.ServiceEndpoint, error) {
+				return dns_experiment.ResolveServiceEndpoints(host, port, upstreamQuery)
+			})
+		})
+	default:
+		log.Fatal("error :upstream-ech must be one of off,on,strict")
+	}
+	var getUpstreamECHClient = func() *ech.Client {
+		return upstreamECHClient
+	}
+	/* 使用 ECH 时需要自己完成TLS握手，ALPN使用与不使用 ECH 时相同的协议列表 */
+	var createUpstreamECHRoundTripper = func(alpns []string) http.RoundTripper {
+		upstreamHostname, err := load_balance.ExtractHostname(upstreamServer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return h12_experiment.CreateHTTP12TransportWithIPGetter(func() []string {
+			return load_balance.LookupServerAddresses(upstreamHostname)
+		}, getUpstreamECHClient, alpns...)
+	}
 
-	if strings.Contains(*StringArgprotocol, "h3") {
-		upstreamServerDefaultTransport = CreateHTTP3RoundTripperOfUpStreamServer(upstreamServer)
+	if *StringArgprotocol == "auto" {
+		/* 先使用HTTP/2,根据上游响应的 Alt-Svc 或者上游的 HTTPS 记录自动升级到HTTP/3 */
+		var rt = alt_svc.NewTransport(func(o *alt_svc.Options) {
+			var alpns = []string{"h2", "http/1.1"}
+			o.H2 = CreateHTTP12RoundTripperOfUpStreamServer(alpns)
+			if upstreamECHClient != nil {
+				o.H2 = createUpstreamECHRoundTripper(alpns)
+			}
+			o.GetECHClient = getUpstreamECHClient
+			/* 替代服务的主机同样使用覆盖表和分流规则解析 */
+			o.LookupAddresses = func(ctx context.Context, host string) ([]string, error) {
+				return load_balance.LookupServerAddresses(host), nil
+			}
+			o.Race = *ArgupstreamRace
+			o.QUICHeadStart = time.Duration(*ArgupstreamQuicHeadStartMs) * time.Millisecond
+			if upstreamQueryCallbacks != nil {
+				o.LookupServiceEndpoints = func(host string, port int) ([]dns_experiment.ServiceEndpoint, error) {
+					return dns_experiment.ResolveServiceEndpoints(host, port, upstreamQuery)
+				}
+			}
+		})
+		upstreamServerDefaultTransport = adapter.RoundTripTransport(func(r *http.Request) (*http.Response, error) {
+			return CreateHTTPRoundTripperMiddleWareOfUpStreamServerURL(upstreamServer)(r, rt.RoundTrip)
+		})
+	} else if strings.Contains(*StringArgprotocol, "h3") {
+		upstreamServerDefaultTransport = CreateHTTP3RoundTripperOfUpStreamServer(upstreamServer, getUpstreamECHClient)
 	} else if strings.Contains(*StringArgprotocol, "h2c") {
 		var rt = CreateHTTP2CRoundTripperOfUpStreamServer()
 		upstreamServerDefaultTransport = adapter.RoundTripTransport(func(r *http.Request) (*http.Response, error) {
 			return CreateHTTPRoundTripperMiddleWareOfUpStreamServerURL(upstreamServer)(r, rt.RoundTrip)
 		})
 	} else if !strings.Contains(*StringArgprotocol, "h3") {
-		var rt = CreateHTTP12RoundTripperOfUpStreamServer(strings.Split(*StringArgprotocol, ","))
+		var alpns = strings.Split(*StringArgprotocol, ",")
+		var rt = CreateHTTP12RoundTripperOfUpStreamServer(alpns)
+		if upstreamECHClient != nil {
+			rt = createUpstreamECHRoundTripper(alpns)
+		}
 		upstreamServerDefaultTransport = adapter.RoundTripTransport(func(r *http.Request) (*http.Response, error) {
 			return CreateHTTPRoundTripperMiddleWareOfUpStreamServerURL(upstreamServer)(r, rt.RoundTrip)
 		})
 	}
+	/* WebSocket 和其他经过负载均衡器的请求共用同一个负载均衡器,只运行一组健康检查 */
+	var setUpgradeConnectionMaxCount = func(upstream load_balance.LoadBalanceAndUpStream) {
+		upstream.GetLoadBalanceService().IfSome(func(v load_balance.LoadBalanceService) {
+			v.GetUpStreams().ForEach(func(lbaus load_balance.LoadBalanceAndUpStream, s string, mi generic.MapInterface[string, load_balance.LoadBalanceAndUpStream]) {
+				lbaus.GetServerConfigCommon().SetUpgradeConnectionMaxCount(*ArgwebsocketMaxConnections)
+			})
+		})
+	}
+	var upstreamLoadBalancer load_balance.LoadBalanceAndUpStream
+	var err error
+	/* 按 SRV 记录或者按地址负载均衡时，请求经过使用HTTP/3并回退到HTTP/2的子上游，不使用 upstream-protocol 创建的传输，
+	只有 auto 在按地址负载均衡时保留，普通请求仍然根据 Alt-Svc 和 HTTPS 记录选择协议 */
+	var balanceAllRequests = *ArgupstreamSRV != "" || *StringArgprotocol != "auto"
+	if upstreamQueryCallbacks != nil && balanceAllRequests && *StringArgprotocol != "h3" {
+		log.Println("upstream-protocol " + *StringArgprotocol + " is ignored,upstream-resolvers and upstream-srv balance requests with h3 and h2 fallback")
+	}
+	if *ArgupstreamSRV != "" {
+		if upstreamQueryCallbacks == nil {
+			log.Fatal("error :upstream-srv requires upstream-resolvers")
+		}
+		/* 每个 SRV 记录的目标主机和端口是一个有独立健康状态的上游，普通请求和 WebSocket 都使用它们 */
+		upstreamLoadBalancer, err = load_balance.NewSRVLoadBalancer(upstreamServer, upstreamServer, *ArgupstreamSRV, upstreamQueryCallbacks, func(r *load_balance.SRVLoadBalancer) {
+			r.ResolveIntervalMs = *ArgupstreamResolveIntervalMs
+			r.GetECHClient = getUpstreamECHClient
+			r.ChildOptions = append(r.ChildOptions, func(child *load_balance.SingleHostHTTP3HTTP2LoadBalancerOfAddress) {
+				setUpgradeConnectionMaxCount(child)
+			})
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		upstreamServerDefaultTransport = adapter.RoundTripTransport(upstreamLoadBalancer.RoundTrip)
+	} else if upstreamQueryCallbacks != nil {
+		/* 解析上游主机名的所有地址，每个地址是一个有独立健康状态的上游，WebSocket 和 gRPC 使用它们，upstream-protocol 不是 auto 时普通请求也使用它们 */
+		upstreamLoadBalancer, err = load_balance.NewResolvingLoadBalancerOfHostname(upstreamServer, upstreamServer, upstreamQueryCallbacks, func(r *load_balance.ResolvingLoadBalancerOfHostname) {
+			r.ResolveIntervalMs = *ArgupstreamResolveIntervalMs
+			r.GetECHClient = getUpstreamECHClient
+			r.ChildOptions = append(r.ChildOptions, func(child *load_balance.SingleHostHTTP3HTTP2LoadBalancerOfAddress) {
+				setUpgradeConnectionMaxCount(child)
+			})
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if balanceAllRequests {
+			upstreamServerDefaultTransport = adapter.RoundTripTransport(upstreamLoadBalancer.RoundTrip)
+		}
+	} else {
+		upstreamLoadBalancer, err = load_balance.NewSingleHostHTTP3HTTP2LoadBalancerOfAddress(upstreamServer, upstreamServer, func(m *load_balance.SingleHostHTTP3HTTP2LoadBalancerOfAddress) {
+			m.GetECHClient = getUpstreamECHClient
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		setUpgradeConnectionMaxCount(upstreamLoadBalancer)
+	}
+	/* gRPC 经过负载均衡器转发，才能根据尾部中的 grpc-status 执行被动健康检查，h2c 上游只能使用默认的传输 */
+	var grpcTransport = upstreamServerDefaultTransport
+	if !strings.Contains(*StringArgprotocol, "h2c") {
+		grpcTransport = adapter.RoundTripTransport(upstreamLoadBalancer.RoundTrip)
+	}
+	var websocketUpgrader = upstreamLoadBalancer.(load_balance.UpgradeUpStream).Upgrade
+	/* HTTP/2 和 HTTP/3 的客户端通过扩展 CONNECT 建立 WebSocket,按照上游支持的协议转发 */
+	var websocketDialer = upstreamLoadBalancer.(load_balance.WebSocketUpStream).DialWebSocket
+	var websocketIdleTimeout = time.Duration(*ArgwebsocketIdleTimeoutMs) * time.Millisecond
+	/* 扩展 CONNECT 依赖 extended_connect 包在初始化时设置的环境变量,启动时确认它已经生效 */
+	if err := websocket_proxy.CheckExtendedConnect(); err != nil {
+		log.Println("ERROR: http2 extended connect is disabled,websockets over http2 will not work", err)
+	}
+	var grpcWeb *grpc_proxy.GRPCWeb
+	if *ArggrpcWeb {
+		grpcWeb = grpc_proxy.NewGRPCWeb(func(o *grpc_proxy.GRPCWebOptions) {
+			o.AllowedOrigins = strings.Split(*ArggrpcWebAllowedOrigins, ",")
+		})
+	}
 	//健康检查过期时间毫秒
 	// var maxAge = int64(5 * 1000)
 	// 定义上游服务器地址
@@ -136,7 +418,31 @@ func main() {
 	var httpPort = *intArghttpPort
 	// var upStreamServerSchemeAndHostOfName map[string]generic.PairInterface[string, string] = map[string]generic.PairInterface[string, string]{}
 	engine := gin.Default()
-	engine.Use(Forwarded(), LoopDetect())
+	trustedProxies, err := forwarded.ParseCIDRList(*ArgtrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	trustedAction, err := forwarded.ParseAction(*ArgforwardedTrustedAction)
+	if err != nil {
+		log.Fatal(err)
+	}
+	untrustedAction, err := forwarded.ParseAction(*ArgforwardedUntrustedAction)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var proxyIdentifier = *ArgproxyIdentifier
+	if proxyIdentifier == "" {
+		proxyIdentifier = forwarded.NewInstanceID()
+	}
+	log.Println("proxy instance id:", proxyIdentifier)
+	var forwardedOptions = &forwarded.Options{
+		TrustedProxies:  trustedProxies,
+		TrustedAction:   trustedAction,
+		UntrustedAction: untrustedAction,
+		EmitXForwarded:  *ArgxForwarded,
+		ProxyIdentifier: proxyIdentifier,
+	}
+	engine.Use(LoopDetect(forwardedOptions, *ArgmaxHops), Forwarded(forwardedOptions))
 	engine.Use(func(c *gin.Context) {
 		if *Arglistenhttp3 {
 			c.Writer.Header().Add("Alt-Svc",
@@ -183,6 +489,48 @@ func main() {
 		req.URL.Host = req.Host
 		PrintRequest(req) // 打印请求信息
 
+		if websocket_proxy.IsWebSocketUpgrade(req) {
+			if err := websocket_proxy.ServeUpgrade(ctx.Writer, req, websocketUpgrader, websocketIdleTimeout); err != nil {
+				log.Println("ERROR:", err)
+				if errors.Is(err, load_balance.ErrUpgradeConnectionLimit) {
+					ctx.String(http.StatusServiceUnavailable, "ERROR: "+err.Error())
+				} else {
+					ctx.String(http.StatusBadGateway, "ERROR: "+err.Error())
+				}
+			}
+			ctx.Abort()
+			return
+		}
+		if websocket_proxy.IsExtendedConnectWebSocket(req) {
+			if err := websocket_proxy.ServeExtendedConnect(ctx.Writer, req, websocketDialer, websocketIdleTimeout); err != nil {
+				log.Println("ERROR:", err)
+				if errors.Is(err, load_balance.ErrUpgradeConnectionLimit) {
+					ctx.String(http.StatusServiceUnavailable, "ERROR: "+err.Error())
+				} else {
+					ctx.String(http.StatusBadGateway, "ERROR: "+err.Error())
+				}
+			}
+			ctx.Abort()
+			return
+		}
+
+		if grpcWeb != nil && grpc_proxy.IsGRPCWebPreflight(req) {
+			grpcWeb.ServePreflight(ctx.Writer, req)
+			ctx.Abort()
+			return
+		}
+		if grpcWeb != nil && grpc_proxy.IsGRPCWeb(req) {
+			grpcWeb.Serve(ctx.Writer, req, grpcTransport.RoundTrip)
+			ctx.Abort()
+			return
+		}
+		/* gRPC 需要双向流式转发和HTTP尾部，不能使用下面的缓冲转发 */
+		if grpc_proxy.IsGRPC(req) {
+			grpc_proxy.Serve(ctx.Writer, req, grpcTransport.RoundTrip)
+			ctx.Abort()
+			return
+		}
+
 		// 使用随机负载均衡策略选择一个健康状态的传输函数，并执行请求
 
 		var resp, err = upstreamServerDefaultTransport.RoundTrip(req) //RandomLoadBalancer(getHealthyProxyServers(), req, upStreamServerSchemeAndHostOfName)
@@ -234,6 +582,77 @@ func main() {
 
 	// }()
 
+	var forwardProxy *forward_proxy.Proxy
+	if *ArgforwardProxy {
+		allowList, err := acl.Parse(*ArgforwardProxyAllowedTargets)
+		if err != nil {
+			log.Fatal("error :forward-proxy-allowed-targets ", err)
+		}
+		if len(allowList) == 0 {
+			log.Println("warning :forward-proxy-allowed-targets is empty, all CONNECT targets will be denied")
+		}
+		denyList, err := acl.Parse(*ArgforwardProxyDeniedTargets)
+		if err != nil {
+			log.Fatal("error :forward-proxy-denied-targets ", err)
+		}
+		var username, password, _ = strings.Cut(*ArgforwardProxyAuth, ":")
+		forwardProxy = forward_proxy.NewProxy(func(o *forward_proxy.Options) {
+			o.AllowList = allowList
+			o.DenyList = denyList
+			o.Username = username
+			o.Password = password
+			o.IdleTimeout = time.Duration(*ArgforwardProxyIdleTimeoutMs) * time.Millisecond
+		})
+	}
+	/* DoH、DoQ和DoT服务使用同一组上游DNS服务器和缓存 */
+	var dnsServerQuery func(m *dns.Msg) (r *dns.Msg, err error)
+	if *ArgdohServer || *ArgdoqServerPort != 0 || *ArgdotServerPort != 0 {
+		var dnsServerQueryCallbacks = upstreamQueryCallbacks
+		if *ArgdnsServerResolvers != "" {
+			dnsServerQueryCallbacks, err = load_balance.DNSQueryCallbacksFromURLs(strings.Split(*ArgdnsServerResolvers, ","), dnsQueryOptions)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if dnsServerQueryCallbacks == nil {
+			log.Fatal("error :doh-server,doq-server-port and dot-server-port require dns-server-resolvers or upstream-resolvers")
+		}
+		dnsServerQuery = dns_experiment.QueryCallbackOfServers(dnsServerQueryCallbacks, dns_experiment.DefaultCache)
+	}
+	var dnsServerOptions = func(o *dns_server.Options) {
+		o.Path = *ArgdohServerPath
+		o.Query = dnsServerQuery
+	}
+	if *ArgdnsServerECS != "" {
+		var ipv4PrefixLength, ipv6PrefixLength uint8
+		if _, err := fmt.Sscanf(*ArgdnsServerECS, "%d/%d", &ipv4PrefixLength, &ipv6PrefixLength); err != nil || ipv4PrefixLength > 32 || ipv6PrefixLength > 128 {
+			log.Fatal("error :dns-server-ecs must be ipv4/ipv6 prefix lengths such as 24/56 ", err)
+		}
+		var queryOptions = dnsServerOptions
+		dnsServerOptions = func(o *dns_server.Options) {
+			queryOptions(o)
+			o.ClientSubnet = true
+			o.ClientSubnetIPv4PrefixLength = ipv4PrefixLength
+			o.ClientSubnetIPv6PrefixLength = ipv6PrefixLength
+		}
+	}
+	var dohHandler *dns_server.DoHHandler
+	if *ArgdohServer {
+		dohHandler = dns_server.NewDoHHandler(dnsServerOptions)
+	}
+	/* CONNECT 请求在进入 gin 之前交给正向代理处理，DNS查询交给DoH服务，其他请求交给反向代理 */
+	var serveHTTP = func(w http.ResponseWriter, req *http.Request) {
+		if forwardProxy != nil && forward_proxy.IsConnect(req) {
+			forwardProxy.ServeHTTP(w, req)
+			return
+		}
+		if dohHandler != nil && dohHandler.IsDNSQuery(req) {
+			dohHandler.ServeHTTP(w, req)
+			return
+		}
+		engine.Handler().ServeHTTP(w, req)
+	}
+
 	var group sync.WaitGroup
 	certFile := *tlscertArg //"cert.crt"
 	keyFile := *tlskeyArg   // "key.pem"
@@ -242,8 +661,28 @@ func main() {
 
 		defer group.Done()
 		if *Arglistenhttp3 {
+			var masqueProxy *masque.Proxy
+			if *Argmasque {
+				allowList, err := acl.Parse(*ArgmasqueAllowedTargets)
+				if err != nil {
+					log.Fatal("error :masque-allowed-targets ", err)
+				}
+				if len(allowList) == 0 {
+					log.Println("warning :masque-allowed-targets is empty, all CONNECT-UDP targets will be denied")
+				}
+				masqueProxy = masque.NewProxy(func(o *masque.Options) {
+					o.AllowList = allowList
+					o.MaxSessionsPerClient = *ArgmasqueMaxSessionsPerClient
+					o.IdleTimeout = time.Duration(*ArgmasqueIdleTimeoutMs) * time.Millisecond
+				})
+			}
 			var handlerFunc = func(w http.ResponseWriter, req *http.Request) {
-				engine.Handler().ServeHTTP(w, req)
+				/* gin 的响应写入器没有实现 http3.HTTPStreamer，CONNECT-UDP 请求需要在进入 gin 之前处理 */
+				if masqueProxy != nil && masque.IsConnectUDP(req) {
+					masqueProxy.ServeHTTP(w, req)
+					return
+				}
+				serveHTTP(w, req)
 			}
 
 			bCap := hostname + ":" + fmt.Sprint(httpsPort)
@@ -251,9 +690,10 @@ func main() {
 				handlerFunc(w, req)
 			})
 			server := http3.Server{
-				Handler:    handler,
-				Addr:       bCap,
-				QUICConfig: &quic.Config{
+				Handler:         handler,
+				Addr:            bCap,
+				EnableDatagrams: *Argmasque,
+				QUICConfig:      &quic.Config{
 					// Tracer: qlog.DefaultTracer,
 				},
 			}
@@ -278,7 +718,7 @@ func main() {
 				Addr: hostname + ":" + strconv.Itoa(httpsPort),
 				Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 
-					engine.Handler().ServeHTTP(w, req) // 调用Gin引擎的Handler方法处理HTTP请求。
+					serveHTTP(w, req) // 调用Gin引擎的Handler方法处理HTTP请求。
 
 				}), /*  &LoadBalanceHandler{
 					engine: engine,
@@ -303,7 +743,7 @@ func main() {
 
 			// 设置自定义处理器
 			var handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-				engine.Handler().ServeHTTP(w, req)
+				serveHTTP(w, req)
 			})
 			http2Server := &http2.Server{
 				// ...
@@ -325,6 +765,36 @@ func main() {
 			}
 		}
 	}()
+	/* DoQ和DoT服务使用与HTTPS监听器相同的证书 */
+	if *ArgdoqServerPort != 0 || *ArgdotServerPort != 0 {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var dnsServerTLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		if *ArgdoqServerPort != 0 {
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				log.Println("Starting doq server on " + hostname + ":" + strconv.Itoa(*ArgdoqServerPort))
+				var err = dns_server.NewDoQServer(dnsServerOptions).ListenAndServe(hostname+":"+strconv.Itoa(*ArgdoqServerPort), dnsServerTLSConfig)
+				if err != nil {
+					log.Fatal("Serve: ", err)
+				}
+			}()
+		}
+		if *ArgdotServerPort != 0 {
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				log.Println("Starting dot server on " + hostname + ":" + strconv.Itoa(*ArgdotServerPort))
+				var err = dns_server.NewDoTServer(dnsServerOptions).ListenAndServe(hostname+":"+strconv.Itoa(*ArgdotServerPort), dnsServerTLSConfig)
+				if err != nil {
+					log.Fatal("Serve: ", err)
+				}
+			}()
+		}
+	}
 	group.Wait()
 }
 
@@ -411,20 +881,21 @@ func CreateHTTP12RoundTripperOfUpStreamServer(alpns []string) http.RoundTripper
 // 参数:
 //
 //	upstreamServer string - 上游服务器的URL。
+//	getECHClient func() *ech.Client - 返回连接上游时使用的 ECH 客户端，返回nil时不使用 ECH。
 //
 // 返回值:
 //
 //	adapter.HTTPRoundTripperAndCloserInterface - 支持HTTP/3协议的轮询器接口，可用于发起HTTP请求。
-func CreateHTTP3RoundTripperOfUpStreamServer(upstreamServer string) adapter.HTTPRoundTripperAndCloserInterface {
+func CreateHTTP3RoundTripperOfUpStreamServer(upstreamServer string, getECHClient func() *ech.Client) adapter.HTTPRoundTripperAndCloserInterface {
 	var mutex sync.Mutex
 	var started = false
-	var h3rt = h3_experiment.CreateHTTP3TransportWithIPGetter(func() (string, error) {
+	var h3rt = h3_experiment.CreateHTTP3TransportWithIPGetter(func() ([]string, error) {
 		upstreamServerURL, err := url.Parse(upstreamServer)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		return upstreamServerURL.Hostname(), nil
-	})
+		return load_balance.LookupServerAddresses(upstreamServerURL.Hostname()), nil
+	}, getECHClient)
 	log.Println(
 		"INFO: Creating new HTTP/3 round tripper for upstream server",
 	)
@@ -444,13 +915,13 @@ func CreateHTTP3RoundTripperOfUpStreamServer(upstreamServer string) adapter.HTTP
 					"INFO: Creating new HTTP/3 round tripper for upstream server",
 				)
 				oldH3rt = optional.Some(h3rt)
-				h3rt = h3_experiment.CreateHTTP3TransportWithIPGetter(func() (string, error) {
+				h3rt = h3_experiment.CreateHTTP3TransportWithIPGetter(func() ([]string, error) {
 					upstreamServerURL, err := url.Parse(upstreamServer)
 					if err != nil {
-						return "", err
+						return nil, err
 					}
-					return upstreamServerURL.Hostname(), nil
-				})
+					return load_balance.LookupServerAddresses(upstreamServerURL.Hostname()), nil
+				}, getECHClient)
 
 				if oldH3rt != nil && oldH3rt.IsSome() {
 					oldH3rt.Unwrap().Close()
@@ -539,121 +1010,62 @@ func CreateHTTP3RoundTripperOfUpStreamServer(upstreamServer string) adapter.HTTP
 // refreshHealthyUpStreams加锁操作
 // var mutex sync.Mutex
 
-// Forwarded 创建并返回一个 gin.HandlerFunc，用于在 HTTP 请求的 Header 中添加 "Forwarded" 信息。
+// Forwarded 创建并返回一个 gin.HandlerFunc，用于按照 RFC 7239 在 HTTP 请求的 Header 中添加 "Forwarded" 信息，
+// 并在 "Via" 头部中追加本代理实例的标识。
 // 这个信息包含了客户端的 IP 地址、代理的标识、原始请求的目标主机名以及使用的协议（HTTP 或 HTTPS）。
+// 对端是否属于受信任的代理决定了已有的转发头部是被保留、追加还是丢弃。
+// 参数 options 为转发头部处理配置。
 // 返回值是一个处理 gin.Context 的函数。
-func Forwarded() gin.HandlerFunc {
+func Forwarded(options *forwarded.Options) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var clienthost = c.RemoteIP()
-		var address = c.Request.Host
-		if address == "" {
-			address = c.Request.URL.Host
-		}
-		var proto = "http"
-
-		if c.Request.TLS != nil {
-			proto = "https"
-		}
-		forwarded := fmt.Sprintf(
-			"for=%s;by=%s;host=%s;proto=%s",
-			clienthost,     // 代理自己的标识或IP地址
-			c.Request.Host, // 代理的标识
-			address,        // 原始请求的目标主机名
-			proto,          // 或者 "https" 根据实际协议
-		)
-		c.Request.Header.Add("Forwarded", forwarded)
-		c.Next()
-	}
-}
-
-// ForwardedBy 结构体
-//
-// 描述：这个结构体用于表示一个转发标识。
-//
-// 字段：
-// Identifier string - 用于唯一标识转发的字符串。
-type ForwardedBy struct {
-	Identifier string
-}
-
-// 辅助函数：将ForwardedBy列表转换为集合（set），用于快速判断重复项
-func setFromForwardedBy(forwardedByList []ForwardedBy) map[string]bool {
-	set := make(map[string]bool)
-	for _, fb := range forwardedByList {
-		set[fb.Identifier] = true
-	}
-	return set
-}
-
-// parseForwardedHeader 解析 "Forwarded" HTTP 头部信息，返回一个 ForwardedBy 结构体切片。
-// header: 代表被转发的请求的 "Forwarded" 头部字符串。
-// 返回值: 一个包含所有转发标识的 ForwardedBy 结构体切片，以及可能发生的错误。
-
-func parseForwardedHeader(header string) ([]ForwardedBy, error) {
-	var forwardedByList []ForwardedBy
-	parts := strings.Split(header, ", ")
-
-	for _, part := range parts {
-		for _, param := range strings.Split(part, ";") {
-			param = strings.TrimSpace(param)
-			if !strings.HasPrefix(param, "by=") {
-				continue
-			}
-
-			// 分离 by 参数的值
-			value := strings.TrimPrefix(param, "by=")
-			// host, port, err := net.SplitHostPort(value)
-			// if err != nil {
-			// 如果没有端口信息，host 就是整个值
-			var host = value
-			// port = ""
-			// }
-
-			forwardedBy := ForwardedBy{
-				Identifier: host,
-				// Port:       port,
-			}
-
-			// 检查是否重复
-			// isDuplicate := false
-			// for _, existing := range forwardedByList {
-			// 	if existing.Identifier == forwardedBy.Identifier && existing.Port == forwardedBy.Port {
-			// 		isDuplicate = true
-			// 		break
-			// 	}
-			// }
-			// if !isDuplicate {
-			forwardedByList = append(forwardedByList, forwardedBy)
-			// }
+		if err := forwarded.Apply(c.Request, c.RemoteIP(), options); err != nil {
+			log.Println("Error parsing 'Forwarded' header:", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			c.Writer.WriteString("Error parsing 'Forwarded' header: " + err.Error())
+			return
 		}
+		forwarded.AppendVia(c.Request, options.ProxyIdentifier)
+		c.Next()
 	}
-
-	return forwardedByList, nil
 }
 
-// LoopDetect 是一个用于检测请求中'Forwarded'头是否存在重复'by'标识符的gin中间件。
-// 如果发现重复的'by'标识符，将返回状态码508并提供错误信息。
-// 如果无法解析'Forwarded'头，将返回状态码400并给出解析错误的具体信息。
+// LoopDetect 是一个基于代理实例标识的防环检测gin中间件，需要在 Forwarded 中间件之前执行，
+// 以便在传入的转发头部被丢弃之前完成检查。
+// 如果'Forwarded'头的'by'标识符或'Via'头中已经包含本实例的标识，
+// 又或者受信任代理策略保留的转发路径中的代理数量达到 maxHops，将返回状态码508并给出JSON格式的错误信息。
+// 如果需要保留的'Forwarded'头无法解析，将返回状态码400并给出解析错误的具体信息。
+// 参数 options 为转发头部处理配置，其中的 ProxyIdentifier 为本代理实例的标识，maxHops 为允许的最大跳数，小于等于0时不限制。
 // 返回值为一个gin.HandlerFunc类型的函数，可直接用于gin路由的中间件配置。
-
-func LoopDetect() gin.HandlerFunc {
+func LoopDetect(options *forwarded.Options, maxHops int) gin.HandlerFunc {
+	var identifier = options.ProxyIdentifier
 	return func(c *gin.Context) {
-		var r = c.Request
-		var w = c.Writer
-		forwardedHeader := strings.Join(r.Header.Values("Forwarded"), ", ")
-		log.Println("forwardedHeader:", forwardedHeader)
-		forwardedByList, err := parseForwardedHeader(forwardedHeader)
-		log.Println("forwardedByList:", forwardedByList)
-		if len(forwardedByList) != len(setFromForwardedBy(forwardedByList)) {
-			w.WriteHeader(508)
-			fmt.Fprintln(w, "Duplicate 'by' identifiers found in 'Forwarded' header.")
-			log.Println("Duplicate 'by' identifiers found in 'Forwarded' header.")
-			c.Abort()
+		info, err := forwarded.InspectLoop(c.Request, c.RemoteIP(), options)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error":   "invalid_forwarded_header",
+				"message": "Error parsing 'Forwarded' header: " + err.Error(),
+			})
 			return
 		}
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "Error parsing 'Forwarded' header: %v", err)
+		if info.ContainsSelf {
+			log.Println("Loop detected, proxy id:", identifier, "hops:", info.Hops)
+			c.AbortWithStatusJSON(http.StatusLoopDetected, gin.H{
+				"error":    "loop_detected",
+				"message":  "The request has already passed through this proxy.",
+				"proxy_id": identifier,
+				"hops":     info.Hops,
+			})
+			return
+		}
+		if maxHops > 0 && info.Hops >= maxHops {
+			log.Println("Too many hops, proxy id:", identifier, "hops:", info.Hops)
+			c.AbortWithStatusJSON(http.StatusLoopDetected, gin.H{
+				"error":    "too_many_hops",
+				"message":  "The request has exceeded the maximum number of proxy hops.",
+				"proxy_id": identifier,
+				"hops":     info.Hops,
+				"max_hops": maxHops,
+			})
 			return
 		}
 		c.Next()
@@ -0,0 +1,324 @@
+package masque
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/acl"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+)
+
+// ConnectUDPProtocol 是 CONNECT-UDP 请求中 :protocol 伪头部的值（RFC 9298）。
+const ConnectUDPProtocol = "connect-udp"
+
+// PathPrefix 是默认的 CONNECT-UDP URI 模板 "/.well-known/masque/udp/{target_host}/{target_port}/" 的前缀。
+const PathPrefix = "/.well-known/masque/udp/"
+
+// maxUDPPayloadSize 是UDP载荷的最大长度。
+const maxUDPPayloadSize = 65535
+
+// ErrInvalidTarget 表示请求路径不符合 CONNECT-UDP 的URI模板。
+var ErrInvalidTarget = errors.New("masque: invalid connect-udp target")
+
+// Options 是 MASQUE 代理的配置。
+//
+// 字段：
+// AllowList - 允许访问的目标地址列表，为空时拒绝所有目标。
+// MaxSessionsPerClient - 每个客户端IP地址同时存在的会话数量上限，小于等于0时不限制。
+// MaxSessions - 全部客户端同时存在的会话数量上限，小于等于0时不限制。
+// IdleTimeout - 会话的空闲超时时间，小于等于0时不限制。
+// DialTimeout - 解析目标地址的超时时间。
+type Options struct {
+	AllowList            []acl.Rule
+	MaxSessionsPerClient int
+	MaxSessions          int
+	IdleTimeout          time.Duration
+	DialTimeout          time.Duration
+}
+
+// Proxy 是基于 HTTP/3 的 MASQUE CONNECT-UDP 代理（RFC 9298），
+// 通过 HTTP Datagrams（RFC 9297）在客户端和目标UDP地址之间转发数据报。
+// http3.Server 需要开启 EnableDatagrams，并且 Proxy 必须直接作为 http3.Server 的处理器（或由其直接调用），
+// 因为会话需要通过 http3.HTTPStreamer 接管请求流。
+type Proxy struct {
+	Options
+	mutex    sync.Mutex
+	sessions map[string]int
+	total    int
+}
+
+// NewProxy 创建一个 MASQUE 代理。
+//
+// 参数:
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的代理。
+func NewProxy(options ...func(*Options)) *Proxy {
+	var proxy = &Proxy{
+		Options: Options{
+			IdleTimeout: 2 * time.Minute,
+			DialTimeout: 10 * time.Second,
+		},
+		sessions: map[string]int{},
+	}
+	for _, option := range options {
+		option(&proxy.Options)
+	}
+	return proxy
+}
+
+// IsConnectUDP 判断请求是否为 HTTP/3 的 CONNECT-UDP 请求。
+// quic-go 将扩展CONNECT的 :protocol 伪头部保存在 Proto 字段中。
+func IsConnectUDP(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.ProtoMajor == 3 && strings.EqualFold(r.Proto, ConnectUDPProtocol)
+}
+
+// ParseTarget 从默认的 CONNECT-UDP URI 模板中解析目标主机和端口。
+// 目标主机是经过百分号编码的主机名或IP地址，IPv6地址中的冒号被编码为 "%3A"。
+//
+// 参数:
+// path - 请求的转义路径。
+//
+// 返回值:
+// 目标主机、目标端口和解析时遇到的错误。
+func ParseTarget(path string) (string, int, error) {
+	rest, ok := strings.CutPrefix(path, PathPrefix)
+	if !ok {
+		return "", 0, ErrInvalidTarget
+	}
+	var parts = strings.Split(strings.TrimSuffix(rest, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, ErrInvalidTarget
+	}
+	host, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", 0, ErrInvalidTarget
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, ErrInvalidTarget
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port, nil
+}
+
+// acquire 为客户端占用一个会话名额，超过配额时返回false。
+func (p *Proxy) acquire(client string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.MaxSessions > 0 && p.total >= p.MaxSessions {
+		return false
+	}
+	if p.MaxSessionsPerClient > 0 && p.sessions[client] >= p.MaxSessionsPerClient {
+		return false
+	}
+	p.sessions[client]++
+	p.total++
+	return true
+}
+
+// release 释放客户端的一个会话名额。
+func (p *Proxy) release(client string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.total--
+	if p.sessions[client]--; p.sessions[client] <= 0 {
+		delete(p.sessions, client)
+	}
+}
+
+// SessionCount 返回客户端当前的会话数量。
+func (p *Proxy) SessionCount(client string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.sessions[client]
+}
+
+// resolve 解析目标地址，返回第一个被允许列表允许的UDP地址。
+func (p *Proxy) resolve(ctx context.Context, host string, port int) (*net.UDPAddr, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.DialTimeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		if acl.Allowed(p.AllowList, host, address.IP, port) {
+			return &net.UDPAddr{IP: address.IP, Port: port, Zone: address.Zone}, nil
+		}
+	}
+	return nil, nil
+}
+
+// ServeHTTP 实现了 http.Handler 接口，处理 CONNECT-UDP 请求。
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !IsConnectUDP(r) {
+		http.Error(w, "masque: expected connect-udp request", http.StatusBadRequest)
+		return
+	}
+	streamer, ok := w.(http3.HTTPStreamer)
+	if !ok {
+		http.Error(w, "masque: response writer does not support http3 streams", http.StatusInternalServerError)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "masque: response writer does not support flushing", http.StatusInternalServerError)
+		return
+	}
+	host, port, err := ParseTarget(r.URL.EscapedPath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target, err := p.resolve(r.Context(), host, port)
+	if err != nil {
+		log.Println("masque: resolve target", host, port, err)
+		w.Header().Set("Proxy-Status", "masque; error=dns_error")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if target == nil {
+		log.Println("masque: target not allowed", host, port)
+		w.Header().Set("Proxy-Status", "masque; error=destination_ip_prohibited")
+		http.Error(w, "masque: target not allowed", http.StatusForbidden)
+		return
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if !p.acquire(client) {
+		log.Println("masque: session quota exceeded", client)
+		http.Error(w, "masque: session quota exceeded", http.StatusTooManyRequests)
+		return
+	}
+	defer p.release(client)
+
+	conn, err := net.DialUDP("udp", nil, target)
+	if err != nil {
+		log.Println("masque: dial target", target, err)
+		w.Header().Set("Proxy-Status", "masque; error=connection_refused")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+
+	w.Header().Set(http3.CapsuleProtocolHeader, "?1")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	var stream = streamer.HTTPStream()
+	defer stream.Close()
+
+	var start = time.Now()
+	stats := p.relay(r.Context(), stream, conn)
+	log.Println("masque: session closed", client, target,
+		"client->target", stats.clientToTarget, "target->client", stats.targetToClient,
+		"idle timeout", stats.idleTimeout, "duration", time.Since(start))
+}
+
+// sessionStats 统计会话转发的UDP载荷字节数。
+type sessionStats struct {
+	clientToTarget int64
+	targetToClient int64
+	idleTimeout    bool
+}
+
+// relay 在请求流的 HTTP Datagrams 和目标UDP连接之间转发数据报，
+// 直到客户端关闭请求流、连接出错或者空闲超时。
+func (p *Proxy) relay(ctx context.Context, stream *http3.Stream, conn *net.UDPConn) sessionStats {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var stats sessionStats
+	var mutex sync.Mutex
+	var timer *time.Timer
+	if p.IdleTimeout > 0 {
+		timer = time.AfterFunc(p.IdleTimeout, func() {
+			mutex.Lock()
+			stats.idleTimeout = true
+			mutex.Unlock()
+			cancel()
+		})
+		defer timer.Stop()
+	}
+	var activity = func() {
+		if timer != nil {
+			timer.Reset(p.IdleTimeout)
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Add(3)
+	/* 客户端 -> 目标：只转发上下文ID为0的数据报，其他上下文ID的数据报被丢弃 */
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		for {
+			datagram, err := stream.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			contextID, n, err := quicvarint.Parse(datagram)
+			if err != nil || contextID != 0 {
+				continue
+			}
+			written, err := conn.Write(datagram[n:])
+			if err != nil {
+				return
+			}
+			activity()
+			mutex.Lock()
+			stats.clientToTarget += int64(written)
+			mutex.Unlock()
+		}
+	}()
+	/* 目标 -> 客户端 */
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		var buf = make([]byte, maxUDPPayloadSize+1)
+		for {
+			/* 为上下文ID 0 预留第一个字节 */
+			n, err := conn.Read(buf[1:])
+			if err != nil {
+				return
+			}
+			buf[0] = 0
+			if err := stream.SendDatagram(buf[:n+1]); err != nil {
+				/* 数据报超过连接允许的大小时直接丢弃 */
+				var tooLarge *quic.DatagramTooLargeError
+				if errors.As(err, &tooLarge) {
+					continue
+				}
+				return
+			}
+			activity()
+			mutex.Lock()
+			stats.targetToClient += int64(n)
+			mutex.Unlock()
+		}
+	}()
+	/* 请求流上只会收到胶囊，读到流结束表示客户端关闭了会话 */
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		io.Copy(io.Discard, stream)
+	}()
+	<-ctx.Done()
+	conn.Close()
+	stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeNoError))
+	wg.Wait()
+	mutex.Lock()
+	defer mutex.Unlock()
+	return stats
+}
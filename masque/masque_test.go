@@ -0,0 +1,165 @@
+package masque
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/acl"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/internal/testcert"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newUDPEcho 启动一个原样回显数据报的UDP服务器。
+func newUDPEcho(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var buf = make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// newProxyServer 启动开启了 HTTP Datagrams 的 HTTP/3 服务器并返回其地址。
+func newProxyServer(t *testing.T, proxy *Proxy, certificate tls.Certificate) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http3.Server{
+		Handler:         proxy,
+		EnableDatagrams: true,
+		TLSConfig:       http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{certificate}}),
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		server.Close()
+		conn.Close()
+	})
+	return conn.LocalAddr().String()
+}
+
+// dialConnectUDP 向代理发送 CONNECT-UDP 请求，返回请求流和响应。
+func dialConnectUDP(t *testing.T, clientConn *http3.ClientConn, proxyAddress string, target string) (*http3.RequestStream, *http.Response) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	host, port, _ := net.SplitHostPort(target)
+	stream, err := clientConn.OpenRequestStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  ConnectUDPProtocol,
+		Host:   proxyAddress,
+		Header: http.Header{http3.CapsuleProtocolHeader: []string{"?1"}},
+		URL:    &url.URL{Scheme: "https", Host: proxyAddress, Path: PathPrefix + host + "/" + port + "/"},
+	}
+	if err := stream.SendRequestHeader(request); err != nil {
+		t.Fatal(err)
+	}
+	response, err := stream.ReadResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream, response
+}
+
+func TestConnectUDPEcho(t *testing.T) {
+	echo := newUDPEcho(t)
+	defer echo.Close()
+	certificate, pool := testcert.New(t, "localhost", "127.0.0.1")
+	rules, err := acl.Parse("127.0.0.1:" + strconv.Itoa(echo.LocalAddr().(*net.UDPAddr).Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewProxy(func(o *Options) {
+		o.AllowList = rules
+		o.MaxSessionsPerClient = 1
+	})
+	proxyAddress := newProxyServer(t, proxy, certificate)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, proxyAddress, &tls.Config{RootCAs: pool, NextProtos: []string{http3.NextProtoH3}}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+	clientConn := (&http3.Transport{EnableDatagrams: true}).NewClientConn(conn)
+	select {
+	case <-clientConn.ReceivedSettings():
+	case <-ctx.Done():
+		t.Fatal("settings not received")
+	}
+	if !clientConn.Settings().EnableDatagrams {
+		t.Fatal("proxy did not enable datagrams")
+	}
+
+	stream, response := dialConnectUDP(t, clientConn, proxyAddress, echo.LocalAddr().String())
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", response.StatusCode)
+	}
+	if response.Header.Get(http3.CapsuleProtocolHeader) != "?1" {
+		t.Error("missing Capsule-Protocol header")
+	}
+	/* UDP可能丢包，重复发送直到收到回显 */
+	var received []byte
+	for i := 0; i < 10 && received == nil; i++ {
+		if err := stream.SendDatagram(append([]byte{0}, "hello"...)); err != nil {
+			t.Fatal(err)
+		}
+		receiveCtx, receiveCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		received, _ = stream.ReceiveDatagram(receiveCtx)
+		receiveCancel()
+	}
+	if string(received) != "\x00hello" {
+		t.Fatalf("unexpected echo: %q", received)
+	}
+
+	second, response := dialConnectUDP(t, clientConn, proxyAddress, echo.LocalAddr().String())
+	second.Close()
+	if response.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected session quota, got status %d", response.StatusCode)
+	}
+
+	forbidden, response := dialConnectUDP(t, clientConn, proxyAddress, "127.0.0.1:9")
+	forbidden.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("expected forbidden target, got status %d", response.StatusCode)
+	}
+
+	stream.Close()
+	var deadline = time.Now().Add(2 * time.Second)
+	for proxy.SessionCount("127.0.0.1") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session was not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	host, port, err := ParseTarget("/.well-known/masque/udp/2001%3Adb8%3A%3A1/443/")
+	if err != nil || host != "2001:db8::1" || port != 443 {
+		t.Fatalf("unexpected target: %q %d %v", host, port, err)
+	}
+	if _, _, err := ParseTarget("/.well-known/masque/udp/example.com/0/"); err == nil {
+		t.Error("expected invalid port")
+	}
+}
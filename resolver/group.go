@@ -0,0 +1,263 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/miekg/dns"
+)
+
+// Strategy 是组合解析器选择上游DNS服务器的策略。
+type Strategy string
+
+const (
+	// StrategyFastest 同时查询所有服务器，使用最快的成功应答，并取消其他查询。
+	StrategyFastest Strategy = "fastest"
+	// StrategyFailover 按照配置的顺序依次查询，前一个服务器失败时查询下一个。
+	StrategyFailover Strategy = "failover"
+	// StrategyRandom 按照随机的顺序依次查询，分散各个服务器的负载。
+	StrategyRandom Strategy = "random"
+	// StrategyUnion 同时查询所有服务器，合并所有成功应答中的记录。
+	StrategyUnion Strategy = "union"
+)
+
+// Stats 是组合解析器中一个服务器的统计信息。
+//
+// 字段：
+// Name - 服务器的名称。
+// Latency - 成功查询的延迟的指数加权移动平均值，没有成功的查询时为0。
+// Successes - 成功的查询数。
+// Failures - 失败的查询数，被取消的查询不计入。
+type Stats struct {
+	Name      string
+	Latency   time.Duration
+	Successes uint64
+	Failures  uint64
+}
+
+// GroupOptions 是组合解析器的配置。
+//
+// 字段：
+// GroupName - 组合解析器的名称，为空时使用策略和所有服务器的名称。
+// Strategy - 选择服务器的策略，默认为 StrategyFailover。
+// Timeout - Exchange 每个查询的超时时间，默认为10秒。
+type GroupOptions struct {
+	GroupName string
+	Strategy  Strategy
+	Timeout   time.Duration
+}
+
+// Group 是按照策略组合多个解析器的解析器，记录每个服务器的延迟和成功失败次数，可以被多个协程同时使用。
+type Group struct {
+	GroupOptions
+	members []*member
+}
+
+// member 是组合解析器中的一个服务器和它的统计信息。
+type member struct {
+	Resolver
+	mutex sync.Mutex
+	stats Stats
+}
+
+// NewGroup 创建一个组合解析器。
+//
+// 参数:
+// resolvers - 组合的解析器，failover 策略按照这个顺序查询。
+// options - 用于修改默认配置的函数。
+//
+// 返回值:
+// 新创建的组合解析器，没有解析器或者策略不支持时返回错误。
+func NewGroup(resolvers []Resolver, options ...func(*GroupOptions)) (*Group, error) {
+	var group = &Group{GroupOptions: GroupOptions{Strategy: StrategyFailover, Timeout: defaultTimeout}}
+	for _, option := range options {
+		option(&group.GroupOptions)
+	}
+	switch group.Strategy {
+	case StrategyFastest, StrategyFailover, StrategyRandom, StrategyUnion:
+	default:
+		return nil, errors.New("unsupported resolver strategy " + string(group.Strategy) + ",supports (fastest,failover,random,union)")
+	}
+	if len(resolvers) == 0 {
+		return nil, errors.New("no resolvers provided")
+	}
+	var names []string
+	for _, resolver := range resolvers {
+		group.members = append(group.members, &member{Resolver: resolver, stats: Stats{Name: resolver.Name()}})
+		names = append(names, resolver.Name())
+	}
+	if group.GroupName == "" {
+		group.GroupName = string(group.Strategy) + "(" + strings.Join(names, ",") + ")"
+	}
+	return group, nil
+}
+
+// Name 返回组合解析器的名称。
+func (g *Group) Name() string {
+	return g.GroupName
+}
+
+// Exchange 按照策略发送查询并返回应答。
+func (g *Group) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.Timeout)
+	defer cancel()
+	return g.ExchangeContext(ctx, msg)
+}
+
+// ExchangeContext 按照策略发送查询并返回应答，所有服务器都失败时返回所有的错误。
+// 应答的 Rcode 为 SERVFAIL 或者 REFUSED 时视为失败。
+func (g *Group) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	switch g.Strategy {
+	case StrategyFastest:
+		return g.fastest(ctx, msg)
+	case StrategyRandom:
+		return g.sequential(ctx, msg, generic.RandomShuffle(append([]*member(nil), g.members...)))
+	case StrategyUnion:
+		return g.union(ctx, msg)
+	default:
+		return g.sequential(ctx, msg, g.members)
+	}
+}
+
+// Stats 返回每个服务器的统计信息，顺序与创建时的解析器相同。
+func (g *Group) Stats() []Stats {
+	var stats []Stats
+	for _, m := range g.members {
+		m.mutex.Lock()
+		stats = append(stats, m.stats)
+		m.mutex.Unlock()
+	}
+	return stats
+}
+
+// exchange 查询一个服务器并记录结果，SERVFAIL 和 REFUSED 应答转换为错误。
+func (m *member) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var start = time.Now()
+	resp, err := m.ExchangeContext(ctx, msg)
+	if err == nil && resp == nil {
+		err = errors.New(m.Name() + " dns server returned no response")
+	}
+	if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+		err = errors.New(m.Name() + " dns server response error:" + dns.RcodeToString[resp.Rcode])
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err != nil {
+		/* 被取消的查询不是服务器的问题，不计入失败 */
+		if ctx.Err() == nil {
+			m.stats.Failures++
+		}
+		return nil, err
+	}
+	var elapsed = time.Since(start)
+	if m.stats.Successes == 0 {
+		m.stats.Latency = elapsed
+	} else {
+		m.stats.Latency += (elapsed - m.stats.Latency) / 8
+	}
+	m.stats.Successes++
+	return resp, nil
+}
+
+// sequential 按照顺序依次查询，返回第一个成功的应答。
+func (g *Group) sequential(ctx context.Context, msg *dns.Msg, members []*member) (*dns.Msg, error) {
+	var errs []error
+	for _, m := range members {
+		resp, err := m.exchange(ctx, msg)
+		if err == nil {
+			return resp, nil
+		}
+		log.Println(g.Name(), err)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// exchangeResult 是同时查询时一个服务器的结果。
+type exchangeResult struct {
+	index int
+	resp  *dns.Msg
+	err   error
+}
+
+// exchangeAll 同时查询所有服务器，按照完成的顺序返回结果。
+func (g *Group) exchangeAll(ctx context.Context, msg *dns.Msg) <-chan exchangeResult {
+	var results = make(chan exchangeResult, len(g.members))
+	for i, m := range g.members {
+		go func() {
+			resp, err := m.exchange(ctx, msg)
+			results <- exchangeResult{index: i, resp: resp, err: err}
+		}()
+	}
+	return results
+}
+
+// fastest 同时查询所有服务器，返回最先完成的成功应答，然后取消其他查询。
+func (g *Group) fastest(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var results = g.exchangeAll(ctx, msg)
+	var errs []error
+	for range g.members {
+		var result = <-results
+		if result.err == nil {
+			return result.resp, nil
+		}
+		errs = append(errs, result.err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// union 同时查询所有服务器，以按照服务器顺序第一个有记录的应答为基础，合并其他成功应答中不重复的记录。
+func (g *Group) union(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	var results = g.exchangeAll(ctx, msg)
+	var responses = make([]*dns.Msg, len(g.members))
+	var errs []error
+	for range g.members {
+		var result = <-results
+		if result.err != nil {
+			errs = append(errs, result.err)
+			continue
+		}
+		responses[result.index] = result.resp
+	}
+	var merged *dns.Msg
+	for _, resp := range responses {
+		if resp != nil && (merged == nil || len(merged.Answer) == 0 && len(resp.Answer) > 0) {
+			merged = resp
+		}
+	}
+	if merged == nil {
+		return nil, errors.Join(errs...)
+	}
+	merged = merged.Copy()
+	for _, resp := range responses {
+		if resp == nil || resp.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if !containsRR(merged.Answer, rr) {
+				merged.Answer = append(merged.Answer, rr)
+			}
+		}
+	}
+	return merged, nil
+}
+
+// containsRR 检查记录列表中是否已经有相同的记录，不比较TTL。
+func containsRR(rrs []dns.RR, rr dns.RR) bool {
+	for _, existing := range rrs {
+		if dns.IsDuplicate(existing, rr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+package resolver
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/miekg/dns"
+)
+
+// answerResolver 返回一个延迟 delay 后应答指定 A 记录的解析器，err 不为nil时返回该错误。
+func answerResolver(name string, delay time.Duration, err error, ips ...string) Resolver {
+	return NewFuncResolver(name, func(m *dns.Msg) (*dns.Msg, error) {
+		time.Sleep(delay)
+		if err != nil {
+			return nil, err
+		}
+		var r = new(dns.Msg)
+		r.SetReply(m)
+		for _, ip := range ips {
+			r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(ip)})
+		}
+		return r, nil
+	})
+}
+
+// servfailResolver 返回一个总是应答 SERVFAIL 的解析器。
+func servfailResolver(name string) Resolver {
+	return NewFuncResolver(name, func(m *dns.Msg) (*dns.Msg, error) {
+		var r = new(dns.Msg)
+		r.SetRcode(m, dns.RcodeServerFailure)
+		return r, nil
+	})
+}
+
+func answerIPs(resp *dns.Msg) []string {
+	var ips []string
+	for _, rr := range resp.Answer {
+		ips = append(ips, rr.(*dns.A).A.String())
+	}
+	return ips
+}
+
+func query() *dns.Msg {
+	return new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+}
+
+func TestGroupFastest(t *testing.T) {
+	group, err := NewGroup([]Resolver{
+		answerResolver("slow", time.Second, nil, "192.0.2.1"),
+		answerResolver("failed", 0, errors.New("failed")),
+		answerResolver("fast", 10*time.Millisecond, nil, "192.0.2.2"),
+	}, func(o *GroupOptions) { o.Strategy = StrategyFastest })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start = time.Now()
+	resp, err := group.Exchange(query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.2" {
+		t.Errorf("expected fastest answer: %v", ips)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("fastest strategy should not wait for slow servers")
+	}
+	var stats = group.Stats()
+	if stats[0].Successes != 0 || stats[0].Failures != 0 {
+		t.Errorf("cancelled query should not be counted: %+v", stats[0])
+	}
+	if stats[1].Failures != 1 || stats[2].Successes != 1 || stats[2].Latency <= 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestGroupFailover(t *testing.T) {
+	group, err := NewGroup([]Resolver{
+		servfailResolver("servfail"),
+		answerResolver("failed", 0, errors.New("failed")),
+		answerResolver("backup", 0, nil, "192.0.2.3"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		resp, err := group.Exchange(query())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.3" {
+			t.Errorf("expected backup answer: %v", ips)
+		}
+	}
+	var stats = group.Stats()
+	if stats[0].Failures != 3 || stats[1].Failures != 3 || stats[2].Successes != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	group, err = NewGroup([]Resolver{servfailResolver("a"), servfailResolver("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := group.Exchange(query()); err == nil {
+		t.Error("expected error when every server fails")
+	}
+}
+
+func TestGroupRandom(t *testing.T) {
+	group, err := NewGroup([]Resolver{
+		answerResolver("a", 0, nil, "192.0.2.1"),
+		answerResolver("b", 0, nil, "192.0.2.2"),
+	}, func(o *GroupOptions) { o.Strategy = StrategyRandom })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := group.Exchange(query()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, stats := range group.Stats() {
+		if stats.Successes == 0 || stats.Successes == 100 {
+			t.Errorf("random strategy should spread queries: %+v", group.Stats())
+		}
+	}
+}
+
+func TestGroupUnion(t *testing.T) {
+	group, err := NewGroup([]Resolver{
+		answerResolver("empty", 0, nil),
+		answerResolver("a", 0, nil, "192.0.2.1", "192.0.2.2"),
+		answerResolver("b", 20*time.Millisecond, nil, "192.0.2.2", "192.0.2.3"),
+		answerResolver("failed", 0, errors.New("failed")),
+	}, func(o *GroupOptions) { o.Strategy = StrategyUnion })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var q = query()
+	q.Id = 1234
+	resp, err := group.Exchange(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := answerIPs(resp); len(ips) != 3 || ips[0] != "192.0.2.1" || ips[2] != "192.0.2.3" {
+		t.Errorf("expected deduplicated union of answers: %v", ips)
+	}
+	if resp.Id != q.Id || resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("unexpected response header: %v", resp.MsgHdr)
+	}
+}
+
+func TestNewGroupErrors(t *testing.T) {
+	if _, err := NewGroup(nil); err == nil {
+		t.Error("expected error without resolvers")
+	}
+	if _, err := NewGroup([]Resolver{servfailResolver("a")}, func(o *GroupOptions) { o.Strategy = "unknown" }); err == nil {
+		t.Error("expected error for unknown strategy")
+	}
+	group, err := NewGroup([]Resolver{servfailResolver("a"), servfailResolver("b")}, func(o *GroupOptions) { o.Strategy = StrategyUnion })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Name() != "union(a,b)" {
+		t.Errorf("unexpected group name %s", group.Name())
+	}
+}
+
+func TestFromURL(t *testing.T) {
+	var server = &dns.Server{Net: "udp", Addr: "127.0.0.1:0", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		var r = new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.53")})
+		w.WriteMsg(r)
+	})}
+	var started = make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ListenAndServe()
+	<-started
+	defer server.Shutdown()
+
+	resolver, err := FromURL("udp://" + server.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := resolver.Exchange(query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := answerIPs(resp); len(ips) != 1 || ips[0] != "192.0.2.53" {
+		t.Errorf("unexpected answer %v", ips)
+	}
+
+	for _, serverURL := range []string{"https://dns.example/dns-query", "h3://dns.example/dns-query", "quic://dns.example", "tls://dns.example:8853", "tcp://192.0.2.1"} {
+		resolver, err := FromURL(serverURL)
+		if err != nil {
+			t.Error(serverURL, err)
+		} else if resolver.Name() != serverURL {
+			t.Errorf("unexpected resolver name %s", resolver.Name())
+		}
+	}
+	for _, serverURL := range []string{"ftp://dns.example", "quic://"} {
+		if _, err := FromURL(serverURL); err == nil {
+			t.Error("expected error for", serverURL)
+		}
+	}
+}
+
+func TestFromURLEDNS(t *testing.T) {
+	var subnets = make(chan *dns.EDNS0_SUBNET, 1)
+	var server = &dns.Server{Net: "udp", Addr: "127.0.0.1:0", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		var subnet *dns.EDNS0_SUBNET
+		for _, option := range m.IsEdns0().Option {
+			switch option := option.(type) {
+			case *dns.EDNS0_SUBNET:
+				subnet = option
+			case *dns.EDNS0_PADDING:
+				t.Error("plain dns queries should not be padded")
+			}
+		}
+		subnets <- subnet
+		var r = new(dns.Msg)
+		r.SetReply(m)
+		w.WriteMsg(r)
+	})}
+	var started = make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ListenAndServe()
+	<-started
+	defer server.Shutdown()
+
+	var address = server.PacketConn.LocalAddr().String()
+	resolver, err := FromURL("udp://"+address+"#ecs=16/48&padding=on", func(o *dns_experiment.EDNSOptions) { o.Padding = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolver.Name() != "udp://"+address+" ecs=16/48" {
+		t.Errorf("unexpected resolver name %s", resolver.Name())
+	}
+	var msg = query()
+	msg.SetEdns0(1232, false)
+	msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("198.51.100.77")})
+	if _, err := resolver.Exchange(msg); err != nil {
+		t.Fatal(err)
+	}
+	if subnet := <-subnets; subnet == nil || subnet.SourceNetmask != 16 || !subnet.Address.Equal(net.ParseIP("198.51.0.0")) {
+		t.Errorf("expected truncated client subnet: %v", subnet)
+	}
+
+	for serverURL, name := range map[string]string{
+		"https://dns.example/dns-query#padding=on": "https://dns.example/dns-query padding=128",
+		"tls://dns.example#ecs=off&padding=468":    "tls://dns.example ecs=off padding=468",
+		"quic://dns.example#ecs=24/56":             "quic://dns.example",
+	} {
+		if resolver, err := FromURL(serverURL); err != nil || resolver.Name() != name {
+			t.Errorf("%s: expected name %s: %v %v", serverURL, name, resolver, err)
+		}
+	}
+	for _, serverURL := range []string{"tls://dns.example#ecs=33", "tls://dns.example#padding=0", "tls://dns.example#cookie=on"} {
+		if _, err := FromURL(serverURL); err == nil {
+			t.Error("expected error for", serverURL)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	dns_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/dns"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	h3_experiment "github.com/masx200/http3-reverse-proxy-server-experiment/h3"
+	"github.com/miekg/dns"
+)
+
+// defaultTimeout 是单个DNS查询的默认超时时间。
+const defaultTimeout = 10 * time.Second
+
+// Resolver 是DNS上游服务器的统一接口，DoH、DoH3、DoQ、DoT和普通DNS服务器以及组合的解析器都实现了该接口。
+type Resolver interface {
+	// Name 返回解析器的名称，用于日志、缓存和延迟统计。
+	Name() string
+	// Exchange 发送查询并返回应答。
+	Exchange(msg *dns.Msg) (*dns.Msg, error)
+	// ExchangeContext 发送查询并返回应答，ctx 取消时放弃查询。
+	ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+// funcResolver 是使用查询函数实现的解析器。
+type funcResolver struct {
+	name     string
+	exchange func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+func (r *funcResolver) Name() string {
+	return r.name
+}
+
+func (r *funcResolver) Exchange(msg *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return r.exchange(ctx, msg)
+}
+
+func (r *funcResolver) ExchangeContext(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	return r.exchange(ctx, msg)
+}
+
+// NewFuncResolver 使用已有的DNS查询回调函数创建解析器，查询回调函数不支持取消时 ctx 取消后立即返回。
+//
+// 参数:
+// name - 解析器的名称。
+// queryCallback - DNS查询回调函数。
+//
+// 返回值:
+// 新创建的解析器。
+func NewFuncResolver(name string, queryCallback func(m *dns.Msg) (r *dns.Msg, err error)) Resolver {
+	return &funcResolver{name: name, exchange: func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		type result struct {
+			msg *dns.Msg
+			err error
+		}
+		var done = make(chan result, 1)
+		go func() {
+			msg, err := queryCallback(msg)
+			done <- result{msg, err}
+		}()
+		select {
+		case r := <-done:
+			return r.msg, r.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}}
+}
+
+// FromURL 根据DNS服务器的URL创建解析器，同一个服务器的解析器共用保持连接的客户端。
+// 支持的协议：https:// 使用 DoH，h3:// 使用基于HTTP/3的 DoH，quic:// 使用 DoQ，tls:// 使用 DoT，
+// udp:// 和 tcp:// 使用普通DNS。quic:// 和 tls:// 的默认端口为853，udp:// 和 tcp:// 的默认端口为53。
+// URL的片段可以为这个服务器单独配置EDNS选项，例如 "#ecs=16/48&padding=on"，参见 parseEDNSFragment。
+// EDNS配置与默认配置不同时，解析器的名称为不带片段的URL加上配置的描述，不同配置的应答分开缓存。
+//
+// 参数:
+// serverURL - DNS服务器的URL，例如 "https://dns.alidns.com/dns-query"、"h3://dns.alidns.com/dns-query"、"quic://dns.alidns.com"、"tls://dns.alidns.com"、"udp://223.5.5.5"。
+// options - 用于修改默认EDNS配置的函数，URL片段中的配置优先。普通DNS服务器不使用填充。
+//
+// 返回值:
+// 新创建的解析器，以及遇到不支持的协议或者无效的EDNS配置时的错误。
+func FromURL(serverURL string, options ...func(*dns_experiment.EDNSOptions)) (Resolver, error) {
+	var name, fragment, _ = strings.Cut(strings.TrimSpace(serverURL), "#")
+	var edns = dns_experiment.NewEDNS(options...)
+	if err := parseEDNSFragment(fragment, &edns.EDNSOptions); err != nil {
+		return nil, errors.New("invalid edns options of dns server url " + serverURL + " " + err.Error())
+	}
+	var exchange func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+	switch {
+	case strings.HasPrefix(name, "https://"):
+		exchange = dns_experiment.DoHPersistentClientOf(name, "").ExchangeContext
+	case strings.HasPrefix(name, "h3://"):
+		exchange = h3_experiment.DoHTTP3PersistentClientOf("https://"+strings.TrimPrefix(name, "h3://"), "").ExchangeContext
+	case strings.HasPrefix(name, "quic://"):
+		address, err := serverAddress(name, "853")
+		if err != nil {
+			return nil, err
+		}
+		exchange = dns_experiment.DoQPersistentClientOf(address).ExchangeContext
+	case strings.HasPrefix(name, "tls://"):
+		address, err := serverAddress(name, "853")
+		if err != nil {
+			return nil, err
+		}
+		exchange = dns_experiment.DoTPersistentClientOf(address).ExchangeContext
+	case strings.HasPrefix(name, "udp://"), strings.HasPrefix(name, "tcp://"):
+		client, err := dns_experiment.PlainClientOfURL(name)
+		if err != nil {
+			return nil, err
+		}
+		exchange = client.ExchangeContext
+		/* RFC 8467：填充只对加密的传输有意义 */
+		edns.Padding = false
+	default:
+		return nil, errors.New("unsupported dns server url " + name + ",supports (https://,h3://,quic://,tls://,udp://,tcp://)")
+	}
+	if description := edns.String(); description != "" {
+		name += " " + description
+	}
+	return &funcResolver{name: name, exchange: func(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+		return exchange(ctx, edns.Prepare(msg))
+	}}, nil
+}
+
+// parseEDNSFragment 解析URL片段中的EDNS配置，格式与URL查询参数相同：
+// ecs=off 删除ECS选项，ecs=24/56 设置IPv4和IPv6地址的最大源前缀长度，只写一个数字时只设置IPv4；
+// padding=on 或者 padding=off 开启或者关闭填充，padding=数字 开启填充并设置块大小。
+func parseEDNSFragment(fragment string, options *dns_experiment.EDNSOptions) error {
+	values, err := url.ParseQuery(fragment)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		var last = value[len(value)-1]
+		switch key {
+		case "ecs":
+			if last == "off" {
+				options.ClientSubnet = false
+				continue
+			}
+			var ipv4, ipv6, hasIPv6 = strings.Cut(last, "/")
+			ipv4Length, err := strconv.ParseUint(ipv4, 10, 8)
+			if err != nil || ipv4Length > 32 {
+				return errors.New("invalid ecs prefix length " + last)
+			}
+			options.ClientSubnet = true
+			options.IPv4PrefixLength = uint8(ipv4Length)
+			if hasIPv6 {
+				ipv6Length, err := strconv.ParseUint(ipv6, 10, 8)
+				if err != nil || ipv6Length > 128 {
+					return errors.New("invalid ecs prefix length " + last)
+				}
+				options.IPv6PrefixLength = uint8(ipv6Length)
+			}
+		case "padding":
+			switch last {
+			case "on":
+				options.Padding = true
+			case "off":
+				options.Padding = false
+			default:
+				blockSize, err := strconv.Atoi(last)
+				if err != nil || blockSize <= 0 {
+					return errors.New("invalid padding block size " + last)
+				}
+				options.Padding = true
+				options.PaddingBlockSize = blockSize
+			}
+		default:
+			return errors.New("unknown edns option " + key)
+		}
+	}
+	return nil
+}
+
+// FromURLs 根据多个DNS服务器的URL创建解析器，忽略空的URL。
+func FromURLs(urls []string, options ...func(*dns_experiment.EDNSOptions)) ([]Resolver, error) {
+	var resolvers []Resolver
+	for _, serverURL := range urls {
+		if strings.TrimSpace(serverURL) == "" {
+			continue
+		}
+		resolver, err := FromURL(serverURL, options...)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, resolver)
+	}
+	return resolvers, nil
+}
+
+// serverAddress 返回URL中的 host:port 地址，没有端口时使用默认端口。
+func serverAddress(serverURL string, defaultPort string) (string, error) {
+	parsedURL, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	if parsedURL.Hostname() == "" {
+		return "", errors.New("missing dns server host " + serverURL)
+	}
+	var port = parsedURL.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(parsedURL.Hostname(), port), nil
+}
+
+// QueryCallbacks 返回以解析器名称为键的DNS查询回调函数集合，可以传给 dns.DnsResolverMultipleServers 等使用查询回调函数的接口。
+func QueryCallbacks(resolvers ...Resolver) generic.MapInterface[string, func(m *dns.Msg) (r *dns.Msg, err error)] {
+	var queryCallbacks = generic.NewMapImplement[string, func(m *dns.Msg) (r *dns.Msg, err error)]()
+	for _, resolver := range resolvers {
+		queryCallbacks.Set(resolver.Name(), resolver.Exchange)
+	}
+	return queryCallbacks
+}
@@ -0,0 +1,143 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats 记录了一条隧道两个方向上传输的字节数。
+//
+// 字段：
+// LeftToRight - 从 left 复制到 right 的字节数。
+// RightToLeft - 从 right 复制到 left 的字节数。
+// IdleTimeout - 隧道是否因为空闲超时而被关闭。
+type Stats struct {
+	LeftToRight int64
+	RightToLeft int64
+	IdleTimeout bool
+}
+
+// idleTimer 在每次有数据传输时重置计时器，超时后调用 onTimeout。
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   atomic.Bool
+}
+
+func newIdleTimer(timeout time.Duration, onTimeout func()) *idleTimer {
+	var t = &idleTimer{timeout: timeout}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, func() {
+			t.fired.Store(true)
+			onTimeout()
+		})
+	}
+	return t
+}
+
+func (t *idleTimer) touch() {
+	if t.timer != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// countingWriter 统计写入的字节数，并在每次写入时刷新空闲计时器。
+type countingWriter struct {
+	writer io.Writer
+	count  *atomic.Int64
+	idle   *idleTimer
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.count.Add(int64(n))
+	c.idle.touch()
+	return n, err
+}
+
+// Pipe 在两个连接之间双向复制数据，直到任意一个方向结束、发生错误或者空闲超时。
+// 任意一个方向结束后两个连接都会被关闭，函数会等待两个方向的复制都退出后再返回。
+//
+// 参数:
+// left - 隧道一端的连接，通常是下游客户端的连接。
+// right - 隧道另一端的连接，通常是上游服务器的连接。
+// idleTimeout - 两个方向都没有数据传输的最长时间，小于等于0时不限制。
+//
+// 返回值:
+// 两个方向上传输的字节数，以及第一个非正常结束的错误。
+func Pipe(left io.ReadWriteCloser, right io.ReadWriteCloser, idleTimeout time.Duration) (Stats, error) {
+	var leftToRight, rightToLeft atomic.Int64
+	var closeOnce sync.Once
+	var closeBoth = func() {
+		closeOnce.Do(func() {
+			left.Close()
+			right.Close()
+		})
+	}
+	var idle = newIdleTimer(idleTimeout, closeBoth)
+	defer idle.stop()
+
+	var errs = make(chan error, 2)
+	go func() {
+		_, err := io.Copy(&countingWriter{writer: right, count: &leftToRight, idle: idle}, left)
+		errs <- err
+	}()
+	go func() {
+		_, err := io.Copy(&countingWriter{writer: left, count: &rightToLeft, idle: idle}, right)
+		errs <- err
+	}()
+
+	var first = <-errs
+	closeBoth()
+	<-errs
+
+	var stats = Stats{
+		LeftToRight: leftToRight.Load(),
+		RightToLeft: rightToLeft.Load(),
+		IdleTimeout: idle.fired.Load(),
+	}
+	if first != nil && !IsClosedError(first) {
+		return stats, first
+	}
+	return stats, nil
+}
+
+// IsClosedError 判断错误是否只是表示连接已经被关闭，这类错误在隧道结束时是正常的。
+func IsClosedError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// StreamConn 将HTTP/2或HTTP/3请求的请求体和响应写入器组合为一个双向连接，每次写入后立即刷新，
+// 用于在CONNECT或扩展CONNECT请求的数据流上建立隧道。
+type StreamConn struct {
+	Body    io.ReadCloser
+	Writer  io.Writer
+	Flusher http.Flusher
+}
+
+func (s *StreamConn) Read(p []byte) (int, error) {
+	return s.Body.Read(p)
+}
+
+func (s *StreamConn) Write(p []byte) (int, error) {
+	n, err := s.Writer.Write(p)
+	if err == nil {
+		s.Flusher.Flush()
+	}
+	return n, err
+}
+
+func (s *StreamConn) Close() error {
+	return s.Body.Close()
+}
@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipeCopiesBothDirections(t *testing.T) {
+	clientSide, left := net.Pipe()
+	right, serverSide := net.Pipe()
+
+	var done = make(chan Stats, 1)
+	go func() {
+		stats, err := Pipe(left, right, time.Second)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- stats
+	}()
+
+	go func() {
+		var buf = make([]byte, 5)
+		if _, err := io.ReadFull(serverSide, buf); err != nil {
+			t.Error(err)
+			return
+		}
+		serverSide.Write([]byte("pong!!"))
+	}()
+	if _, err := clientSide.Write([]byte("ping!")); err != nil {
+		t.Fatal(err)
+	}
+	var buf = make([]byte, 6)
+	if _, err := io.ReadFull(clientSide, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "pong!!" {
+		t.Fatalf("unexpected reply: %q", buf)
+	}
+	clientSide.Close()
+
+	var stats = <-done
+	if stats.LeftToRight != 5 || stats.RightToLeft != 6 || stats.IdleTimeout {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestPipeIdleTimeout(t *testing.T) {
+	_, left := net.Pipe()
+	right, _ := net.Pipe()
+
+	var start = time.Now()
+	stats, err := Pipe(left, right, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.IdleTimeout {
+		t.Errorf("expected idle timeout, got %+v", stats)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("idle timeout took too long: %v", elapsed)
+	}
+}
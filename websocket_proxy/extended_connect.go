@@ -0,0 +1,74 @@
+package websocket_proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// CheckExtendedConnect 确认 net/http 和 golang.org/x/net/http2 的HTTP/2服务器都在 SETTINGS 帧中通告了
+// SETTINGS_ENABLE_CONNECT_PROTOCOL（RFC 8441）。两者只在初始化时读取 GODEBUG 环境变量，
+// 参见 extended_connect 包，启动时检查一次可以发现设置没有生效的情况，而不是让 WebSocket 请求静默失败。
+//
+// 返回值:
+// 没有开启扩展 CONNECT 的服务器对应的错误。
+func CheckExtendedConnect() error {
+	var errs []error
+	if err := advertisesExtendedConnect(func(listener net.Listener) {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{Handler: http.NotFoundHandler()})
+	}); err != nil {
+		errs = append(errs, errors.New("golang.org/x/net/http2: "+err.Error()))
+	}
+	if err := advertisesExtendedConnect(func(listener net.Listener) {
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+		var server = &http.Server{Handler: http.NotFoundHandler(), Protocols: &protocols}
+		server.Serve(listener)
+	}); err != nil {
+		errs = append(errs, errors.New("net/http: "+err.Error()))
+	}
+	return errors.Join(errs...)
+}
+
+// advertisesExtendedConnect 在本地回环地址上启动 serve 提供的不加密HTTP/2服务器，读取它的第一个 SETTINGS 帧。
+func advertisesExtendedConnect(serve func(listener net.Listener)) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	go serve(listener)
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return err
+	}
+	var framer = http2.NewFramer(conn, conn)
+	if err := framer.WriteSettings(); err != nil {
+		return err
+	}
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return err
+		}
+		if settings, ok := frame.(*http2.SettingsFrame); ok && !settings.IsAck() {
+			if value, _ := settings.Value(http2.SettingEnableConnectProtocol); value != 1 {
+				return errors.New("extended connect is not enabled, set GODEBUG=http2xconnect=1")
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package websocket_proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/masx200/http3-reverse-proxy-server-experiment/extended_connect"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/load_balance"
+	"golang.org/x/net/http2"
+)
+
+// flushWriter 在每次写入后立即刷新响应。
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.w.(http.Flusher).Flush()
+	return n, err
+}
+
+// dialExtendedConnect 通过HTTP/2扩展CONNECT向服务器发起WebSocket请求。
+func dialExtendedConnect(t *testing.T, server *httptest.Server) (*http.Response, *io.PipeWriter) {
+	transport := &http2.Transport{TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig}
+	reader, writer := io.Pipe()
+	req, err := http.NewRequest(http.MethodConnect, server.URL+"/chat", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(":protocol", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	response, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, writer
+}
+
+func expectEcho(t *testing.T, writer io.Writer, reader io.Reader) {
+	if _, err := writer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var buf = make([]byte, 5)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected echo: %q", buf)
+	}
+}
+
+func TestServeExtendedConnectToHTTP1Upstream(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	defer upstream.Close()
+	client, err := load_balance.NewSingleHostHTTP12ClientOfAddress("websocket-h1", upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var dialer = client.(load_balance.WebSocketUpStream).DialWebSocket
+
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsExtendedConnectWebSocket(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := ServeExtendedConnect(w, r, dialer, time.Second); err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	proxy.EnableHTTP2 = true
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	response, writer := dialExtendedConnect(t, proxy)
+	defer writer.Close()
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %d", response.StatusCode)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != "" {
+		t.Error("Sec-WebSocket-Accept should not be sent over extended CONNECT")
+	}
+	expectEcho(t, writer, response.Body)
+}
+
+func TestDialWebSocketOverHTTP2ExtendedConnect(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsExtendedConnectWebSocket(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		io.Copy(flushWriter{w}, r.Body)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	client, err := load_balance.NewSingleHostHTTP12ClientOfAddress("websocket-h2", upstream.URL, func(c *load_balance.SingleHostHTTP12ClientOfAddress) {
+		c.ExtendedConnectRoundTripper = &http2.Transport{TLSClientConfig: &tls.Config{RootCAs: upstream.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/chat", nil)
+	req.RequestURI = ""
+	response, conn, err := client.(load_balance.WebSocketUpStream).DialWebSocket(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn == nil {
+		t.Fatalf("websocket rejected with status %d", response.StatusCode)
+	}
+	defer conn.Close()
+	if response.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2 extended CONNECT, got %s", response.Proto)
+	}
+	expectEcho(t, conn, conn)
+}
+
+func TestCheckExtendedConnect(t *testing.T) {
+	if err := CheckExtendedConnect(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,235 @@
+package websocket_proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/tunnel"
+)
+
+// Upgrader 向上游发送协议升级请求。
+// 上游返回101状态码时第二个返回值为升级后的双向连接，否则为nil，此时应当按普通响应处理。
+type Upgrader func(*http.Request) (*http.Response, io.ReadWriteCloser, error)
+
+// hopHeaders 是逐跳头部，不应当被转发到上游（RFC 9110 第 7.6.1 节）。
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// headerContainsToken 判断以逗号分隔的头部值中是否包含指定的 token（不区分大小写）。
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsWebSocketUpgrade 判断请求是否为 HTTP/1.1 的 WebSocket 协议升级请求。
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return r.ProtoMajor == 1 &&
+		headerContainsToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(strings.TrimSpace(r.Header.Get("Upgrade")), "websocket")
+}
+
+// removeHopHeaders 删除逐跳头部以及 Connection 头部中列出的头部。
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// ServeUpgrade 将下游的 WebSocket 协议升级请求通过 upgrader 转发到上游，
+// 上游同意升级后接管下游连接，并在两个连接之间建立双向隧道，直到任意一端关闭或空闲超时。
+//
+// 参数:
+// w - 下游的响应写入器，必须实现 http.Hijacker。
+// r - 下游的协议升级请求。
+// upgrader - 向上游发送协议升级请求的函数。
+// idleTimeout - 隧道的空闲超时时间，小于等于0时不限制。
+//
+// 返回值:
+// 在向下游写入任何响应之前发生的错误，调用者应当据此返回错误响应；隧道建立之后的错误只会被记录到日志。
+func ServeUpgrade(w http.ResponseWriter, r *http.Request, upgrader Upgrader, idleTimeout time.Duration) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return errors.New("websocket_proxy: response writer does not support hijacking")
+	}
+	var upgrade = r.Header.Get("Upgrade")
+	outreq := r.Clone(r.Context())
+	outreq.RequestURI = ""
+	removeHopHeaders(outreq.Header)
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", upgrade)
+
+	response, upstream, err := upgrader(outreq)
+	if err != nil {
+		return err
+	}
+	if upstream == nil {
+		defer response.Body.Close()
+		for k, vv := range response.Header {
+			for _, v := range vv {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(response.StatusCode)
+		_, err = io.Copy(w, response.Body)
+		if err != nil {
+			log.Println("websocket_proxy: copy response body:", err)
+		}
+		return nil
+	}
+
+	if !strings.EqualFold(response.Header.Get("Upgrade"), upgrade) {
+		upstream.Close()
+		return errors.New("websocket_proxy: upstream switched to unexpected protocol " + response.Header.Get("Upgrade"))
+	}
+
+	downstream, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return err
+	}
+	if err := writeSwitchingProtocols(buffered.Writer, response.Header); err != nil {
+		downstream.Close()
+		upstream.Close()
+		log.Println("websocket_proxy: write 101 response:", err)
+		return nil
+	}
+	/* 劫持之前已经被缓冲的下游数据需要先发送给上游 */
+	if n := buffered.Reader.Buffered(); n > 0 {
+		pending, _ := buffered.Reader.Peek(n)
+		if _, err := upstream.Write(pending); err != nil {
+			downstream.Close()
+			upstream.Close()
+			log.Println("websocket_proxy: write buffered data:", err)
+			return nil
+		}
+	}
+
+	var start = time.Now()
+	stats, err := tunnel.Pipe(downstream, upstream, idleTimeout)
+	log.Println("websocket_proxy: tunnel closed", r.Host, r.URL.Path,
+		"client->upstream", stats.LeftToRight, "upstream->client", stats.RightToLeft,
+		"idle timeout", stats.IdleTimeout, "duration", time.Since(start), "error", err)
+	return nil
+}
+
+// writeSwitchingProtocols 向下游写入101响应行和上游返回的头部。
+func writeSwitchingProtocols(writer *bufio.Writer, header http.Header) error {
+	if _, err := writer.WriteString("HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return err
+	}
+	if err := header.Write(writer); err != nil {
+		return err
+	}
+	if _, err := writer.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// IsExtendedConnectWebSocket 判断请求是否为通过扩展CONNECT建立WebSocket的请求，
+// 包括HTTP/2（RFC 8441，:protocol 伪头部保存在 Header 中）和HTTP/3（RFC 9220，quic-go 将 :protocol 保存在 Proto 字段中）。
+func IsExtendedConnectWebSocket(r *http.Request) bool {
+	if r.Method != http.MethodConnect {
+		return false
+	}
+	switch r.ProtoMajor {
+	case 2:
+		return strings.EqualFold(r.Header.Get(":protocol"), "websocket")
+	case 3:
+		return strings.EqualFold(r.Proto, "websocket")
+	}
+	return false
+}
+
+// ServeExtendedConnect 接受下游通过HTTP/2或HTTP/3扩展CONNECT发起的WebSocket请求，
+// 将其转换为与协议无关的WebSocket握手请求交给 dialer，由 dialer 选择上游支持的协议建立连接，
+// 上游接受后向下游返回200响应，并在下游数据流和上游连接之间建立双向隧道。
+//
+// 参数:
+// w - 下游的响应写入器，必须实现 http.Flusher。
+// r - 下游的扩展CONNECT请求。
+// dialer - 建立上游WebSocket连接的函数，约定与 load_balance.WebSocketUpStream 相同。
+// idleTimeout - 隧道的空闲超时时间，小于等于0时不限制。
+//
+// 返回值:
+// 在向下游写入任何响应之前发生的错误，调用者应当据此返回错误响应；隧道建立之后的错误只会被记录到日志。
+func ServeExtendedConnect(w http.ResponseWriter, r *http.Request, dialer Upgrader, idleTimeout time.Duration) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("websocket_proxy: response writer does not support flushing")
+	}
+	outreq := r.Clone(r.Context())
+	outreq.Method = http.MethodGet
+	outreq.Proto = "HTTP/1.1"
+	outreq.ProtoMajor = 1
+	outreq.ProtoMinor = 1
+	outreq.RequestURI = ""
+	outreq.Body = http.NoBody
+	outreq.ContentLength = 0
+	removeHopHeaders(outreq.Header)
+	outreq.Header.Del(":protocol")
+
+	response, upstream, err := dialer(outreq)
+	if err != nil {
+		return err
+	}
+	if upstream == nil {
+		defer response.Body.Close()
+		for k, vv := range response.Header {
+			for _, v := range vv {
+				w.Header().Add(k, v)
+			}
+		}
+		w.WriteHeader(response.StatusCode)
+		_, err = io.Copy(w, response.Body)
+		if err != nil {
+			log.Println("websocket_proxy: copy response body:", err)
+		}
+		return nil
+	}
+
+	removeHopHeaders(response.Header)
+	response.Header.Del("Content-Length")
+	for k, vv := range response.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var downstream = &tunnel.StreamConn{Body: r.Body, Writer: w, Flusher: flusher}
+	var start = time.Now()
+	stats, err := tunnel.Pipe(downstream, upstream, idleTimeout)
+	log.Println("websocket_proxy: extended connect tunnel closed", r.Proto, r.Host, r.URL.Path,
+		"client->upstream", stats.LeftToRight, "upstream->client", stats.RightToLeft,
+		"idle timeout", stats.IdleTimeout, "duration", time.Since(start), "error", err)
+	return nil
+}
@@ -0,0 +1,123 @@
+package websocket_proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/masx200/http3-reverse-proxy-server-experiment/generic"
+	"github.com/masx200/http3-reverse-proxy-server-experiment/load_balance"
+)
+
+// newEchoUpstream 启动一个接受 WebSocket 协议升级后原样回显数据的上游服务器。
+func newEchoUpstream(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsWebSocketUpgrade(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		sum := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+		buffered.Flush()
+		io.Copy(conn, buffered)
+	}))
+}
+
+// dialUpgrade 向代理发送协议升级请求并返回升级后的连接。
+func dialUpgrade(t *testing.T, address string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET /chat HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reader, response
+}
+
+func TestServeUpgradeThroughLoadBalancer(t *testing.T) {
+	upstream := newEchoUpstream(t)
+	defer upstream.Close()
+
+	balancer, err := load_balance.NewSingleHostHTTP3HTTP2LoadBalancerOfAddress("websocket-test", upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer balancer.Close()
+	balancer.GetLoadBalanceService().Unwrap().GetUpStreams().ForEach(func(value load_balance.LoadBalanceAndUpStream, key string, m generic.MapInterface[string, load_balance.LoadBalanceAndUpStream]) {
+		value.GetServerConfigCommon().SetUpgradeConnectionMaxCount(1)
+	})
+	var upgrader = balancer.(load_balance.UpgradeUpStream).Upgrade
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := ServeUpgrade(w, r, upgrader, time.Second); err != nil {
+			status := http.StatusBadGateway
+			if errors.Is(err, load_balance.ErrUpgradeConnectionLimit) {
+				status = http.StatusServiceUnavailable
+			}
+			w.WriteHeader(status)
+		}
+	}))
+	defer proxy.Close()
+
+	conn, reader, response := dialUpgrade(t, proxy.Listener.Addr().String())
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %d", response.StatusCode)
+	}
+	conn.Write([]byte("hello"))
+	var buf = make([]byte, 5)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected echo: %q", buf)
+	}
+
+	second, _, response := dialUpgrade(t, proxy.Listener.Addr().String())
+	second.Close()
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected connection limit, got status %d", response.StatusCode)
+	}
+
+	conn.Close()
+	var deadline = time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		var total int64
+		balancer.GetLoadBalanceService().Unwrap().GetUpStreams().ForEach(func(value load_balance.LoadBalanceAndUpStream, key string, m generic.MapInterface[string, load_balance.LoadBalanceAndUpStream]) {
+			total += value.GetServerConfigCommon().GetUpgradeConnectionCount()
+		})
+		if total == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("upgrade connection was not released")
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if IsWebSocketUpgrade(req) {
+		t.Error("plain request detected as upgrade")
+	}
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "WebSocket")
+	if !IsWebSocketUpgrade(req) {
+		t.Error("upgrade request not detected")
+	}
+}